@@ -2,176 +2,10570 @@
 set -euo pipefail
 
 log() {
-  echo "[$(date +'%Y-%m-%d %H:%M:%S')] $*"
+  echo "[$(date +'%Y-%m-%d %H:%M:%S')] $(redact <<<"$*")"
 }
 
-log "Starting CCA for issue: $1"
+# Messages shown to users and posted to GitHub, by UI_LANGUAGE. Values are
+# printf formats; keys missing from a catalog fall back to English.
+declare -A MESSAGES_EN=(
+  [report.title]='Report:'
+  [report.branch]='  Branch: %s'
+  [report.pr]='  Pull request: %s'
+  [report.none]='none'
+  [report.artifacts]='  Artifacts: %s'
+  [report.baseline]='  Baseline: verification failed on %s (best effort)'
+  [report.self_review]='  Self-review %s'
+  [report.tdd]='  TDD %s'
+  [report.fuzzing]='  Fuzzing %s'
+  [report.untested]='  Untested criterion: %s'
+  [report.skipped]='  Skipped: %s'
+  [pr.semver]='Semver impact: **%s**'
+  [pr.baseline]='Baseline failures (verification already failed on `%s`):'
+  [pr.reproduction]='Reproduction (%s):'
+  [pr.repro_passes]='The reproduction test passes on `%s`, so it may not capture the reported bug.'
+  [pr.repro_fails]='The reproduction test fails on `%s`:'
+  [pr.criteria]='Acceptance criteria coverage:'
+  [pr.self_review]='Self-review findings:'
+  [pr.fuzzing]='Fuzzing findings:'
+  [pr.dependencies]='Dependency changes:'
+  [pr.threat_model]='Threat model (STRIDE):'
+  [pr.build]='Build performance:'
+  [pr.a11y]='Accessibility:'
+  [pr.bundle]='Bundle size:'
+  [pr.code_findings]='Code review findings:'
+  [pr.findings_comments]='Review findings are listed in the comments below.'
+  [pr.findings_page]='CCA review findings (page %s of %s)'
+  [pr.findings_none]='No findings.'
+  [pr.instrumentation]='Instrumentation:'
+  [pr.obsolete_tests]='Obsolete tests:'
+  [pr.codegen]='Generated code:'
+  [pr.owners]='This change spans several ownership areas. Owners, please review your part:'
+  [pr.split]='Changes owned by other teams were split into these pull requests. They may depend on each other, so merge them together:'
+  [pr.split_part]='Part of the change for %s, split from branch `%s` by code ownership. It may depend on the other parts, so merge them together.'
+  [pr.pipeline]='Pipeline'
+  [pr.verified]='`.cca/verify.sh` passes on this branch.'
+  [comment.multi]='This issue is implemented across %s repositories. Merge the pull requests in this order, each after the ones it depends on:'
+  [comment.multi_after]='after %s'
+  [comment.multi_missing]='%s: no pull request'
+  [comment.skipped]='skipped because a repository it depends on failed'
+  [comment.rolled_back]='This pull request was rolled back with `cca rollback %s`.'
+  [comment.fix_vulns_resolved]='`cca fix-vulns recheck` scanned %s after this pull request was merged: the findings it addressed are gone.'
+  [comment.fix_vulns_remaining]='`cca fix-vulns recheck` scanned %s after this pull request was merged. These findings are still present:'
+  [pr.revert]='Reverts %s, which was rolled back with `cca rollback %s`.'
+  [pr.fix_vulns]='Opened by `cca fix-vulns` to fix these security findings on %s:'
+  [pr.fix_vulns_recheck]='After this pull request is merged, `cca fix-vulns recheck` scans %s again to confirm that they are gone.'
+  [comment.baseline]='CCA could not start cleanly: verification already fails on `%s`.'
+  [comment.clarify]='CCA needs a few answers before it can work on this issue:'
+  [comment.clarify_reply]='Reply in a comment and run cca again (or `cca resume`) to continue.'
+  [comment.decision]='CCA did not implement this issue because it leaves a product or design decision open:'
+  [comment.decision_reply]='Reply with the option you choose, or another approach, and run cca again (or `cca resume`) to continue.'
+  [comment.pros]='Pros'
+  [comment.cons]='Cons'
+  [comment.pushed]='Pushed %s for:'
+  [comment.truncated]='_This report was truncated to fit the GitHub size limit. Full report: %s_'
+  [comment.partial]='CCA stopped during %s without opening a pull request (time budget: %s). This is what it produced so far.'
+  [partial.plan]='Plan:'
+  [partial.patch]='Patch so far:'
+  [partial.verify]='Last verification output:'
+  [comment.oversized]='CCA did not open a pull request for this issue: the change on branch `%s` is too large to review.'
+  [comment.rebased]='Rebased onto %s and re-ran verification successfully.'
+  [comment.rebase_conflict]='Automatic rebase onto %s failed: conflicts could not be resolved within the configured limits.'
+  [comment.rebase_failed]='Rebased onto %s locally, but verification failed, so the branch was not pushed:'
+  [comment.revalidate]='**CCA re-validation: %s** (checked against %s)'
+  [comment.references]='References:'
+  [comment.history]='Commits since this issue was opened:'
+  [comment.triage]='**Dependency update risk: %s** (verification %s)'
+  [comment.passed]='passed'
+  [comment.failed]='failed'
+  [comment.versions]='Version changes:'
+  [comment.concerns]='Concerns:'
+)
+declare -A MESSAGES_JA=(
+  [report.title]='レポート:'
+  [report.branch]='  ブランチ: %s'
+  [report.pr]='  プルリクエスト: %s'
+  [report.none]='なし'
+  [report.artifacts]='  成果物: %s'
+  [report.baseline]='  ベースライン: %s で検証が失敗しています（ベストエフォート）'
+  [report.self_review]='  セルフレビュー %s'
+  [report.tdd]='  TDD %s'
+  [report.fuzzing]='  ファジング %s'
+  [report.untested]='  テストのない受け入れ基準: %s'
+  [report.skipped]='  スキップ: %s'
+  [pr.semver]='セマンティックバージョニングへの影響: **%s**'
+  [pr.baseline]='ベースラインの失敗（`%s` で既に検証が失敗していました）:'
+  [pr.reproduction]='再現テスト (%s):'
+  [pr.repro_passes]='再現テストは `%s` で成功するため、報告された不具合を捉えていない可能性があります。'
+  [pr.repro_fails]='再現テストは `%s` で失敗します:'
+  [pr.criteria]='受け入れ基準のカバレッジ:'
+  [pr.self_review]='セルフレビューの指摘:'
+  [pr.fuzzing]='ファジングの検出結果:'
+  [pr.dependencies]='依存関係の変更:'
+  [pr.threat_model]='脅威モデル（STRIDE）:'
+  [pr.build]='ビルドパフォーマンス:'
+  [pr.a11y]='アクセシビリティ:'
+  [pr.bundle]='バンドルサイズ:'
+  [pr.code_findings]='コードレビューの指摘:'
+  [pr.findings_comments]='レビューの指摘は下のコメントに記載しています。'
+  [pr.findings_page]='CCA レビューの指摘（%s / %s ページ）'
+  [pr.findings_none]='指摘はありません。'
+  [pr.instrumentation]='計装:'
+  [pr.obsolete_tests]='不要になったテスト:'
+  [pr.codegen]='生成コード:'
+  [pr.owners]='この変更は複数の担当領域にまたがっています。各担当者はそれぞれの部分をレビューしてください:'
+  [pr.split]='他チームが担当する変更は次のプルリクエストに分割しました。相互に依存している可能性があるため、まとめてマージしてください:'
+  [pr.split_part]='%s の変更のうち、コードの担当に基づいてブランチ `%s` から分割した部分です。他の部分に依存している可能性があるため、まとめてマージしてください。'
+  [pr.pipeline]='パイプライン'
+  [pr.verified]='このブランチで `.cca/verify.sh` が成功します。'
+  [comment.multi]='この Issue は %s 個のリポジトリにまたがって実装されています。依存先のプルリクエストを先に、次の順序でマージしてください:'
+  [comment.multi_after]='%s の後'
+  [comment.multi_missing]='%s: プルリクエストなし'
+  [comment.skipped]='依存先のリポジトリが失敗したためスキップ'
+  [comment.rolled_back]='このプルリクエストは `cca rollback %s` でロールバックされました。'
+  [comment.fix_vulns_resolved]='このプルリクエストのマージ後に `cca fix-vulns recheck` が %s をスキャンしました。対象の指摘はすべて解消されています。'
+  [comment.fix_vulns_remaining]='このプルリクエストのマージ後に `cca fix-vulns recheck` が %s をスキャンしました。次の指摘がまだ残っています:'
+  [pr.revert]='%s を元に戻します（`cca rollback %s` によるロールバック）。'
+  [pr.fix_vulns]='`cca fix-vulns` が %s の次のセキュリティ上の指摘を修正するために作成しました:'
+  [pr.fix_vulns_recheck]='マージ後に `cca fix-vulns recheck` が %s を再スキャンし、指摘が解消されたことを確認します。'
+  [comment.baseline]='CCA を開始できませんでした: `%s` で既に検証が失敗しています。'
+  [comment.clarify]='この Issue に取り組む前に、CCA からいくつか質問があります:'
+  [comment.clarify_reply]='コメントで回答してから cca を再実行（または `cca resume`）すると続行します。'
+  [comment.decision]='この Issue にはプロダクトまたは設計上の未決事項があるため、CCA は実装を行いませんでした:'
+  [comment.decision_reply]='選んだ案（または別の方針）をコメントで返信してから cca を再実行（または `cca resume`）すると続行します。'
+  [comment.pros]='利点'
+  [comment.cons]='欠点'
+  [comment.pushed]='%s をプッシュしました:'
+  [comment.truncated]='_GitHub のサイズ上限に収めるため、このレポートは途中で切り詰められています。全文: %s_'
+  [comment.partial]='CCA は %s の途中で停止し、プルリクエストを作成しませんでした（時間予算: %s）。ここまでの成果を以下に示します。'
+  [partial.plan]='計画:'
+  [partial.patch]='ここまでのパッチ:'
+  [partial.verify]='最後の検証出力:'
+  [comment.oversized]='ブランチ `%s` の変更がレビューするには大きすぎるため、CCA はこの Issue のプルリクエストを作成しませんでした。'
+  [comment.rebased]='%s にリベースし、検証を再実行して成功しました。'
+  [comment.rebase_conflict]='%s への自動リベースに失敗しました: 設定された上限内でコンフリクトを解消できませんでした。'
+  [comment.rebase_failed]='ローカルで %s にリベースしましたが、検証が失敗したためブランチはプッシュしていません:'
+  [comment.revalidate]='**CCA による再検証: %s**（%s で確認）'
+  [comment.references]='参照:'
+  [comment.history]='この Issue の作成以降のコミット:'
+  [comment.triage]='**依存関係更新のリスク: %s**（検証 %s）'
+  [comment.passed]='成功'
+  [comment.failed]='失敗'
+  [comment.versions]='バージョンの変更:'
+  [comment.concerns]='懸念点:'
+)
+
+# JSON Schemas of the JSON CCA writes and reads, by name. Artifacts carry the
+# SCHEMA_VERSION they were written with in schema_version; the version changes
+# whenever a schema changes in a way consumers could notice. Responses from
+# the AI backend are checked against their schema before they are used.
+SCHEMA_VERSION=1
+declare -A SCHEMAS=(
+  [status]='{
+    "title": "Run status (status.json)",
+    "type": "object",
+    "required": ["schema_version", "status", "started"],
+    "properties": {
+      "schema_version": {"const": 1},
+      "status": {"enum": ["processing", "completed", "failed", "paused", "needs-decision", "rolled_back"]},
+      "pid": {"type": "string"}, "host": {"type": "string"}, "started": {"type": "string"},
+      "issue_url": {"type": "string"}, "prompt_version": {"type": "string"},
+      "variants": {"type": "array", "items": {"type": "string"}},
+      "cause": {"type": "string"}, "branch": {"type": "string"}, "work_dir": {"type": "string"},
+      "pr_url": {"type": "string"}, "pr_head": {"type": "string"}, "pr_lines": {"type": "string"},
+      "pr_labels": {"type": "string"}
+    }
+  }'
+  [plan]='{
+    "title": "Implementation plan (plan.json)",
+    "type": "object",
+    "required": ["schema_version", "files"],
+    "properties": {
+      "schema_version": {"const": 1},
+      "files": {"type": "array", "items": {"type": "object", "required": ["path", "change"],
+        "properties": {"path": {"type": "string"}, "change": {"type": "string"}}}},
+      "functions": {"type": "array", "items": {"type": "string"}},
+      "tests": {"type": "array", "items": {"type": "string"}},
+      "migration_steps": {"type": "array", "items": {"type": "string"}}
+    }
+  }'
+  [findings]='{
+    "title": "Code review findings (findings.json)",
+    "type": "object",
+    "required": ["schema_version", "findings"],
+    "properties": {
+      "schema_version": {"const": 1},
+      "findings": {"type": "array", "items": {"type": "object", "required": ["severity", "category", "location", "message"],
+        "additionalProperties": false,
+        "properties": {"severity": {"enum": ["critical", "high", "serious", "major", "medium", "moderate", "minor", "low", "info"]},
+          "category": {"type": "string"},
+          "location": {"type": "string"}, "message": {"type": "string"}}}}
+    }
+  }'
+  [gate]='{
+    "title": "Quality gate decision (a line of gates.jsonl)",
+    "type": "object",
+    "required": ["schema_version", "time", "gate", "decision", "detail"],
+    "properties": {
+      "schema_version": {"const": 1},
+      "time": {"type": "string"}, "gate": {"type": "string"},
+      "decision": {"enum": ["passed", "acknowledged", "failed", "skipped"]}, "detail": {"type": "string"}
+    }
+  }'
+  [hook]='{
+    "title": "Run state passed to lifecycle hooks on stdin",
+    "type": "object",
+    "required": ["schema_version", "event", "run_id", "issue", "run_dir", "status"],
+    "properties": {
+      "schema_version": {"const": 1},
+      "event": {"enum": ["pre-analysis", "post-generation", "pre-pr"]},
+      "run_id": {"type": "string"}, "repository": {"type": "string"},
+      "issue": {"type": "object", "required": ["url", "file", "number", "title", "body", "labels"],
+        "properties": {"url": {"type": "string"}, "file": {"type": "string"}, "number": {"type": "string"},
+          "title": {"type": "string"}, "body": {"type": "string"}, "labels": {"type": "array", "items": {"type": "string"}}}},
+      "run_dir": {"type": "string"}, "branch": {"type": "string"}, "base_commit": {"type": "string"},
+      "work_dir": {"type": "string"}, "status": {"type": "object"},
+      "changed_files": {"type": "array", "items": {"type": "string"}},
+      "commits": {"type": "array", "items": {"type": "string"}},
+      "verify_attempts": {"type": "integer"},
+      "semver": {"type": "string"},
+      "pull_request": {"type": "object", "required": ["title", "body", "draft"],
+        "properties": {"title": {"type": "string"}, "body": {"type": "string"}, "draft": {"type": "boolean"}}}
+    }
+  }'
+  [changes]='{
+    "title": "Code changes returned by the AI backend",
+    "type": "object",
+    "properties": {
+      "files": {"type": ["object", "null"], "additionalProperties": {"type": "string"}},
+      "patches": {"type": ["object", "null"], "additionalProperties": {"type": "string"}},
+      "edits": {"type": ["array", "null"], "items": {"type": "object", "required": ["file", "operation"],
+        "properties": {"file": {"type": "string"},
+          "operation": {"enum": ["create", "replace", "insert_before", "insert_after", "delete"]},
+          "anchor": {"type": "string"}, "content": {"type": "string"}}}},
+      "new_files": {"type": ["array", "null"], "items": {"type": "string"}},
+      "deleted_files": {"type": ["array", "null"], "items": {"type": "string"}},
+      "summary": {"type": ["string", "null"]}
+    }
+  }'
+)
+
+# JSON_SCHEMA_CHECK defines the jq function check(schema; path), which prints
+# a message for each place the input violates the schema. It covers the
+# keywords SCHEMAS use: type, const, enum, required, properties,
+# additionalProperties and items.
+JSON_SCHEMA_CHECK='
+def check($s; $path):
+  . as $v
+  | ($v | type) as $t
+  | (if $t == "number" and ($v | floor) == $v then ["number", "integer"] else [$t] end) as $types
+  | (if $s.type == null then empty
+     else ($s.type | if type == "array" then . else [.] end) as $want
+       | if any($types[]; . as $x | $want | index($x)) then empty
+         else "\($path): expected \($want | join(" or ")), got \($t)" end
+     end),
+    (if $s | has("const") and $v != $s.const then "\($path): expected \($s.const | tojson), got \($v | tojson)" else empty end),
+    (if $s.enum != null and ([$s.enum[] | select(. == $v)] | length) == 0
+     then "\($path): expected one of \($s.enum | map(tojson) | join(", ")), got \($v | tojson)" else empty end),
+    (if $t == "object" then
+       ($s.required // [] | .[] | select(. as $k | $v | has($k) | not) | "\($path): missing \(.)"),
+       ($s.properties // {} | to_entries[] | select(.key as $k | $v | has($k)) | .key as $k | .value as $p
+         | $v[$k] | check($p; "\($path).\($k)")),
+       ($v | to_entries[] | select(.key as $k | $s.properties // {} | has($k) | not)
+         | if $s.additionalProperties == false then "\($path): unexpected \(.key)"
+           elif ($s.additionalProperties | type) == "object" then .key as $k | .value | check($s.additionalProperties; "\($path).\($k)")
+           else empty end)
+     else empty end),
+    (if $t == "array" and $s.items != null then
+       $v | to_entries[] | .key as $i | .value | check($s.items; "\($path)[\($i)]")
+     else empty end);
+'
+
+# msg prints the message $1 of the current UI_LANGUAGE, formatted with the
+# remaining arguments.
+msg() {
+  local -n catalog="MESSAGES_${UI_LANGUAGE^^}"
+  local format="${catalog[$1]:-${MESSAGES_EN[$1]}}"
+  shift
+  printf "$format" "$@"
+}
+
+# is_japanese succeeds when the text on stdin contains Japanese characters.
+is_japanese() {
+  LC_ALL=C.UTF-8 grep -qP '[\x{3040}-\x{30ff}\x{4e00}-\x{9fff}]' 2>/dev/null
+}
+
+# repo_language prints "ja" when most of the recently merged pull requests of
+# the repository are written in Japanese and "en" when most are not. It prints
+# nothing offline or when there is no history to go by.
+repo_language() {
+  [ "$OFFLINE" -eq 0 ] || return 0
+  local prs total japanese=0 pr
+  prs=$(gh pr list --state merged --limit 20 --json title,body --jq '.[] | (.title + " " + .body) | @json' 2>/dev/null || true)
+  total=$(grep -c . <<<"$prs" || true)
+  [ "$total" -gt 0 ] || return 0
+  while read -r pr; do
+    if jq -r . <<<"$pr" | is_japanese; then
+      japanese=$((japanese + 1))
+    fi
+  done <<<"$prs"
+  if [ $((japanese * 2)) -gt "$total" ]; then echo ja; else echo en; fi
+}
+
+# resolve_language sets UI_LANGUAGE from CCA_LANGUAGE. When it is "auto", the
+# dominant language of the repository's recent pull requests is used, or
+# Japanese when the issue title or body contains Japanese text.
+resolve_language() {
+  if [ "$LANGUAGE_SETTING" != "auto" ]; then
+    UI_LANGUAGE="$LANGUAGE_SETTING"
+  else
+    UI_LANGUAGE=$(repo_language)
+    if [ -z "$UI_LANGUAGE" ]; then
+      if is_japanese <<<"${title:-} ${body:-}"; then UI_LANGUAGE="ja"; else UI_LANGUAGE="en"; fi
+    fi
+  fi
+  if ! declare -p "MESSAGES_${UI_LANGUAGE^^}" >/dev/null 2>&1; then
+    log "Unsupported language $UI_LANGUAGE; using English" >&2
+    UI_LANGUAGE="en"
+  fi
+}
+
+# redact copies stdin to stdout with credentials masked: the values of known
+# token variables and of the secrets passed to verification, common token
+# formats, key=value secrets and any extended regular expressions listed one
+# per line in CCA_REDACT_PATTERNS.
+redact() {
+  local text var pattern value
+  text=$(cat)
+  for var in ANTHROPIC_API_KEY GH_TOKEN GITHUB_TOKEN ${REDACT_VARS:-}; do
+    [ -z "${!var:-}" ] || text=${text//"${!var}"/[redacted]}
+  done
+  for value in ${REDACT_VALUES[@]+"${REDACT_VALUES[@]}"}; do
+    [ -z "$value" ] || text=${text//"$value"/[redacted]}
+  done
+  text=$(sed -E \
+    -e 's/(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})/[redacted]/g' \
+    -e 's/sk-(ant-)?[A-Za-z0-9_-]{20,}/[redacted]/g' \
+    -e 's/AKIA[0-9A-Z]{16}/[redacted]/g' \
+    -e 's/xox[abprs]-[A-Za-z0-9-]{10,}/[redacted]/g' \
+    -e 's/-----BEGIN [A-Z ]*PRIVATE KEY-----/[redacted private key]/g' \
+    -e 's/((password|passwd|secret|token|api[_-]?key)["'"'"']?[[:space:]]*[:=][[:space:]]*["'"'"']?)[^"'"'"'[:space:]]+/\1[redacted]/gI' \
+    <<<"$text")
+  while IFS= read -r pattern; do
+    [ -z "$pattern" ] || text=$(sed -E "s$(printf '\001')$pattern$(printf '\001')[redacted]$(printf '\001')g" <<<"$text")
+  done <<<"${REDACT_PATTERNS:-}"
+  printf '%s\n' "$text"
+}
+
+usage() {
+  log "Usage: $0 [--offline] [--read-only] [--deterministic] [--plan [--interactive]] [--tdd] [--best-effort] [--time-budget <duration>] [--issue-file <file>] [<github-issue-url>]" >&2
+  log "       $0 update [<github-pr-url>]" >&2
+  log "       $0 rebase [<github-pr-url>]" >&2
+  log "       $0 gc [--dry-run] [--retention-days <days>]" >&2
+  log "       $0 resume" >&2
+  log "       $0 replay <run-id>" >&2
+  log "       $0 vulndb sync" >&2
+  log "       $0 cassette list|show <name>|delete <name>" >&2
+  log "       $0 scaffold <template> <target>" >&2
+  log "       $0 debug prompts|show|reissue|diff|context <run-id> [<n>|<run-id>]" >&2
+  log "       $0 explain <finding-id> [<run-id>]" >&2
+  log "       $0 digest [--since <n>h|d|w] [--format markdown|slack]" >&2
+  log "       $0 triage <pull-request-url>" >&2
+  log "       $0 revalidate <issue-url>" >&2
+  log "       $0 multi <issue-url> <manifest>" >&2
+  log "       $0 rank [--repo <owner/repo>]" >&2
+  log "       $0 outcomes" >&2
+  log "       $0 show <run-id|branch|commit|pr-url|comment-url|issue-url>" >&2
+  log "       $0 report diff <run-a> <run-b> [--format json]" >&2
+  log "       $0 badge" >&2
+  log "       $0 monitor" >&2
+  log "       $0 fix-vulns [--dry-run] [recheck]" >&2
+  log "       $0 schedule [--dry-run] [list]" >&2
+  log "       $0 rollback [--dry-run] <run-id|branch|commit|pr-url|comment-url|issue-url>" >&2
+  log "       $0 audit [<filter>] [--format json]" >&2
+  log "       $0 evidence export <run-id|branch|commit|pr-url|comment-url|issue-url>" >&2
+  log "       $0 evidence verify <bundle.zip>" >&2
+  log "       $0 doctor" >&2
+  log "       $0 index" >&2
+  log "       $0 warm" >&2
+  log "       $0 devcontainer feature" >&2
+  log "       $0 schema [<name> [<file>]]" >&2
+  log "       $0 search <query>" >&2
+  exit 1
+}
+
+# cassette_call runs gh or curl through the cassette named by CCA_CASSETTE:
+# in record mode the redacted arguments, output and exit code of every call are
+# saved under .cca/cassettes/<name>/, and in replay mode the saved output is
+# returned instead of running the command. Repeated identical calls are
+# numbered so they replay in order.
+cassette_call() {
+  local dir key n file
+  dir="$(git rev-parse --show-toplevel)/.cca/cassettes/$CASSETTE"
+  key=$(redact <<<"$*" | sha256sum | cut -c1-16)
+  n=$(($(cat "$CASSETTE_STATE/$key" 2>/dev/null || echo 0) + 1))
+  echo "$n" >"$CASSETTE_STATE/$key"
+  file="$dir/$key-$n.json"
+
+  if [ "$CASSETTE_MODE" = "replay" ]; then
+    if [ ! -f "$file" ]; then
+      log "Cassette $CASSETTE has no recording for: $(redact <<<"$*")" >&2
+      return 1
+    fi
+    jq -j '.stdout' "$file"
+    return "$(jq '.exit_code' "$file")"
+  fi
+
+  local output code=0
+  output=$(command "$@") || code=$?
+  mkdir -p "$dir"
+  jq -n --arg args "$(redact <<<"${*:2}")" --arg command "$1" --arg stdout "$(redact <<<"$output")" \
+    --argjson code "$code" '{command: $command, args: $args, exit_code: $code, stdout: ($stdout + "\n")}' >"$file"
+  printf '%s\n' "$output"
+  return "$code"
+}
+
+# chaos succeeds when a fault of the given kind should be injected, which
+# happens for CCA_CHAOS percent of the calls when the kind is listed in
+# CCA_CHAOS_FAULTS.
+chaos() {
+  [ "$CHAOS" -gt 0 ] && [[ " $CHAOS_FAULTS " == *" $1 "* ]] && [ $((RANDOM % 100)) -lt "$CHAOS" ] || return 1
+  log "Chaos: injecting $1 fault" >&2
+}
+
+# fetch_secret prints the secret that reference $1 points to:
+# vault:<path>#<field>, aws:<secret-id>[#<json-key>],
+# gcp:<project>/<secret>[#<json-key>] or file:<path>.
+fetch_secret() {
+  local ref="$1" kind location key value
+  kind="${ref%%:*}"
+  location="${ref#*:}"
+  key=""
+  if [[ "$location" == *"#"* ]]; then
+    key="${location##*#}"
+    location="${location%#*}"
+  fi
+  case "$kind" in
+    vault)
+      require_commands vault
+      [ -n "$key" ] || { log "Vault secret reference needs a #field: $ref" >&2; return 1; }
+      vault kv get -field="$key" "$location"
+      return
+      ;;
+    aws)
+      require_commands aws
+      value=$(aws secretsmanager get-secret-value --secret-id "$location" --query SecretString --output text)
+      ;;
+    gcp)
+      require_commands gcloud
+      value=$(gcloud secrets versions access latest --secret="${location#*/}" --project="${location%%/*}")
+      ;;
+    file)
+      value=$(cat "$location")
+      ;;
+    *)
+      log "Unknown secret reference: $ref" >&2
+      return 1
+      ;;
+  esac
+  if [ -n "$key" ]; then
+    jq -er --arg key "$key" '.[$key]' <<<"$value"
+  else
+    printf '%s\n' "$value"
+  fi
+}
+
+# load_secrets sets each variable NAME that has a CCA_SECRET_NAME reference,
+# for example CCA_SECRET_GH_TOKEN=vault:secret/cca#gh_token, to the secret
+# it points to, and masks the value in output. It runs at startup and again
+# from gh when GitHub rejects the credentials, to pick up rotated tokens.
+load_secrets() {
+  local ref name value err
+  err=$(mktemp)
+  for ref in $(compgen -v CCA_SECRET_ || true); do
+    name="${ref#CCA_SECRET_}"
+    if ! value=$(fetch_secret "${!ref}" 2>"$err"); then
+      log "Could not fetch $name from ${!ref%%:*}: $(head -n 1 "$err")" >&2
+      rm -f "$err"
+      return 1
+    fi
+    export "$name=$value"
+    [[ " ${REDACT_VARS:-} " == *" $name "* ]] || REDACT_VARS="${REDACT_VARS:+$REDACT_VARS }$name"
+  done
+  rm -f "$err"
+}
+
+# load_verify_env collects the variables only verification receives:
+# CCA_VERIFY_ENV_NAME=value sets NAME, and CCA_VERIFY_SECRET_NAME=<ref> sets
+# NAME to the secret the reference points to (see fetch_secret). They are
+# written to VERIFY_ENV_FILE, which only the user can read, instead of being
+# exported, so the AI backend and other tools never see them, and secret
+# values are masked in output.
+load_verify_env() {
+  local var name value err lines=()
+  for var in $(compgen -v CCA_VERIFY_ENV_ || true); do
+    lines+=("${var#CCA_VERIFY_ENV_}=${!var}")
+  done
+  err=$(mktemp)
+  for var in $(compgen -v CCA_VERIFY_SECRET_ || true); do
+    name="${var#CCA_VERIFY_SECRET_}"
+    if ! value=$(fetch_secret "${!var}" 2>"$err"); then
+      log "Could not fetch $name for verification from ${!var%%:*}: $(head -n 1 "$err")" >&2
+      rm -f "$err"
+      return 1
+    fi
+    if [[ "$value" == *$'\n'* ]]; then
+      log "Secret $name for verification spans several lines; only single-line values can be passed" >&2
+      rm -f "$err"
+      return 1
+    fi
+    lines+=("$name=$value")
+    REDACT_VALUES+=("$value")
+  done
+  rm -f "$err"
+  [ "${#lines[@]}" -gt 0 ] || return 0
+  VERIFY_ENV_FILE=$(mktemp)
+  printf '%s\n' "${lines[@]}" >"$VERIFY_ENV_FILE"
+  VERIFY_ENV_EXEC=$(mktemp)
+  cat >"$VERIFY_ENV_EXEC" <<EOF25
+#!/usr/bin/env bash
+while IFS= read -r line; do export "\$line"; done <"$VERIFY_ENV_FILE"
+exec "\$@"
+EOF25
+  chmod 700 "$VERIFY_ENV_EXEC"
+}
+
+# gh_mutation prints the action and target, tab-separated, of a gh call that
+# changes something on GitHub, and fails for calls that only read.
+gh_mutation() {
+  local method="" arg prev="" endpoint="" target="" fields=0
+  case "$1 ${2:-}" in
+    "pr create"|"pr edit"|"pr comment"|"pr merge"|"pr close"|"pr reopen"|"pr ready"|"pr review"|\
+    "issue create"|"issue comment"|"issue edit"|"issue close"|"issue reopen"|\
+    "label create"|"label edit"|"label delete"|"gist create"|"release create"|"repo edit")
+      if [ -n "${3:-}" ] && [[ "$3" != -* ]]; then
+        target="$3"
+      elif [ "$1 $2" = "pr create" ]; then
+        target=$(command git branch --show-current 2>/dev/null || true)
+        for arg in "$@"; do
+          [ "$prev" != "--head" ] || target="$arg"
+          prev="$arg"
+        done
+      fi
+      printf '%s %s\t%s\n' "$1" "$2" "$target"
+      ;;
+    "api "*)
+      shift
+      while [ "$#" -gt 0 ]; do
+        case "$1" in
+          -X|--method) method="$2"; shift ;;
+          -f|-F|--field|--raw-field|--input) fields=1; shift ;;
+          -H|--header|-q|--jq|-t|--template|--hostname|--cache) shift ;;
+          -*) ;;
+          *) [ -n "$endpoint" ] || endpoint="$1" ;;
+        esac
+        shift
+      done
+      [ -n "$method" ] || { [ "$fields" -eq 1 ] && method=POST; } || return 1
+      [ "${method^^}" != "GET" ] || return 1
+      printf 'api %s\t%s\n' "${method^^}" "$endpoint"
+      ;;
+    *) return 1 ;;
+  esac
+}
+
+# gh_read_only succeeds for gh calls that cannot change anything: subcommands
+# known to only read, and gh api requests that are GETs.
+gh_read_only() {
+  ! gh_mutation "$@" >/dev/null || return 1
+  case "$1 ${2:-}" in
+    "pr view"|"pr list"|"pr diff"|"pr checks"|"pr status"|"issue view"|"issue list"|"issue status"|\
+    "repo view"|"label list"|"release list"|"release view"|"run list"|"run view"|"auth status"|"config get"|\
+    "search "*|"api "*)
+      return 0
+      ;;
+  esac
+  return 1
+}
+
+# gh_applied checks, after gh call "$@" changing something failed with a
+# server error, whether GitHub applied it anyway. It succeeds when it did,
+# printing the URL of a pull request that was created, fails with 1 when it
+# did not and the call can be repeated, and fails with 2 when that cannot be
+# told. Edits are idempotent and always repeated; pull requests are looked up
+# by head branch and comments by their body, which carries the run marker.
+gh_applied() {
+  local arg prev="" body="" head="" url found
+  for arg in "$@"; do
+    case "$prev" in
+      --body|-b) body="$arg" ;;
+      --head|-H) head="$arg" ;;
+    esac
+    prev="$arg"
+  done
+  case "$(gh_mutation "$@" | cut -f1)" in
+    "pr edit"|"issue edit"|"label edit"|"repo edit"|"api PATCH"|"api PUT")
+      return 1
+      ;;
+    "pr create")
+      head=${head:-$(command git branch --show-current 2>/dev/null || true)}
+      [ -n "$head" ] || return 2
+      url=$(gh pr list --head "$head" --state open --json url --jq '.[0].url // empty') || return 2
+      [ -n "$url" ] || return 1
+      echo "$url"
+      ;;
+    "pr comment"|"issue comment")
+      [ -n "$body" ] && [ -n "${3:-}" ] || return 2
+      found=$(gh "$1" view "$3" --json comments |
+        jq --arg body "$body" 'any(.comments[]; (.body | rtrimstr("\n")) == ($body | rtrimstr("\n")))') || return 2
+      [ "$found" = "true" ] || return 1
+      ;;
+    *)
+      return 2
+      ;;
+  esac
+}
+
+# git runs git. In read-only mode it refuses pushes, whichever code path asks
+# for one.
+git() {
+  if [ "$READ_ONLY" -eq 1 ]; then
+    local arg skip=0
+    for arg in "$@"; do
+      if [ "$skip" -eq 1 ]; then
+        skip=0
+        continue
+      fi
+      case "$arg" in
+        -C|-c|--git-dir|--work-tree) skip=1 ;;
+        -*) ;;
+        push)
+          log "Read-only mode: refusing git $*" >&2
+          return 1
+          ;;
+        *) break ;;
+      esac
+    done
+  fi
+  command git "$@"
+}
+
+# audit_credential names the GitHub credential in use by its variable and a
+# fingerprint of the token, never the token itself.
+audit_credential() {
+  local var
+  for var in GH_TOKEN GITHUB_TOKEN; do
+    if [ -n "${!var:-}" ]; then
+      echo "$var sha256:$(printf '%s' "${!var}" | sha256sum | cut -c1-8)"
+      return
+    fi
+  done
+  echo "gh auth"
+}
+
+# audit appends a mutating operation to the audit log: action $1 on target $2
+# with exit code $3, the run and command it belongs to, the GitHub account
+# and credential used, and the host and user. Records are only ever appended
+# to AUDIT_LOG and, when AUDIT_WEBHOOK is set, also posted there for a
+# central log.
+audit() {
+  [ "$AUDIT" -eq 1 ] || return 0
+  local file="$AUDIT_LOG" actor record
+  # Resolve relative paths against the main checkout, not a worktree.
+  [[ "$file" == /* ]] || file="$(dirname "$(command git rev-parse --path-format=absolute --git-common-dir 2>/dev/null || echo "$PWD/.git")")/$file"
+  mkdir -p "$(dirname "$file")"
+  actor="${GITHUB_ACTOR:-$(command gh config get user -h github.com 2>/dev/null || true)}"
+  record=$(jq -cn --arg action "$1" --arg target "$(redact <<<"$2")" --argjson exit_code "$3" \
+    --arg run_id "$(current_run_id)" --arg command "$COMMAND" --arg actor "${actor:-unknown}" \
+    --arg credential "$(audit_credential)" --arg host "$(hostname)" --arg user "${USER:-$(id -un)}" \
+    '{time: (now | todate), run_id: $run_id, command: $command, action: $action, target: $target,
+      exit_code: $exit_code, actor: $actor, credential: $credential, host: $host, user: $user}')
+  printf '%s\n' "$record" >>"$file"
+  if [ -n "$AUDIT_WEBHOOK" ]; then
+    curl -fsS -X POST -H 'Content-Type: application/json' -d "$record" "$AUDIT_WEBHOOK" >/dev/null 2>&1 ||
+      log "Could not send the audit record to CCA_AUDIT_WEBHOOK" >&2
+  fi
+}
+
+# gh_category prints the API a gh invocation uses and its endpoint category
+# as "<kind>\t<category>". gh api calls are rest or graphql, with the method
+# and the endpoint with owner, repository, numbers and commits replaced by
+# placeholders; gh's own commands are cli, with the subcommand.
+gh_category() {
+  local method="" endpoint="" fields=0
+  if [ "$1" != "api" ]; then
+    printf 'cli\t%s %s\n' "$1" "${2:-}"
+    return
+  fi
+  shift
+  while [ "$#" -gt 0 ]; do
+    case "$1" in
+      -X|--method) method="$2"; shift ;;
+      -f|-F|--field|--raw-field|--input) fields=1; shift ;;
+      -H|--header|-q|--jq|-t|--template|--hostname|--cache) shift ;;
+      -*) ;;
+      *) [ -n "$endpoint" ] || endpoint="$1" ;;
+    esac
+    shift
+  done
+  if [ "$endpoint" = "graphql" ]; then
+    printf 'graphql\tgraphql\n'
+    return
+  fi
+  [ -n "$method" ] || { [ "$fields" -eq 1 ] && method=POST; } || method=GET
+  printf 'rest\t%s %s\n' "${method^^}" "$(sed -E 's#^/##; s#\?.*##; s#^repos/[^/]+/[^/]+#repos/{owner}/{repo}#
+    s#/compare/.*#/compare/{range}#; s#/[0-9a-f]{40}(/|$)#/{sha}\1#g; s#/[0-9]+(/|$)#/{n}\1#g' <<<"$endpoint")"
+}
+
+# record_api_call appends a gh call to api-calls.jsonl: its kind and
+# category, exit code, attempts and the seconds spent waiting out rate
+# limits. Calls made before the run has an artifacts directory are kept in
+# api_records until init_run_dir writes them.
+record_api_call() {
+  local record
+  record=$(jq -nc --arg kind "$1" --arg category "$2" --argjson code "$3" --argjson attempts "$4" --argjson waited "$5" \
+    '{kind: $kind, category: $category, exit_code: $code, attempts: $attempts, wait_seconds: $waited}')
+  if [ -n "$run_dir" ]; then
+    printf '%s\n' "$record" >>"$run_dir/api-calls.jsonl"
+  else
+    api_records+="$record"$'\n'
+  fi
+}
+
+# rate_limit prints the REST and GraphQL quota left as JSON, or nothing
+# offline, when replaying a cassette or when it cannot be read. Reading it
+# does not count against the quota.
+rate_limit() {
+  [ "$OFFLINE" -eq 0 ] && { [ -z "$CASSETTE" ] || [ "$CASSETTE_MODE" != "replay" ]; } || return 0
+  command gh api rate_limit \
+    --jq '.resources | {rest: .core, graphql: .graphql} | map_values({limit, remaining, used, reset})' 2>/dev/null || true
+}
+
+# gh runs the GitHub CLI, through the cassette when one is set, retrying up
+# to GH_RETRIES times with backoff on server errors and rate limits. A call
+# that changes something is only repeated after a server error when
+# gh_applied shows GitHub did not apply it. Such calls are recorded in the
+# audit log, and refused in read-only mode. Every call is recorded for the API
+# usage report, and the quota is read before the first one.
+gh() {
+  local attempt=1 code err mutation="" refreshed=0 waited=0 kind category applied landed
+  if [ "$READ_ONLY" -eq 1 ] && ! gh_read_only "$@"; then
+    log "Read-only mode: refusing gh $*" >&2
+    return 1
+  fi
+  if [ "$rate_limit_read" -eq 0 ]; then
+    rate_limit_read=1
+    rate_limit_before=$(rate_limit)
+  fi
+  if [ -z "$CASSETTE" ] || [ "$CASSETTE_MODE" != "replay" ]; then
+    mutation=$(gh_mutation "$@" || true)
+  fi
+  err=$(mktemp)
+  while true; do
+    code=0
+    if chaos api; then
+      echo "HTTP 502: Bad Gateway (injected)" >"$err"
+      code=1
+    elif chaos ratelimit; then
+      echo "HTTP 403: API rate limit exceeded (injected)" >"$err"
+      code=1
+    elif [ -n "$CASSETTE" ]; then
+      cassette_call gh "$@" 2>"$err" || code=$?
+    else
+      command gh "$@" 2>"$err" || code=$?
+    fi
+    if [ "$code" -ne 0 ] && [ "$refreshed" -eq 0 ] && compgen -v CCA_SECRET_ >/dev/null &&
+      grep -Eqi 'HTTP 401|Bad credentials' "$err"; then
+      log "GitHub rejected the credentials; fetching them again from the secret manager" >&2
+      refreshed=1
+      load_secrets && continue
+    fi
+    landed=1
+    if [ "$code" -ne 0 ] && [ -n "$mutation" ] && grep -Eqi 'HTTP 5[0-9][0-9]' "$err"; then
+      landed=0
+      applied=$(gh_applied "$@") || landed=$?
+      if [ "$landed" -eq 0 ]; then
+        log "gh $1 $2 reported $(head -n 1 "$err") but was applied" >&2
+        [ -z "$applied" ] || echo "$applied"
+        : >"$err"
+        code=0
+      elif [ "$landed" -eq 2 ]; then
+        log "gh $1 $2 failed and may have been applied; not retrying" >&2
+      fi
+    fi
+    if [ "$code" -eq 0 ] || [ "$landed" -eq 2 ] || [ "$attempt" -ge "$GH_RETRIES" ] ||
+      ! grep -Eqi 'HTTP 5[0-9][0-9]|rate limit' "$err"; then
+      cat "$err" >&2
+      rm -f "$err"
+      [ -z "$mutation" ] || audit "${mutation%%$'\t'*}" "${mutation#*$'\t'}" "$code"
+      IFS=$'\t' read -r kind category < <(gh_category "$@")
+      record_api_call "$kind" "$category" "$code" "$attempt" "$waited"
+      return "$code"
+    fi
+    log "gh $1 failed ($(head -n 1 "$err")); retrying in $((attempt * 2))s" >&2
+    ! grep -qi 'rate limit' "$err" || waited=$((waited + attempt * 2))
+    sleep $((attempt * 2))
+    attempt=$((attempt + 1))
+  done
+}
+
+# push runs git push, retrying once after a failure, and records the result
+# in the audit log. In read-only mode it fails at once, without an audit entry
+# for a push that was never attempted.
+push() {
+  local attempt
+  if [ "$READ_ONLY" -eq 1 ]; then
+    log "Read-only mode: refusing git push $*" >&2
+    return 1
+  fi
+  for attempt in 1 2; do
+    if chaos push; then
+      log "git push failed (injected)" >&2
+    elif git push "$@"; then
+      audit "git push" "$*" 0
+      return 0
+    fi
+    [ "$attempt" -eq 2 ] || { log "Retrying git push" >&2; sleep 2; }
+  done
+  audit "git push" "$*" 1
+  return 1
+}
+
+# objects_kb prints the size of the repository's object store in KB.
+objects_kb() {
+  command git count-objects -v | awk '/^(size|size-pack):/ { kb += $2 } END { print kb + 0 }'
+}
+
+# record_fetch appends what a fetch downloaded, the growth of the object store
+# since before KB, to fetches.jsonl of the run. Fetches made before the run
+# has an artifacts directory are kept until init_run_dir writes them.
+record_fetch() {
+  local kind="$1" before="$2" refs="$3" record
+  record=$(jq -nc --arg kind "$kind" --arg refs "$refs" --argjson kb "$(($(objects_kb) - before))" \
+    --arg at "$(date -u +%Y-%m-%dT%H:%M:%SZ)" '{at: $at, kind: $kind, refs: $refs, kb: $kb}')
+  if [ -n "$run_dir" ]; then
+    printf '%s\n' "$record" >>"$run_dir/fetches.jsonl"
+  else
+    fetch_records+="$record"$'\n'
+  fi
+}
+
+# fetch fetches refs from origin. In a shallow clone they are fetched at
+# FETCH_DEPTH commits, so history is only downloaded when deepen_until asks
+# for it; once this process has deepened the clone fetches keep its depth.
+fetch() {
+  local before args=()
+  before=$(objects_kb)
+  if [ "$FETCH_DEPTH" -gt 0 ] && [ "$history_deepened" -eq 0 ] &&
+     [ "$(command git rev-parse --is-shallow-repository)" = "true" ]; then
+    args+=(--depth="$FETCH_DEPTH")
+  fi
+  git fetch ${args[@]+"${args[@]}"} origin "$@"
+  record_fetch fetch "$before" "$*"
+}
+
+# history_covers succeeds when the local history reaches back to the given
+# date, that is the clone is not shallow or its oldest boundary commit is
+# older.
+history_covers() {
+  local shallow since oldest
+  shallow=$(command git rev-parse --git-path shallow)
+  [ -s "$shallow" ] || return 0
+  since=$(date -d "$1" +%s) || return 0
+  oldest=$(xargs git log --no-walk --format=%ct <"$shallow" | sort -n | head -n 1)
+  [ "${oldest:-0}" -le "$since" ]
+}
+
+# has_merge_base succeeds when the two commits share history locally.
+has_merge_base() {
+  command git merge-base "$1" "$2" >/dev/null 2>&1
+}
+
+# has_commit succeeds when the commit is available locally.
+has_commit() {
+  command git cat-file -e "$1^{commit}" 2>/dev/null
+}
+
+# deepen_until deepens a shallow clone by DEEPEN_STEP commits at a time until
+# the given command succeeds, fetching the full history after DEEPEN_MAX
+# rounds. The reason names the module that needed the history in the log and
+# in fetches.jsonl.
+deepen_until() {
+  local reason="$1" round=0 before
+  shift
+  [ "$(command git rev-parse --is-shallow-repository 2>/dev/null)" = "true" ] || return 0
+  "$@" && return 0
+  before=$(objects_kb)
+  while [ "$(command git rev-parse --is-shallow-repository)" = "true" ] && ! "$@"; do
+    round=$((round + 1))
+    if [ "$round" -gt "$DEEPEN_MAX" ]; then
+      log "Fetching the full history for $reason" >&2
+      git fetch --quiet --unshallow origin || break
+    else
+      log "Deepening history by $DEEPEN_STEP commits for $reason" >&2
+      git fetch --quiet --deepen="$DEEPEN_STEP" origin || break
+    fi
+  done
+  history_deepened=1
+  record_fetch "deepen: $reason" "$before" ""
+}
+
+# curl records and replays only OSV requests; backend traffic always goes out.
+# Requests use the client certificate of network_setup.
+curl() {
+  if [ -n "$CASSETTE" ] && [[ "$*" == *api.osv.dev* ]]; then
+    cassette_call curl "$@"
+  else
+    command curl ${tls_curl_args[@]+"${tls_curl_args[@]}"} "$@"
+  fi
+}
+
+# run_cassette lists, shows or deletes recorded cassettes.
+run_cassette() {
+  local dir
+  dir="$(git rev-parse --show-toplevel)/.cca/cassettes"
+  case "$TARGET" in
+    list)
+      [ -d "$dir" ] || return 0
+      local name
+      for name in "$dir"/*/; do
+        [ -d "$name" ] || continue
+        echo "$(basename "$name") $(find "$name" -name '*.json' | wc -l) interactions"
+      done
+      ;;
+    show)
+      [ -n "$OPERAND" ] && [ -d "$dir/$OPERAND" ] || { log "No cassette named $OPERAND" >&2; exit 1; }
+      jq -s -r 'sort_by(.command, .args)[] | "\(.command) \(.args) -> exit \(.exit_code), \(.stdout | length) bytes"' "$dir/$OPERAND"/*.json
+      ;;
+    delete)
+      [ -n "$OPERAND" ] && [ -d "$dir/$OPERAND" ] || { log "No cassette named $OPERAND" >&2; exit 1; }
+      rm -rf "${dir:?}/$OPERAND"
+      log "Deleted cassette $OPERAND"
+      ;;
+    *) usage ;;
+  esac
+}
+
+# init_run_dir creates the artifacts directory for this invocation under
+# .cca/runs/, named by timestamp and the given label.
+init_run_dir() {
+  run_dir="$root_dir/.cca/runs/$(date +%Y%m%d-%H%M%S)-$1"
+  mkdir -p "$run_dir"
+  [ -z "$fetch_records" ] || printf '%s' "$fetch_records" >"$run_dir/fetches.jsonl"
+  [ -z "$api_records" ] || printf '%s' "$api_records" >"$run_dir/api-calls.jsonl"
+}
+
+# set_status updates fields of the run's status.json from key/value pairs.
+set_status() {
+  [ -n "$run_dir" ] && [ -f "$run_dir/status.json" ] || return 0
+  local args=() filter="." key
+  while [ "$#" -ge 2 ]; do
+    key="$1"
+    args+=(--arg "$key" "$2")
+    filter="$filter | .$key = \$$key"
+    shift 2
+  done
+  jq "${args[@]}" "$filter" "$run_dir/status.json" >"$run_dir/status.json.tmp"
+  mv "$run_dir/status.json.tmp" "$run_dir/status.json"
+}
+
+# schema_json prints the JSON Schema named $1 with its $schema and $id.
+schema_json() {
+  jq --arg id "https://github.com/fumiya-kume/cca/schemas/v$SCHEMA_VERSION/$1.json" \
+    '{"$schema": "https://json-schema.org/draft/2020-12/schema", "$id": $id} + .' <<<"${SCHEMAS[$1]}"
+}
+
+# validate_json prints where the JSON on stdin violates schema $1, checking
+# every document of a JSON Lines stream, and fails when it does or when the
+# input is not JSON.
+validate_json() {
+  local input errors
+  input=$(cat)
+  if [ -z "$input" ] || ! errors=$(jq -r --argjson schema "${SCHEMAS[$1]}" "$JSON_SCHEMA_CHECK"' check($schema; "$")' <<<"$input" 2>/dev/null); then
+    echo "$: not valid JSON"
+    return 1
+  fi
+  [ -z "$errors" ] || { printf '%s\n' "$errors"; return 1; }
+}
+
+# check_artifact logs where run artifact $2 violates schema $1.
+check_artifact() {
+  local errors
+  [ -f "$2" ] || return 0
+  errors=$(validate_json "$1" <"$2") || log "$(basename "$2") does not match the $1 schema:"$'\n'"$errors" >&2
+}
+
+# check_changes checks the backend response $1 against the changes schema,
+# logging where it does not match and failing then.
+check_changes() {
+  local errors
+  errors=$(validate_json changes <<<"$1") && return 0
+  log "$BACKEND response does not match the changes schema:"$'\n'"$errors" >&2
+  return 1
+}
+
+# run_schema lists the schemas, prints schema $1, or checks the JSON or JSON
+# Lines file $2 against it.
+run_schema() {
+  local name errors
+  if [ -z "$1" ]; then
+    for name in $(printf '%s\n' "${!SCHEMAS[@]}" | sort); do
+      printf '%s\tv%s\t%s\n' "$name" "$SCHEMA_VERSION" "$(jq -r .title <<<"${SCHEMAS[$name]}")"
+    done
+    return
+  fi
+  if [ -z "${SCHEMAS[$1]+set}" ]; then
+    log "Unknown schema $1; run '$0 schema' for the list" >&2
+    exit 1
+  fi
+  if [ -z "$2" ]; then
+    schema_json "$1"
+    return
+  fi
+  [ -f "$2" ] || { log "File not found: $2" >&2; exit 1; }
+  if ! errors=$(validate_json "$1" <"$2"); then
+    printf '%s\n' "$errors"
+    exit 1
+  fi
+  log "$2 matches the $1 schema (version $SCHEMA_VERSION)"
+}
+
+# gate_decision records the outcome of quality gate $1 in gates.jsonl: $2 is
+# passed, acknowledged, failed or skipped, and $3 what it was based on.
+gate_decision() {
+  [ -n "$run_dir" ] && [ -d "$run_dir" ] || return 0
+  jq -cn --argjson v "$SCHEMA_VERSION" --arg gate "$1" --arg decision "$2" --arg detail "$3" \
+    '{schema_version: $v, time: (now | todate), gate: $gate, decision: $decision, detail: $detail}' >>"$run_dir/gates.jsonl"
+}
+
+# hook_state prints the run state passed to lifecycle hooks as JSON: event $1,
+# the issue, the run, its branch and status.json, merged with the JSON
+# object $2.
+hook_state() {
+  jq -n --argjson v "$SCHEMA_VERSION" --arg event "$1" --argjson extra "$2" --arg run_id "$(current_run_id)" \
+    --arg issue_url "$ISSUE_URL" --arg issue_file "$ISSUE_FILE" --arg number "${number:-}" \
+    --arg title "${title:-}" --arg body "${body:-}" --arg labels "$issue_labels" --arg repo "${repo:-}" \
+    --arg run_dir "$run_dir" --arg branch "$branch" --arg base_commit "$base_commit" --arg work_dir "$work_dir" \
+    --argjson status "$(cat "$run_dir/status.json" 2>/dev/null || echo '{}')" \
+    '{schema_version: $v, event: $event, run_id: $run_id, repository: $repo,
+      issue: {url: $issue_url, file: $issue_file, number: $number, title: $title, body: $body,
+        labels: ($labels | split("\n") | map(select(. != "")))},
+      run_dir: $run_dir, branch: $branch, base_commit: $base_commit, work_dir: $work_dir, status: $status} + $extra'
+}
+
+# run_hook runs the hooks of lifecycle event $1 (pre-analysis,
+# post-generation or pre-pr): the executable .cca/hooks/<event> of the
+# checkout CCA was started in, then the command in CCA_HOOK_<EVENT>, each with
+# the run state (see hook_state, with the JSON object $2 merged in) on stdin
+# and CCA_HOOK_EVENT set. Hooks come from the checkout rather than the
+# worktree so that generated changes cannot alter them. A hook that fails or
+# runs longer than HOOK_TIMEOUT seconds stops the run. Each run is recorded in
+# hooks.jsonl.
+run_hook() {
+  local event="$1" var state errors cmd output code hooks=()
+  var="CCA_HOOK_${event//-/_}"
+  var="${var^^}"
+  [ ! -x "${root_dir:-$PWD}/.cca/hooks/$event" ] || hooks+=("$(printf '%q' "${root_dir:-$PWD}/.cca/hooks/$event")")
+  [ -z "${!var:-}" ] || hooks+=("${!var}")
+  [ "${#hooks[@]}" -gt 0 ] || return 0
+  state=$(hook_state "$event" "${2:-"{}"}")
+  errors=$(validate_json hook <<<"$state") || log "The $event hook state does not match the hook schema:"$'\n'"$errors" >&2
+  for cmd in "${hooks[@]}"; do
+    log "Running $event hook: $cmd"
+    code=0
+    output=$(CCA_HOOK_EVENT="$event" timeout "$HOOK_TIMEOUT" bash -c "$cmd" <<<"$state" 2>&1) || code=$?
+    output=$(redact <<<"$output")
+    [ -z "$output" ] || log "$output"
+    [ -z "$run_dir" ] || jq -cn --arg event "$event" --arg command "$cmd" --argjson code "$code" --arg output "$output" \
+      '{time: (now | todate), event: $event, command: $command, exit_code: $code, output: $output}' >>"$run_dir/hooks.jsonl"
+    if [ "$code" -ne 0 ]; then
+      gate_decision "hook:$event" failed "$cmd exited with $code"
+      log "The $event hook failed (exit code $code${output:+: $(tail -n 1 <<<"$output")})" >&2
+      exit 1
+    fi
+  done
+  gate_decision "hook:$event" passed "${#hooks[@]} hooks"
+}
+
+# start_heartbeat marks the run as processing in status.json and touches its
+# heartbeat file every HEARTBEAT_INTERVAL seconds while this process lives.
+start_heartbeat() {
+  jq -n --argjson v "$SCHEMA_VERSION" --arg pid "$$" --arg host "$(hostname)" --arg started "$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+    --arg issue_url "$ISSUE_URL" --arg prompt_version "$PROMPT_VERSION" --arg variants "$EXPERIMENT_VARIANTS" \
+    '{schema_version: $v, status: "processing", pid: $pid, host: $host, started: $started, issue_url: $issue_url,
+      prompt_version: $prompt_version, variants: ($variants | split(" ") | map(select(. != "")))}' \
+    >"$run_dir/status.json"
+  touch "$run_dir/heartbeat"
+  (
+    while kill -0 "$$" 2>/dev/null; do
+      touch "$run_dir/heartbeat"
+      sleep "$HEARTBEAT_INTERVAL"
+    done
+  ) >/dev/null 2>&1 &
+  heartbeat_pid=$!
+}
+
+# recover_orphans finds runs still marked processing whose heartbeat is older
+# than HEARTBEAT_TIMEOUT minutes, removes their worktree and unpushed branch
+# and marks them failed.
+recover_orphans() {
+  local status dir branch work_dir last
+  for status in "$root_dir"/.cca/runs/*/status.json; do
+    [ -f "$status" ] && [ "$(jq -r '.status' "$status")" = "processing" ] || continue
+    dir=$(dirname "$status")
+    [ -n "$(find "$dir/heartbeat" -mmin "+$HEARTBEAT_TIMEOUT" 2>/dev/null)" ] || continue
+    last=$(date -u -r "$dir/heartbeat" +%Y-%m-%dT%H:%M:%SZ)
+    log "Run $(basename "$dir") stopped sending heartbeats at $last"
+    work_dir=$(jq -r '.work_dir // empty' "$status")
+    branch=$(jq -r '.branch // empty' "$status")
+    if [ -n "$work_dir" ] && [ -d "$work_dir" ]; then
+      remove git worktree remove --force "$work_dir"
+    fi
+    if [ -n "$branch" ] && git show-ref --verify --quiet "refs/heads/$branch" &&
+       ! git ls-remote --exit-code --heads origin "$branch" >/dev/null 2>&1; then
+      remove git branch -D "$branch"
+    fi
+    if [ "$DRY_RUN" -eq 0 ]; then
+      jq --arg cause "worker stopped responding; last heartbeat at $last" \
+        '.status = "failed" | .cause = $cause' "$status" >"$status.tmp"
+      mv "$status.tmp" "$status"
+    fi
+  done
+}
+
+# context_excluded succeeds when a path matches a CCA_CONTEXT_EXCLUDE glob and
+# prints the glob.
+context_excluded() {
+  local glob
+  for glob in $CONTEXT_EXCLUDE; do
+    if [[ "$1" == $glob || "$(basename "$1")" == $glob ]]; then
+      echo "$glob"
+      return 0
+    fi
+  done
+  return 1
+}
+
+# context_replay records the sources listed in file $1 again for the next
+# prompt, for context gathered once and sent in several prompts.
+context_replay() {
+  [ ! -f "$1" ] || cat "$1" >>"$CONTEXT_PENDING"
+}
+
+# context_record notes a source considered for the next prompt (its path, the
+# bytes included, included, truncated, excluded or pruned, and why) so that
+# claude_chat can log it in context.jsonl.
+context_record() {
+  printf '%s\t%s\t%s\t%s\n' "$1" "$2" "$3" "${4:-}" >>"$CONTEXT_PENDING"
+}
+
+# context_file prints a file for inclusion in a prompt, applying the exclude
+# globs, the per-file byte cap and optional comment and string stripping.
+context_file() {
+  local path="$1" content glob
+  if glob=$(context_excluded "$path"); then
+    context_record "$path" 0 excluded "matches CCA_CONTEXT_EXCLUDE glob $glob"
+    echo "(content omitted by policy)"
+    return
+  fi
+  content=$(head -c "$CONTEXT_MAX_BYTES" "$path")
+  if [ "$STRIP_COMMENTS" -eq 1 ]; then
+    content=$(sed -E -e '/^[[:space:]]*(\/\/|#)/d' -e 's/"[^"]*"/""/g' <<<"$content")
+  fi
+  if [ "$(wc -c <"$path")" -gt "$CONTEXT_MAX_BYTES" ]; then
+    context_record "$path" "${#content}" truncated "$(wc -c <"$path") bytes, capped at CCA_CONTEXT_MAX_BYTES"
+    printf '%s\n(truncated)\n' "$content"
+  else
+    context_record "$path" "${#content}" included
+    printf '%s\n' "$content"
+  fi
+}
+
+# context_diff prints git diff output for a prompt without excluded paths.
+context_diff() {
+  local excludes=() glob diff
+  for glob in $CONTEXT_EXCLUDE; do
+    excludes+=(":(exclude,glob)**/$glob" ":(exclude,glob)$glob")
+  done
+  diff=$(git diff "$@" -- . "${excludes[@]}")
+  if [ "${#diff}" -gt "$CONTEXT_MAX_BYTES" ]; then
+    context_record "diff $*" "$CONTEXT_MAX_BYTES" truncated "${#diff} bytes, capped at CCA_CONTEXT_MAX_BYTES"
+    diff=$(head -c "$CONTEXT_MAX_BYTES" <<<"$diff")
+  else
+    context_record "diff $*" "${#diff}" included
+  fi
+  printf '%s\n' "$diff"
+}
 
 claude_chat() {
   local prompt_file="$1"
   local mode="${2:-with-p}"
   local prompt
-  prompt=$(cat "$prompt_file")
-  if [ "$mode" = "with-p" ]; then
-    claude -p "$prompt"
+  prompt=$(redact <"$prompt_file")
+  [ -z "$PROMPT_APPEND" ] || prompt+=$'\n\n'$(redact <"$PROMPT_APPEND")
+  if [ -n "$run_dir" ]; then
+    jq -cn --arg backend "$BACKEND" --arg stage "$current_stage" --argjson bytes "${#prompt}" --rawfile files "$CONTEXT_PENDING" '{
+      time: (now | todate),
+      backend: $backend,
+      stage: $stage,
+      prompt_bytes: $bytes,
+      files: [$files | split("\n")[] | select(. != "") | split("\t")
+        | {path: .[0], bytes: (.[1] | tonumber), status: .[2], detail: (.[3] // "")}]
+    }' >>"$run_dir/context.jsonl"
+  fi
+  : >"$CONTEXT_PENDING"
+  if chaos slow; then
+    sleep "$CHAOS_DELAY"
+  fi
+  local response limit=() model=()
+  # A backend call may not outlast the time budget.
+  [ "$budget_seconds" -eq 0 ] || limit=(timeout "$(budget_left)")
+  [ -z "$MODEL" ] || model=(--model "$MODEL")
+  if [ "$mode" = "stream" ]; then
+    response=$(stream_chat "$prompt")
+  elif [ "$BACKEND" = "ollama" ]; then
+    response=$(ollama_chat "$prompt")
+  elif [ "$mode" = "with-p" ]; then
+    response=$(${limit[@]+"${limit[@]}"} claude ${model[@]+"${model[@]}"} -p "$prompt")
+  else
+    response=$(${limit[@]+"${limit[@]}"} claude ${model[@]+"${model[@]}"} "$prompt")
+  fi
+  [ -z "$run_dir" ] || save_transcript "$prompt" "$response"
+  printf '%s\n' "$response"
+}
+
+# save_transcript stores a redacted prompt and response under transcripts/ in
+# the run directory, numbered in order and named after the current stage.
+save_transcript() {
+  local dir="$run_dir/transcripts" n name
+  mkdir -p "$dir"
+  n=$(printf '%03d' $(($(find "$dir" -name '*.prompt.txt' | wc -l) + 1)))
+  name="$n-$(tr -c 'a-z0-9-' '-' <<<"${current_stage:-prompt}" | sed 's/-*$//')"
+  printf '%s\n' "$1" >"$dir/$name.prompt.txt"
+  redact <<<"$2" >"$dir/$name.response.txt"
+}
+
+# ollama_chat prints the response of the Ollama model to a prompt, or with
+# "true" as $2 the raw stream of response chunks.
+ollama_chat() {
+  local prompt="$1" stream="${2:-false}"
+  local request
+  request=$(jq -n --arg model "$OLLAMA_MODEL" --arg prompt "$prompt" \
+    --argjson deterministic "$DETERMINISTIC" --argjson seed "$SEED" --argjson stream "$stream" \
+    '{model: $model, prompt: $prompt, stream: $stream}
+     + if $deterministic == 1 then {options: {temperature: 0, seed: $seed}} else {} end')
+  local limit=()
+  [ "$budget_seconds" -eq 0 ] || limit=(--max-time "$(budget_left)")
+  if [ "$stream" = "true" ]; then
+    curl -sfN ${limit[@]+"${limit[@]}"} "$OLLAMA_HOST/api/generate" -d "$request"
+  else
+    curl -sf ${limit[@]+"${limit[@]}"} "$OLLAMA_HOST/api/generate" -d "$request" | jq -r '.response'
+  fi
+}
+
+# stream_preview reads the text of a streamed response as JSON strings on
+# stdin and prints the contents of the "files" object as it arrives: a
+# "+++ path" line when a file starts and a "+" line for each completed line.
+stream_preview() {
+  jq -rn --unbuffered '
+    def ch: [.] | implode;
+    foreach (inputs | explode[]) as $c (
+      {s: 0, depth: 0, fdepth: -1, colon: false, str: "", buf: "", val: false, line: "", out: []};
+      .out = []
+      | if .s == 2 then
+          .s = 1
+          | if .val then
+              if $c == 110 then .out = ["+" + .line] | .line = ""
+              elif $c == 116 then .line += "\t"
+              else .line += ($c | ch) end
+            else . end
+        elif .s == 1 then
+          if $c == 92 then .s = 2
+          elif $c == 34 then
+            .s = 0
+            | if .val then (if .line != "" then .out = ["+" + .line] else . end) | .line = "" | .val = false else .str = .buf end
+            | .buf = ""
+          elif .val then .line += ($c | ch)
+          else .buf += ($c | ch) end
+        elif $c == 34 then
+          .s = 1
+          | if .depth == .fdepth and .colon then .val = true | .out = ["+++ " + .str] else . end
+        elif $c == 58 then .colon = true
+        elif $c == 44 then .colon = false
+        elif $c == 123 or $c == 91 then
+          .depth += 1
+          | if $c == 123 and .colon and .str == "files" and .depth == 2 then .fdepth = .depth else . end
+          | .colon = false
+        elif $c == 125 or $c == 93 then
+          .depth -= 1 | if .depth < .fdepth then .fdepth = -1 else . end
+        else . end;
+      .out[]
+    )'
+}
+
+# issue_key prints a short stable key for the issue being worked on, derived
+# from its URL or the path of its issue file.
+issue_key() {
+  printf '%s' "${ISSUE_URL:-$(realpath "$ISSUE_FILE")}" | sha256sum | cut -c1-12
+}
+
+# take_lock takes lock directory $1 for process $2. The directory is built
+# with the pid in it and renamed into place, so it never exists without one.
+# A lock held by a running process, or whose pid cannot be read after a few
+# tries, is not taken: take_lock returns 1 with the holder's pid (empty when
+# unknown) in lock_holder. A lock whose process is gone is taken over, with
+# its pid left in lock_holder.
+take_lock() {
+  local lock="$1" pid="$2" tmp holder tries=0
+  lock_holder=""
+  tmp=$(mktemp -d "$lock.XXXXXX")
+  echo "$pid" >"$tmp/pid"
+  until [ ! -e "$lock" ] && mv -T "$tmp" "$lock" 2>/dev/null; do
+    holder=$(cat "$lock/pid" 2>/dev/null || true)
+    if [ -n "$holder" ] && ! kill -0 "$holder" 2>/dev/null; then
+      # Take over under a second lock, so that of two runs finding the
+      # process gone only one removes its lock.
+      if mkdir "$lock.takeover" 2>/dev/null; then
+        if [ "$(cat "$lock/pid" 2>/dev/null || true)" = "$holder" ]; then
+          rm -rf "$lock"
+          lock_holder="$holder"
+        fi
+        rmdir "$lock.takeover"
+        continue
+      fi
+    elif [ -n "$holder" ]; then
+      rm -rf "$tmp"
+      lock_holder="$holder"
+      return 1
+    fi
+    tries=$((tries + 1))
+    if [ "$tries" -ge 5 ]; then
+      rm -rf "$tmp"
+      lock_holder="$holder"
+      return 1
+    fi
+    sleep 1
+  done
+}
+
+# issue_lock takes the issue's lock under .cca/locks, so that a second run for
+# the same issue started while one is in progress, for example by a webhook
+# delivered twice, stops instead of racing it. The lock of a process that is
+# gone is taken over.
+issue_lock() {
+  local lock
+  lock="$root_dir/.cca/locks/$(issue_key)"
+  mkdir -p "$root_dir/.cca/locks"
+  if ! take_lock "$lock" "$$"; then
+    log "Another cca run (pid ${lock_holder:-unknown}) is already working on this issue; not starting a second one"
+    exit 0
+  fi
+  [ -z "$lock_holder" ] || log "Taking over the lock of a run that stopped (pid $lock_holder)"
+  issue_lock_dir="$lock"
+}
+
+# duplicate_guard looks for work CCA already pushed for the issue: an open
+# pull request on a cca/ branch that resolves it, or a cca/ branch for the
+# issue that never got a pull request. Depending on ON_DUPLICATE it stops with
+# a pointer to it (abort), updates the existing pull request (update) or
+# carries on with a new one (new).
+duplicate_guard() {
+  [ "$ON_DUPLICATE" != "new" ] || return 0
+  local pr ref orphan=""
+  pr=$(gh pr list --state open --search "\"Resolves: $ISSUE_URL\" in:body" --limit 20 --json url,headRefName,body |
+    jq -r --arg url "$ISSUE_URL" '[.[] | select((.headRefName | startswith("cca/")) and (.body | contains("Resolves: " + $url)))][0].url // empty')
+  if [ -n "$pr" ]; then
+    if [ "$ON_DUPLICATE" = "update" ]; then
+      log "Issue already has pull request $pr; updating it instead of opening another"
+      run_update "$pr"
+      exit 0
+    fi
+    log "Issue already has pull request $pr; not opening another."
+    log "Run '$0 update $pr' to iterate on it, or set CCA_ON_DUPLICATE=new to open a new one."
+    exit 0
+  fi
+  while read -r ref; do
+    ref="${ref#refs/heads/}"
+    [[ "$ref" != *-part[0-9]* ]] || continue
+    if [ "$(gh pr list --head "$ref" --state all --json number --jq length)" -eq 0 ]; then
+      orphan="$ref"
+      break
+    fi
+  done < <(git ls-remote --heads origin "cca/*-$number-*" 2>/dev/null | cut -f2)
+  [ -n "$orphan" ] || return 0
+  log "Branch $orphan was already pushed for this issue but has no pull request."
+  log "Open one with 'gh pr create --draft --head $orphan', delete the branch, or set CCA_ON_DUPLICATE=new to start over."
+  exit 0
+}
+
+# checkpoint_dir prints the directory that keeps the interrupted generation
+# of the current issue for the next run: checkpoint.json describing the run,
+# partial.txt with the output received so far and, when the user cancelled,
+# guidance.txt with what to do differently.
+checkpoint_dir() {
+  echo "$root_dir/.cca/checkpoints/$(issue_key)"
+}
+
+# stream_chat sends prompt $1 to the backend with streaming output and prints
+# the response. While it arrives, the text is appended to the checkpoint and
+# the files being written are previewed on stderr, so that a generation going
+# the wrong way can be stopped with Ctrl-C. After a cancellation the user can
+# leave guidance for the next attempt; the checkpoint stays for cca resume.
+stream_chat() {
+  local prompt="$1" dir filter cancelled=0 code=0 guidance="" limit=() model=()
+  dir=$(checkpoint_dir)
+  mkdir -p "$dir"
+  rm -f "$dir/guidance.txt"
+  : >"$dir/partial.txt"
+  jq -n --arg issue_url "$ISSUE_URL" --arg issue_file "$([ -z "$ISSUE_FILE" ] || realpath "$ISSUE_FILE")" \
+    --argjson offline "$OFFLINE" --arg run_id "$(current_run_id)" --arg stage "$current_stage" \
+    '{issue_url: $issue_url, issue_file: $issue_file, offline: ($offline == 1), run_id: $run_id, stage: $stage,
+      started: (now | todate)}' >"$dir/checkpoint.json"
+  [ "$budget_seconds" -eq 0 ] || limit=(timeout "$(budget_left)")
+  [ -z "$MODEL" ] || model=(--model "$MODEL")
+  trap 'cancelled=1' INT
+  log "Streaming the response; press Ctrl-C to stop a generation that is going the wrong way" >&2
+  filter='select(.type == "stream_event" and .event.delta.type? == "text_delta") | .event.delta.text'
+  [ "$BACKEND" != "ollama" ] || filter='.response // empty'
+  if [ "$BACKEND" = "ollama" ]; then
+    ollama_chat "$prompt" true
+  else
+    ${limit[@]+"${limit[@]}"} claude ${model[@]+"${model[@]}"} -p --output-format stream-json --verbose \
+      --include-partial-messages "$prompt"
+  fi | jq --unbuffered -c "$filter" 2>/dev/null | tee -a "$dir/partial.txt" | stream_preview >&2 || code=$?
+  trap - INT
+  if [ "$cancelled" -eq 1 ]; then
+    log "Generation cancelled; the partial output is kept in $dir for cca resume" >&2
+    if [ -t 0 ]; then
+      read -r -p "What should the next attempt do differently? (empty to continue from the partial output) " guidance || true
+    fi
+    [ -z "$guidance" ] || printf '%s\n' "$guidance" >"$dir/guidance.txt"
+    exit 130
+  fi
+  if [ "$code" -ne 0 ]; then
+    log "Streaming from $BACKEND failed; the partial output is kept in $dir for cca resume" >&2
+    exit "$code"
+  fi
+  jq -j . "$dir/partial.txt"
+}
+
+# checkpoint_context prints the prompt section for a generation that resumes
+# an interrupted one: the user's guidance when they cancelled it, otherwise
+# the partial output to continue from.
+checkpoint_context() {
+  local dir
+  dir=$(checkpoint_dir)
+  if [ -s "$dir/guidance.txt" ]; then
+    printf 'An earlier attempt was stopped by the user, who asked for this instead:\n%s\n' "$(cat "$dir/guidance.txt")"
+  elif [ -s "$dir/partial.txt" ]; then
+    printf 'An earlier attempt was interrupted. Continue from its partial output, keeping what\nis correct, and return the complete JSON:\n%s\n' \
+      "$(jq -j . "$dir/partial.txt" | head -c "$CONTEXT_MAX_BYTES")"
+  fi
+}
+
+# run_tool executes one tool call requested by the backend and prints its
+# result. Only tools listed in CCA_TOOLS_ALLOWED run.
+run_tool() {
+  local call="$1" tool path
+  tool=$(jq -r '.tool' <<<"$call")
+  if [[ " $TOOLS_ALLOWED " != *" $tool "* ]]; then
+    echo "Tool $tool is not allowed."
+    return
+  fi
+  path=$(jq -r '.args.path // empty' <<<"$call")
+  if [[ "$path" == /* || "$path" == *..* ]]; then
+    echo "Paths must be relative to the repository root."
+    return
+  fi
+  case "$tool" in
+    read_file)
+      if [ -f "$path" ]; then
+        context_file "$path"
+      else
+        echo "No such file: $path"
+      fi
+      ;;
+    search_code)
+      git grep -n -I -e "$(jq -r '.args.pattern' <<<"$call")" -- . ':!*.min.js' 2>/dev/null | head -n 50 || true
+      ;;
+    find_symbols)
+      [ -s "$root_dir/.cca/index/symbols.tsv" ] || update_index
+      search_symbols "$(jq -r '.args.query' <<<"$call")" 20
+      ;;
+    git_blame)
+      deepen_until "blame of $path" history_covers "1 year ago"
+      git blame -L "$(jq -r '"\(.args.start // 1),\(.args.end // "+40")"' <<<"$call")" -- "$path" 2>&1 | head -n 80
+      ;;
+    run_tests)
+      if [ -f .cca/verify.sh ]; then
+        detect_toolchains >&2
+        run_verify full 2>&1 | tail -n 80
+      else
+        echo "No .cca/verify.sh in this repository."
+      fi
+      ;;
+    *) echo "Unknown tool: $tool" ;;
+  esac
+}
+
+# chat_with_tools sends a prompt to the backend, letting it request tool calls
+# before answering. Results are appended to the conversation and logged to
+# tools.jsonl, for at most TOOL_MAX_ROUNDS rounds. The final answer is printed.
+chat_with_tools() {
+  local conversation response round=1 call result
+  conversation=$(mktemp)
+  cat "$1" >"$conversation"
+  cat >>"$conversation" <<EOF11
+
+Before answering you may inspect the repository with tools. To use them,
+reply with only this JSON instead of the answer:
+{"tool_calls": [{"tool": "name", "args": {}}]}
+
+Available tools:
+$(for call in $TOOLS_ALLOWED; do
+  case "$call" in
+    read_file) echo '- read_file {"path": "relative/path"}: file content' ;;
+    search_code) echo '- search_code {"pattern": "regex"}: matching lines (git grep)' ;;
+    find_symbols) echo '- find_symbols {"query": "words"}: declarations matching the words' ;;
+    git_blame) echo '- git_blame {"path": "relative/path", "start": 1, "end": 40}: who changed the lines and when' ;;
+    run_tests) echo '- run_tests {}: output of the verification script on the current code' ;;
+  esac
+done)
+EOF11
+  while true; do
+    response=$(claude_chat "$conversation" "$2")
+    if [ "$round" -gt "$TOOL_MAX_ROUNDS" ] || ! jq -e '.tool_calls | length > 0' <<<"$response" >/dev/null 2>&1; then
+      break
+    fi
+    printf '\n%s\n' "$response" >>"$conversation"
+    while read -r call; do
+      log "Tool call: $(jq -c . <<<"$call")" >&2
+      result=$(run_tool "$call")
+      [ -z "$run_dir" ] || jq -cn --argjson round "$round" --argjson call "$call" --argjson bytes "${#result}" \
+        '{round: $round, call: $call, result_bytes: $bytes}' >>"$run_dir/tools.jsonl"
+      printf '\nResult of %s:\n%s\n' "$(jq -c . <<<"$call")" "$result" >>"$conversation"
+    done < <(jq -c '.tool_calls[]' <<<"$response")
+    if [ "$round" -eq "$TOOL_MAX_ROUNDS" ]; then
+      printf '\nNo more tool calls are available. Give your final answer now.\n' >>"$conversation"
+    fi
+    round=$((round + 1))
+  done
+  rm "$conversation"
+  printf '%s\n' "$response"
+}
+
+# markdown_section prints the body of a "## <heading>" section of a markdown
+# file.
+markdown_section() {
+  awk -v heading="$2" '
+    /^## / { in_section = (tolower(substr($0, 4)) == tolower(heading)); next }
+    in_section { print }
+  ' "$1" | sed '/^[[:space:]]*$/d'
+}
+
+# load_issue_file reads a markdown or YAML task file into title, body,
+# acceptance_criteria and target_paths.
+load_issue_file() {
+  local file="$1"
+  local task_json
+  case "$file" in
+    *.yaml|*.yml)
+      if ! command -v yq >/dev/null; then
+        log "yq command not found (required for YAML task files)" >&2
+        exit 1
+      fi
+      task_json=$(yq -o=json '.' "$file")
+      title=$(echo "$task_json" | jq -r '.title // empty')
+      body=$(echo "$task_json" | jq -r '.body // empty')
+      acceptance_criteria=$(echo "$task_json" | jq -r '.acceptance_criteria[]? | "- " + .')
+      target_paths=$(echo "$task_json" | jq -r '.target_paths[]? | "- " + .')
+      ;;
+    *)
+      title=$(head -n 1 "$file" | sed -E 's/^#+[[:space:]]*//')
+      body=$(tail -n +2 "$file" | awk '
+        /^## / { h = tolower(substr($0, 4)); skip = (h == "acceptance criteria" || h == "target paths") }
+        !skip { print }
+      ')
+      acceptance_criteria=$(markdown_section "$file" "Acceptance Criteria")
+      target_paths=$(markdown_section "$file" "Target Paths")
+      ;;
+  esac
+  if [ -z "$title" ]; then
+    log "Task file has no title: $file" >&2
+    exit 1
+  fi
+}
+
+# skip records a stage that did not run so it shows up in the final report.
+skip() {
+  skipped_stages+=("$1")
+  log "Skipping $1"
+}
+
+# stage marks the start of a pipeline stage for the workflow diagram, ending
+# the previous one.
+stage() {
+  stage_end ok
+  current_stage="$1"
+  stage_start=$(date +%s)
+  stage_retries=0
+}
+
+# stage_end records the current stage with its duration, the given status and
+# the number of verification retries it needed.
+stage_end() {
+  [ -n "$current_stage" ] || return 0
+  stage_records+=("$current_stage"$'\t'"$(($(date +%s) - stage_start))"$'\t'"$1"$'\t'"$stage_retries")
+  current_stage=""
+}
+
+# start_budget starts the clock on TIME_BUDGET, a duration such as 90s, 20m
+# or 1h. Optional stages are skipped when the run falls behind schedule, and
+# once the budget is spent the run stops with what it has produced so far.
+start_budget() {
+  [ -n "$TIME_BUDGET" ] || return 0
+  local amount="${TIME_BUDGET%[smh]}"
+  if ! [[ "$amount" =~ ^[0-9]+$ ]] || [ "$amount" -eq 0 ]; then
+    log "Invalid time budget: $TIME_BUDGET" >&2
+    exit 1
+  fi
+  case "$TIME_BUDGET" in
+    *h) budget_seconds=$((amount * 3600)) ;;
+    *m) budget_seconds=$((amount * 60)) ;;
+    *) budget_seconds=$amount ;;
+  esac
+  budget_started=$(date +%s)
+  log "Time budget: $TIME_BUDGET"
+}
+
+# budget_left prints the seconds left in the time budget, at least 1 so that
+# it can be passed to timeout, or nothing when there is no budget.
+budget_left() {
+  [ "$budget_seconds" -gt 0 ] || return 0
+  local left=$((budget_started + budget_seconds - $(date +%s)))
+  echo $((left > 0 ? left : 1))
+}
+
+# budget_spent succeeds when the time budget has run out.
+budget_spent() {
+  [ "$budget_seconds" -gt 0 ] && [ "$(date +%s)" -ge $((budget_started + budget_seconds)) ]
+}
+
+# on_schedule succeeds when the run has used at most $1 percent of its time
+# budget, or has none. Otherwise it records optional stage $2 as skipped, so
+# that the remaining time goes to generating and verifying the change.
+on_schedule() {
+  [ "$budget_seconds" -gt 0 ] || return 0
+  [ $((($(date +%s) - budget_started) * 100)) -gt $((budget_seconds * $1)) ] || return 0
+  skip "$2 (behind the $TIME_BUDGET time budget)"
+  return 1
+}
+
+# budget_check stops the run before stage $1 when the time budget is spent.
+budget_check() {
+  budget_spent || return 0
+  log "The $TIME_BUDGET time budget is spent; stopping before $1" >&2
+  exit 1
+}
+
+# partial_report writes what a run with a time budget produced before it
+# stopped during stage $1 to partial.md in the run directory: the plan, the
+# patch so far, the last verification output and the findings. It is also
+# posted on the issue, so a long run never ends with nothing to show.
+partial_report() {
+  local patch="" findings="" body
+  if [ -n "$work_dir" ] && [ -d "$work_dir" ] && [ -n "$base_commit" ]; then
+    git -C "$work_dir" add -N . 2>/dev/null || true
+    patch=$(git -C "$work_dir" diff "$base_commit" 2>/dev/null || true)
+  fi
+  findings=$(findings_tsv | awk -F'\t' '{ printf "- **%s** %s `%s`: %s\n", $1, $2, $3, $4 }')
+  if [ -z "$plan_json" ] && [ -z "$patch" ] && [ ! -s "$run_dir/verify-output.txt" ] && [ -z "$findings" ]; then
+    log "Nothing was produced within the $TIME_BUDGET time budget" >&2
+    return 0
+  fi
+  body=$(msg comment.partial "$1" "$TIME_BUDGET")
+  if [ -n "$plan_json" ]; then
+    body+=$'\n\n'"$(msg partial.plan)"$'\n\n```json\n'"$(jq . <<<"$plan_json" 2>/dev/null || printf '%s' "$plan_json")"$'\n```'
+  fi
+  if [ -n "$patch" ]; then
+    body+=$'\n\n'"$(msg partial.patch)"$'\n\n```diff\n'"$patch"$'\n```'
+  fi
+  if [ -s "$run_dir/verify-output.txt" ]; then
+    body+=$'\n\n'"$(msg partial.verify)"$'\n\n```\n'"$(tail -n 50 "$run_dir/verify-output.txt")"$'\n```'
+  fi
+  if [ -n "$findings" ]; then
+    body+=$'\n\n'"$(msg pr.code_findings)"$'\n\n'"$findings"
+  fi
+  redact <<<"$body" >"$run_dir/partial.md"
+  set_status partial "$run_dir/partial.md"
+  log "Wrote partial results to $run_dir/partial.md" >&2
+  if [ -n "$ISSUE_URL" ] && [ "$OFFLINE" -eq 0 ] && [ "$READ_ONLY" -eq 0 ]; then
+    body=$(fit_body "$body" partial)
+    gh issue comment "$ISSUE_URL" --body "$(redact <<<"$body"$'\n\n'"$(run_marker)")" >/dev/null
+  fi
+}
+
+# workflow_diagram prints the recorded stages as a Mermaid flowchart, or as
+# a Graphviz digraph when $1 is "dot". Failed stages are highlighted.
+workflow_diagram() {
+  local record name seconds status retries label i=0
+  if [ "$1" = "dot" ]; then
+    echo "digraph workflow {"
+    echo "  rankdir=LR;"
+    echo "  node [shape=box];"
+  else
+    echo "flowchart LR"
+  fi
+  for record in ${stage_records[@]+"${stage_records[@]}"}; do
+    IFS=$'\t' read -r name seconds status retries <<<"$record"
+    label="$name ${seconds}s"
+    [ "$retries" -eq 0 ] || label="$label, $retries retries"
+    if [ "$1" = "dot" ]; then
+      echo "  s$i [label=\"$label\"$([ "$status" = "failed" ] && echo ', color=red, fontcolor=red')];"
+      [ "$i" -eq 0 ] || echo "  s$((i - 1)) -> s$i;"
+    else
+      echo "  s$i[\"$label\"]"
+      [ "$i" -eq 0 ] || echo "  s$((i - 1)) --> s$i"
+      [ "$status" != "failed" ] || echo "  class s$i failed"
+    fi
+    i=$((i + 1))
+  done
+  if [ "$1" = "dot" ]; then
+    echo "}"
+  else
+    echo "  classDef failed fill:#fdd,stroke:#c00"
+  fi
+}
+
+# write_workflow saves the recorded stages and their diagrams to the run
+# directory.
+write_workflow() {
+  [ -n "$run_dir" ] && [ "${#stage_records[@]}" -gt 0 ] || return 0
+  printf '%s\n' "${stage_records[@]}" >"$run_dir/stages.tsv"
+  workflow_diagram mermaid >"$run_dir/workflow.mmd"
+  workflow_diagram dot >"$run_dir/workflow.dot"
+}
+
+# context_report writes context-report.md in run directory $1 (the current
+# run by default) from context.jsonl: the size of every prompt and what went
+# into it, the files that were truncated or excluded and the candidates that
+# were pruned, with the reason for each, and logs a one-line summary.
+context_report() {
+  local dir="${1:-$run_dir}"
+  [ -n "$dir" ] && [ -s "$dir/context.jsonl" ] || return 0
+  jq -rs '
+    def count(s): [.files[] | select(.status == s)] | length;
+    def rows(s): [.[] as $p | $p.files[] | select(.status == s) | . + {prompt: $p.n}]
+      | group_by(.path) | map({path: .[0].path, bytes: (map(.bytes) | max), detail: (.[0].detail // ""),
+        prompts: (map(.prompt) | unique | map(tostring) | join(", "))});
+    def list(title; s): rows(s) | if length > 0 then "## \(title)", "", (.[] | "- `\(.path)`: \(.detail) (prompts \(.prompts))"), "" else empty end;
+    to_entries | map(.value + {n: (.key + 1)})
+    | "# Context report", "",
+      "| Prompt | Stage | Bytes | Included | Truncated | Excluded | Pruned |",
+      "| --- | --- | --- | --- | --- | --- | --- |",
+      (.[] | "| \(.n) | \(.stage // "") | \(.prompt_bytes) | \(count("included")) | \(count("truncated")) | \(count("excluded")) | \(count("pruned")) |"),
+      "",
+      list("Truncated"; "truncated"),
+      list("Excluded"; "excluded"),
+      list("Pruned"; "pruned"),
+      (rows("included") | sort_by(-.bytes) | if length > 0 then
+        "## Included", "", "| Source | Bytes | Prompts | Detail |", "| --- | --- | --- | --- |",
+        (.[] | "| `\(.path)` | \(.bytes) | \(.prompts) | \(.detail) |") else empty end)
+  ' "$dir/context.jsonl" >"$dir/context-report.md"
+  jq -rs '
+    [.[].files[]] as $files | def count(s): [$files[] | select(.status == s) | .path] | unique | length;
+    "Context: \(length) prompts, \(map(.prompt_bytes) | add) bytes; \(count("truncated")) truncated, \(count("excluded")) excluded and \(count("pruned")) pruned sources (see context-report.md)"
+  ' "$dir/context.jsonl" | while read -r line; do log "$line"; done
+}
+
+# write_api_usage writes api-usage.json from api-calls.jsonl: the gh calls of
+# the run by API and endpoint category, with failures, retries and the time
+# spent waiting out rate limits, and the quota before the first call and
+# after the run.
+write_api_usage() {
+  [ -n "$run_dir" ] && [ -s "$run_dir/api-calls.jsonl" ] || return 0
+  local after
+  after=$(rate_limit)
+  jq -s --argjson before "${rate_limit_before:-null}" --argjson after "${after:-null}" '
+    def used($k): if $before[$k] and $after[$k] and $before[$k].reset == $after[$k].reset
+      then $before[$k].remaining - $after[$k].remaining else null end;
+    {
+      calls: length,
+      by_kind: (group_by(.kind) | map({key: .[0].kind, value: length}) | from_entries),
+      failed: map(select(.exit_code != 0)) | length,
+      retries: map(.attempts - 1) | add,
+      wait_seconds: map(.wait_seconds) | add,
+      categories: (group_by([.kind, .category]) | map({kind: .[0].kind, category: .[0].category, calls: length,
+        failed: map(select(.exit_code != 0)) | length, retries: (map(.attempts - 1) | add),
+        wait_seconds: (map(.wait_seconds) | add)}) | sort_by(-.calls)),
+      quota: {before: $before, after: $after, used: (if $before and $after then {rest: used("rest"), graphql: used("graphql")} else null end)}
+    }' "$run_dir/api-calls.jsonl" >"$run_dir/api-usage.json"
+  jq -r '"GitHub API: \(.calls) calls (\(.by_kind | to_entries | map("\(.value) \(.key)") | join(", ")))"
+    + (if .wait_seconds > 0 then ", \(.wait_seconds)s waiting for rate limits" else "" end)
+    + (if .quota.after then "; \(.quota.after.rest.remaining) REST and \(.quota.after.graphql.remaining) GraphQL requests left" else "" end)' \
+    "$run_dir/api-usage.json" | while read -r line; do log "$line"; done
+}
+
+# on_exit marks the stage that was running as failed when the run stops with
+# an error, writes the workflow diagram and removes temporary files.
+on_exit() {
+  local code=$? failed_stage=""
+  if [ "$code" -ne 0 ] && [ -n "$current_stage" ]; then
+    failed_stage="$current_stage"
+    stage_end failed
+  else
+    stage_end ok
+  fi
+  write_workflow
+  write_resources
+  write_api_usage
+  context_report
+  if [ "$code" -ne 0 ] && [ "$budget_seconds" -gt 0 ] && [ -n "$run_dir" ] &&
+    { budget_spent || [[ "$failed_stage" == generate || "$failed_stage" == verify ]]; }; then
+    partial_report "${failed_stage:-the run}" || true
+  fi
+  [ -z "$heartbeat_pid" ] || kill "$heartbeat_pid" 2>/dev/null || true
+  [ -z "$issue_lock_dir" ] || rm -rf "$issue_lock_dir"
+  if [ "$code" -ne 0 ]; then
+    set_status status failed cause "exit code $code${failed_stage:+ during $failed_stage}"
+  elif [ -n "$run_dir" ] && [ "$(jq -r '.status' "$run_dir/status.json" 2>/dev/null)" = "processing" ]; then
+    set_status status completed
+  fi
+  if [ -n "$run_dir" ]; then
+    check_artifact status "$run_dir/status.json"
+    check_artifact gate "$run_dir/gates.jsonl"
+  fi
+  if [ "$DEVCONTAINER" -eq 1 ] && command -v docker >/dev/null; then
+    docker ps -aq --filter "label=cca.pid=$$" 2>/dev/null | xargs -r docker rm -f >/dev/null 2>&1 || true
+  fi
+  [ "$SERVICES" -eq 0 ] || stop_services
+  rm -rf "$CONTEXT_PENDING" "$CASSETTE_STATE" "$VERIFY_ENV_FILE" "$VERIFY_ENV_EXEC"
+}
+
+# apply_changes writes the files, applies the patches and edits and removes
+# the deleted files of a changes file in the current directory.
+apply_changes() {
+  local file="$1"
+  jq -r '.deleted_files[]?' "$file" | while read -r path; do
+    rm -f "$path"
+    log "Deleted $path"
+  done
+
+  jq -r '.files // {} | to_entries[] | [.key, (.value|@base64)] | @tsv' "$file" 2>/dev/null | \
+  while IFS=$'\t' read -r path b64; do
+    content=$(echo "$b64" | base64 --decode)
+    mkdir -p "$(dirname "$path")"
+    printf '%s' "$content" > "$path"
+    log "Wrote $path"
+  done
+  apply_patches "$file"
+  apply_edits "$file"
+}
+
+# patch_file writes the unified diff for path to a temporary file with
+# canonical git headers, replacing whatever headers the backend wrote, and
+# prints its name. With a blob id it adds an index line naming it as the
+# preimage, which git apply --3way needs to merge.
+patch_file() {
+  local path="$1" diff="$2" blob="${3:-}" file old="a/$path"
+  file=$(mktemp)
+  [ -e "$path" ] || old=/dev/null
+  {
+    echo "diff --git a/$path b/$path"
+    [ -z "$blob" ] || echo "index $blob..0000000"
+    echo "--- $old"
+    echo "+++ b/$path"
+    sed -n '/^@@ /,$p' <<<"$diff"
+  } >"$file"
+  echo "$file"
+}
+
+# apply_patch applies a unified diff to path, trying an exact apply, then a
+# three-way merge against the base version the backend saw, then fuzzy
+# context matching. It records the outcome in patches.jsonl and adds hunks
+# that still do not apply, with the reasons, to rejected_changes.
+apply_patch() {
+  local path="$1" diff="$2" patch output reason="" method="" blob backup rejects rejected=0
+  patch=$(patch_file "$path" "$diff")
+  if git apply --reverse --check --recount "$patch" 2>/dev/null; then
+    method="already applied"
+  elif output=$(git apply --recount --whitespace=nowarn "$patch" 2>&1); then
+    method=exact
+  else
+    reason=$(sed -n 's/^error: //p' <<<"$output" | paste -sd ';' - | sed 's/;/; /g')
+    blob=$(git rev-parse -q --verify "${base_commit:-HEAD}:$path" 2>/dev/null || true)
+    if [ -n "$blob" ] && [ -f "$path" ]; then
+      backup=$(mktemp)
+      cp "$path" "$backup"
+      git add -- "$path"
+      rm "$patch"
+      patch=$(patch_file "$path" "$diff" "$blob")
+      if git apply --3way --recount --whitespace=nowarn "$patch" >/dev/null 2>&1; then
+        method=three-way
+      else
+        cp "$backup" "$path"
+      fi
+      git reset -q -- "$path"
+      rm "$backup"
+      rm "$patch"
+      patch=$(patch_file "$path" "$diff")
+    fi
+  fi
+  if [ -z "$method" ]; then
+    rejects=$(mktemp)
+    rm -f "$rejects"
+    if type -P patch >/dev/null; then
+      output=$(command patch -p1 --forward --batch --fuzz=3 --ignore-whitespace --no-backup-if-mismatch \
+        --reject-file="$rejects" -i "$patch" 2>&1) || true
+      reason+=$(grep -o 'Hunk #[0-9]* FAILED at [0-9]*' <<<"$output" | sed 's/^/; /' | paste -sd ' ' -)
+    else
+      output=$(git apply --reject -C1 --ignore-whitespace --recount "$patch" 2>&1) || true
+      [ ! -f "$path.rej" ] || mv "$path.rej" "$rejects"
+      reason+=$(grep -o 'Rejected hunk #[0-9]*' <<<"$output" | sed 's/^/; /' | paste -sd ' ' -)
+    fi
+    if [ -s "$rejects" ]; then
+      rejected=$(grep -c '^@@ ' "$rejects")
+      method=partial
+      rejected_changes+=$(jq -cn --arg path "$path" --arg reason "${reason#; }" --rawfile hunks "$rejects" \
+        '{path: $path, reason: $reason, hunks: $hunks}')$'\n'
+      log "Could not apply $rejected hunks to $path: ${reason#; }" >&2
+    else
+      method=fuzzy
+    fi
+    rm -f "$rejects"
+  fi
+  rm "$patch"
+  [ "$method" = partial ] || log "Patched $path ($method)"
+  [ -z "$run_dir" ] || jq -cn --arg path "$path" --arg method "$method" --argjson rejected "$rejected" \
+    --arg reason "${reason#; }" '{path: $path, method: $method, rejected_hunks: $rejected}
+      + (if $reason == "" then {} else {reason: $reason} end)' >>"$run_dir/patches.jsonl"
+}
+
+# apply_patches applies the unified diffs in the "patches" object of a
+# changes file.
+apply_patches() {
+  local path b64
+  while IFS=$'\t' read -r path b64; do
+    apply_patch "$path" "$(base64 --decode <<<"$b64")"
+  done < <(jq -r '.patches // {} | to_entries[] | [.key, (.value|@base64)] | @tsv' "$1" 2>/dev/null)
+}
+
+# apply_edits validates and applies the structured edits in the "edits"
+# array of a changes file. Each edit names a file, an operation (create,
+# replace, insert_before, insert_after or delete), an anchor that must occur
+# exactly once in the file, and the new content. Edits apply to the base
+# version of the file, which is what the backend saw, or to its content under
+# "files", so applying them again gives the same result. A file is only
+# written when all of its edits are valid; otherwise it is left unchanged and
+# added to rejected_changes with the reasons. Every edit is recorded in
+# edits.jsonl.
+apply_edits() {
+  local file="$1" path base exists result reason
+  while read -r path; do
+    base=$(mktemp)
+    exists=true
+    if git cat-file -e "${base_commit:-HEAD}:$path" 2>/dev/null; then
+      git show "${base_commit:-HEAD}:$path" >"$base"
+    elif jq -e --arg path "$path" '.files // {} | has($path)' "$file" >/dev/null; then
+      jq -j --arg path "$path" '.files[$path]' "$file" >"$base"
+    else
+      exists=false
+    fi
+    result=$(jq -c --arg path "$path" --rawfile content "$base" --argjson exists "$exists" '
+      [.edits | to_entries[] | select(.value.file == $path)] as $edits
+      | reduce $edits[] as {key: $index, value: $e} ({content: $content, exists: $exists, records: [], edits: []};
+        ($e.operation // "") as $op
+        | (if (["create", "replace", "insert_before", "insert_after", "delete"] | index($op)) == null then
+            {error: "unknown operation \"\($op)\""}
+          elif $op != "delete" and ($e.content | type) != "string" then {error: "content is missing"}
+          elif $op == "create" then
+            if .exists then {error: "file already exists"} else {content: $e.content, line: 1} end
+          elif (.exists | not) then {error: "file does not exist"}
+          elif ($e.anchor | type) != "string" or $e.anchor == "" then {error: "anchor is missing"}
+          else (.content | split($e.anchor)) as $parts
+            | if ($parts | length) == 1 then {error: "anchor not found"}
+              elif ($parts | length) > 2 then {error: "anchor occurs \(($parts | length) - 1) times"}
+              else {line: ($parts[0] | split("\n") | length),
+                content: ($parts[0] + {replace: $e.content, insert_before: ($e.content + $e.anchor),
+                  insert_after: ($e.anchor + $e.content), delete: ""}[$op] + $parts[1])}
+              end
+          end) as $r
+        | .records += [{edit: ($index + 1), file: $path, operation: $op} + ($r | del(.content))]
+        | .edits += [$e]
+        | if $r.error then . else .content = $r.content | .exists = true end)
+      | .errors = [.records[] | select(.error) | "edit \(.edit): \(.error)"]' "$file")
+    rm "$base"
+    [ -z "$run_dir" ] || jq -c '.records[]' <<<"$result" >>"$run_dir/edits.jsonl"
+    if jq -e '.errors | length > 0' <<<"$result" >/dev/null; then
+      reason=$(jq -r '.errors | join("; ")' <<<"$result")
+      rejected_changes+=$(jq -c --arg path "$path" --arg reason "$reason" '{path: $path, reason: $reason, edits: .edits}' <<<"$result")$'\n'
+      log "Rejected the edits to $path: $reason" >&2
+      continue
+    fi
+    mkdir -p "$(dirname "$path")"
+    jq -j '.content' <<<"$result" >"$path"
+    log "Edited $path ($(jq '.records | length' <<<"$result") edits)"
+  done < <(jq -r '.edits // [] | map(.file // empty) | unique[]' "$file" 2>/dev/null)
+}
+
+# repair_changes asks the backend to redo the patch hunks and edits that
+# could not be applied, showing it the current content of each file, and
+# writes the files it returns. The repaired files replace their patches and
+# edits in changes_json so later verification attempts start from them.
+repair_changes() {
+  local round=1 prompt_file repair tmp path
+  while [ -n "$rejected_changes" ]; do
+    if [ "$round" -gt "$PATCH_RETRIES" ]; then
+      log "Could not apply the changes to $(jq -rs 'map(.path) | unique | join(", ")' <<<"$rejected_changes") after $PATCH_RETRIES repair attempts" >&2
+      exit 1
+    fi
+    log "Asking $BACKEND to redo the rejected changes to $(jq -rs 'map(.path) | unique | join(", ")' <<<"$rejected_changes")"
+    prompt_file=$(mktemp)
+    {
+      echo "These changes could not be applied because the files do not contain the"
+      echo "lines they expect. The other hunks of a patch have been applied; edits to"
+      echo "a file are only applied when all of them are valid."
+      while read -r path; do
+        echo
+        echo "File: $path"
+        echo "Reason: $(jq -rs --arg path "$path" 'map(select(.path == $path) | .reason) | join("; ")' <<<"$rejected_changes")"
+        jq -rs --arg path "$path" 'map(select(.path == $path)) | (map(.hunks // empty) | join("")) as $hunks
+          | (map(.edits // empty) | add) as $edits
+          | if $hunks != "" then "Rejected hunks:", $hunks else empty end,
+            if $edits then "Rejected edits:", ($edits | tojson) else empty end' <<<"$rejected_changes"
+        echo "Current content:"
+        cat "$path" 2>/dev/null || echo "(file does not exist)"
+      done < <(jq -rs 'map(.path) | unique[]' <<<"$rejected_changes")
+      echo
+      echo "Make the changes the rejected hunks and edits intended on the current content."
+      echo 'Format as JSON: {"files": {"path": "complete file content"}}'
+    } >"$prompt_file"
+    repair=$(claude_chat "$prompt_file" "with-p")
+    rm "$prompt_file"
+    round=$((round + 1))
+    stage_retries=$((stage_retries + 1))
+    if ! check_changes "$repair" || ! jq -e '.files | length > 0' <<<"$repair" >/dev/null 2>&1; then
+      log "$BACKEND returned no files for the rejected changes" >&2
+      continue
+    fi
+    changes_json=$(jq -c --argjson repair "$repair" '.files += $repair.files
+      | if .patches then .patches |= with_entries(select(.key as $k | $repair.files | has($k) | not)) else . end
+      | if .edits then .edits |= map(select(.file as $k | $repair.files | has($k) | not)) else . end' <<<"$changes_json")
+    rejected_changes=$(jq -c --argjson repair "$repair" 'select(.path as $k | $repair.files | has($k) | not)' <<<"$rejected_changes")
+    [ -z "$rejected_changes" ] || rejected_changes+=$'\n'
+    tmp=$(mktemp)
+    jq -c '{files}' <<<"$repair" >"$tmp"
+    apply_changes "$tmp"
+    rm "$tmp"
+  done
+}
+
+# run_formatter runs a formatter or auto-fixing linter on files, logging its
+# output as a diagnostic when it fails.
+run_formatter() {
+  local output
+  if output=$("$@" 2>&1); then
+    log "Formatted with $1"
+  else
+    log "$1 failed:"$'\n'"$(head -n 20 <<<"$output")" >&2
+  fi
+}
+
+# node_tool prints the project-local or global path of a Node.js tool.
+node_tool() {
+  if [ -x "node_modules/.bin/$1" ]; then
+    echo "node_modules/.bin/$1"
+  elif command -v "$1" >/dev/null; then
+    command -v "$1"
+  else
+    return 1
+  fi
+}
+
+# format_changes runs the formatters and auto-fixable linters the repository
+# uses on the files changed in the working tree.
+format_changes() {
+  local changed=() go=() web=() py=() rs=() path tool
+  mapfile -t changed < <(git status --porcelain | cut -c4- | sed 's/^"\(.*\)"$/\1/')
+  for path in ${changed[@]+"${changed[@]}"}; do
+    [ -f "$path" ] || continue
+    case "$path" in
+      *.go) go+=("$path") ;;
+      *.js|*.jsx|*.ts|*.tsx|*.mjs|*.cjs|*.css|*.scss|*.vue) web+=("$path") ;;
+      *.py) py+=("$path") ;;
+      *.rs) rs+=("$path") ;;
+    esac
+  done
+
+  if [ "${#go[@]}" -gt 0 ]; then
+    if command -v goimports >/dev/null; then
+      run_formatter goimports -w "${go[@]}"
+    elif command -v gofmt >/dev/null; then
+      run_formatter gofmt -w "${go[@]}"
+    fi
+  fi
+  if [ "${#web[@]}" -gt 0 ]; then
+    if compgen -G '.eslintrc*' >/dev/null || compgen -G 'eslint.config.*' >/dev/null; then
+      tool=$(node_tool eslint) && run_formatter "$tool" --fix "${web[@]}"
+    fi
+    if compgen -G '.prettierrc*' >/dev/null || compgen -G 'prettier.config.*' >/dev/null ||
+       { [ -f package.json ] && jq -e '.prettier' package.json >/dev/null 2>&1; }; then
+      tool=$(node_tool prettier) && run_formatter "$tool" --write "${web[@]}"
+    fi
+  fi
+  if [ "${#py[@]}" -gt 0 ] && [ -f pyproject.toml ]; then
+    if grep -q '^\[tool\.ruff' pyproject.toml && command -v ruff >/dev/null; then
+      run_formatter ruff check --fix "${py[@]}"
+      run_formatter ruff format "${py[@]}"
+    elif grep -q '^\[tool\.black\]' pyproject.toml && command -v black >/dev/null; then
+      run_formatter black -q "${py[@]}"
+    fi
+  fi
+  if [ "${#rs[@]}" -gt 0 ] && command -v rustfmt >/dev/null; then
+    local edition
+    edition=$(sed -n 's/^edition[[:space:]]*=[[:space:]]*"\(.*\)"/\1/p' Cargo.toml 2>/dev/null | head -n 1)
+    run_formatter rustfmt --edition "${edition:-2021}" "${rs[@]}"
+  fi
+  return 0
+}
+
+# tidy_dependencies brings lockfiles and vendored dependencies in line with
+# the manifests after changes are applied, so the commit stays consistent. Go
+# modules are tidied in each module the change touches.
+tidy_dependencies() {
+  local changed
+  changed=$(git status --porcelain | cut -c4-)
+  local module
+  while read -r module; do
+    [ -n "$module" ] || continue
+    if (cd "$module" && go mod tidy >/dev/null 2>&1); then
+      git diff --quiet -- "$module/go.mod" "$module/go.sum" || log "go mod tidy updated $module/go.mod"
+      if [ -d "$module/vendor" ]; then
+        (cd "$module" && go mod vendor >/dev/null 2>&1) && log "Refreshed $module/vendor/ with go mod vendor" ||
+          log "go mod vendor failed in $module" >&2
+      fi
+    else
+      log "go mod tidy failed in $module; leaving go.mod and go.sum as generated" >&2
+    fi
+  done < <(grep -E '(^|/)go\.mod$|\.go$' <<<"$changed" | module_of | sort -u)
+
+  grep -Eq '(^|/)package\.json$' <<<"$changed" || return 0
+  local cmd=()
+  if [ -f pnpm-lock.yaml ]; then
+    cmd=(pnpm install --lockfile-only --ignore-scripts)
+  elif [ -f yarn.lock ]; then
+    cmd=(yarn install --mode update-lockfile)
+  elif [ -f package-lock.json ]; then
+    cmd=(npm install --package-lock-only --ignore-scripts)
+  else
+    return 0
+  fi
+  if ! command -v "${cmd[0]}" >/dev/null; then
+    log "${cmd[0]} not installed; lockfile may be out of date with package.json" >&2
+  elif "${cmd[@]}" >/dev/null 2>&1; then
+    log "Updated lockfile with ${cmd[*]}"
+  else
+    log "${cmd[*]} failed; lockfile may be out of date with package.json" >&2
+  fi
+}
+
+# current_run_id prints the ID of this run, the name of its run directory.
+current_run_id() {
+  basename "${run_dir:-none}"
+}
+
+# run_marker prints a hidden HTML comment with the run ID for the comments
+# CCA posts, so that cca show can find the run a comment came from.
+run_marker() {
+  printf '<!-- cca-run-id: %s -->\n' "$(current_run_id)"
+}
+
+# fit_body prints body $1 for a pull request, review or comment. A body longer
+# than COMMENT_MAX_CHARS is saved in full as <$2>-<run-id>.md in the run
+# directory and cut at a line break, ending with a link to the full text. With
+# REPORT_UPLOAD=auto the full text is uploaded as a secret gist only for
+# public repositories, since anyone with the link can read a gist; for private
+# ones it is offered as a workflow artifact when running in GitHub Actions.
+fit_body() {
+  local body="$1" file link="" note
+  if [ "${#body}" -le "$COMMENT_MAX_CHARS" ]; then
+    printf '%s\n' "$body"
+    return
+  fi
+  file="$run_dir/$2-$(current_run_id).md"
+  printf '%s\n' "$body" >"$file"
+  if [ "$REPORT_UPLOAD" = "gist" ] ||
+    { [ "$REPORT_UPLOAD" = "auto" ] && [ "$(gh repo view --json visibility -q .visibility 2>/dev/null)" = "PUBLIC" ]; }; then
+    link=$(gh gist create --desc "cca run $(current_run_id): $2" "$file" 2>/dev/null | tail -n 1 || true)
+  fi
+  if [ -z "$link" ] && [ "$REPORT_UPLOAD" != "0" ] && [ "${GITHUB_ACTIONS:-}" = "true" ] && [ -n "${GITHUB_OUTPUT:-}" ]; then
+    echo "report-path=$file" >>"$GITHUB_OUTPUT"
+    link="$GITHUB_SERVER_URL/$GITHUB_REPOSITORY/actions/runs/$GITHUB_RUN_ID"
+  fi
+  log "$2 is ${#body} characters; truncated it${link:+ and linked the full text at $link}" >&2
+  note=$(msg comment.truncated "${link:-\`cca show $(current_run_id)\`}")
+  body="${body:0:$((COMMENT_MAX_CHARS - ${#note} - 100))}"
+  body="${body%$'\n'*}"
+  # Close a code block the cut left open.
+  [ $(($(grep -c '^[[:space:]]*```' <<<"$body" || true) % 2)) -eq 0 ] || body+=$'\n```'
+  printf '%s\n\n%s\n\n%s\n' "$body" "$note" "$(run_marker)"
+}
+
+# backend_model prints the model the backend generates with.
+backend_model() {
+  if [ "$BACKEND" = "ollama" ]; then
+    echo "$OLLAMA_MODEL"
+  else
+    echo "claude ${MODEL:-default}"
+  fi
+}
+
+# route_model picks the Claude model for the rest of the run from the size
+# and risk of the task: the files the plan lists or, without a plan, the
+# files the issue's error messages, stack trace and target paths point at,
+# the length of the issue and its labels. A model set with CCA_MODEL is used
+# as is. The decision is logged and written to model-routing.json in the run
+# directory.
+route_model() {
+  if [ -n "$MODEL" ]; then
+    log "Using model $MODEL (CCA_MODEL)"
+    return
+  fi
+  if [ "$MODEL_ROUTING" -eq 0 ]; then
+    skip "model routing"
+    return
+  fi
+  local files count words small large label labels=() tier reasons=() risky=0
+  if [ -n "$plan_json" ]; then
+    files=$(jq -r '.files[].path' <<<"$plan_json")
+  else
+    files=$(printf '%s\n%s\n' "$error_locations" "$stack_locations" |
+      grep -oE '^[[:space:]]*[^[:space:]:"]+:[0-9]+' | sed -E 's/^[[:space:]]*//; s/:[0-9]+$//' || true)
+    files+=$'\n'$(sed 's/^- //' <<<"$target_paths")
+  fi
+  files=$(grep -v '^$' <<<"$files" | sort -u || true)
+  count=$(grep -c . <<<"$files" || true)
+  words=$(wc -w <<<"$title $body")
+  read -r small large <<<"$MODEL_ROUTING_FILES"
+  if [ -n "$files" ] && grep -Eq "$RISKY_PATHS" <<<"$files"; then
+    risky=1
+    reasons+=("touches $(grep -E "$RISKY_PATHS" <<<"$files" | head -n 1)")
+  fi
+  read -r -a labels <<<"$MODEL_RISK_LABELS"
+  for label in ${labels[@]+"${labels[@]}"}; do
+    if grep -qixF "$label" <<<"$issue_labels"; then
+      risky=1
+      reasons+=("labeled $label")
+    fi
+  done
+  if [ "$risky" -eq 1 ]; then
+    tier=large
+  elif [ "$count" -gt "$large" ]; then
+    tier=large
+    reasons+=("about $count files")
+  elif [ "$count" -le "$small" ] && [ "$words" -le "$MODEL_SMALL_WORDS" ]; then
+    tier=small
+    reasons+=("about $count files" "$words words")
+  else
+    tier=medium
+    reasons+=("about $count files" "$words words")
+  fi
+  case "$tier" in
+    small) MODEL="$MODEL_SMALL" ;;
+    medium) MODEL="$MODEL_MEDIUM" ;;
+    large) MODEL="$MODEL_LARGE" ;;
+  esac
+  printf -v label '%s, ' "${reasons[@]}"
+  log "Routing to $MODEL ($tier task: ${label%, })"
+  jq -n --arg tier "$tier" --arg model "$MODEL" --argjson files "$count" --argjson words "$words" \
+    --arg reasons "$(printf '%s\n' "${reasons[@]}")" '{tier: $tier, model: $model, estimated_files: $files,
+      issue_words: $words, reasons: ($reasons | split("\n") | map(select(. != "")))}' >"$run_dir/model-routing.json"
+  set_status model "$MODEL" model_tier "$tier"
+}
+
+# cca_commit runs git commit with the arguments given, adding Cca-Run-Id and
+# Cca-Model trailers, and a Co-authored-by trailer when CO_AUTHOR is set, so
+# that generated commits can be found with git log --grep or
+# git interpret-trailers.
+cca_commit() {
+  local trailers=()
+  if [ "$TRAILERS" -eq 1 ]; then
+    trailers=(--trailer "Cca-Run-Id: $(current_run_id)" --trailer "Cca-Model: $(backend_model)")
+    [ -z "$CO_AUTHOR" ] || trailers+=(--trailer "Co-authored-by: $CO_AUTHOR")
+  fi
+  git commit ${trailers[@]+"${trailers[@]}"} "$@"
+}
+
+# run_metadata prints a hidden HTML comment with the run's metadata as JSON
+# for pull request bodies, for tools that look for CCA pull requests.
+run_metadata() {
+  printf '<!-- cca-run: %s -->\n' "$(jq -cn --arg run_id "$(current_run_id)" --arg backend "$BACKEND" \
+    --arg model "$(backend_model)" --arg prompt_version "$PROMPT_VERSION" --arg issue_url "$ISSUE_URL" \
+    --arg variants "$EXPERIMENT_VARIANTS" '{run_id: $run_id, backend: $backend, model: $model,
+      prompt_version: $prompt_version, issue_url: $issue_url, variants: ($variants | split(" ") | map(select(. != "")))}')"
+}
+
+# commit_kind classifies a path as config, impl, test or docs for commit_split.
+commit_kind() {
+  case "$1" in
+    *_test.go|*.test.*|*.spec.*|test/*|tests/*|*/test/*|*/tests/*|*/__tests__/*|test_*.py|*/test_*.py) echo test ;;
+    *.md|*.rst|*.adoc|docs/*|*/docs/*|.changeset/*) echo docs ;;
+    .github/*|.cca/*|go.mod|go.sum|*/go.mod|*/go.sum|package.json|package-lock.json|yarn.lock|pnpm-lock.yaml|\
+      Dockerfile|*/Dockerfile|*.toml|*.yml|*.yaml|.gitignore|Makefile) echo config ;;
+    *) echo impl ;;
+  esac
+}
+
+# commit_split commits the staged change as separate conventional commits for
+# configuration, implementation, tests and documentation, in that order.
+commit_split() {
+  local staged=() path kind message
+  mapfile -t staged < <(git diff --cached --name-only)
+  git reset -q
+  for kind in config impl test docs; do
+    local files=()
+    for path in "${staged[@]}"; do
+      [ "$(commit_kind "$path")" != "$kind" ] || files+=("$path")
+    done
+    [ "${#files[@]}" -gt 0 ] || continue
+    case "$kind" in
+      config) message="chore: update configuration for $title" ;;
+      impl) message="feat: $title" ;;
+      test) message="test: cover $title" ;;
+      docs) message="docs: document $title" ;;
+    esac
+    git add -A -- "${files[@]}"
+    cca_commit -q -m "$message"
+    log "Committed ${#files[@]} files: $message"
+  done
+}
+
+# comment_prefix prints the line comment marker of files with extension $1.
+comment_prefix() {
+  case "$1" in
+    go|js|jsx|ts|tsx|mjs|cjs|java|kt|kts|swift|c|h|cc|cpp|hpp|rs|cs|scala|dart|proto|php) echo "//" ;;
+    py|sh|bash|rb|yaml|yml|toml|tf|r|pl|ex|exs) echo "#" ;;
+    sql|lua|hs) echo "--" ;;
+  esac
+}
+
+# file_header prints the comment block file $1 starts with, after a shebang,
+# with its years replaced by {year}. Build constraints, encoding lines and
+# "Code generated" markers end the block.
+file_header() {
+  awk '
+    NR == 1 && /^#!/ { next }
+    block { print; if (/\*\//) exit; next }
+    /^\/\*/ { block = 1; print; if (/\*\//) exit; next }
+    /^\/\/go:|^\/\/ *Code generated|^# *-\*-/ { exit }
+    /^(\/\/|#|--)( |$)/ { print; next }
+    { exit }' "$1" | sed -E 's/(19|20)[0-9]{2}([[:space:]]*[-,][[:space:]]*(19|20)[0-9]{2})*/{year}/g'
+}
+
+# license_owner prints the copyright holder for license headers: LICENSE_OWNER,
+# the holder named in the repository's LICENSE file, or the owner of origin.
+license_owner() {
+  local owner="$LICENSE_OWNER"
+  [ -n "$owner" ] || owner=$(cat LICENSE LICENSE.* COPYING 2>/dev/null |
+    sed -nE 's/^[[:space:]]*Copyright[[:space:]]+(\([cC]\)[[:space:]]+|©[[:space:]]+)?[0-9][0-9, -]*[[:space:]]+(.*[^.[:space:]]).*$/\2/p' | head -n 1)
+  [ -n "$owner" ] || owner=$(git remote get-url origin 2>/dev/null | sed -nE 's#.*[:/]([^/]+)/[^/]+$#\1#p')
+  echo "$owner"
+}
+
+# license_template prints the license header for files with extension $1,
+# with {year} for the year: LICENSE_HEADER rendered as line comments with
+# {owner} filled in when that file exists, or else the header most of the
+# repository's files with that extension start with. It prints nothing when
+# fewer than half of them have a header mentioning a copyright or license.
+license_template() {
+  local ext="$1" prefix files=() file header headers="" with=0 line owner
+  if [ -f "$LICENSE_HEADER" ]; then
+    prefix=$(comment_prefix "$ext")
+    [ -n "$prefix" ] || return 0
+    owner=$(license_owner)
+    while IFS= read -r line || [ -n "$line" ]; do
+      line="$prefix ${line//\{owner\}/$owner}"
+      echo "${line%"${line##*[![:space:]]}"}"
+    done <"$LICENSE_HEADER"
+    return
+  fi
+  mapfile -t files < <(git ls-files -- "*.$ext" | grep -Ev '(^|/)(vendor|node_modules|third_party)/' | head -n 50)
+  [ "${#files[@]}" -gt 0 ] || return 0
+  for file in "${files[@]}"; do
+    [ -f "$file" ] || continue
+    header=$(file_header "$file")
+    grep -Eqi 'copyright|licen[cs]e|spdx' <<<"$header" || continue
+    with=$((with + 1))
+    headers+=$(jq -Rs . <<<"$header")$'\n'
+  done
+  [ $((with * 2)) -gt "${#files[@]}" ] || return 0
+  jq -rs 'group_by(.) | max_by(length) | .[0]' <<<"$headers"
+}
+
+# has_license_header succeeds when file $1 starts with a comment block that
+# mentions a copyright or license.
+has_license_header() {
+  file_header "$1" | grep -Eqi 'copyright|licen[cs]e|spdx'
+}
+
+# apply_license_headers adds the license header of their kind of file, with
+# the current year, to the files the change adds that lack one, after any
+# shebang line.
+apply_license_headers() {
+  local file ext header year tmp
+  local -A templates=()
+  year=$(date +%Y)
+  while IFS= read -r file; do
+    [ -f "$file" ] && [ -s "$file" ] || continue
+    ext="${file##*.}"
+    [ "$ext" != "$file" ] && [ -n "$(comment_prefix "$ext")" ] || continue
+    [ -n "${templates[$ext]+set}" ] || templates[$ext]=$(license_template "$ext")
+    header="${templates[$ext]//\{year\}/$year}"
+    [ -n "$header" ] || continue
+    has_license_header "$file" && continue
+    tmp=$(mktemp)
+    header="$header" awk 'NR == 1 && /^#!/ { print; next } !done { print ENVIRON["header"] "\n"; done = 1 } { print }' "$file" >"$tmp"
+    cat "$tmp" >"$file"
+    rm "$tmp"
+    log "Added the license header to $file"
+  done < <(git status --porcelain --untracked-files=all | sed -nE 's/^(\?\?|A.) "?([^"]*)"?$/\2/p')
+}
+
+# license_review prints a finding for each file added between $1 and HEAD
+# that lacks the license header the repository's other files of its kind
+# start with.
+license_review() {
+  local file ext template
+  local -A templates=()
+  while IFS= read -r file; do
+    [ -f "$file" ] || continue
+    ext="${file##*.}"
+    [ "$ext" != "$file" ] && [ -n "$(comment_prefix "$ext")" ] || continue
+    [ -n "${templates[$ext]+set}" ] || templates[$ext]=$(license_template "$ext")
+    template="${templates[$ext]}"
+    [ -n "$template" ] && ! has_license_header "$file" || continue
+    printf 'major\tlicense\t%s:1\tThe file lacks the license header other .%s files start with; add "%s"\n' \
+      "$file" "$ext" "$(head -n 1 <<<"${template//\{year\}/$(date +%Y)}")"
+  done < <(git diff --name-only --diff-filter=A "$1...HEAD")
+}
+
+# import_reorder_only succeeds when the changes to tracked file $1 only
+# reorder its lines and every changed line is an import, using or include
+# statement or an entry of a Go import block.
+import_reorder_only() {
+  [ "$(git show "HEAD:$1" | sort)" = "$(sort "$1")" ] || return 1
+  git diff -U0 -- "$1" | awk -v go="$([[ "$1" != *.go ]] || echo 1)" '
+    /^@@/ { hunks = 1; next }
+    !hunks || !/^[-+]/ { next }
+    {
+      line = substr($0, 2)
+      if (line ~ /^[[:space:]]*(import|from|using|use|require|#include|#import|@import)[[:space:](]/) next
+      if (go && line ~ /^[[:space:]]*([A-Za-z_.][A-Za-z0-9_]*[[:space:]]+)?"[^"]*"[[:space:]]*$/) next
+      other = 1
+    }
+    END { exit other }'
+}
+
+# minimize_diff reduces noise in modified tracked files: files whose only
+# changes are whitespace or reordered imports are reverted, and
+# whitespace-only hunks are dropped from the rest. Whitespace-sensitive
+# formats are left alone.
+minimize_diff() {
+  local path full trimmed backup
+  while read -r path; do
+    [ -f "$path" ] || continue
+    case "$path" in
+      *.py|*.yml|*.yaml|Makefile|*.mk|*.md) continue ;;
+    esac
+    if git diff --quiet -w --ignore-blank-lines -- "$path"; then
+      git checkout -- "$path"
+      log "Reverted whitespace-only changes to $path"
+    elif import_reorder_only "$path"; then
+      git checkout -- "$path"
+      log "Reverted import reordering in $path"
+    else
+      full=$(git diff -- "$path")
+      trimmed=$(git diff -w --ignore-blank-lines -- "$path")
+      [ "$full" != "$trimmed" ] || continue
+      backup=$(mktemp)
+      cp "$path" "$backup"
+      git checkout -- "$path"
+      if git apply --ignore-whitespace --recount <<<"$trimmed" 2>/dev/null; then
+        log "Dropped whitespace-only hunks from $path"
+      else
+        cp "$backup" "$path"
+      fi
+      rm "$backup"
+    fi
+  done < <(git diff --name-only --diff-filter=M)
+}
+
+# allowed_paths prints the path globs changes are restricted to: those in
+# CCA_ALLOWED_PATHS, the task file's target paths and the files in the plan.
+allowed_paths() {
+  local glob
+  for glob in $ALLOWED_PATHS; do
+    echo "$glob"
+  done
+  [ -z "$target_paths" ] || sed 's/^-[[:space:]]*//' <<<"$target_paths"
+  [ -z "$plan_json" ] || jq -r '.files[].path' <<<"$plan_json"
+}
+
+# enforce_paths removes files outside the allowed paths from changes_json, or
+# exits when CCA_PATH_POLICY is "reject".
+enforce_paths() {
+  local globs=() path glob allowed outside=()
+  mapfile -t globs < <(allowed_paths | sed '/^$/d')
+  [ "${#globs[@]}" -gt 0 ] || return 0
+
+  while read -r path; do
+    [ -n "$path" ] || continue
+    allowed=0
+    for glob in "${globs[@]}"; do
+      [[ "$path" == $glob ]] && { allowed=1; break; }
+    done
+    [ "$allowed" -eq 1 ] || outside+=("$path")
+  done < <(jq -r '(.files // {} | keys[]), (.patches // {} | keys[]), (.edits[]?.file // empty), (.deleted_files[]?)' <<<"$changes_json" 2>/dev/null)
+  [ "${#outside[@]}" -gt 0 ] || return 0
+
+  if [ "$PATH_POLICY" = "reject" ]; then
+    log "Generated changes touch paths outside the allowed scope: ${outside[*]}" >&2
+    exit 1
+  fi
+  log "Dropping changes outside the allowed scope: ${outside[*]}"
+  changes_json=$(jq -c --args '
+    ($ARGS.positional) as $drop
+    | if .files then .files |= with_entries(select(.key as $k | $drop | index($k) | not)) else . end
+    | if .patches then .patches |= with_entries(select(.key as $k | $drop | index($k) | not)) else . end
+    | if .edits then .edits |= map(select(.file as $k | $drop | index($k) | not)) else . end
+    | if .deleted_files then .deleted_files |= map(select(. as $k | $drop | index($k) | not)) else . end
+  ' "${outside[@]}" <<<"$changes_json")
+}
+
+# require_commands exits unless every given command is installed.
+require_commands() {
+  local cmd
+  for cmd in "$@"; do
+    if ! type -P "$cmd" >/dev/null; then
+      log "$cmd command not found" >&2
+      exit 1
+    fi
+  done
+}
+
+# require_tools exits unless every command needed for the selected mode is
+# installed.
+require_tools() {
+  local required=(jq "$@")
+  [ "$OFFLINE" -eq 1 ] || [ "$CASSETTE_MODE" = "replay" ] || required+=(gh)
+  if [ "$BACKEND" = "ollama" ]; then
+    required+=(curl)
+  else
+    required+=(claude)
+  fi
+  require_commands "${required[@]}"
+}
+
+# devcontainer_config prints the repository's dev container configuration:
+# .devcontainer/devcontainer.json, .devcontainer.json or the first
+# .devcontainer/<name>/devcontainer.json.
+devcontainer_config() {
+  local file
+  for file in .devcontainer/devcontainer.json .devcontainer.json .devcontainer/*/devcontainer.json; do
+    if [ -f "$file" ]; then
+      echo "$file"
+      return
+    fi
+  done
+}
+
+# devcontainer_start starts a container for the working tree from the dev
+# container configuration $1, or reuses the one this process started, and
+# prints "<container id>\t<user>\t<workspace folder>". The devcontainer CLI
+# builds the configured image and features; without it only configurations
+# that name an image are supported, and are run with docker. The worktree's
+# git directory and TMPDIR are mounted at their host paths, and containers
+# are labelled with the CCA process so that on_exit removes them.
+devcontainer_start() {
+  local config="$1" common json id folder user env_args=()
+  common=$(git rev-parse --path-format=absolute --git-common-dir)
+  if command -v devcontainer >/dev/null; then
+    json=$(devcontainer up --workspace-folder "$PWD" --config "$PWD/$config" \
+      --id-label "cca.pid=$$" --id-label "cca.worktree=$PWD" \
+      --mount "type=bind,source=$common,target=$common" --mount "type=bind,source=${TMPDIR:-/tmp},target=${TMPDIR:-/tmp}" \
+      2>/dev/null | tail -n 1)
+    jq -e '.outcome == "success"' <<<"$json" >/dev/null 2>&1 || return 1
+    jq -r '[.containerId, .remoteUser // "", .remoteWorkspaceFolder] | @tsv' <<<"$json"
+    return
+  fi
+  # JSONC: drop whole-line comments so that jq can read simple configurations.
+  json=$(sed -E 's#^[[:space:]]*//.*$##' "$config" | jq -c . 2>/dev/null) || json=""
+  if [ -z "$(jq -r '.image // empty' <<<"$json")" ] || jq -e '.build or .dockerFile or .dockerComposeFile or ((.features // {}) | length > 0)' <<<"$json" >/dev/null; then
+    log "$config needs the devcontainer CLI (npm install -g @devcontainers/cli)" >&2
+    return 1
+  fi
+  folder=$(jq -r --arg name "$(basename "$PWD")" '.workspaceFolder // "/workspaces/\($name)"' <<<"$json")
+  user=$(jq -r '.remoteUser // .containerUser // ""' <<<"$json")
+  id=$(docker ps -q --filter "label=cca.pid=$$" --filter "label=cca.worktree=$PWD" | head -n 1)
+  if [ -z "$id" ]; then
+    mapfile -t env_args < <(jq -r '(.containerEnv // {}) | to_entries[] | "-e", "\(.key)=\(.value)"' <<<"$json")
+    id=$(docker run -d --label "cca.pid=$$" --label "cca.worktree=$PWD" \
+      -v "$PWD:$folder" -v "$common:$common" -v "${TMPDIR:-/tmp}:${TMPDIR:-/tmp}" \
+      ${env_args[@]+"${env_args[@]}"} \
+      --entrypoint sleep "$(jq -r .image <<<"$json")" infinity) || return 1
+  fi
+  printf '%s\t%s\t%s\n' "$id" "$user" "$folder"
+}
+
+# use_devcontainer points VERIFY_RUNNER at a wrapper that runs commands in the
+# repository's dev container (see devcontainer_start), in the directory that
+# corresponds to the current one and with the CCA_* variables verification
+# scripts receive, and the variables in VERIFY_ENV_FILE. It fails when the
+# repository has no dev container or it cannot be started.
+use_devcontainer() {
+  local config id user folder runner
+  config=$(devcontainer_config)
+  [ -n "$config" ] || return 1
+  if ! command -v docker >/dev/null; then
+    log "docker not installed; verifying on the host instead of in $config" >&2
+    return 1
+  fi
+  if ! IFS=$'\t' read -r id user folder < <(devcontainer_start "$config"); then
+    log "Could not start the dev container of $config; verifying on the host" >&2
+    return 1
+  fi
+  runner="$(git rev-parse --path-format=absolute --git-dir)/cca-devcontainer-exec"
+  cat >"$runner" <<EOF23
+#!/usr/bin/env bash
+exec docker exec -i ${user:+-u "$user"} -w "$folder/\$(realpath --relative-to="$PWD" "\$PWD")" \\
+  -e CCA_VERIFY_SCOPE -e CCA_CHANGED_FILES -e CCA_AFFECTED_PACKAGES -e CCA_GO_MODULES -e CCA_AFFECTED_MODULES \\
+  -e CCA_BUILD_SYSTEM -e CCA_AFFECTED_TARGETS -e CCA_AFFECTED_TEST_TARGETS \\
+  -e CCA_JS_WORKSPACES -e CCA_AFFECTED_WORKSPACES -e CCA_TURBO_TASKS \\
+  -e CCA_SHARD_INDEX -e CCA_SHARD_COUNT -e CCA_SHARD_PACKAGES -e CCA_SHARD_TARGETS \\
+  -e CCA_COMPOSE_FILE -e CCA_COMPOSE_PROJECT -e CCA_COMPOSE_SERVICES \\
+  ${VERIFY_ENV_FILE:+--env-file "$VERIFY_ENV_FILE"} "$id" "\$@"
+EOF23
+  chmod +x "$runner"
+  VERIFY_RUNNER=("$runner")
+  log "Verifying in the dev container of $config (${id:0:12})"
+}
+
+# nix_runner prints the command prefix, one word per line, that runs a
+# command in the development shell of the repository's flake.nix. It fails
+# when there is no flake or nix is not installed.
+nix_runner() {
+  [ -f flake.nix ] || return 1
+  if ! command -v nix >/dev/null; then
+    log "nix not installed; verifying without the development shell of flake.nix" >&2
+    return 1
+  fi
+  printf '%s\n' nix --extra-experimental-features "nix-command flakes" develop "$PWD" --command env
+}
+
+# detect_toolchains sets VERIFY_RUNNER to the command prefix that runs
+# verification in the repository's dev container when it has one (see
+# use_devcontainer), else in the development shell of its flake.nix (see
+# nix_runner), or else with the toolchain versions pinned in the repository:
+# Go via GOTOOLCHAIN, and Node.js, Python and Rust via mise when it is
+# installed. Outside a dev container, the runner starts with VERIFY_ENV_EXEC
+# when there are variables for verification (see load_verify_env).
+detect_toolchains() {
+  local prefix=(${VERIFY_ENV_EXEC:+"$VERIFY_ENV_EXEC"})
+  VERIFY_RUNNER=(${prefix[@]+"${prefix[@]}"} env)
+  if [ "$DEVCONTAINER" -eq 1 ] && use_devcontainer; then
+    return 0
+  fi
+  if [ "$NIX" -eq 1 ] && [ -f flake.nix ]; then
+    local runner
+    if runner=$(nix_runner); then
+      mapfile -t VERIFY_RUNNER <<<"$runner"
+      VERIFY_RUNNER=(${prefix[@]+"${prefix[@]}"} "${VERIFY_RUNNER[@]}")
+      log "Verifying in the nix develop shell of flake.nix"
+      return 0
+    fi
+  fi
+  [ "$TOOLCHAINS" -eq 1 ] || return 0
+
+  local version tools=()
+  if [ -f .go-version ]; then
+    version=$(tr -d '[:space:]' < .go-version)
+    VERIFY_RUNNER+=("GOTOOLCHAIN=go${version#go}")
+    log "Using Go $version from .go-version"
+  fi
+  if [ -f .nvmrc ]; then
+    version=$(tr -d '[:space:]' < .nvmrc)
+    tools+=("node@${version#v}")
+  fi
+  if [ -f .python-version ]; then
+    tools+=("python@$(head -n 1 .python-version | tr -d '[:space:]')")
+  fi
+  if [ -f rust-toolchain.toml ]; then
+    version=$(sed -n 's/^channel[[:space:]]*=[[:space:]]*"\(.*\)"/\1/p' rust-toolchain.toml)
+    [ -z "$version" ] || tools+=("rust@$version")
+  fi
+  [ "${#tools[@]}" -gt 0 ] || return 0
+
+  if command -v mise >/dev/null; then
+    VERIFY_RUNNER+=(mise exec "${tools[@]}" --)
+    log "Using ${tools[*]} via mise"
+  else
+    log "mise not installed; verifying with host toolchains instead of ${tools[*]}" >&2
+  fi
+}
+
+# go_modules prints the directories of the repository's Go modules relative to
+# its root, "." for the root module: the modules go.work uses when there is
+# one, else every directory with a go.mod outside vendor/ and testdata/.
+# Git submodules only count when go.work uses them.
+go_modules() {
+  command -v go >/dev/null || return 0
+  if [ -f go.work ]; then
+    go work edit -json 2>/dev/null | jq -r '.Use[]?.DiskPath' | sed -E 's#^\./##; s#/$##; s#^$#.#'
+  else
+    git ls-files --cached --others --exclude-standard -- go.mod '*/go.mod' |
+      grep -Ev '(^|/)(vendor|testdata)/' | xargs -r -n1 dirname | sort -u
+  fi
+}
+
+# has_go succeeds when go is installed and the repository has a Go module.
+has_go() {
+  [ -n "$(go_modules)" ]
+}
+
+# module_of prints the Go module of each path on stdin, the deepest module
+# directory containing it. Paths outside every module print nothing.
+module_of() {
+  awk -v modules="$(go_modules)" '
+    BEGIN { n = split(modules, m, "\n") }
+    {
+      best = ""; best_len = -1
+      for (i = 1; i <= n; i++) {
+        len = (m[i] == "." ? 0 : length(m[i]))
+        if ((m[i] == "." || index($0, m[i] "/") == 1) && len > best_len) { best = m[i]; best_len = len }
+      }
+      if (best != "") print best
+    }'
+}
+
+# go_list runs go list with the given arguments on ./... in the directory of
+# every Go module, so nested modules are listed without a go.work too.
+go_list() {
+  local module
+  while read -r module; do
+    (cd "$module" && go list -e "$@" ./... 2>/dev/null) || true
+  done < <(go_modules)
+}
+
+# affected_go_packages prints the Go packages whose code or tests depend on
+# the packages containing the given changed files, each as "<import path>
+# <module directory>".
+affected_go_packages() {
+  has_go || return 0
+  local changed
+  changed=$(printf '%s\n' "$@" | grep '\.go$' | xargs -r -n1 dirname | sort -u | xargs -r realpath -m)
+  [ -n "$changed" ] || return 0
+  go_list -f '{{.Dir}} {{with .Module}}{{.Dir}}{{end}} {{.ImportPath}}{{range .Deps}} {{.}}{{end}}{{range .TestImports}} {{.}}{{end}}' |
+    awk -v changed="$changed" -v root="$PWD" '
+      BEGIN { n = split(changed, c, "\n"); for (i = 1; i <= n; i++) dir[c[i]] = 1 }
+      { line[NR] = $0; if ($1 in dir) want[$3] = 1 }
+      END {
+        for (r = 1; r <= NR; r++) {
+          m = split(line[r], f, " ")
+          for (i = 3; i <= m; i++) if (f[i] in want) {
+            module = f[2] == root ? "." : substr(f[2], length(root) + 2)
+            print f[3], module
+            break
+          }
+        }
+      }'
+}
+
+# build_system prints "bazel" or "buck2" when the repository is a Bazel or
+# Buck2 workspace whose tool is installed, and nothing otherwise.
+build_system() {
+  if [ -f MODULE.bazel ] || [ -f WORKSPACE ] || [ -f WORKSPACE.bazel ]; then
+    if command -v bazel >/dev/null || command -v bazelisk >/dev/null; then
+      echo bazel
+    fi
+  elif [ -f .buckconfig ] && command -v buck2 >/dev/null; then
+    echo buck2
+  fi
+}
+
+# build_query runs query $2 with build system $1 (see build_system) and
+# prints the matching target labels as "<rule kind>\t<label>". Unknown files
+# and broken packages are skipped rather than failing the query.
+build_query() {
+  case "$1" in
+    bazel)
+      "${VERIFY_RUNNER[@]}" "$(command -v bazel || command -v bazelisk)" query --keep_going --output=label_kind "$2" 2>/dev/null |
+        awk '$2 == "rule" { print $1 "\t" $3 }' || true
+      ;;
+    buck2)
+      "${VERIFY_RUNNER[@]}" buck2 uquery "$2" --output-attribute buck.type --json 2>/dev/null |
+        jq -r 'to_entries[] | "\(.value["buck.type"] // "rule")\t\(.key)"' || true
+      ;;
+  esac
+}
+
+# affected_targets prints the targets of build system $1 that depend on the
+# changed files given as the remaining arguments, as "<test|build>\t<label>":
+# test rules are marked test, every other rule build.
+affected_targets() {
+  local system="$1" file files=() query
+  shift
+  for file in "$@"; do
+    [ ! -f "$file" ] || files+=("$file")
+  done
+  [ "${#files[@]}" -gt 0 ] || return 0
+  if [ "$system" = "bazel" ]; then
+    query="rdeps(//..., set(${files[*]}))"
+  else
+    query="rdeps(//..., owner(set(${files[*]})))"
+  fi
+  build_query "$system" "$query" |
+    awk -F'\t' '{ print ($1 ~ /_test$/ ? "test" : "build") "\t" $2 }' | sort -u
+}
+
+# submodule_paths prints the paths of the repository's git submodules.
+submodule_paths() {
+  [ ! -f .gitmodules ] || git config -f .gitmodules --get-regexp '\.path$' | awk '{ print $2 }'
+}
+
+# init_submodules checks out the submodules of the worktree in the current
+# directory, which git worktree add leaves empty.
+init_submodules() {
+  [ -f .gitmodules ] || return 0
+  log "Checking out submodules"
+  git submodule update --init --recursive --quiet || log "Could not check out all submodules" >&2
+}
+
+# drop_submodule_changes removes files inside git submodules from
+# changes_json: they belong to other repositories and cannot be committed here.
+drop_submodule_changes() {
+  local submodules=() path sub inside=()
+  mapfile -t submodules < <(submodule_paths)
+  [ "${#submodules[@]}" -gt 0 ] || return 0
+  while read -r path; do
+    for sub in "${submodules[@]}"; do
+      [[ "$path" != "$sub"/* ]] || { inside+=("$path"); break; }
+    done
+  done < <(jq -r '(.files // {} | keys[]), (.patches // {} | keys[]), (.edits[]?.file // empty), (.deleted_files[]?)' <<<"$changes_json" 2>/dev/null)
+  [ "${#inside[@]}" -gt 0 ] || return 0
+  log "Dropping changes inside git submodules: ${inside[*]}"
+  changes_json=$(jq -c --args '
+    ($ARGS.positional) as $drop
+    | if .files then .files |= with_entries(select(.key as $k | $drop | index($k) | not)) else . end
+    | if .patches then .patches |= with_entries(select(.key as $k | $drop | index($k) | not)) else . end
+    | if .edits then .edits |= map(select(.file as $k | $drop | index($k) | not)) else . end
+    | if .deleted_files then .deleted_files |= map(select(. as $k | $drop | index($k) | not)) else . end
+  ' "${inside[@]}" <<<"$changes_json")
+}
+
+# workspace_guidance prints prompt text for repositories with several Go
+# modules, JS/TS workspace packages or git submodules: the modules, the ones
+# the issue most likely affects (those of the files already pointed at), the
+# workspace packages and their dependencies, and the submodules that must not
+# be changed. The affected modules are saved in status.json.
+workspace_guidance() {
+  local modules affected submodules workspaces
+  modules=$(go_modules)
+  if [ "$(grep -c . <<<"$modules")" -gt 1 ]; then
+    affected=$({
+      sed -n 's/^-[[:space:]]*//p' <<<"$target_paths"
+      printf '%s\n%s\n%s\n' "$related_symbols" "$error_locations" "$stack_locations" | grep -oE '^[^ :]+' || true
+    } | module_of | sort | uniq -c | sort -rn | awk '{ print $2 }' | paste -sd' ' -)
+    echo "This repository has several Go modules, each with its own go.mod: $(paste -sd' ' - <<<"$modules")."
+    echo "Import packages of another module by its module path, and add requirements to the go.mod of the module that needs them."
+    if [ -n "$affected" ]; then
+      echo "The issue most likely affects: $affected."
+      log "Go modules affected by the issue: $affected" >&2
+      set_status modules "$affected"
+    fi
+  fi
+  workspaces=$(js_workspaces)
+  if [ -n "$workspaces" ]; then
+    echo "This repository is a JS/TS monorepo. Its workspace packages, with the workspace packages each depends on:"
+    awk -F'\t' '{ printf "- %s (%s)%s\n", $1, $2, ($3 == "" ? "" : ": depends on " $3) }' <<<"$workspaces" | head -n 50
+    echo "Depend on another workspace package by its package name, add dependencies to the package.json of the package that needs them, and keep changes to shared packages compatible with the packages that depend on them."
+  fi
+  submodules=$(submodule_paths | paste -sd' ' -)
+  [ -z "$submodules" ] || echo "These directories are git submodules from other repositories; do not change files in them: $submodules."
+}
+
+# js_workspaces prints the packages of a pnpm, yarn or npm workspace as
+# "<name>\t<directory>\t<workspace packages it depends on>", from the
+# patterns in pnpm-workspace.yaml or the workspaces of package.json.
+js_workspaces() {
+  local patterns=""
+  if [ -f pnpm-workspace.yaml ]; then
+    patterns=$(awk '
+      /^packages:/ { p = 1; next }
+      p && /^[^[:space:]-]/ { p = 0 }
+      p && /^[[:space:]]*-/ { sub(/^[[:space:]]*-[[:space:]]*/, ""); sub(/[[:space:]]+#.*$/, ""); gsub(/["\x27]/, ""); print }' pnpm-workspace.yaml)
+  elif [ -f package.json ]; then
+    patterns=$(jq -r '(.workspaces | if type == "object" then .packages else . end // [])[]' package.json 2>/dev/null || true)
+  fi
+  [ -n "$patterns" ] || return 0
+  (
+    shopt -s globstar nullglob
+    for pattern in $(grep -v '^!' <<<"$patterns"); do
+      for dir in $pattern; do
+        dir="${dir%/}"
+        [ -f "$dir/package.json" ] || continue
+        while read -r exclude; do
+          [ -z "$exclude" ] || [[ "$dir" != ${exclude#!} ]] || continue 2
+        done <<<"$(grep '^!' <<<"$patterns" || true)"
+        echo "$dir"
+      done
+    done | sort -u | while read -r dir; do
+      jq -r --arg dir "$dir" '[.name // $dir, $dir,
+        ([.dependencies, .devDependencies, .peerDependencies, .optionalDependencies] | map(. // {} | keys) | add | join(" "))] | @tsv' "$dir/package.json"
+    done
+  ) | awk -F'\t' '
+    { name[NR] = $1; dir[NR] = $2; deps[NR] = $3; known[$1] = 1 }
+    END {
+      for (i = 1; i <= NR; i++) {
+        n = split(deps[i], d, " "); ws = ""
+        for (j = 1; j <= n; j++) if (d[j] in known) ws = ws (ws == "" ? "" : " ") d[j]
+        print name[i] "\t" dir[i] "\t" ws
+      }
+    }'
+}
+
+# affected_js_workspaces prints the names of the workspace packages (see
+# js_workspaces) that contain the changed files given as arguments, and of
+# every package that depends on them, directly or through other packages.
+affected_js_workspaces() {
+  js_workspaces | awk -F'\t' -v changed="$(printf '%s\n' "$@")" '
+    { name[NR] = $1; dir[NR] = $2; deps[NR] = $3 }
+    END {
+      n = split(changed, c, "\n")
+      for (i = 1; i <= n; i++) {
+        best = 0
+        for (w = 1; w <= NR; w++) if (index(c[i], dir[w] "/") == 1 && (best == 0 || length(dir[w]) > length(dir[best]))) best = w
+        if (best) hit[name[best]] = 1
+      }
+      do {
+        added = 0
+        for (w = 1; w <= NR; w++) {
+          if (name[w] in hit) continue
+          m = split(deps[w], d, " ")
+          for (j = 1; j <= m; j++) if (d[j] in hit) { hit[name[w]] = 1; added = 1; break }
+        }
+      } while (added)
+      for (w = 1; w <= NR; w++) if (name[w] in hit) print name[w]
+    }'
+}
+
+# turbo_tasks prints the tasks of the turbo.json pipeline, without package
+# prefixes.
+turbo_tasks() {
+  [ -f turbo.json ] || return 0
+  jq -r '(.tasks // .pipeline // {}) | keys[] | sub("^.*#"; "")' turbo.json 2>/dev/null | sort -u || true
+}
+
+# coverage_candidates prints up to 10 existing source files the change is
+# likely to touch: those in the plan and those the issue was mapped to.
+coverage_candidates() {
+  {
+    [ -z "$plan_json" ] || jq -r '.files[].path' <<<"$plan_json"
+    printf '%s\n%s\n%s\n' "$error_locations" "$stack_locations" "$related_symbols" | sed -E 's/^[[:space:]]+//' | grep -oE '^[^ :"]+' || true
+  } | awk '!seen[$0]++' | while IFS= read -r path; do
+    [ ! -f "$path" ] || [ -n "$(test_files <<<"$path")" ] || echo "$path"
+  done | head -n 10
+}
+
+# coverage_map prints "<path>\t<line>\t<function>\t<percent>" for the
+# functions in the given files: from the LCOV file COVERAGE_FILE (or
+# coverage/lcov.info or lcov.info) when there is one, where a function is
+# either covered (100) or not (0), and for Go files from go test -coverprofile
+# on their packages.
+coverage_map() {
+  local lcov="$COVERAGE_FILE" module prefix path profile pkgs=()
+  [ -n "$lcov" ] || for path in coverage/lcov.info lcov.info; do
+    [ ! -f "$path" ] || { lcov="$path"; break; }
+  done
+  if [ -n "$lcov" ] && [ -f "$lcov" ]; then
+    awk -F'[:,]' -v root="$PWD/" '
+      NR == FNR { want[$0] = 1; next }
+      /^SF:/ { file = substr($0, 4); sub("^" root, "", file); sub(/^\.\//, "", file) }
+      /^FN:/ && (file in want) { line[file, $3] = $2; names[file] = names[file] SUBSEP $3 }
+      /^FNDA:/ && (file in want) { hits[file, $3] += $2 }
+      END {
+        for (f in names) {
+          n = split(substr(names[f], 2), list, SUBSEP)
+          for (i = 1; i <= n; i++) printf "%s\t%d\t%s\t%d\n", f, line[f, list[i]], list[i], (hits[f, list[i]] > 0 ? 100 : 0)
+        }
+      }' <(printf '%s\n' "$@") "$lcov"
+  fi
+  has_go || return 0
+  profile=$(mktemp)
+  while read -r module; do
+    prefix=""
+    [ "$module" = "." ] || prefix="$module/"
+    mapfile -t pkgs < <(for path in "$@"; do
+        [[ "$path" == *.go ]] && [ "$(module_of <<<"$path")" = "$module" ] && echo "./$(dirname "${path#"$prefix"}")"
+      done | sort -u)
+    [ "${#pkgs[@]}" -gt 0 ] || continue
+    (cd "$module" && limited timeout -k 30s "$VERIFY_TIMEOUT" go test -count=1 -coverprofile="$profile" "${pkgs[@]}" >/dev/null 2>&1) || true
+    [ -s "$profile" ] || continue
+    (cd "$module" && go tool cover -func="$profile" 2>/dev/null) |
+      awk -v module_path="$(sed -n 's/^module[[:space:]]*//p' "$module/go.mod" | head -n 1)" -v prefix="$prefix" '
+        $1 ~ /\.go:[0-9]+:$/ {
+          split($1, parts, ":"); file = parts[1]
+          if (index(file, module_path "/") == 1) file = substr(file, length(module_path) + 2)
+          pct = $3; sub(/%$/, "", pct)
+          printf "%s%s\t%d\t%s\t%s\n", prefix, file, parts[2], $2, pct
+        }' | awk -F'\t' 'NR == FNR { want[$0] = 1; next } $1 in want' <(printf '%s\n' "$@") -
+    : >"$profile"
+  done < <(go_modules)
+  rm -f "$profile"
+}
+
+# coverage_context measures the coverage of the files coverage_candidates
+# prints, saves it to coverage-map.tsv in the run directory and leaves the
+# functions below 50% in uncovered_functions for the prompts, which replay
+# coverage-considered.tsv as their context record. Files measured by an
+# earlier call are not measured again.
+coverage_context() {
+  local files=() map="$run_dir/coverage-map.tsv"
+  touch "$map"
+  mapfile -t files < <(coverage_candidates | grep -vxFf <(cut -f1 "$map") || true)
+  if [ "${#files[@]}" -gt 0 ]; then
+    coverage_map "${files[@]}" >>"$map"
+  fi
+  uncovered_functions=$(awk -F'\t' '$4 < 50 { printf "%s:%s %s (%s%% covered)\n", $1, $2, $3, $4 }' "$map" | sort -t: -k1,1 -k2,2n)
+  if [ -n "$uncovered_functions" ]; then
+    printf 'coverage-map.tsv\t%s\tincluded\t%s functions below 50%% coverage\n' "${#uncovered_functions}" "$(grep -c . <<<"$uncovered_functions")" \
+      >"$run_dir/coverage-considered.tsv"
+    log "Coverage: $(grep -c . <<<"$uncovered_functions") of $(grep -c . "$map") functions in the files likely to change are below 50%"
+  fi
+}
+
+# process_tree prints the PID and resident memory in KB of process $1 and of
+# each of its descendants, one per line.
+process_tree() {
+  ps -e -o pid=,ppid=,rss= | awk -v root="$1" '
+    { parent[$1] = $2; rss[$1] = $3 }
+    END {
+      for (p in parent)
+        for (q = p; q in parent; q = parent[q])
+          if (q == root) { print p, rss[p]; break }
+    }'
+}
+
+# limited runs a command with the per-run memory and process limits applied.
+# When a transient systemd scope can be created, MemoryMax and TasksMax cap
+# the memory and processes of the command and its children. Otherwise the
+# resident memory of the command's process tree is polled every second and
+# the tree is killed once it exceeds MAX_MEMORY_MB, and ulimit -u caps the
+# processes of the whole user rather than of the run.
+limited() {
+  [ -n "$MAX_MEMORY_MB$MAX_PROCS" ] || { "$@"; return; }
+  if [ -z "$systemd_scope" ]; then
+    systemd_scope=0
+    ! systemd-run --user --scope --quiet true >/dev/null 2>&1 || systemd_scope=1
+  fi
+  if [ "$systemd_scope" -eq 1 ]; then
+    local scope=(systemd-run --user --scope --quiet --collect)
+    [ -z "$MAX_MEMORY_MB" ] || scope+=(-p "MemoryMax=${MAX_MEMORY_MB}M" -p MemorySwapMax=0)
+    [ -z "$MAX_PROCS" ] || scope+=(-p "TasksMax=$MAX_PROCS")
+    "${scope[@]}" "$@"
+    return
+  fi
+  (
+    [ -z "$MAX_PROCS" ] || ulimit -u "$MAX_PROCS"
+    [ -n "$MAX_MEMORY_MB" ] || exec "$@"
+    local pid kb
+    "$@" <&0 &
+    pid=$!
+    while kill -0 "$pid" 2>/dev/null; do
+      kb=$(process_tree "$pid" | awk '{ kb += $2 } END { print kb + 0 }')
+      if [ "$kb" -gt $((MAX_MEMORY_MB * 1024)) ]; then
+        log "Memory use of $((kb / 1024)) MB exceeds CCA_MAX_MEMORY_MB=$MAX_MEMORY_MB; stopping the command" >&2
+        kill -KILL $(process_tree "$pid" | cut -d' ' -f1) 2>/dev/null || true
+        break
+      fi
+      sleep 1
+    done
+    wait "$pid"
+  )
+}
+
+# check_disk records the disk usage of the current directory and exits when
+# it exceeds MAX_DISK_MB.
+check_disk() {
+  local kb
+  kb=$(du -sk . 2>/dev/null | cut -f1)
+  [ "$kb" -le "$disk_peak_kb" ] || disk_peak_kb=$kb
+  if [ -n "$MAX_DISK_MB" ] && [ "$kb" -gt $((MAX_DISK_MB * 1024)) ]; then
+    log "Worktree uses $((kb / 1024)) MB, more than CCA_MAX_DISK_MB=$MAX_DISK_MB" >&2
+    exit 1
+  fi
+}
+
+# write_resources records the CPU time of the run and its subprocesses, the
+# peak worktree disk usage, the size of git fetches and, when the run has its
+# own cgroup, the peak memory and process counts in resources.json.
+write_resources() {
+  [ -n "$run_dir" ] || return 0
+  local cgroup peak_memory="" peak_pids="" fetched_kb=0
+  [ ! -s "$run_dir/fetches.jsonl" ] || fetched_kb=$(jq -s 'map(.kb) | add' "$run_dir/fetches.jsonl")
+  cgroup="/sys/fs/cgroup$(cut -d: -f3 /proc/self/cgroup 2>/dev/null | head -n 1)"
+  [ ! -r "$cgroup/memory.peak" ] || peak_memory=$(cat "$cgroup/memory.peak")
+  [ ! -r "$cgroup/pids.peak" ] || peak_pids=$(cat "$cgroup/pids.peak")
+  times | awk '
+    function seconds(t,  m) { m = t; sub(/m.*/, "", m); sub(/^[0-9]+m/, "", t); sub(/s$/, "", t); return m * 60 + t }
+    { user += seconds($1); sys += seconds($2) }
+    END { printf "%.2f %.2f\n", user, sys }' | {
+    read -r user sys
+    jq -n --argjson user "$user" --argjson sys "$sys" --argjson disk "$disk_peak_kb" --argjson fetched "$fetched_kb" \
+      --arg memory "$peak_memory" --arg pids "$peak_pids" \
+      --arg max_memory "$MAX_MEMORY_MB" --arg max_disk "$MAX_DISK_MB" --arg max_procs "$MAX_PROCS" '{
+        cpu_user_seconds: $user,
+        cpu_system_seconds: $sys,
+        peak_disk_kb: $disk,
+        fetched_kb: $fetched,
+        peak_memory_bytes: (if $memory == "" then null else ($memory | tonumber) end),
+        peak_processes: (if $pids == "" then null else ($pids | tonumber) end),
+        limits: {memory_mb: $max_memory, disk_mb: $max_disk, processes: $max_procs} | with_entries(select(.value != ""))
+      }' >"$run_dir/resources.json"
+  }
+}
+
+# run_verify runs .cca/verify.sh with the verification scope ("affected" or
+# "full") and the changed files and affected Go packages, or in a Bazel or
+# Buck2 workspace the affected targets, and the affected JS/TS workspace
+# packages in its environment, after starting the services integration tests
+# need (see start_services). With more than one worker the script runs once
+# per shard in parallel.
+run_verify() {
+  local scope="$1"
+  local changed=() packages="" affected="" modules system targets="" test_targets="" workspaces=""
+  mapfile -t changed < <(git status --porcelain | cut -c4-)
+  modules=$(printf '%s\n' ${changed[@]+"${changed[@]}"} | module_of)
+  system=$(build_system)
+  if [ "$scope" = "affected" ] && [ -n "$system" ]; then
+    affected=$(affected_targets "$system" ${changed[@]+"${changed[@]}"})
+    targets=$(cut -f2 <<<"$affected" | paste -sd' ' -)
+    test_targets=$(awk -F'\t' '$1 == "test" { print $2 }' <<<"$affected" | paste -sd' ' -)
+    log "Test selection: ${#changed[@]} changed files affect $(grep -c . <<<"$affected" || true) $system targets, $(wc -w <<<"$test_targets") of them tests" >&2
+  elif [ "$scope" = "affected" ]; then
+    affected=$(affected_go_packages ${changed[@]+"${changed[@]}"})
+    packages=$(cut -d' ' -f1 <<<"$affected" | paste -sd' ' -)
+    modules+=$'\n'$(cut -s -d' ' -f2 <<<"$affected")
+    log "Test selection: ${#changed[@]} changed files affect Go packages: ${packages:-none}" >&2
+  fi
+  if [ "$scope" = "affected" ] && [ -n "$(js_workspaces)" ]; then
+    workspaces=$(affected_js_workspaces ${changed[@]+"${changed[@]}"} | paste -sd' ' -)
+    log "Test selection: ${#changed[@]} changed files affect workspace packages: ${workspaces:-none}" >&2
+  fi
+  export CCA_VERIFY_SCOPE="$scope"
+  export CCA_CHANGED_FILES="$(printf '%s\n' ${changed[@]+"${changed[@]}"})"
+  export CCA_AFFECTED_PACKAGES="$packages"
+  export CCA_GO_MODULES="$(go_modules | paste -sd' ' -)"
+  export CCA_AFFECTED_MODULES="$(grep -v '^$' <<<"$modules" | sort -u | paste -sd' ' -)"
+  export CCA_BUILD_SYSTEM="$system"
+  export CCA_AFFECTED_TARGETS="$targets"
+  export CCA_AFFECTED_TEST_TARGETS="$test_targets"
+  export CCA_JS_WORKSPACES="$(js_workspaces | cut -f2 | paste -sd' ' -)"
+  export CCA_AFFECTED_WORKSPACES="$workspaces"
+  export CCA_TURBO_TASKS="$(turbo_tasks | paste -sd' ' -)"
+  [ "$SERVICES" -eq 0 ] || start_services
+  local code=0
+  if [ "$VERIFY_WORKERS" -le 1 ]; then
+    limited timeout -k 30s "$VERIFY_TIMEOUT" "${VERIFY_RUNNER[@]}" bash .cca/verify.sh 2>&1 || code=$?
+  else
+    run_verify_shards "$packages" || code=$?
+  fi
+  if [ "$code" -ne 0 ]; then
+    service_logs
+    return "$code"
+  fi
+  if [ "$scope" = "full" ] && [ "$SMOKE" -eq 1 ] && [ -f .cca/smoke/commands ]; then
+    run_smoke
+  fi
+}
+
+# compose_file prints the Compose file of the services integration tests
+# need: SERVICES_FILE, or else docker-compose.test.yml, compose.test.yml or
+# their .yaml variants.
+compose_file() {
+  local file
+  for file in $SERVICES_FILE docker-compose.test.yml docker-compose.test.yaml compose.test.yml compose.test.yaml; do
+    if [ -f "$file" ]; then
+      echo "$file"
+      return
+    fi
+  done
+}
+
+# uses_testcontainers succeeds when the repository depends on Testcontainers
+# in a Go, Node.js, Python or JVM manifest.
+uses_testcontainers() {
+  git grep -qi testcontainers -- '*go.mod' '*package.json' '*requirements*.txt' '*pyproject.toml' '*pom.xml' '*build.gradle*' 2>/dev/null
+}
+
+# start_services starts the services in the Compose file for integration
+# tests (see compose_file) as a Compose project of this process and worktree,
+# waits up to SERVICES_TIMEOUT seconds for their health checks to pass, and
+# exports CCA_COMPOSE_FILE, CCA_COMPOSE_PROJECT and CCA_COMPOSE_SERVICES for
+# verification. Services that are already up are left as they are. Tests
+# that use Testcontainers start their own containers, so for them it only
+# checks that docker is reachable. on_exit removes the projects.
+start_services() {
+  local file
+  file=$(compose_file)
+  if [ -z "$file" ]; then
+    if uses_testcontainers && ! docker info >/dev/null 2>&1; then
+      log "The tests use Testcontainers but docker is not reachable; integration tests may fail" >&2
+    fi
+    return 0
+  fi
+  if ! docker compose version >/dev/null 2>&1; then
+    log "docker compose not available; not starting the services of $file" >&2
+    return 0
+  fi
+  export CCA_COMPOSE_FILE="$PWD/$file"
+  export CCA_COMPOSE_PROJECT="cca-$$-$(cksum <<<"$PWD" | cut -d' ' -f1)"
+  export CCA_COMPOSE_SERVICES="$(docker compose -f "$CCA_COMPOSE_FILE" config --services 2>/dev/null | paste -sd' ' -)"
+  log "Starting services for integration tests from $file: $CCA_COMPOSE_SERVICES" >&2
+  if ! timeout "$SERVICES_TIMEOUT" docker compose -f "$CCA_COMPOSE_FILE" -p "$CCA_COMPOSE_PROJECT" \
+      up -d --wait --quiet-pull >/dev/null 2>&1; then
+    log "The services of $file did not become healthy within ${SERVICES_TIMEOUT}s" >&2
+    service_logs
+  fi
+}
+
+# service_logs saves the logs of the services start_services started to
+# services.log in the run directory.
+service_logs() {
+  [ -n "${CCA_COMPOSE_PROJECT:-}" ] && [ -n "$run_dir" ] || return 0
+  docker compose -f "$CCA_COMPOSE_FILE" -p "$CCA_COMPOSE_PROJECT" logs --no-color --timestamps 2>&1 |
+    redact >"$run_dir/services.log" || true
+  log "Saved the service logs to $run_dir/services.log" >&2
+}
+
+# stop_services removes the Compose projects start_services started in this
+# process, with their volumes.
+stop_services() {
+  local project
+  command -v docker >/dev/null || return 0
+  docker compose ls -a --format json 2>/dev/null | jq -r --arg prefix "cca-$$-" '.[].Name | select(startswith($prefix))' 2>/dev/null |
+    while read -r project; do
+      docker compose -p "$project" down -v --remove-orphans >/dev/null 2>&1 || true
+    done
+}
+
+# cli_packages prints the directories of the main packages of the Go modules
+# in the current directory.
+cli_packages() {
+  go_list -f '{{if eq .Name "main"}}{{.Dir}}{{end}}' | sed '/^$/d'
+}
+
+# smoke_setup asks the backend for the key commands of a CLI project and
+# writes them to .cca/smoke/commands, one shell command per line, so that
+# run_smoke can compare their output against golden files.
+smoke_setup() {
+  local packages
+  packages=$(cli_packages)
+  if [ -z "$packages" ]; then
+    skip "smoke tests (not a CLI project)"
+    return
+  fi
+  [ ! -f .cca/smoke/commands ] || return 0
+
+  local prompt_file commands dir file
+  prompt_file=$(mktemp)
+  {
+    echo "List the key commands of this command line tool for a smoke test: the help"
+    echo "output, the version and the main subcommands with harmless arguments. Use"
+    echo "the binary names below as commands. Avoid commands that need network"
+    echo "access, credentials or interactive input, or whose output contains times"
+    echo "or other values that change between runs."
+    echo
+    while read -r dir; do
+      echo "Binary: $(basename "$dir")"
+      for file in "$dir"/*.go; do
+        case "$file" in *_test.go) continue ;; esac
+        [ -f "$file" ] || continue
+        echo "File: $file"
+        context_file "$file"
+        echo
+      done
+    done < <(cli_packages | xargs -r realpath --relative-to=.)
+    echo 'Format as JSON: {"commands": ["tool --help"]}'
+  } >"$prompt_file"
+  log "Generating smoke test commands..."
+  commands=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  if ! commands=$(jq -r '.commands[]' <<<"$commands" 2>/dev/null) || [ -z "$commands" ]; then
+    log "Backend did not return smoke test commands; skipping" >&2
+    return
+  fi
+  mkdir -p .cca/smoke
+  printf '%s\n' "$commands" >.cca/smoke/commands
+  log "Wrote $(wc -l <<<"$commands") smoke test commands to .cca/smoke/commands"
+}
+
+# run_smoke builds the main packages and runs every command in
+# .cca/smoke/commands with the binaries on PATH, comparing the combined output
+# and exit code against .cca/smoke/golden/. Missing golden files are recorded;
+# with CCA_SMOKE_UPDATE=1 all of them are rewritten.
+run_smoke() {
+  local bin dir cmd name output golden failed=0
+  bin=$(mktemp -d)
+  while read -r dir; do
+    (cd "$dir" && "${VERIFY_RUNNER[@]}" go build -o "$bin/$(basename "$dir")" . 2>&1) || failed=1
+  done < <(cli_packages)
+  mkdir -p .cca/smoke/golden
+  while IFS= read -r cmd; do
+    [ -n "$cmd" ] || continue
+    name=$(tr -c 'A-Za-z0-9._-' '_' <<<"$cmd" | sed 's/_*$//')
+    golden=".cca/smoke/golden/$name.txt"
+    output=$(PATH="$bin:$PATH" timeout 60 bash -c "$cmd" </dev/null 2>&1; echo "exit status $?")
+    if [ ! -f "$golden" ] || [ "$SMOKE_UPDATE" -eq 1 ]; then
+      printf '%s\n' "$output" >"$golden"
+      echo "Recorded smoke test output for: $cmd"
+    elif ! diff -u --label "$golden" --label "$cmd" "$golden" <(printf '%s\n' "$output"); then
+      failed=1
+    fi
+  done <.cca/smoke/commands
+  rm -rf "$bin"
+  return "$failed"
+}
+
+# run_verify_shards runs .cca/verify.sh in VERIFY_WORKERS parallel shards with
+# CCA_SHARD_INDEX, CCA_SHARD_COUNT and CCA_SHARD_PACKAGES set (in a Bazel or
+# Buck2 workspace, CCA_SHARD_TARGETS with a share of the test targets
+# instead), prints every shard's output and records the results in
+# verify.json.
+run_verify_shards() {
+  local packages="$1"
+  local dir="${run_dir:-$(mktemp -d)}" i failed=0 targets=""
+  if [ -n "$CCA_BUILD_SYSTEM" ]; then
+    targets="$CCA_AFFECTED_TEST_TARGETS"
+    if [ -z "$targets" ]; then
+      targets=$(build_query "$CCA_BUILD_SYSTEM" "kind('.*_test', //...)" | cut -f2 | paste -sd' ' -)
+    fi
+  elif [ -z "$packages" ]; then
+    packages=$(go_list | paste -sd' ' -)
+  fi
+
+  log "Running verification in $VERIFY_WORKERS shards" >&2
+  local pids=()
+  for ((i = 0; i < VERIFY_WORKERS; i++)); do
+    (
+      start=$(date +%s)
+      code=0
+      CCA_SHARD_INDEX=$i CCA_SHARD_COUNT=$VERIFY_WORKERS \
+        CCA_SHARD_PACKAGES=$(tr ' ' '\n' <<<"$packages" | awk -v n="$VERIFY_WORKERS" -v i="$i" 'NF && (NR - 1) % n == i' | paste -sd' ' -) \
+        CCA_SHARD_TARGETS=$(tr ' ' '\n' <<<"$targets" | awk -v n="$VERIFY_WORKERS" -v i="$i" 'NF && (NR - 1) % n == i' | paste -sd' ' -) \
+        limited timeout -k 30s "$VERIFY_TIMEOUT" "${VERIFY_RUNNER[@]}" bash .cca/verify.sh >"$dir/verify-shard-$i.log" 2>&1 || code=$?
+      jq -n --argjson index "$i" --argjson code "$code" --argjson seconds "$(($(date +%s) - start))" \
+        '{index: $index, exit_code: $code, duration_seconds: $seconds}' >"$dir/verify-shard-$i.json"
+    ) &
+    pids+=($!)
+  done
+  wait "${pids[@]}"
+
+  for ((i = 0; i < VERIFY_WORKERS; i++)); do
+    redact <"$dir/verify-shard-$i.log" >"$dir/verify-shard-$i.tmp"
+    mv "$dir/verify-shard-$i.tmp" "$dir/verify-shard-$i.log"
+    echo "--- shard $i ---"
+    cat "$dir/verify-shard-$i.log"
+  done
+  jq -s --argjson workers "$VERIFY_WORKERS" --arg scope "$CCA_VERIFY_SCOPE" \
+    '{workers: $workers, scope: $scope, shards: ., passed: all(.[]; .exit_code == 0)}' \
+    "$dir"/verify-shard-*.json >"$dir/verify.json"
+  for ((i = 0; i < VERIFY_WORKERS; i++)); do
+    [ "$(jq '.exit_code' "$dir/verify-shard-$i.json")" -eq 0 ] || failed=1
+  done
+  rm -f "$dir"/verify-shard-*.json
+  return "$failed"
+}
+
+# preflight checks that the repository is healthy before any generation
+# happens: the remote is reachable, the base ref resolves and the verification
+# script passes on it. A broken base is reported on the issue and aborts the
+# run unless best-effort mode records the failures and carries on.
+preflight() {
+  log "Running pre-flight checks..."
+  if [ "$OFFLINE" -eq 1 ]; then
+    skip "remote check (offline)"
+  elif ! git ls-remote origin >/dev/null 2>&1; then
+    log "Pre-flight: remote origin is not reachable" >&2
+    exit 1
+  fi
+  if ! git rev-parse --verify --quiet "$BASE_REF^{commit}" >/dev/null; then
+    log "Pre-flight: base ref $BASE_REF does not resolve to a commit" >&2
+    exit 1
+  fi
+
+  local dir="$root_dir/.cca/worktrees/preflight-$rand" output="" status=0
+  git worktree add --detach "$dir" "$BASE_REF" >/dev/null 2>&1
+  pushd "$dir" >/dev/null
+  if [ -f .cca/verify.sh ]; then
+    detect_toolchains
+    output=$(run_verify full) || status=$?
+  else
+    skip "baseline verification (no .cca/verify.sh on $BASE_REF)"
+  fi
+  popd >/dev/null
+  git worktree remove --force "$dir"
+
+  if [ "$status" -eq 0 ]; then
+    log "Pre-flight: verification passes on $BASE_REF"
+    return 0
+  fi
+  output=${output:-"exit code $status"}
+  baseline_failures="$output"
+  printf '%s\n' "$output" >"$run_dir/baseline.log"
+  log "Pre-flight: verification fails on $BASE_REF; see $run_dir/baseline.log" >&2
+  if [ -n "$ISSUE_URL" ] && [ "$OFFLINE" -eq 0 ] && [ "$READ_ONLY" -eq 0 ]; then
+    gh issue comment "$ISSUE_URL" --body "$(redact <<EOF
+$(msg comment.baseline "$BASE_REF")
+
+\`\`\`
+$(tail -n 50 <<<"$output")
+\`\`\`
+
+$(run_marker)
+EOF
+)" >/dev/null
+  fi
+  if [ "$BEST_EFFORT" -eq 0 ]; then
+    log "Fix the base or rerun with --best-effort" >&2
+    exit 1
+  fi
+  log "Continuing in best-effort mode with baseline failures recorded"
+}
+
+# verify_changes applies changes_json in the current directory and runs
+# .cca/verify.sh, asking the backend to fix failures up to max_retries times.
+# Attempts run only the affected tests when test selection is enabled; the
+# full suite must pass before verification succeeds.
+verify_changes() {
+  local max_retries=3
+  local attempt=1
+  local tmp_changes verify_output verify_code fix_prompt_file scope=full
+
+  [ "$TEST_SELECTION" -eq 0 ] || scope=affected
+  detect_toolchains
+  while true; do
+    log "Verification attempt $attempt"
+    enforce_paths
+    drop_submodule_changes
+    tmp_changes=$(mktemp)
+    echo "$changes_json" > "$tmp_changes"
+
+    rejected_changes=""
+    apply_changes "$tmp_changes"
+    rm "$tmp_changes"
+    repair_changes
+    [ "$LICENSE_HEADERS" -eq 0 ] || apply_license_headers
+    format_changes
+    [ "$MINIMIZE_DIFF" -eq 0 ] || minimize_diff
+    [ "$TIDY" -eq 0 ] || tidy_dependencies
+    check_disk
+
+    log "Running verification ($scope)..."
+    if verify_output=$(run_verify "$scope"); then
+      verify_code=0
+      if [ "$scope" = "affected" ]; then
+        log "Affected tests passed; running full verification..."
+        if ! verify_output=$(run_verify full); then
+          verify_code=1
+        fi
+      fi
+    else
+      verify_code=$?
+    fi
+
+    if [ $verify_code -eq 0 ]; then
+      log "Verification passed"
+      verify_attempts=$attempt
+      break
+    fi
+    [ -z "$run_dir" ] || printf '%s\n' "$verify_output" >"$run_dir/verify-output.txt"
+
+    if [ $attempt -ge $max_retries ] && [ -n "$baseline_failures" ]; then
+      log "Verification still fails after $max_retries attempts; keeping changes because the base was already broken" >&2
+      break
+    fi
+    if [ $attempt -ge $max_retries ]; then
+      log "Verification failed after $max_retries attempts" >&2
+      log "$verify_output" >&2
+      exit 1
+    fi
+
+    log "Verification failed: $verify_output"
+    if budget_spent; then
+      log "Verification failed and the $TIME_BUDGET time budget is spent" >&2
+      exit 1
+    fi
+
+    fix_prompt_file=$(mktemp)
+    cat >"$fix_prompt_file" <<EOF3
+The verification script failed with these errors:
+
+$verify_output
+
+Here are the current code changes:
+$changes_json
+
+Please fix the code to resolve these verification errors. Return the corrected implementation.
+
+Format as JSON with the same structure as before:
+{
+  "files": {"path": "content"},
+  "new_files": [],
+  "deleted_files": [],
+  "summary": "..."
+}
+EOF3
+    changes_json=$(claude_chat "$fix_prompt_file" "with-p")
+    rm "$fix_prompt_file"
+    check_changes "$changes_json" || exit 1
+    attempt=$((attempt + 1))
+    stage_retries=$((stage_retries + 1))
+    log "Retrying verification..."
+  done
+}
+
+# write_release_note adds a news fragment or changeset for repositories that
+# use towncrier or changesets, so release tooling picks up the change.
+write_release_note() {
+  local note
+  note=$(echo "$changes_json" | jq -r '.summary // empty' 2>/dev/null || true)
+  note="${note:-$title}"
+
+  if [ -f .changeset/config.json ]; then
+    local package="" file=".changeset/cca-$(current_run_id).md"
+    [ -f package.json ] && package=$(jq -r '.name // empty' package.json)
+    {
+      echo "---"
+      [ -z "$package" ] || echo "\"$package\": $RELEASE_NOTE_BUMP"
+      echo "---"
+      echo
+      echo "$note"
+    } > "$file"
+    log "Wrote changeset $file"
+  elif grep -qs '^\[tool\.towncrier\]' pyproject.toml || [ -f towncrier.toml ]; then
+    local config=towncrier.toml dir
+    [ -f "$config" ] || config=pyproject.toml
+    dir=$(sed -n 's/^directory[[:space:]]*=[[:space:]]*"\(.*\)"/\1/p' "$config" | head -n 1)
+    dir="${dir:-newsfragments}"
+    local name="$number"
+    [ "$number" != "local" ] || name="+cca-$(current_run_id)"
+    mkdir -p "$dir"
+    echo "$note" > "$dir/$name.$RELEASE_NOTE_TYPE.md"
+    log "Wrote news fragment $dir/$name.$RELEASE_NOTE_TYPE.md"
+  fi
+}
+
+# semver_impact compares the exported declarations removed and added between
+# $1 and HEAD in Go and JS/TS files. It prints the suggested bump (major, minor
+# or patch) on the first line followed by the affected declarations.
+semver_impact() {
+  local diff removed added
+  diff=$(git diff -U0 "$1...HEAD" -- '*.go' '*.js' '*.jsx' '*.ts' '*.tsx' '*.mjs' ':!*_test.go')
+  local exported='^(func (\([^)]*\) )?[A-Z]|type [A-Z]|(var|const) [A-Z]|export )'
+  removed=$(sed -n 's/^-\([^-]\)/\1/p' <<<"$diff" | grep -E "$exported" | sed 's/[[:space:]]*{[[:space:]]*$//' | sort -u || true)
+  added=$(sed -n 's/^+\([^+]\)/\1/p' <<<"$diff" | grep -E "$exported" | sed 's/[[:space:]]*{[[:space:]]*$//' | sort -u || true)
+
+  local broken introduced
+  broken=$(comm -23 <(echo "$removed") <(echo "$added") | sed '/^$/d')
+  introduced=$(comm -13 <(echo "$removed") <(echo "$added") | sed '/^$/d')
+  if [ -n "$broken" ]; then
+    echo "major"
+    sed 's/^/- removed or changed: `/; s/$/`/' <<<"$broken"
+  elif [ -n "$introduced" ]; then
+    echo "minor"
+  else
+    echo "patch"
+  fi
+  [ -z "$introduced" ] || sed 's/^/- added: `/; s/$/`/' <<<"$introduced"
+}
+
+# go_api_surface prints the exported declarations and struct fields of a Go
+# package directory as reported by go doc.
+go_api_surface() {
+  (cd "$1" && go doc -all . 2>/dev/null) |
+    grep -E '^(func|type|var|const) |^	[A-Z][A-Za-z0-9_]*[[:space:]]' |
+    sed 's/[[:space:]]*\/\/.*$//; s/[[:space:]]*{[[:space:]]*$//; s/[[:space:]]\+/ /g' | sort -u || true
+}
+
+# go_api_breaks compares the exported API of every Go package changed between
+# $1 and HEAD and prints a finding for each removed or changed symbol.
+go_api_breaks() {
+  has_go || return 0
+  local dirs base_dir dir decl
+  dirs=$(git diff --name-only "$1...HEAD" -- '*.go' ':!*_test.go' | xargs -r -n1 dirname | sort -u)
+  [ -n "$dirs" ] || return 0
+  base_dir=$(mktemp -d)
+  git worktree add --detach "$base_dir" "$1" >/dev/null 2>&1
+
+  while read -r dir; do
+    [ -d "$base_dir/$dir" ] || continue
+    while read -r decl; do
+      [ -n "$decl" ] || continue
+      case "$decl" in
+        func*) echo "- \`$dir\`: \`$decl\` was removed or changed. Keep it as a wrapper marked \`// Deprecated:\` that calls the new API." ;;
+        type*) echo "- \`$dir\`: \`$decl\` was removed or changed. Keep the old type (or a type alias) marked \`// Deprecated:\`." ;;
+        var*|const*) echo "- \`$dir\`: \`$decl\` was removed or changed. Keep the old name marked \`// Deprecated:\`." ;;
+        *) echo "- \`$dir\`: struct field \`$(echo "$decl" | sed 's/^[[:space:]]*//')\` was removed or changed. Keep the field and mark it \`// Deprecated:\`." ;;
+      esac
+    done < <(comm -23 <(go_api_surface "$base_dir/$dir") <(go_api_surface "$dir"))
+  done <<<"$dirs"
+
+  git worktree remove --force "$base_dir"
+}
+
+# sql_review prints findings for the SQL in the given Go files: queries run
+# inside loops, SELECT *, SQL built from strings and, when the repository has
+# SQL schema files, filtered columns that no index or unique constraint
+# mentions.
+sql_review() {
+  local findings kind column location schema
+  findings=$(awk '
+    function report(severity, message) { printf "%s\tsql\t%s:%d\t%s\n", severity, FILENAME, FNR, message }
+    {
+      line = $0
+      sub(/\/\/.*$/, "", line)
+    }
+    line ~ /^[[:space:]]*for[[:space:]{]/ || line ~ /^[[:space:]]*for$/ { loops[++nloops] = depth }
+    line ~ /\.(Query|QueryRow|QueryContext|QueryRowContext|Exec|ExecContext|Select|SelectContext|Get|GetContext|NamedExec|Raw|Find|First|Take|Preload)\(/ &&
+      line ~ /(\.(Query|QueryRow|Exec)(Context)?\(|\.(Select|Get)(Context)?\([^)]*&|\.(Find|First|Take)\(&|\.(Raw|NamedExec|Preload)\()/ {
+      if (nloops > 0) report("major", "query inside a loop (N+1); load the rows in one query with IN (...) or a join, or batch the statements")
+    }
+    toupper(line) ~ /SELECT[[:space:]]+\*/ { report("minor", "SELECT * fetches every column and breaks when the table changes; list the columns") }
+    line ~ /fmt\.Sprintf\("[^"]*(SELECT|INSERT|UPDATE|DELETE|select|insert|update|delete)[[:space:]]/ ||
+      line ~ /"[^"]*(SELECT|INSERT INTO|UPDATE|DELETE FROM|WHERE)[^"]*"[[:space:]]*\+/ {
+      report("critical", "SQL built from strings; pass values as query parameters (?, $1) or use a prepared statement")
+    }
+    {
+      rest = toupper(line)
+      while (match(rest, /WHERE[[:space:]]+[A-Z_][A-Z0-9_.]*[[:space:]]*(=|IN|LIKE)/)) {
+        column = substr(rest, RSTART, RLENGTH)
+        sub(/^WHERE[[:space:]]+/, "", column); sub(/[[:space:]]*(=|IN|LIKE)$/, "", column); sub(/^.*\./, "", column)
+        if (column != "ID") printf "where\t%s\t%s:%d\n", tolower(column), FILENAME, FNR
+        rest = substr(rest, RSTART + RLENGTH)
+      }
+    }
+    {
+      opened = gsub(/{/, "{", line); closed = gsub(/}/, "}", line)
+      depth += opened - closed
+      while (nloops > 0 && depth <= loops[nloops] && closed > 0) nloops--
+    }
+  ' "$@")
+  grep -v '^where' <<<"$findings" || true
+  schema=$(git grep -liE 'create[[:space:]]+table' -- '*.sql' 2>/dev/null || true)
+  [ -n "$schema" ] || return 0
+  while IFS=$'\t' read -r kind column location; do
+    [ "$kind" = "where" ] || continue
+    git grep -qiE "(index|unique|primary key).*\\b$column\\b|\\b$column\\b.*(index|unique|primary key)" -- '*.sql' '*.go' 2>/dev/null ||
+      printf 'minor\tsql\t%s\tno index found on column %s; add one if this query runs often\n' "$location" "$column"
+  done < <(grep '^where' <<<"$findings" | sort -u -k2,2)
+}
+
+# concurrency_review prints findings for common Go concurrency bugs in the
+# given files: goroutines capturing loop variables before Go 1.22, WaitGroup
+# misuse, sync values passed by copy, unguarded package-level maps, channels
+# ranged over but never closed and time.After in loops. Concurrency reports
+# from go vet and, with RACE=1, data races found by go test -race on the
+# changed packages are added to the same category.
+concurrency_review() {
+  local old_loopvar=0 minor pkgs=()
+  minor=$(sed -n 's/^go 1\.\([0-9]*\).*/\1/p' go.mod 2>/dev/null | head -n 1)
+  [ -z "$minor" ] || [ "$minor" -ge 22 ] || old_loopvar=1
+  awk -v old_loopvar="$old_loopvar" '
+    function report(severity, message) { printf "%s\tconcurrency\t%s:%d\t%s\n", severity, FILENAME, FNR, message }
+    FNR == 1 { depth = 0; nloops = 0; closure = 0 }
+    {
+      line = $0
+      sub(/\/\/.*$/, "", line)
+    }
+    line ~ /^[[:space:]]*for[[:space:]{]/ {
+      vars = ""
+      if (match(line, /for[[:space:]]+[A-Za-z_][A-Za-z0-9_]*([[:space:]]*,[[:space:]]*[A-Za-z_][A-Za-z0-9_]*)?[[:space:]]*:=/)) {
+        vars = substr(line, RSTART + 3, RLENGTH - 5)
+        gsub(/[[:space:]]/, "", vars)
+      }
+      loops[++nloops] = depth
+      loopvars[nloops] = vars
+    }
+    line ~ /(^|[^A-Za-z0-9_])go[[:space:]]+func[[:space:]]*\([[:space:]]*\)/ && nloops > 0 && old_loopvar && loopvars[nloops] != "" {
+      closure = depth + 1; captured = loopvars[nloops]; reported = 0
+    }
+    closure && !reported && depth >= closure - 1 {
+      n = split(captured, names, ",")
+      for (i = 1; i <= n; i++) {
+        if (names[i] != "_" && line ~ ("(^|[^A-Za-z0-9_.])" names[i] "([^A-Za-z0-9_]|$)") && line !~ /go[[:space:]]+func/) {
+          report("critical", "goroutine captures loop variable " names[i] "; pass it as an argument (loop variables are shared before Go 1.22)")
+          reported = 1
+          break
+        }
+      }
+    }
+    line ~ /time\.After\(/ && nloops > 0 { report("minor", "time.After in a loop allocates a timer per iteration that is not released until it fires; reuse a time.Timer") }
+    line ~ /go[[:space:]]+func/ { in_go = depth + 1 }
+    in_go && line ~ /[A-Za-z_]*[wW][gG][A-Za-z_]*\.Add\(/ && depth >= in_go - 1 && line !~ /go[[:space:]]+func/ {
+      report("major", "WaitGroup.Add inside the goroutine races with Wait; call Add before starting it")
+    }
+    line ~ /func[^{]*[[:space:]][A-Za-z_]+[[:space:]]+sync\.(WaitGroup|Mutex|RWMutex)[,)]/ {
+      report("critical", "sync value passed by copy; pass a pointer")
+    }
+    line ~ /^var[[:space:]]+[A-Za-z_][A-Za-z0-9_]*[[:space:]]*(=[[:space:]]*(make\(map|map\[)|map\[)/ { shared[FILENAME] = shared[FILENAME] " " FNR }
+    line ~ /sync\.(RW)?Mutex|sync\.Map/ { locked[FILENAME] = 1 }
+    line ~ /(^|[^A-Za-z0-9_])go[[:space:]]/ { spawns[FILENAME] = 1 }
+    match(line, /[A-Za-z_][A-Za-z0-9_]*[[:space:]]*:?=[[:space:]]*make\(chan /) {
+      name = substr(line, RSTART); sub(/[[:space:]]*:?=.*/, "", name); chans[FILENAME, name] = FNR; chanfiles[FILENAME] = 1
+    }
+    match(line, /close\([A-Za-z_][A-Za-z0-9_.]*\)/) { c = substr(line, RSTART + 6, RLENGTH - 7); sub(/^.*\./, "", c); closed[FILENAME, c] = 1 }
+    match(line, /range[[:space:]]+[A-Za-z_][A-Za-z0-9_]*[[:space:]]*\{/) { r = substr(line, RSTART + 5); gsub(/[[:space:]{]/, "", r); ranged[FILENAME, r] = FNR }
+    {
+      opened = gsub(/{/, "{", line); closedb = gsub(/}/, "}", line)
+      depth += opened - closedb
+      while (nloops > 0 && depth <= loops[nloops] && closedb > 0) nloops--
+      if (closure && depth < closure) closure = 0
+      if (in_go && depth < in_go) in_go = 0
+    }
+    END {
+      for (f in shared) {
+        if (spawns[f] && !locked[f]) {
+          n = split(shared[f], lines, " ")
+          for (i = 1; i <= n; i++) printf "major\tconcurrency\t%s:%d\tpackage-level map used in a file that starts goroutines without a mutex; guard it with sync.Mutex or use sync.Map\n", f, lines[i]
+        }
+      }
+      for (key in ranged) {
+        split(key, parts, SUBSEP)
+        if (((parts[1], parts[2]) in chans) && !((parts[1], parts[2]) in closed))
+          printf "major\tconcurrency\t%s:%d\tranging over channel %s that is never closed in this file; the loop never ends\n", parts[1], ranged[key], parts[2]
+      }
+    }
+  ' "$@"
+  has_go || return 0
+  local module prefix file root="$PWD/"
+  while read -r module; do
+    prefix=""
+    [ "$module" = "." ] || prefix="$module/"
+    mapfile -t pkgs < <(for file in "$@"; do
+        [ "$(module_of <<<"$file")" != "$module" ] || echo "./$(dirname "${file#"$prefix"}")"
+      done | sort -u)
+    [ "${#pkgs[@]}" -gt 0 ] || continue
+    (cd "$module" && go vet "${pkgs[@]}" 2>&1) | grep -iE '^[^ ]+\.go:[0-9]+:.*(lock|loop variable|goroutine|WaitGroup|cancel|atomic)' |
+      sed -E "s|^\./||; s|^|$prefix|; s/^([^:]+:[0-9]+)(:[0-9]+)?: (.*)$/major\tconcurrency\t\1\tgo vet: \3/" || true
+    if [ "$RACE" -eq 1 ] && [ "$(go env CGO_ENABLED)" = "1" ]; then
+      (cd "$module" && limited timeout -k 30s "$VERIFY_TIMEOUT" go test -race -count=1 "${pkgs[@]}" 2>&1) | awk -v root="$root" '
+        /^WARNING: DATA RACE/ { race = 1; next }
+        race && index($1, root) == 1 && $1 ~ /\.go:[0-9]+$/ {
+          printf "critical\tconcurrency\t%s\tdata race reported by go test -race\n", substr($1, length(root) + 1)
+          race = 0
+        }' | sort -u || true
+    fi
+  done < <(go_modules)
+}
+
+# context_callers prints how many call sites of Go function $1 sit in
+# functions that already receive a context, as "<with ctx> <total>".
+context_callers() {
+  local file line total=0 with=0
+  while IFS=: read -r file line _; do
+    total=$((total + 1))
+    if awk -v stop="$line" 'NR <= stop && /^func / { sig = $0 } NR == stop { exit } END { exit !(sig ~ /context\.Context|\*http\.Request/) }' "$file"; then
+      with=$((with + 1))
+    fi
+  done < <(git grep -nE "(^|[^A-Za-z0-9_])$1\\(" -- '*.go' ':!*_test.go' | grep -vE ":func (\\([^)]*\\) )?$1\\(" || true)
+  echo "$with $total"
+}
+
+# context_review prints findings for Go code that drops or lacks a context:
+# context.Background or TODO outside main and init (with how many callers
+# could pass theirs), I/O in functions without a context parameter with a
+# suggested signature, and outbound HTTP calls without a timeout.
+context_review() {
+  local severity category location message fn with total
+  while IFS=$'\t' read -r severity category location message fn; do
+    if [ -n "$fn" ]; then
+      read -r with total < <(context_callers "${fn#callers:}")
+      [ "$total" -eq 0 ] || message="$message; $with of its $total call sites already have a ctx to pass"
+    fi
+    printf '%s\t%s\t%s\t%s\n' "$severity" "$category" "$location" "$message"
+  done < <(awk '
+    function report(severity, message) { printf "%s\tcontext\t%s:%d\t%s\n", severity, FILENAME, FNR, message }
+    {
+      line = $0
+      sub(/\/\/.*$/, "", line)
+    }
+    /^func / {
+      fn = line; sub(/^func[[:space:]]+(\([^)]*\)[[:space:]]*)?/, "", fn); sub(/\(.*/, "", fn)
+      signature = line; sub(/[[:space:]]*\{[[:space:]]*$/, "", signature)
+      hasctx = line ~ /context\.Context/ || line ~ /\*http\.Request/
+      io_reported = 0
+    }
+    line ~ /context\.(Background|TODO)\(\)/ && fn != "main" && fn != "init" && fn != "" {
+      report("major", "context." (line ~ /TODO/ ? "TODO" : "Background") "() in " fn " ignores cancellation and deadlines from the caller; take ctx context.Context as the first parameter" (hasctx ? " and use the one it has" : "") "\tcallers:" fn)
+    }
+    line ~ /(http\.(Get|Post|Head|PostForm)\(|http\.NewRequest\(|\.(Query|QueryRow|Exec|Prepare|Begin)\(|net\.Dial\(|\.Do\(req\))/ && !hasctx && !io_reported && fn != "main" && fn != "" {
+      suggested = signature
+      sub(/\(/, "(ctx context.Context, ", suggested); sub(/\(ctx context\.Context, \)/, "(ctx context.Context)", suggested)
+      if (signature ~ /^func \(/) { suggested = signature; sub(/\)[[:space:]]*[A-Za-z_][A-Za-z0-9_]*\(/, "&ctx context.Context, ", suggested); sub(/ctx context\.Context, \)/, "ctx context.Context)", suggested) }
+      report("major", "I/O in " fn " without a context; use the Context variant and change the signature to `" suggested "`")
+      io_reported = 1
+    }
+    line ~ /http\.(Get|Post|Head|PostForm)\(|http\.DefaultClient/ { report("major", "the default HTTP client has no timeout; use a client with Timeout set or a request with a context deadline") }
+    line ~ /http\.Client\{[^}]*\}/ && line !~ /Timeout/ { report("minor", "http.Client without Timeout; outbound calls can hang forever") }
+  ' "$@")
+}
+
+# repo_logger prints the logging package most used by the repository's Go
+# code: slog, zap, logrus, zerolog or log.
+repo_logger() {
+  local name pattern count best="log" best_count=0
+  for name in slog zap logrus zerolog log; do
+    case "$name" in
+      log) pattern='(^|[^A-Za-z0-9_.])log\.(Print|Fatal|Panic)' ;;
+      *) pattern="(^|[^A-Za-z0-9_])$name\\.[A-Z]" ;;
+    esac
+    count=$(git grep -hcE "$pattern" -- '*.go' ':!*_test.go' 2>/dev/null | awk '{ n += $1 } END { print n + 0 }')
+    if [ "$count" -gt "$best_count" ]; then
+      best="$name"
+      best_count="$count"
+    fi
+  done
+  echo "$best"
+}
+
+# logging_review prints findings for log calls in the given Go files: secrets
+# and personal data (by name, or matched by the redaction patterns), errors
+# logged without context or at info level, fmt.Print in library code and
+# loggers other than the repository's own (LOGGER, or detected).
+logging_review() {
+  local logger="${LOGGER:-$(repo_logger)}" file number text
+  awk -v logger="$logger" '
+    function report(severity, message) { printf "%s\tlogging\t%s:%d\t%s\n", severity, FILENAME, FNR, message }
+    FNR == 1 { is_main = 0 }
+    /^package main$/ { is_main = 1 }
+    {
+      line = $0
+      sub(/\/\/.*$/, "", line)
+      logcall = line ~ /(^|[^A-Za-z0-9_])(log|slog|logger|logrus|zap|zerolog|[a-z]*[lL]og(ger)?)\.[A-Za-z]+\(/ || line ~ /\.(Info|Warn|Error|Debug|Fatal|Panic)[fw]?\(/
+    }
+    logcall && tolower(line) ~ /(password|passwd|secret|token|api_?key|authorization|credential|ssn|credit_?card|card_?number|email|phone)/ {
+      report("critical", "log call may write a secret or personal data; drop the value or log a redacted form")
+    }
+    logcall && line ~ /\.(Print|Println|Error|Errorf|Warn|Fatal|Fatalln)\([[:space:]]*err(\.Error\(\))?[[:space:]]*\)/ {
+      report("minor", "error logged without context; say what failed, for example log.Printf(\"loading config: %v\", err)")
+    }
+    logcall && line ~ /\.(Info|Debug|Infof|Debugf|Infow|Debugw)\(/ && line ~ /[^A-Za-z0-9_]err[^A-Za-z0-9_]/ {
+      report("minor", "error logged at info or debug level; use the error or warn level")
+    }
+    !is_main && FILENAME !~ /_test\.go$/ && line ~ /fmt\.Print(ln|f)?\(/ {
+      report("minor", "fmt.Print in library code writes to stdout; use the " logger " logger or return the information")
+    }
+    logger != "log" && line ~ /(^|[^A-Za-z0-9_.])log\.(Print|Printf|Println|Fatal|Fatalf|Panic)\(/ {
+      report("minor", "standard log package used; this repository logs with " logger)
+    }
+    logger != "slog" && line ~ /(^|[^A-Za-z0-9_])slog\.[A-Z]/ { report("minor", "slog used; this repository logs with " logger) }
+    logger != "zap" && line ~ /(^|[^A-Za-z0-9_])zap\.[A-Z]/ { report("minor", "zap used; this repository logs with " logger) }
+    logger != "logrus" && line ~ /(^|[^A-Za-z0-9_])logrus\.[A-Z]/ { report("minor", "logrus used; this repository logs with " logger) }
+    logger != "zerolog" && line ~ /(^|[^A-Za-z0-9_])zerolog\.[A-Z]/ { report("minor", "zerolog used; this repository logs with " logger) }
+  ' "$@"
+  for file in "$@"; do
+    while IFS=: read -r number text; do
+      [ "$(redact <<<"$text")" = "$text" ] ||
+        printf 'critical\tlogging\t%s:%s\tlog call contains a value matched by the redaction patterns\n' "$file" "$number"
+    done < <(grep -nE '[lL]og(ger)?\.[A-Za-z]+\(|\.(Info|Warn|Error|Debug)[fw]?\(' "$file" || true)
+  done
+}
+
+# errors_review prints findings for Go error handling in the given files:
+# errors discarded with _ or by calling a function that returns one as a
+# statement, fmt.Errorf with an error argument but no %w, and errors compared
+# with == or != instead of errors.Is. Error-related reports from go vet on the
+# changed packages are added to the same category.
+errors_review() {
+  awk '
+    function report(severity, message) { printf "%s\terrors\t%s:%d\t%s\n", severity, FILENAME, FNR, message }
+    {
+      line = $0
+      sub(/\/\/.*$/, "", line)
+    }
+    match(line, /^[[:space:]]*_[[:space:]]*=[[:space:]]*[A-Za-z_][A-Za-z0-9_.]*\(/) {
+      call = substr(line, RSTART, RLENGTH - 1); sub(/^[[:space:]]*_[[:space:]]*=[[:space:]]*/, "", call)
+      if (call !~ /\.$/) report("major", "error returned by " call " is discarded; handle it or return it wrapped with fmt.Errorf(\"...: %w\", err)")
+    }
+    match(line, /^[[:space:]]*[A-Za-z_][A-Za-z0-9_]*[[:space:]]*,[[:space:]]*_[[:space:]]*:?=[[:space:]]*(strconv|json|os|io|ioutil|filepath|url|time|hex|base64)\.[A-Z][A-Za-z0-9]*\(/) {
+      call = substr(line, RSTART, RLENGTH - 1); sub(/^.*=[[:space:]]*/, "", call)
+      report("major", "error returned by " call " is discarded with _; check it before using the result")
+    }
+    match(line, /^[[:space:]]*(json\.Unmarshal|os\.(Remove|RemoveAll|Mkdir|MkdirAll|WriteFile|Rename|Setenv|Chmod|Chdir)|[A-Za-z_][A-Za-z0-9_.]*\.(Encode|Decode|Exec|Flush|Commit|Rollback|Unmarshal))\(.*\)[[:space:]]*$/) {
+      call = line; sub(/^[[:space:]]*/, "", call); sub(/\(.*/, "", call)
+      report("major", "error returned by " call " is ignored; check it")
+    }
+    line ~ /fmt\.Errorf\(/ && line !~ /%w/ && line ~ /,[[:space:]]*([A-Za-z_][A-Za-z0-9_.]*)?[eE]rr[A-Za-z0-9_]*[[:space:]]*[,)]/ {
+      report("minor", "fmt.Errorf formats an error without %w, so callers cannot match it with errors.Is or errors.As; use %w instead of %v")
+    }
+    match(line, /[A-Za-z_][A-Za-z0-9_.]*[[:space:]]*[!=]=[[:space:]]*(([A-Za-z_][A-Za-z0-9_]*\.)?Err[A-Z][A-Za-z0-9_]*|io\.EOF)([^A-Za-z0-9_]|$)/) {
+      cmp = substr(line, RSTART, RLENGTH); sub(/[^A-Za-z0-9_.]$/, "", cmp)
+      lhs = cmp; sub(/[[:space:]]*[!=]=.*/, "", lhs)
+      rhs = cmp; sub(/^.*[!=]=[[:space:]]*/, "", rhs)
+      if (lhs ~ /[eE]rr/) report("major", "error compared with " (cmp ~ /!=/ ? "!=" : "==") " misses wrapped errors; use " (cmp ~ /!=/ ? "!" : "") "errors.Is(" lhs ", " rhs ")")
+    }
+  ' "$@"
+  has_go || return 0
+  local module prefix file pkgs=()
+  while read -r module; do
+    prefix=""
+    [ "$module" = "." ] || prefix="$module/"
+    mapfile -t pkgs < <(for file in "$@"; do
+        [ "$(module_of <<<"$file")" != "$module" ] || echo "./$(dirname "${file#"$prefix"}")"
+      done | sort -u)
+    [ "${#pkgs[@]}" -gt 0 ] || continue
+    (cd "$module" && go vet "${pkgs[@]}" 2>&1) | grep -E '^[^ ]+\.go:[0-9]+:.*(errors\.As|%w|Errorf|result of .* call not used|unusedresult)' |
+      sed -E "s|^\./||; s|^|$prefix|; s/^([^:]+:[0-9]+)(:[0-9]+)?: (.*)$/major\terrors\t\1\tgo vet: \3/" || true
+  done < <(go_modules)
+}
+
+# flag_framework prints the feature flag framework the repository uses:
+# LaunchDarkly, OpenFeature, Unleash, Flagsmith or GrowthBook from its
+# dependencies, or "config flags" for homegrown flags.
+flag_framework() {
+  local deps
+  deps=$(cat go.mod package.json requirements*.txt pyproject.toml 2>/dev/null || true)
+  case "$deps" in
+    *launchdarkly*) echo "LaunchDarkly" ;;
+    *open-feature*|*openfeature*) echo "OpenFeature" ;;
+    *unleash*) echo "Unleash" ;;
+    *flagsmith*) echo "Flagsmith" ;;
+    *growthbook*) echo "GrowthBook" ;;
+    *)
+      if git grep -qE 'FeatureFlag|featureFlag|feature_flag|FEATURE_[A-Z0-9_]+' -- ':!*.md' 2>/dev/null; then
+        echo "config flags"
+      fi
+      ;;
+  esac
+}
+
+# flag_keys prints "<line>\t<flag key>" for the feature flags evaluated in
+# file $1.
+flag_keys() {
+  grep -noE "(BoolVariation|StringVariation|IntVariation|JSONVariation|Variation|BooleanValue|GetBooleanValue|StringValue|GetStringValue|IsEnabled|isEnabled|IsOn|isOn|hasFeature|getFeatureValue)\([^\"')]*[\"'][A-Za-z0-9_.:-]+[\"']|FEATURE_[A-Z0-9_]+" "$1" |
+    sed -E "s/^([0-9]+):.*[\"']([A-Za-z0-9_.:-]+)[\"']$/\1\t\2/; s/^([0-9]+):(FEATURE_[A-Z0-9_]+)$/\1\t\2/" || true
+}
+
+# flag_examples prints a few places where the repository evaluates feature
+# flags, for the generation prompt.
+flag_examples() {
+  git grep -nE "(BoolVariation|BooleanValue|GetBooleanValue|IsEnabled|isEnabled|IsOn|isOn|hasFeature)\(|FEATURE_[A-Z0-9_]+" -- ':!*.md' ':!*_test.go' 2>/dev/null |
+    head -n 5 | cut -c1-200 || true
+}
+
+# flags_review prints findings for the feature flags evaluated in the given
+# files that were introduced more than FLAG_STALE_DAYS ago, since they are
+# usually fully rolled out and only left as dead branches.
+flags_review() {
+  local file number key introduced age
+  # A shallow boundary commit looks like it introduced every flag, so the
+  # history has to reach back past the staleness threshold.
+  [ "$#" -eq 0 ] || deepen_until "feature flag ages" history_covers "$((FLAG_STALE_DAYS + 1)) days ago"
+  for file in "$@"; do
+    [ -f "$file" ] || continue
+    while IFS=$'\t' read -r number key; do
+      introduced=$(git log --reverse --format=%ct -S"$key" -- . 2>/dev/null | head -n 1)
+      [ -n "$introduced" ] || continue
+      age=$((($(date +%s) - introduced) / 86400))
+      [ "$age" -gt "$FLAG_STALE_DAYS" ] || continue
+      printf 'minor\tflags\t%s:%s\tfeature flag %s was introduced %d days ago; if it is fully rolled out, remove it and its dead branch\n' \
+        "$file" "$number" "$key" "$age"
+    done < <(flag_keys "$file" | sort -u -k2,2)
+  done
+}
+
+# test_files prints the test files among the paths on stdin: Go _test.go
+# files, JS/TS .test and .spec files and Python test_*.py and *_test.py files.
+test_files() {
+  grep -E '(_test\.go|\.(test|spec)\.[cm]?[jt]sx?|(^|/)test_[^/]*\.py|_test\.py)$' || true
+}
+
+# test_quality_review prints findings for the given test files: tests without
+# assertions, sleeps, package- or module-level fixtures that tests modify,
+# tests that set up more than TEST_MAX_MOCKS mocks, and commented-out tests.
+# Each message ends with the fix to make.
+test_quality_review() {
+  awk -v max_mocks="$TEST_MAX_MOCKS" '
+    function report(severity, message) { printf "%s\ttests\t%s:%d\t%s\n", severity, FILENAME, FNR, message }
+    function finish() {
+      if (!intest) return
+      if (asserts == 0) {
+        printf "major\ttests\t%s:%d\t%s has no assertions and only fails if it crashes; %s\n", testfile, testline, testname,
+          (testlang == "go" ? "check the results with t.Errorf or t.Fatalf" : testlang == "py" ? "assert on the results" : "check the results with expect or assert")
+      }
+      if (mocks > max_mocks) {
+        printf "minor\ttests\t%s:%d\t%s sets up %d mocks and is likely to test the implementation rather than the behavior; use a fake or test through a narrower interface\n", testfile, testline, testname, mocks
+      }
+      intest = 0
+    }
+    function mutates(name, line) {
+      return line ~ ("(^|[^A-Za-z0-9_.])" name "(\\[[^]]*\\]|\\.[A-Za-z_][A-Za-z0-9_]*)*[[:space:]]*([-+*/]?=[^=]|\\+\\+|--)") ||
+        line ~ ("(^|[^A-Za-z0-9_.])" name "\\.(append|extend|update|add|pop|clear|insert|remove|setdefault|push|splice|set|delete|shift|unshift)\\(")
+    }
+    FNR == 1 {
+      finish()
+      lang = FILENAME ~ /\.go$/ ? "go" : FILENAME ~ /\.py$/ ? "py" : "js"
+      depth = 0; invar = 0; pending = 0
+    }
+    {
+      line = $0
+      indent = match(line, /[^[:space:]]/) - 1
+    }
+    lang == "go" && line ~ /^[[:space:]]*\/\/[[:space:]]*func[[:space:]]+(Test|Benchmark|Fuzz)[A-Z0-9_]/ ||
+      lang == "js" && line ~ /^[[:space:]]*\/\/[[:space:]]*(it|test|describe)(\.[a-z]+)?\(/ ||
+      lang == "py" && line ~ /^[[:space:]]*#[[:space:]]*def[[:space:]]+test_/ {
+      report("minor", "commented-out test; delete it, or skip it with " (lang == "go" ? "t.Skip(\"reason\")" : lang == "py" ? "@pytest.mark.skip(reason=...)" : "it.skip") " so it stays visible")
+    }
+    lang == "go" { sub(/\/\/.*$/, "", line) }
+    lang == "py" { sub(/#.*$/, "", line) }
+    lang == "js" { sub(/(^|[[:space:]])\/\/.*$/, "", line) }
+    lang == "py" && intest && line ~ /[^[:space:]]/ && indent <= testindent { finish() }
+    lang == "go" && depth == 0 && match(line, /^var[[:space:]]+[A-Za-z_][A-Za-z0-9_]*/) {
+      name = substr(line, RSTART + 4, RLENGTH - 4); gsub(/[[:space:]]/, "", name)
+      globals[FILENAME, name] = FNR; names[FILENAME] = names[FILENAME] " " name
+    }
+    lang == "go" && depth == 0 && line ~ /^var[[:space:]]*\([[:space:]]*$/ { invar = 1; next }
+    invar && line ~ /^\)/ { invar = 0; next }
+    invar && match(line, /^[[:space:]]+[A-Za-z_][A-Za-z0-9_]*/) {
+      name = substr(line, RSTART, RLENGTH); gsub(/[[:space:]]/, "", name)
+      globals[FILENAME, name] = FNR; names[FILENAME] = names[FILENAME] " " name
+      next
+    }
+    lang == "js" && !intest && match(line, /^[[:space:]]*((let|var)[[:space:]]+[A-Za-z_$][A-Za-z0-9_$]*|const[[:space:]]+[A-Za-z_$][A-Za-z0-9_$]*[[:space:]]*=[[:space:]]*(\[|\{|new (Map|Set|Array)\())/) {
+      name = substr(line, RSTART, RLENGTH); sub(/^[[:space:]]*(let|var|const)[[:space:]]+/, "", name); sub(/[[:space:]=].*$/, "", name)
+      globals[FILENAME, name] = FNR; names[FILENAME] = names[FILENAME] " " name
+    }
+    lang == "py" && indent == 0 && match(line, /^[A-Za-z_][A-Za-z0-9_]*[[:space:]]*=[[:space:]]*(\[|\{|dict\(|list\(|set\()/) {
+      name = substr(line, RSTART, RLENGTH); sub(/[[:space:]]*=.*$/, "", name)
+      globals[FILENAME, name] = FNR; names[FILENAME] = names[FILENAME] " " name
+    }
+    lang == "py" && line ~ /^[[:space:]]*@(mock\.)?patch/ { pending++ }
+    !intest && (lang == "go" && match(line, /^func[[:space:]]+Test[A-Z0-9_][A-Za-z0-9_]*\([A-Za-z_]+[[:space:]]+\*testing\.T\)/) ||
+      lang == "js" && match(line, /(^|[^A-Za-z0-9_.])(it|test)\([[:space:]]*["'\''`][^"'\''`]*/) ||
+      lang == "py" && match(line, /^[[:space:]]*(async[[:space:]]+)?def[[:space:]]+test_[A-Za-z0-9_]*/)) {
+      testname = substr(line, RSTART, RLENGTH)
+      if (lang == "go") { sub(/^func[[:space:]]+/, "", testname); sub(/\(.*/, "", testname) }
+      else if (lang == "py") { sub(/^.*def[[:space:]]+/, "", testname) }
+      else { sub(/^.*(it|test)\([[:space:]]*./, "", testname); testname = "test \"" testname "\"" }
+      intest = 1; asserts = 0; mocks = (lang == "py" ? pending : 0)
+      testfile = FILENAME; testline = FNR; testdepth = depth; testindent = indent; testlang = lang
+    }
+    lang == "py" && line ~ /[^[:space:]]/ && line !~ /^[[:space:]]*@/ { pending = 0 }
+    intest {
+      if (lang == "go" && (line ~ /[^A-Za-z0-9_](t|tt)\.(Error|Errorf|Fatal|Fatalf|Fail|FailNow)\(/ || line ~ /(assert|require|is|qt|gomega|Expect|cmp)\.[A-Z]/ ||
+          line ~ /Expect\(/ || line ~ /[A-Za-z0-9_]\((t|tt)[,)]/ || line ~ /\.Run\(/ || line ~ /\.(AssertExpectations|Finish)\(/) ||
+        lang == "js" && (line ~ /expect(\.[a-zA-Z]+)?\(|assert[.(]|\.should[.(]|\.(to|rejects|resolves)\./ || line ~ /\.toMatch/) ||
+        lang == "py" && (line ~ /(^|[^A-Za-z0-9_])assert([^A-Za-z0-9_]|$)|self\.(assert|fail)|pytest\.(raises|fail|warns)|\.assert_[a-z_]*called/)) asserts++
+      if (line ~ /\.EXPECT\(\)|\.On\("|gomock\.|jest\.(fn|mock|spyOn)\(|vi\.(fn|mock|spyOn)\(|sinon\.(stub|mock|spy)\(|(^|[^A-Za-z0-9_])(patch|patch\.object)\(|(Magic)?Mock\(|mocker\.patch/) mocks++
+      if (lang == "go" && line ~ /time\.Sleep\(/) report("minor", "sleep in a test makes it slow and flaky; wait for the condition with a channel, a polling helper such as require.Eventually, or an injected clock")
+      if (lang == "js" && line ~ /(^|[^A-Za-z0-9_.])(setTimeout|sleep|delay)\(|waitForTimeout\(/) report("minor", "sleep in a test makes it slow and flaky; use fake timers (jest.useFakeTimers, vi.useFakeTimers) or wait for the condition with waitFor")
+      if (lang == "py" && line ~ /(time|asyncio)\.sleep\(/) report("minor", "sleep in a test makes it slow and flaky; poll for the condition or freeze the clock (freezegun, time-machine)")
+      n = split(names[FILENAME], list, " ")
+      for (i = 1; i <= n; i++) {
+        if (!((FILENAME, list[i]) in flagged) && mutates(list[i], line)) {
+          flagged[FILENAME, list[i]] = 1
+          printf "major\ttests\t%s:%d\t%s %s is modified by %s, so tests share state and depend on their order; create it inside each test or in a setup helper\n",
+            FILENAME, globals[FILENAME, list[i]], (lang == "go" ? "package-level variable" : lang == "py" ? "module-level variable" : "shared variable"), list[i], testname
+        }
+      }
+    }
+    lang != "py" {
+      opened = gsub(/{/, "{", line); closed = gsub(/}/, "}", line)
+      if (lang == "js") { opened += gsub(/\(/, "(", line); closed += gsub(/\)/, ")", line) }
+      depth += opened - closed
+      if (intest && depth <= testdepth) finish()
+    }
+    END { finish() }
+  ' "$@"
+}
+
+# sibling_tests prints the test files that exist at HEAD for source file $1:
+# foo_test.go for foo.go, foo.test.ts, foo.spec.ts and __tests__/foo.test.ts
+# for foo.ts, and test_foo.py, tests/test_foo.py and foo_test.py for foo.py.
+sibling_tests() {
+  local dir name ext
+  dir=$(dirname "$1")
+  name=$(basename "${1%.*}")
+  ext="${1##*.}"
+  case "$ext" in
+    go) echo "$dir/${name}_test.go" ;;
+    js|jsx|ts|tsx|mjs) printf '%s\n' "$dir/$name.test.$ext" "$dir/$name.spec.$ext" "$dir/__tests__/$name.test.$ext" ;;
+    py) printf '%s\n' "$dir/test_$name.py" "$dir/tests/test_$name.py" "$dir/${name}_test.py" ;;
+  esac | sed 's|^\./||' | while IFS= read -r path; do
+    [ ! -f "$path" ] || echo "$path"
+  done
+}
+
+# obsolete_tests finds the tests left behind by code removed or renamed between
+# $1 and HEAD: test files of deleted or renamed source files, tests named after
+# a deleted function or type, and other test references to it. A function or
+# type counts as deleted when it is no longer declared anywhere, going by the
+# symbol index for the files the change left alone and by the changed files
+# themselves, and as renamed when its file lost exactly that symbol and gained
+# one new symbol of the same kind. The entries are written to
+# obsolete-tests.jsonl in the run directory with a confidence (high, medium or
+# low) and printed as findings.
+obsolete_tests() {
+  local base="$1" tmp status path new sibling target kind name replacement file line text confidence
+  tmp=$(mktemp -d)
+  touch "$tmp/.before" "$tmp/.after" "$tmp/.files" "$tmp/.changed"
+  update_index
+  while IFS=$'\t' read -r status path new; do
+    printf '%s\n' "$path" ${new:+"$new"} >>"$tmp/.changed"
+    [ -n "$path" ] && [ -z "$(test_files <<<"$path")" ] || continue
+    case "$status" in
+      D|M|R*) ;;
+      *) continue ;;
+    esac
+    mkdir -p "$tmp/$(dirname "$path")"
+    git show "$base:$path" >"$tmp/$path" 2>/dev/null || continue
+    (cd "$tmp" && file_symbols "$path") | awk -F'\t' -v OFS='\t' -v new="${new:-$path}" '{ $1 = new; print }' >>"$tmp/.before"
+    [ ! -f "${new:-$path}" ] || file_symbols "${new:-$path}" >>"$tmp/.after"
+    case "$status" in
+      D)
+        while IFS= read -r sibling; do
+          echo "$sibling" >>"$tmp/.files"
+          printf '%s\t1\t%s\thigh\ttests %s, which this change deleted\t\n' "$sibling" "$path" "$path"
+        done < <(sibling_tests "$path")
+        ;;
+      R*)
+        while IFS= read -r sibling; do
+          target=$(sibling_tests "$new" | head -n 1)
+          [ -z "$target" ] || continue
+          echo "$sibling" >>"$tmp/.files"
+          printf '%s\t1\t%s\thigh\ttests %s, which this change renamed to %s; rename the test file to match\t%s\n' "$sibling" "$path" "$path" "$new" "$new"
+        done < <(sibling_tests "$path")
+        ;;
+    esac
+  done < <(git diff --name-status -M "$base...HEAD") >"$tmp/.entries"
+  awk -F'\t' -v OFS='\t' 'NR == FNR { after[$1 "\t" $4] = 1; next } $3 != "route" && !(($1 "\t" $4) in after) { print $1, $3, $4 }' \
+    "$tmp/.after" "$tmp/.before" | sort -u >"$tmp/.removed"
+  while IFS=$'\t' read -r path kind name; do
+    [ "${#name}" -ge 3 ] && [[ "$name" =~ ^[A-Za-z0-9_]+$ ]] || continue
+    ! awk -F'\t' -v name="$name" '
+      FNR == 1 { f++ }
+      f == 1 { changed[$0] = 1; next }
+      $4 == name && $3 != "route" && (f == 3 || !($1 in changed)) { found = 1; exit }
+      END { exit !found }' \
+      "$tmp/.changed" "$root_dir/.cca/index/symbols.tsv" "$tmp/.after" || continue
+    replacement=$(awk -F'\t' -v path="$path" -v kind="$kind" '
+      NR == FNR { if ($1 == path) before[$4] = 1; next }
+      $1 == path && $3 == kind && !($4 in before) { n++; name = $4 }
+      END { if (n == 1) print name }' "$tmp/.before" "$tmp/.after")
+    [ "$(awk -F'\t' -v path="$path" -v kind="$kind" '$1 == path && $2 == kind' "$tmp/.removed" | wc -l)" -eq 1 ] || replacement=""
+    while IFS=: read -r file line text; do
+      ! grep -qxF "$file" "$tmp/.files" || continue
+      if grep -qE "^[[:space:]]*(func[[:space:]]+Test_?$name[_(A-Z]|(async[[:space:]]+)?def[[:space:]]+test_$(tr '[:upper:]' '[:lower:]' <<<"$name")[_(]|(describe|it|test)\\([[:space:]]*[\"'\`]$name[\" .'\`])" <<<"$text"; then
+        confidence=high
+      elif [ "$(dirname "$file")" = "$(dirname "$path")" ] || [[ "$path" != *.go ]]; then
+        confidence=medium
+      else
+        confidence=low
+      fi
+      printf '%s\t%s\t%s\t%s\treferences %s %s, which this change %s\t%s\n' "$file" "$line" "$name" "$confidence" "$kind" "$name" \
+        "${replacement:+renamed to }${replacement:-deleted}" "$replacement"
+    done < <(git grep -nE "(^|[^A-Za-z0-9_])(Test_?|test_)?($name|$(tr '[:upper:]' '[:lower:]' <<<"$name"))([^A-Za-z0-9_]|$)" -- '*_test.go' '*.test.*' '*.spec.*' '*test_*.py' '*_test.py' 2>/dev/null || true)
+  done <"$tmp/.removed" >>"$tmp/.entries"
+  sort -t$'\t' -k1,1 -k2,2n -u "$tmp/.entries" | jq -Rc 'split("\t") |
+    {test: .[0], line: (.[1] | tonumber), reference: .[2], confidence: .[3], reason: .[4], replacement: (if .[5] == "" then null else .[5] end)}' \
+    >"$run_dir/obsolete-tests.jsonl"
+  rm -rf "$tmp"
+  jq -r '[(if .confidence == "high" then "major" elif .confidence == "medium" then "minor" else "info" end), "obsolete-test",
+    "\(.test):\(.line)", "\(.reason) (confidence: \(.confidence))" + (if (.reason | startswith("tests ")) and .replacement then ""
+      elif .replacement then "; update the test to use \(.replacement)" else "; delete the test or point it at the code that replaced it" end)] | @tsv' \
+    "$run_dir/obsolete-tests.jsonl"
+}
+
+# clean_obsolete_tests removes or updates the tests obsolete_tests reports with
+# high confidence for the change between $1 and HEAD, in a commit of its own so
+# reviewers can drop it: test files of deleted source files are removed, those
+# of renamed files are renamed along, and the backend deletes or updates tests
+# named after deleted or renamed functions. The commit is discarded when it
+# fails verification. obsolete_note is left for the pull request.
+clean_obsolete_tests() {
+  local entries test source replacement target files=() prompt_file result output handled='select(.reason | startswith("tests "))'
+  obsolete_tests "$1" >/dev/null
+  entries=$(jq -c 'select(.confidence == "high")' "$run_dir/obsolete-tests.jsonl")
+  if [ -z "$entries" ]; then
+    skip "obsolete test cleanup (none found)"
+    return
+  fi
+  while IFS=$'\t' read -r test source replacement; do
+    if [ -z "$replacement" ]; then
+      git rm -q -- "$test"
+    else
+      target="${test#"$(dirname "$source")/"}"
+      target="$(dirname "$replacement")/$(dirname "$target")/$(basename "$target" | sed "s|$(basename "${source%.*}")|$(basename "${replacement%.*}")|")"
+      target=$(sed 's|/\./|/|g; s|^\./||' <<<"$target")
+      mkdir -p "$(dirname "$target")"
+      git mv -- "$test" "$target"
+    fi
+  done < <(jq -r 'select(.reason | startswith("tests ")) | [.test, .reference, .replacement // ""] | @tsv' <<<"$entries")
+  mapfile -t files < <(jq -r 'select(.reason | startswith("references ")) | .test' <<<"$entries" | sort -u | while IFS= read -r test; do
+      [ ! -f "$test" ] || echo "$test"
+    done)
+  if [ "${#files[@]}" -gt 0 ]; then
+    prompt_file=$(mktemp)
+    cat >"$prompt_file" <<EOF21
+This change deleted or renamed code that these tests still exercise:
+$(jq -r 'select(.reason | startswith("references ")) | "- \(.test):\(.line): \(.reason)"' <<<"$entries")
+
+For each test, delete it when the code it tests is gone, or update it to the
+new name when the code was renamed. Leave every other test as it is.
+$(for file in "${files[@]}"; do context_file "$file"; done)
+
+Format as JSON:
+{
+  "files": {"path": "complete file content..."},
+  "summary": "one line per test deleted or updated"
+}
+EOF21
+    log "Cleaning up obsolete tests in ${#files[@]} files with $BACKEND..."
+    result=$(claude_chat "$prompt_file" "with-p")
+    rm "$prompt_file"
+    if check_changes "$result" && jq -e '.files | length > 0' <<<"$result" >/dev/null 2>&1; then
+      printf '%s\n' "$result" >"$run_dir/obsolete-tests-result.json"
+      apply_changes "$run_dir/obsolete-tests-result.json"
+      handled='.'
+    else
+      log "Backend did not return obsolete test changes" >&2
+    fi
+  fi
+  if git diff --quiet HEAD && git diff --cached --quiet; then
+    return
+  fi
+  format_changes
+  if output=$(run_verify full); then
+    git add -A
+    cca_commit -q -m "test: remove tests of code deleted for $title"
+    obsolete_note="Commit $(git rev-parse --short HEAD) removes or updates tests of code this change deleted or renamed. It is optional; revert it if it is not wanted:
+$(jq -r "$handled"' | "- `\(.test)`: \(.reason)"' <<<"$entries")"
+    log "Committed obsolete test cleanup"
+  else
+    git reset -q --hard HEAD
+    git clean -qfd
+    log "Obsolete test cleanup failed verification; discarded" >&2
+    printf '%s\n' "$output" | redact >"$run_dir/obsolete-tests-verify.log"
+  fi
+}
+
+# schema_files prints the Protobuf, OpenAPI and GraphQL schema files changed
+# between $1 and HEAD, with git diff filter $2 (default AMR).
+schema_files() {
+  git diff --name-only --diff-filter="${2:-AMR}" "$1...HEAD" |
+    grep -E '\.proto$|(^|/)(openapi|swagger)[^/]*\.(ya?ml|json)$|\.(graphqls?|gql)$' || true
+}
+
+# codegen_commands prints the commands that regenerate code from the
+# repository's schemas, one per line: CODEGEN_CMD when set, else a generate
+# target of the Makefile or script of package.json, else every generator
+# configured in the repository (buf.gen.yaml, go:generate directives running
+# a schema compiler, gqlgen, graphql-codegen and openapi-generator).
+codegen_commands() {
+  local file target
+  if [ -n "$CODEGEN_CMD" ]; then
+    echo "$CODEGEN_CMD"
+    return
+  fi
+  if [ -f Makefile ]; then
+    target=$(grep -oE '^(generate|codegen|gen|proto|protos)[[:space:]]*:' Makefile | head -n 1 | tr -d ' :')
+    if [ -n "$target" ]; then
+      echo "make $target"
+      return
+    fi
+  fi
+  if [ -f package.json ]; then
+    target=$(jq -r '.scripts // {} | keys[] | select(test("^(generate|codegen|gen)$"))' package.json 2>/dev/null | head -n 1)
+    if [ -n "$target" ]; then
+      echo "npm run $target"
+      return
+    fi
+  fi
+  git ls-files -- buf.gen.yaml '*/buf.gen.yaml' | while read -r file; do
+    echo "cd $(printf '%q' "$(dirname "$file")") && buf generate"
+  done
+  git grep -lE '^//go:generate .*(protoc|buf |oapi-codegen|openapi-generator|ogen|gqlgen)' -- '*.go' 2>/dev/null |
+    xargs -r -n1 dirname | sort -u | while read -r file; do
+      echo "go generate ./$(printf '%q' "$file")"
+    done
+  [ ! -f gqlgen.yml ] || echo "go run github.com/99designs/gqlgen generate"
+  for file in codegen.yml codegen.yaml codegen.ts; do
+    if [ -f "$file" ]; then
+      echo "npx graphql-codegen --config $file"
+      break
+    fi
+  done
+  [ ! -f openapitools.json ] || echo "npx @openapitools/openapi-generator-cli generate"
+}
+
+# regenerate_code reruns the code generators (see codegen_commands) when the
+# change since $1 touches schema files, and commits the regenerated files
+# separately once they pass verification. codegen_note is left for the pull
+# request.
+regenerate_code() {
+  local schemas commands cmd output
+  schemas=$(schema_files "$1")
+  [ -n "$schemas" ] || return 0
+  commands=$(codegen_commands)
+  if [ -z "$commands" ]; then
+    skip "code generation (no generator found for $(paste -sd' ' - <<<"$schemas"))"
+    codegen_note="Schema files changed, but no code generator was found; regenerate the code from them by hand if needed."
+    return
+  fi
+  : >"$run_dir/codegen.log"
+  while IFS= read -r cmd; do
+    log "Regenerating code: $cmd"
+    if ! limited timeout -k 30s "$VERIFY_TIMEOUT" "${VERIFY_RUNNER[@]}" bash -c "$cmd" >>"$run_dir/codegen.log" 2>&1; then
+      git reset -q --hard HEAD
+      git clean -qfd
+      log "Code generation failed; see $run_dir/codegen.log" >&2
+      codegen_note="Schema files changed, but \`$cmd\` failed; regenerate the code from them by hand."
+      return
+    fi
+  done <<<"$commands"
+  if [ -z "$(git status --porcelain)" ]; then
+    log "Generated code is up to date"
+    return
+  fi
+  if output=$(run_verify full); then
+    git add -A
+    cca_commit -q -m "chore: regenerate code from schemas changed for $title"
+    codegen_note="Commit $(git rev-parse --short HEAD) regenerates $(git diff --name-only HEAD~1 HEAD | wc -l | tr -d ' ') files from the changed schemas with:
+$(sed 's/^/- `/; s/$/`/' <<<"$commands")"
+    log "Committed regenerated code"
+  else
+    git reset -q --hard HEAD
+    git clean -qfd
+    log "Regenerated code failed verification; discarded" >&2
+    printf '%s\n' "$output" | redact >"$run_dir/codegen-verify.log"
+    codegen_note="Schema files changed, but the regenerated code failed verification and was left out; regenerate it by hand."
+  fi
+}
+
+# schema_breaks prints a finding for each breaking change to the schemas
+# changed between $1 and HEAD: Protobuf with buf breaking, OpenAPI with
+# oasdiff and GraphQL with graphql-inspector, each when it is installed.
+schema_breaks() {
+  local schemas git_dir dirs dir file old
+  schemas=$(schema_files "$1" AMRD)
+  [ -n "$schemas" ] || return 0
+  git_dir=$(git rev-parse --path-format=absolute --git-common-dir)
+  if grep -q '\.proto$' <<<"$schemas"; then
+    if ! command -v buf >/dev/null; then
+      log "buf not installed; skipping the Protobuf breaking change check" >&2
+    else
+      if [ -f buf.yaml ] || [ -f buf.work.yaml ]; then
+        dirs="."
+      else
+        dirs=$(git ls-files -- '*/buf.yaml' '*/buf.work.yaml' | xargs -r -n1 dirname | sort -u)
+      fi
+      while read -r dir; do
+        [ -n "$dir" ] || continue
+        buf breaking "$dir" --against "$git_dir#ref=$1$([ "$dir" = . ] || echo ",subdir=$dir")" --error-format text 2>&1 |
+          sed -E 's/^([^:]+:[0-9]+):[0-9]+:(.*)$/- `\1`:\2/' || true
+      done <<<"$dirs"
+    fi
+  fi
+  while read -r file; do
+    [ -n "$file" ] || continue
+    case "$file" in
+      *.proto) continue ;;
+    esac
+    git cat-file -e "$1:$file" 2>/dev/null || continue
+    old=$(mktemp --suffix=".${file##*.}")
+    git show "$1:$file" >"$old"
+    if [ ! -f "$file" ]; then
+      echo "- \`$file\`: schema removed"
+    elif [[ "$file" == *.graphql* || "$file" == *.gql ]]; then
+      if command -v graphql-inspector >/dev/null; then
+        graphql-inspector diff "$old" "$file" 2>&1 | grep '✖' | sed -E "s/^[[:space:]]*✖[[:space:]]*/- \`$(sed 's/[\/&]/\\&/g' <<<"$file")\`: /" || true
+      else
+        log "graphql-inspector not installed; skipping the GraphQL breaking change check of $file" >&2
+      fi
+    elif command -v oasdiff >/dev/null; then
+      oasdiff breaking "$old" "$file" --format json 2>/dev/null |
+        jq -r --arg file "$file" '.[]? | select(.level >= 3) | "- `\($file)` \(.operation // "") \(.path // ""): \(.text)"' || true
+    else
+      log "oasdiff not installed; skipping the OpenAPI breaking change check of $file" >&2
+    fi
+    rm -f "$old"
+  done <<<"$schemas"
+}
+
+# openapi_model prints the paths of OpenAPI document $1 as "path\t<path>" and
+# the properties of its schemas as "property\t<schema>\t<property>", reading
+# JSON with jq and YAML by its indentation.
+openapi_model() {
+  case "$1" in
+    *.json)
+      jq -r '(.paths // {} | keys[] | "path\t\(.)"),
+        ((.components.schemas // .definitions // {}) | to_entries[] | .key as $n | (.value.properties // {}) | keys[] | "property\t\($n)\t\(.)")' \
+        "$1" 2>/dev/null || true
+      ;;
+    *)
+      awk '
+        /^[[:space:]]*(#|$)/ { next }
+        {
+          match($0, /^ */); indent = RLENGTH
+          if (block >= 0 && indent > block) next
+          block = -1
+          line = substr($0, indent + 1)
+          if (line ~ /^- / || !match(line, /^("[^"]*"|\x27[^\x27]*\x27|[^:#]+):([[:space:]]|$)/)) next
+          key = substr(line, 1, RLENGTH); sub(/:[[:space:]]*$/, "", key); gsub(/^["\x27]|["\x27]$/, "", key)
+          while (depth > 0 && ind[depth] >= indent) depth--
+          k[++depth] = key; ind[depth] = indent
+          if (line ~ /:[[:space:]]*[|>][-+0-9]*[[:space:]]*$/) block = indent
+          if (depth == 2 && k[1] == "paths") print "path\t" key
+          if (depth == 5 && k[1] == "components" && k[2] == "schemas" && k[4] == "properties") print "property\t" k[3] "\t" key
+          if (depth == 4 && k[1] == "definitions" && k[3] == "properties") print "property\t" k[2] "\t" key
+        }
+        BEGIN { block = -1 }' "$1"
+      ;;
+  esac
+}
+
+# api_drift_review prints a finding for each place where the API clients and
+# servers in the repository disagree, for changes between $1 and HEAD: a
+# client call whose path matches no path of the OpenAPI document or server
+# route, a field of a Go or TypeScript type named after a schema that the
+# schema does not have, and, when the document changed, schema properties the
+# type lacks. Only drift in changed files, or all of it when the document
+# changed, is reported.
+api_drift_review() {
+  local spec model="" changed sources
+  changed=$(git diff --name-only --diff-filter=AM "$1...HEAD")
+  [ -n "$changed" ] || return 0
+  spec=$(openapi_spec)
+  [ -z "$spec" ] || model=$(openapi_model "$spec")
+  sources=$(git ls-files -- '*.go' '*.ts' '*.tsx' '*.js' '*.jsx' '*.mjs' '*.py' ':!*.d.ts' | sort)
+  sources=$(comm -23 <(cat <<<"$sources") <(test_files <<<"$sources" | sort))
+  [ -n "$sources" ] || return 0
+  model="$model" changed="$changed" xargs -d '\n' awk -v spec="$spec" -v spec_changed="$(grep -qxF "$spec" <<<"$changed" && echo 1)" '
+    function norm(p,  n, s, i, out) {
+      sub(/^(GET|POST|PUT|PATCH|DELETE|HEAD|OPTIONS)[[:space:]]+/, "", p)
+      gsub(/\$\{[^}]*\}|\{[^}]*\}|%[sdvq]/, "{}", p)
+      sub(/^[a-z]+:\/\/[^\/]*/, "", p); sub(/[?#].*$/, "", p)
+      if (substr(p, 1, 1) != "/") { i = index(p, "/"); if (!i) return ""; p = substr(p, i) }
+      n = split(p, s, "/"); out = ""
+      for (i = 1; i <= n; i++) {
+        if (s[i] == "") continue
+        if (s[i] ~ /^:/ || s[i] ~ /^\{\}/ || s[i] ~ /^<[^>]*>$/) s[i] = "{}"
+        out = out "/" s[i]
+      }
+      return out
+    }
+    function literal(line,  s) {
+      if (!match(line, /["\x27`][^"\x27`]*\/[^"\x27`]*["\x27`]/)) return ""
+      s = substr(line, RSTART + 1, RLENGTH - 2)
+      return norm(s)
+    }
+    function matches(a, b,  x, y, n, m, i, same) {
+      n = split(a, x, "/"); m = split(b, y, "/")
+      for (i = 0; i < n - 1 && i < m - 1; i++) {
+        if (x[n - i] == y[m - i] && x[n - i] != "{}") same = 1
+        else if (x[n - i] != "{}" && y[m - i] != "{}") return 0
+      }
+      return same
+    }
+    function finding(severity, file, line, message) {
+      printf "%s\tapi-drift\t%s:%d\t%s\n", severity, file, line, message
+    }
+    BEGIN {
+      n = split(ENVIRON["model"], m, "\n")
+      for (i = 1; i <= n; i++) {
+        split(m[i], f, "\t")
+        if (f[1] == "path") { p = norm(f[2]); if (p != "") server[p] = spec }
+        if (f[1] == "property") { schema[f[2]] = 1; props[f[2], f[3]] = 1 }
+      }
+      n = split(ENVIRON["changed"], c, "\n")
+      for (i = 1; i <= n; i++) changed[c[i]] = 1
+    }
+    FNR == 1 { file = FILENAME; go = file ~ /\.go$/; py = file ~ /\.py$/; type = "" }
+    {
+      if (go && /\.(HandleFunc|Handle|Get|Post|Put|Patch|Delete|GET|POST|PUT|PATCH|DELETE|Method|Route)\("/ && !/\.R\(\)/ ||
+          !go && !py && /(app|router|server|fastify)\.(get|post|put|patch|delete|all|route)\([[:space:]]*["\x27`]\// ||
+          py && /@[A-Za-z_]+\.(get|post|put|patch|delete|route|api_route)\([[:space:]]*["\x27]/) {
+        p = literal($0)
+        if (p != "") { server[p] = file; if (file in changed) server_changed = 1 }
+      } else if (go && /http\.(NewRequest(WithContext)?|Get|Post|Head)\(|\.R\(\)/ ||
+          !go && !py && /(fetch|axios(\.(get|post|put|patch|delete|request))?|(api|client|http)\.(get|post|put|patch|delete))\(/ ||
+          py && /(requests|httpx|session|client)\.(get|post|put|patch|delete|request)\(/) {
+        p = literal($0)
+        if (p != "" && p !~ /\.[A-Za-z0-9]+$/ && p !~ /^(\/\{\})+$/) { calls++; cpath[calls] = p; cfile[calls] = file; cline[calls] = FNR }
+      }
+      if (type == "" && !py) {
+        name = ""
+        if (go && match($0, /^type [A-Za-z0-9_]+ struct \{/)) { name = $2 }
+        else if (!go && match($0, /^[[:space:]]*(export[[:space:]]+)?(interface|type)[[:space:]]+[A-Za-z0-9_]+/)) {
+          name = substr($0, RSTART, RLENGTH); sub(/.*[[:space:]]/, "", name)
+        }
+        if (name in schema) { type = name; types++; tname[types] = name; tfile[types] = file; tline[types] = FNR; depth = 0; opened = 0 }
+      }
+      if (type != "") {
+        field = ""
+        if (depth == 1 && go && match($0, /json:"[^",]+/)) field = substr($0, RSTART + 6, RLENGTH - 6)
+        else if (depth == 1 && !go && match($0, /^[[:space:]]*(readonly[[:space:]]+)?["\x27]?[A-Za-z_$][A-Za-z0-9_$-]*["\x27]?\??[[:space:]]*:/)) {
+          field = substr($0, RSTART, RLENGTH); sub(/^[[:space:]]*(readonly[[:space:]]+)?/, "", field); gsub(/["\x27?:[:space:]]/, "", field)
+        }
+        if (field != "" && field != "-") { fields[types, field] = FNR; has[types] = has[types] " " field }
+        line = $0; o = gsub(/\{/, "", line); cl = gsub(/\}/, "", line); depth += o - cl
+        if (depth > 0) opened = 1
+        if (opened && depth <= 0) type = ""
+      }
+    }
+    END {
+      for (i = 1; i <= calls; i++) {
+        if (!(cfile[i] in changed) && !spec_changed && !server_changed) continue
+        found = 0; any = 0
+        for (p in server) { any = 1; if (matches(cpath[i], p)) { found = 1; break } }
+        if (any && !found) finding("major", cfile[i], cline[i], "calls `" cpath[i] "`, which matches no path in " (spec != "" ? spec " or " : "") "the server routes")
+      }
+      for (t = 1; t <= types; t++) {
+        if (!(tfile[t] in changed) && !spec_changed) continue
+        n = split(has[t], f, " ")
+        for (i = 1; i <= n; i++)
+          if (!((tname[t], f[i]) in props)) finding("major", tfile[t], fields[t, f[i]], "`" tname[t] "." f[i] "` is not a property of schema `" tname[t] "` in " spec)
+        if (!spec_changed || n == 0) continue
+        for (k in props) {
+          split(k, kk, SUBSEP)
+          if (kk[1] == tname[t] && !((t, kk[2]) in fields)) finding("major", tfile[t], tline[t], "`" tname[t] "` lacks property `" kk[2] "` of schema `" tname[t] "` in " spec)
+        }
+      }
+    }' <<<"$sources" | sort -u
+}
+
+# code_review runs the static checks listed in GO_CHECKS on the Go files
+# changed between $1 and HEAD, with FLAG_REVIEW=1 the feature flag check on all
+# changed files, with TEST_REVIEW=1 the test quality check on the changed test
+# files, unless OBSOLETE_TESTS=0, the tests left behind by deleted or
+# renamed code, with API_DRIFT=1 drift between API clients and servers and,
+# with LICENSE_HEADERS=1, added files missing the license header. It writes
+# the findings to findings.tsv in the run directory and leaves them in
+# code_findings as Markdown list items.
+code_review() {
+  local files=() go_files=() tests=() check findings=""
+  mapfile -t files < <(git diff --name-only --diff-filter=AM "$1...HEAD" -- ':!*_test.go' ':!*.test.*' ':!*.spec.*')
+  mapfile -t tests < <(git diff --name-only --diff-filter=AM "$1...HEAD" | test_files)
+  mapfile -t go_files < <(printf '%s\n' ${files[@]+"${files[@]}"} | grep '\.go$' || true)
+  if [ -z "$GO_CHECKS" ]; then
+    skip "Go code review checks"
+  elif [ "${#go_files[@]}" -eq 0 ]; then
+    skip "Go code review checks (no Go files changed)"
+  else
+    for check in $GO_CHECKS; do
+      if ! declare -F "${check}_review" >/dev/null; then
+        log "Unknown check $check in CCA_GO_CHECKS" >&2
+        continue
+      fi
+      findings+=$("${check}_review" "${go_files[@]}")$'\n'
+    done
+  fi
+  if [ "$FLAG_REVIEW" -eq 1 ] && [ "${#files[@]}" -gt 0 ] && [ -n "$(flag_framework)" ]; then
+    findings+=$(flags_review "${files[@]}")$'\n'
+  fi
+  if [ "$TEST_REVIEW" -eq 1 ] && [ "${#tests[@]}" -gt 0 ]; then
+    findings+=$(test_quality_review "${tests[@]}")$'\n'
+  fi
+  if [ "$OBSOLETE_TESTS" != "0" ]; then
+    findings+=$(obsolete_tests "$1")$'\n'
+  fi
+  if [ "$API_DRIFT" -eq 1 ]; then
+    findings+=$(api_drift_review "$1")$'\n'
+  fi
+  if [ "$LICENSE_HEADERS" -eq 1 ]; then
+    findings+=$(license_review "$1")$'\n'
+  fi
+  findings=$(grep -v '^$' <<<"$findings" | persona_weigh || true)
+  [ -n "$findings" ] || return 0
+  printf '%s\n' "$findings" >"$run_dir/findings.tsv"
+  jq -Rn --argjson v "$SCHEMA_VERSION" '{schema_version: $v,
+    findings: [inputs | split("\t") | {severity: .[0], category: .[1], location: .[2], message: .[3]}]}' \
+    <<<"$findings" >"$run_dir/findings.json"
+  check_artifact findings "$run_dir/findings.json"
+  code_findings=$(sort -t$'\t' -k2,2 -k3,3V <<<"$findings" |
+    awk -F'\t' '{ printf "- **%s** %s `%s`: %s\n", $1, $2, $3, $4 }')
+  log "Code review findings:"$'\n'"$code_findings"
+}
+
+# threat_surfaces prints "<area>\t<file>\t<reason>" for the files changed
+# between $1 and HEAD (tests excluded) that touch authentication, networking
+# or data handling, judged by their paths and by the calls on the lines the
+# change added.
+threat_surfaces() {
+  local file added
+  while IFS= read -r file; do
+    [ -z "$(test_files <<<"$file")" ] || continue
+    added=$(git diff "$1...HEAD" -- "$file" | grep '^+[^+]' || true)
+    added="$added" awk -v file="$file" '
+      function check(area, path_re, code_re,  line) {
+        if (tolower(file) ~ path_re) { printf "%s\t%s\tpath\n", area, file; return }
+        if (match(ENVIRON["added"], code_re)) {
+          line = substr(ENVIRON["added"], RSTART, RLENGTH); gsub(/[\t\n]/, " ", line)
+          printf "%s\t%s\tuses %s\n", area, file, line
+        }
+      }
+      BEGIN {
+        check("auth", "(^|/)(auth|authn|authz|login|logout|session|sessions|oauth|oidc|saml|jwt|token|tokens|password|permission|permissions|rbac|acl|iam|crypto|secret|secrets)([/._-]|$)",
+          "(jwt\\.|bcrypt|argon2|scrypt|oauth2\\.|oidc\\.|Authorization|[Ss]et[Cc]ookie|http\\.Cookie|csrf|x509\\.|crypto/|hmac\\.|passport\\.|getServerSession|req\\.user)")
+        check("network", "(^|/)(http|https|server|handler|handlers|api|router|routes|grpc|rpc|client|proxy|gateway|socket|websocket|webhook|webhooks|middleware)([/._-]|$)",
+          "(http\\.(Handle|HandleFunc|ListenAndServe|NewRequest|Get|Post|Client)|net\\.(Dial|Listen)|grpc\\.|ServeMux|\\.(GET|POST|PUT|DELETE|Handle)\\(|fetch\\(|axios\\.|app\\.(get|post|put|delete|use)\\(|url\\.Parse|tls\\.Config|InsecureSkipVerify|CORS|cors\\()")
+        check("data", "(^|/)(db|database|sql|store|storage|repo|repository|model|models|migration|migrations|schema|cache|upload|uploads|export|import|serializer|serializers|pii|user|users|billing|payment|payments)([/._-]|$)",
+          "(sql\\.|\\.(Query|QueryRow|Exec)(Context)?\\(|gorm\\.|mongo\\.|redis\\.|json\\.Unmarshal|yaml\\.Unmarshal|gob\\.|xml\\.Unmarshal|os\\.(Create|WriteFile|OpenFile|Remove)|filepath\\.Join|multipart|pickle\\.|JSON\\.parse|fs\\.(writeFile|readFile)|prisma\\.|knex)")
+      }'
+  done < <(git diff --name-only --diff-filter=AM "$1...HEAD")
+}
+
+# threat_model asks the backend for a STRIDE threat summary of the changes
+# between $1 and HEAD to the components threat_surfaces finds. The summary is
+# saved as threat-model.json and left in threat_summary for the pull request,
+# and the high-risk categories in threat_categories for the quality gate.
+threat_model() {
+  local surfaces prompt_file result files=()
+  surfaces=$(threat_surfaces "$1")
+  if [ -z "$surfaces" ]; then
+    skip "threat model (no authentication, networking or data handling changes)"
+    return
+  fi
+  mapfile -t files < <(cut -f2 <<<"$surfaces" | sort -u)
+  log "Threat surfaces: $(cut -f1 <<<"$surfaces" | sort -u | paste -sd' ' -) in ${#files[@]} files"
+  prompt_file=$(mktemp)
+  cat >"$prompt_file" <<EOF20
+This change touches authentication, networking or data handling code:
+$(awk -F'\t' '{ printf "- %s (%s: %s)\n", $2, $1, $3 }' <<<"$surfaces")
+
+$(context_diff "$1...HEAD" -- "${files[@]}")
+
+Write a brief STRIDE threat model of what this change adds or alters. For
+each threat that applies, give its category (one of spoofing, tampering,
+repudiation, information-disclosure, denial-of-service or
+elevation-of-privilege), the component, a risk of high, medium or low, the
+threat in one sentence, and the mitigation, saying whether the change already
+has it. Leave out categories that do not apply; an empty list is fine.
+
+Format as JSON:
+{
+  "threats": [{"category": "tampering", "component": "path or area", "risk": "high", "threat": "...", "mitigation": "...", "mitigated": false}],
+  "summary": "one or two sentences"
+}
+EOF20
+  log "Generating a threat model with $BACKEND..."
+  result=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  if ! jq -e '.threats | type == "array"' <<<"$result" >/dev/null 2>&1; then
+    log "Backend did not return a threat model" >&2
+    return
+  fi
+  jq --arg surfaces "$surfaces" '. + {surfaces: ($surfaces | split("\n") | map(split("\t") | {area: .[0], file: .[1], reason: .[2]}))}' \
+    <<<"$result" >"$run_dir/threat-model.json"
+  threat_summary=$(jq -r '
+    (.summary // empty),
+    (if (.threats | length) == 0 then "No threats identified." else
+      "| Category | Component | Risk | Threat | Mitigation |", "| --- | --- | --- | --- | --- |",
+      (.threats[] | "| \(.category) | `\(.component)` | \(.risk) | \(.threat | gsub("\\|"; "\\\\|")) | \(.mitigation | gsub("\\|"; "\\\\|"))\(if .mitigated then " (in this change)" else "" end) |")
+    end)' "$run_dir/threat-model.json")
+  threat_categories=$(jq -r '[.threats[] | select(.risk == "high") | .category] | unique | join(" ")' "$run_dir/threat-model.json")
+  log "Threat model: $(jq '.threats | length' "$run_dir/threat-model.json") threats${threat_categories:+, high risk: $threat_categories}"
+}
+
+# observability_stack prints the metrics and tracing libraries the repository
+# depends on: Prometheus and/or OpenTelemetry.
+observability_stack() {
+  local deps
+  deps=$(cat go.mod package.json requirements*.txt pyproject.toml 2>/dev/null || true)
+  [[ "$deps" != *prometheus/client_golang* && "$deps" != *prom-client* && "$deps" != *prometheus-client* && "$deps" != *prometheus_client* ]] || echo "Prometheus"
+  [[ "$deps" != *opentelemetry* ]] || echo "OpenTelemetry"
+}
+
+# new_operations prints the externally visible operations added between $1
+# and HEAD, as "<file>: <added line>": HTTP route registrations and handler,
+# job, worker and consumer functions.
+new_operations() {
+  git diff -U0 "$1...HEAD" -- '*.go' '*.ts' '*.js' '*.py' ':!*_test.go' ':!*.test.*' ':!*.spec.*' | awk '
+    /^\+\+\+ b\// { file = substr($0, 7); next }
+    /^\+/ && (/\.(HandleFunc|Handle|Get|Post|Put|Patch|Delete|GET|POST|PUT|PATCH|DELETE|route)\(["\x27]\// ||
+      /(func|def|function)[[:space:]]+(\([^)]*\)[[:space:]]*)?[A-Za-z_]*(Handler|Handle[A-Z]|Job|Worker|Consume|Consumer)[A-Za-z_]*[[:space:]]*\(/) {
+      line = substr($0, 2); sub(/^[[:space:]]+/, "", line); print file ": " line
+    }'
+}
+
+# instrument asks the backend to add metrics and trace spans, in the style of
+# the repository's existing instrumentation, to the operations added between
+# $1 and HEAD. With INSTRUMENT=commit the result is verified and committed on
+# its own so reviewers can drop it; with INSTRUMENT=suggest it is only
+# described. Either way, instrumentation_note is left for the pull request.
+instrument() {
+  local operations stack
+  operations=$(new_operations "$1")
+  if [ -z "$operations" ]; then
+    skip "instrumentation (no new handlers or jobs)"
+    return
+  fi
+  stack=$(observability_stack | paste -sd' ' -)
+  if [ -z "$stack" ]; then
+    skip "instrumentation (no Prometheus or OpenTelemetry dependency)"
+    return
+  fi
+
+  local prompt_file result examples
+  examples=$(git grep -nE 'prometheus\.New|promauto\.New|NewCounter|NewHistogram|otel\.Tracer|tracer\.Start|\.Start\(ctx|start_as_current_span|startActiveSpan' -- ':!*_test.go' 2>/dev/null |
+    head -n 8 | cut -c1-200 || true)
+  prompt_file=$(mktemp)
+  cat >"$prompt_file" <<EOF17
+This change adds externally visible operations:
+$operations
+
+The repository uses $stack. Existing instrumentation looks like this:
+${examples:-none found}
+
+Add metrics (request or run counts, errors and durations) and trace spans to
+these operations, following the existing naming, labels and registration
+style. Change nothing else.
+$(for file in $(cut -d: -f1 <<<"$operations" | sort -u); do context_file "$file"; done)
+
+Format as JSON:
+{
+  "files": {"path": "complete file content..."},
+  "summary": "one line per metric or span added"
+}
+EOF17
+  log "Generating instrumentation for $(grep -c . <<<"$operations") new operations with $BACKEND..."
+  result=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  if ! check_changes "$result" || ! jq -e '.files | length > 0' <<<"$result" >/dev/null 2>&1; then
+    log "Backend did not return instrumentation" >&2
+    return
+  fi
+
+  if [ "$INSTRUMENT" != "commit" ]; then
+    instrumentation_note="Suggested instrumentation ($stack):
+$(jq -r '.summary // empty' <<<"$result")"
+    return
+  fi
+  local tmp output
+  tmp=$(mktemp)
+  echo "$result" >"$tmp"
+  apply_changes "$tmp"
+  rm "$tmp"
+  format_changes
+  if output=$(run_verify full); then
+    git add -A
+    cca_commit -q -m "feat: add instrumentation for $title"
+    instrumentation_note="Commit $(git rev-parse --short HEAD) adds instrumentation ($stack). It is optional; revert it if it is not wanted:
+$(jq -r '.summary // empty' <<<"$result")"
+    log "Committed instrumentation"
+  else
+    git checkout -q -- .
+    git clean -qfd
+    log "Instrumentation failed verification; discarded" >&2
+    printf '%s\n' "$output" | redact >"$run_dir/instrument-verify.log"
+  fi
+}
+
+# frontend_framework prints react, vue or angular when package.json depends on
+# one of them.
+frontend_framework() {
+  [ -f package.json ] || return 0
+  jq -r '(.dependencies // {}) + (.devDependencies // {}) | keys[]' package.json 2>/dev/null |
+    awk '$0 == "react" { print "react"; exit } $0 == "vue" { print "vue"; exit } $0 == "@angular/core" { print "angular"; exit }'
+}
+
+# a11y_static prints "<severity>\t<WCAG criterion>\t<file>:<line>\t<message>"
+# for common accessibility problems in the markup of the given files.
+a11y_static() {
+  local file
+  for file in "$@"; do
+    [ -f "$file" ] || continue
+    awk -v file="$file" '
+      function report(severity, wcag, message) { printf "%s\t%s\t%s:%d\t%s\n", severity, wcag, file, FNR, message }
+      /<img[ >]/ && !/alt=/ { report("serious", "1.1.1", "<img> without alt text; add alt, or alt=\"\" for decorative images") }
+      /<(div|span|li|td)[ >]/ && /(onClick|@click|v-on:click|\(click\))=/ && !/role=/ {
+        report("serious", "2.1.1", "click handler on a non-interactive element; use a <button> or add role, tabIndex and a key handler")
+      }
+      /<a[ >]/ && (!/href=/ || /href="#"/) { report("moderate", "2.1.1", "<a> without a real href; use a <button> for actions") }
+      /<(input|select|textarea)[ >]/ && !/(aria-label|aria-labelledby|id=|type="hidden")/ {
+        report("serious", "1.3.1", "form control without a label; associate a <label> or add aria-label")
+      }
+      /<button[^>]*>[[:space:]]*<\/button>/ && !/aria-label/ { report("serious", "4.1.2", "empty <button> without an accessible name") }
+      /tab[iI]ndex="?[1-9]/ { report("moderate", "2.4.3", "positive tabindex changes the focus order") }
+      /<html[ >]/ && !/lang=/ { report("serious", "3.1.1", "<html> without a lang attribute") }
+      /outline:[[:space:]]*(none|0)/ { report("moderate", "2.4.7", "focus outline removed; provide a visible focus style") }
+    ' "$file"
+  done
+}
+
+# a11y_axe serves the app with A11Y_SERVE, runs the axe CLI against each of
+# A11Y_URLS and prints its violations in the format of a11y_static.
+a11y_axe() {
+  local axe url pid ready=0
+  axe=$(node_tool axe) || return 1
+  bash -c "$A11Y_SERVE" >"$run_dir/a11y-serve.log" 2>&1 &
+  pid=$!
+  for _ in $(seq 60); do
+    if curl -fsS -o /dev/null "${A11Y_URLS%% *}" 2>/dev/null; then
+      ready=1
+      break
+    fi
+    sleep 2
+  done
+  if [ "$ready" -eq 1 ]; then
+    for url in $A11Y_URLS; do
+      "$axe" "$url" --stdout 2>/dev/null | jq -r --arg url "$url" '
+        .[].violations[]
+        | [.impact, ([.tags[] | capture("^wcag(?<a>[0-9])(?<b>[0-9])(?<c>[0-9]+)$") | "\(.a).\(.b).\(.c)"] | first // "-"),
+           $url, "\(.help) (\(.nodes | length) elements, \(.helpUrl))"] | @tsv' || true
+    done
+  else
+    log "Accessibility: $A11Y_SERVE did not serve ${A11Y_URLS%% *} within two minutes" >&2
+  fi
+  kill "$pid" 2>/dev/null || true
+  wait "$pid" 2>/dev/null || true
+  [ "$ready" -eq 1 ]
+}
+
+# a11y_review checks the markup changed between $1 and HEAD in React, Vue and
+# Angular projects, rendering pages with axe-core when A11Y_SERVE and
+# A11Y_URLS are configured and falling back to static checks otherwise. The
+# violations are written to a11y.tsv in the run directory and left in
+# a11y_findings as Markdown list items.
+a11y_review() {
+  local framework files=() violations=""
+  framework=$(frontend_framework)
+  if [ -z "$framework" ]; then
+    skip "accessibility review (no React, Vue or Angular dependency)"
+    return
+  fi
+  mapfile -t files < <(git diff --name-only --diff-filter=AM "$1...HEAD" -- '*.jsx' '*.tsx' '*.vue' '*.html' '*.css' '*.scss')
+  if [ "${#files[@]}" -eq 0 ]; then
+    skip "accessibility review (no markup changed)"
+    return
+  fi
+  if [ -n "$A11Y_SERVE" ] && [ -n "$A11Y_URLS" ] && violations=$(a11y_axe); then
+    log "Accessibility: ran axe-core on $A11Y_URLS" >&2
+  else
+    violations=$(a11y_static "${files[@]}")
+    log "Accessibility: checked ${#files[@]} $framework files statically" >&2
+  fi
+  [ -n "$violations" ] || return 0
+  printf '%s\n' "$violations" >"$run_dir/a11y.tsv"
+  a11y_findings=$(awk -F'\t' '{ printf "- **%s** WCAG %s `%s`: %s\n", $1, $2, $3, $4 }' <<<"$violations")
+  log "Accessibility findings:"$'\n'"$a11y_findings"
+}
+
+# go_build_stats builds every main package of the Go modules in $1 and prints
+# "<package> <binary bytes> <build milliseconds>" per package.
+go_build_stats() {
+  local out pkg dir start end
+  out=$(mktemp -d)
+  while read -r pkg dir; do
+    [ -n "$pkg" ] || continue
+    start=$(date +%s%N)
+    if (cd "$dir" && go build -o "$out/bin" . >/dev/null 2>&1); then
+      end=$(date +%s%N)
+      echo "$pkg $(stat -c %s "$out/bin") $(((end - start) / 1000000))"
+    fi
+  done < <(cd "$1" && go_list -f '{{if eq .Name "main"}}{{.ImportPath}} {{.Dir}}{{end}}' | sed '/^$/d')
+  rm -rf "$out"
+}
+
+# go_build_report compares binary sizes and build times of HEAD against $1
+# and prints a finding for each package that grew beyond the thresholds.
+go_build_report() {
+  has_go || return 0
+  local base_dir
+  base_dir=$(mktemp -d)
+  git worktree add --detach "$base_dir" "$1" >/dev/null 2>&1
+  join <(go_build_stats "$base_dir" | sort) <(go_build_stats . | sort) |
+    awk -v size_pct="$BINARY_GROWTH_PCT" -v time_pct="$BUILD_TIME_GROWTH_PCT" '
+      $2 > 0 && ($4 - $2) * 100 / $2 > size_pct {
+        printf "- `%s`: binary grew from %d to %d bytes (+%.1f%%)\n", $1, $2, $4, ($4 - $2) * 100 / $2
+      }
+      $3 > 0 && ($5 - $3) * 100 / $3 > time_pct {
+        printf "- `%s`: build time grew from %dms to %dms (+%.1f%%)\n", $1, $3, $5, ($5 - $3) * 100 / $3
+      }'
+  git worktree remove --force "$base_dir"
+}
+
+# js_install installs the dependencies of the JS/TS project in $1 from its
+# lockfile with pnpm, yarn or npm.
+js_install() {
+  (
+    cd "$1"
+    if [ -f pnpm-lock.yaml ]; then
+      pnpm install --frozen-lockfile
+    elif [ -f yarn.lock ]; then
+      yarn install --frozen-lockfile
+    else
+      npm ci
+    fi
+  )
+}
+
+# js_bundle_stats installs the dependencies of the JS/TS project in $1, runs
+# its build script and prints "<entry> <bytes> <gzip bytes> <brotli bytes>"
+# for the JavaScript and CSS files of the output, with content hashes removed
+# from the names so that builds can be compared.
+js_bundle_stats() {
+  { js_install "$1" && (cd "$1" && npm run build); } >/dev/null 2>&1 || return 0
+  local out file name
+  for out in dist build out .next/static; do
+    [ -d "$1/$out" ] && break
+  done
+  [ -d "$1/$out" ] || return 0
+  while read -r file; do
+    name=$(sed -E 's/[.-][A-Za-z0-9_]{8,}(\.(js|mjs|css))$/\1/' <<<"${file#"$1/"}")
+    echo "$name $(stat -c %s "$file") $(gzip -9c "$file" | wc -c) $(
+      if command -v brotli >/dev/null; then brotli -c "$file" | wc -c; else echo 0; fi)"
+  done < <(find "$1/$out" -type f \( -name '*.js' -o -name '*.mjs' -o -name '*.css' \)) |
+    awk '{ raw[$1] += $2; gz[$1] += $3; br[$1] += $4 } END { for (n in raw) print n, raw[n], gz[n], br[n] }' | sort
+}
+
+# js_bundle_report builds the bundle of HEAD and of $1 and prints a Markdown
+# table of the entries whose size changed. Entries whose gzipped size grew by
+# more than BUNDLE_GROWTH_PCT percent are marked and counted in
+# bundle_regressions.
+js_bundle_report() {
+  [ -f package.json ] && jq -e '.scripts.build' package.json >/dev/null 2>&1 || return 0
+  local base_dir rows
+  base_dir=$(mktemp -d)
+  git worktree add --detach "$base_dir" "$1" >/dev/null 2>&1
+  rows=$(join -a 1 -a 2 -e 0 -o 0,1.2,1.3,1.4,2.2,2.3,2.4 <(js_bundle_stats "$base_dir") <(js_bundle_stats "$PWD") |
+    awk -v pct="$BUNDLE_GROWTH_PCT" '
+      function delta(old, new) { return old > 0 ? sprintf("%d (%+.1f%%)", new, (new - old) * 100 / old) : sprintf("%d (new)", new) }
+      $2 != $5 || $3 != $6 {
+        flag = ($3 > 0 && ($6 - $3) * 100 / $3 > pct) ? " **regression**" : ""
+        printf "| `%s`%s | %s | %s | %s |\n", $1, flag, delta($2, $5), delta($3, $6), ($7 > 0 ? delta($4, $7) : "-")
+      }')
+  git worktree remove --force "$base_dir"
+  [ -n "$rows" ] || return 0
+  bundle_regressions=$(grep -c '\*\*regression\*\*' <<<"$rows" || true)
+  bundle_report="| Entry | Bytes | gzip | brotli |
+| --- | --- | --- | --- |
+$rows"
+}
+
+# dependencies prints "<ecosystem> <name> <version>" for the direct
+# dependencies declared in go.mod and package.json at revision $1.
+dependencies() {
+  git show "$1:go.mod" 2>/dev/null | awk '
+    /^require \($/ { block = 1; next }
+    block && /^\)/ { block = 0; next }
+    block && NF >= 2 && $1 !~ /^\/\// { print "Go", $1, $2 }
+    /^require [^(]/ { print "Go", $2, $3 }
+  ' || true
+  git show "$1:package.json" 2>/dev/null |
+    jq -r '(.dependencies // {}) + (.devDependencies // {}) | to_entries[] | "npm \(.key) \(.value)"' 2>/dev/null || true
+}
+
+# version_lte succeeds when version $1 sorts before or equal to version $2.
+version_lte() {
+  [ "$(printf '%s\n%s\n' "$1" "$2" | sort -V | head -n 1)" = "$1" ]
+}
+
+# vulndb_advisories looks a package version up in the local OSV bundle
+# created by "vulndb sync", warning when the bundle is older than
+# CCA_VULNDB_MAX_AGE_DAYS.
+vulndb_advisories() {
+  local eco="$1" name="$2" version="${3#[~^v]}"
+  local index="$VULNDB_DIR/index.tsv"
+  if [ "$(find "$index" -mtime "+$VULNDB_MAX_AGE_DAYS" | wc -l)" -gt 0 ]; then
+    log "Vulnerability bundle is older than $VULNDB_MAX_AGE_DAYS days; run '$0 vulndb sync'" >&2
+  fi
+  local id introduced end kind
+  awk -F'\t' -v eco="$eco" -v name="$name" '$1 == eco && $2 == name { print $3 "\t" $4 "\t" $5 "\t" $6 }' "$index" |
+    while IFS=$'\t' read -r id introduced end kind; do
+      introduced="${introduced#v}"
+      end="${end#v}"
+      case "$kind" in
+        exact) [ "$version" = "$introduced" ] || continue ;;
+        fixed) version_lte "$introduced" "$version" && ! version_lte "$end" "$version" || continue ;;
+        last_affected) version_lte "$introduced" "$version" && version_lte "$version" "$end" || continue ;;
+        *) version_lte "$introduced" "$version" || continue ;;
+      esac
+      echo "$id"
+    done | sort -u
+}
+
+# run_vulndb_sync downloads the OSV advisories for the Go and npm ecosystems
+# into CCA_VULNDB_DIR and indexes their affected version ranges.
+run_vulndb_sync() {
+  require_commands curl unzip
+  local eco tmp
+  mkdir -p "$VULNDB_DIR"
+  tmp=$(mktemp -d)
+  for eco in $VULNDB_ECOSYSTEMS; do
+    log "Downloading $eco advisories"
+    curl -sfL "https://osv-vulnerabilities.storage.googleapis.com/$eco/all.zip" -o "$tmp/$eco.zip"
+    rm -rf "${VULNDB_DIR:?}/$eco"
+    mkdir -p "$VULNDB_DIR/$eco"
+    unzip -q "$tmp/$eco.zip" -d "$VULNDB_DIR/$eco"
+  done
+  rm -rf "$tmp"
+
+  log "Indexing advisories"
+  find "$VULNDB_DIR" -mindepth 2 -name '*.json' -print0 | xargs -0 -r jq -r '
+    .id as $id | .affected[]? | .package as $p
+    | ((.ranges[]? | select(.type != "GIT")
+        | reduce (.events[] | to_entries[0]) as $ev ({out: [], cur: null};
+            if $ev.key == "introduced" then .cur = $ev.value
+            elif .cur != null then .out += [[.cur, $ev.value, $ev.key]] | .cur = null
+            else . end)
+        | .out + (if .cur != null then [[.cur, "", "open"]] else [] end) | .[]),
+       (.versions[]? | [., "", "exact"]))
+    | [$p.ecosystem, $p.name, $id] + . | @tsv' >"$VULNDB_DIR/index.tsv.tmp"
+  mv "$VULNDB_DIR/index.tsv.tmp" "$VULNDB_DIR/index.tsv"
+  log "Indexed $(cut -f3 "$VULNDB_DIR/index.tsv" | sort -u | wc -l) advisories into $VULNDB_DIR"
+}
+
+# osv_advisories prints the IDs of known advisories for a package version.
+osv_advisories() {
+  if [ -f "$VULNDB_DIR/index.tsv" ]; then
+    vulndb_advisories "$@"
+    return
+  fi
+  [ "$OFFLINE" -eq 0 ] || return 0
+  local query
+  query=$(jq -n --arg eco "$1" --arg name "$2" --arg version "${3#[~^v]}" \
+    '{package: {ecosystem: $eco, name: $name}, version: $version}')
+  curl -sf https://api.osv.dev/v1/query -d "$query" | jq -r '.vulns[]?.id' 2>/dev/null || true
+}
+
+# dependency_report prints the direct dependencies added and removed between
+# $1 and HEAD, with the number of new transitive modules and known advisories.
+# Added dependencies with advisories are also appended to risky_dependencies.
+dependency_report() {
+  local base_deps head_deps eco name version advisories
+  base_deps=$(dependencies "$1" | sort -k1,2)
+  head_deps=$(dependencies HEAD | sort -k1,2)
+  [ "$base_deps" != "$head_deps" ] || return 0
+
+  while read -r eco name version; do
+    [ -n "$name" ] || continue
+    advisories=$(osv_advisories "$eco" "$name" "$version" | paste -sd, -)
+    if [ -n "$advisories" ]; then
+      echo "- added $eco \`$name@$version\` (known advisories: $advisories)"
+      risky_dependencies+=("$name")
+    else
+      echo "- added $eco \`$name@$version\`"
+    fi
+  done < <(join -v 2 -j 2 -o 2.1,2.2,2.3 <(echo "$base_deps" | sort -k2,2) <(echo "$head_deps" | sort -k2,2))
+  while read -r eco name version; do
+    [ -z "$name" ] || echo "- removed $eco \`$name\`"
+  done < <(join -v 1 -j 2 -o 1.1,1.2,1.3 <(echo "$base_deps" | sort -k2,2) <(echo "$head_deps" | sort -k2,2))
+
+  local transitive
+  transitive=$(git diff "$1...HEAD" -- go.sum | grep '^+[^+]' | awk '{ print $1 }' | sort -u | grep -c . || true)
+  [ "$transitive" -eq 0 ] || echo "- $transitive new modules in go.sum (including transitive dependencies)"
+  transitive=$(git diff "$1...HEAD" -- package-lock.json | grep -c '^+[[:space:]]*"node_modules/' || true)
+  [ "$transitive" -eq 0 ] || echo "- $transitive new packages in package-lock.json (including transitive dependencies)"
+}
+
+# unpinned_references prints the GitHub Actions in workflow or action file $1
+# that are not pinned to a commit SHA, or the base images in Dockerfile $1 that
+# are not pinned to a digest.
+unpinned_references() {
+  case "$1" in
+    .github/workflows/*.yml|.github/workflows/*.yaml|*/action.yml|action.yml)
+      sed -n -E 's/^[[:space:]-]*uses:[[:space:]]*([^ #]+@[^ #]+)[[:space:]]*$/\1/p' "$1" |
+        grep -Ev '@[0-9a-f]{40}$|^\./|^docker://' | sort -u || true
+      ;;
+    Dockerfile|*/Dockerfile|*.Dockerfile)
+      awk 'toupper($1) == "FROM" { i = ($2 ~ /^--platform=/) ? 3 : 2; print $i }' "$1" |
+        grep -Ev '@sha256:|^scratch$|\$' | sort -u || true
+      ;;
+  esac
+}
+
+# pin_references pins GitHub Actions to commit SHAs and Docker base images to
+# digests in the given files, keeping the original tag as a trailing comment.
+pin_references() {
+  local file ref action repo tag sha image digest
+  for file in "$@"; do
+    [ -f "$file" ] || continue
+    case "$file" in
+      .github/workflows/*.yml|.github/workflows/*.yaml|*/action.yml|action.yml)
+        while read -r ref; do
+          action="${ref%@*}"
+          tag="${ref#*@}"
+          repo=$(cut -d/ -f1-2 <<<"$action")
+          if ! sha=$(gh api "repos/$repo/commits/$tag" --jq '.sha' 2>/dev/null); then
+            log "Could not resolve $ref; leaving it unpinned" >&2
+            continue
+          fi
+          sed -i -E "s|uses:([[:space:]]*)$action@$tag([[:space:]]*)\$|uses:\1$action@$sha # $tag|" "$file"
+          log "Pinned $ref to $sha in $file"
+        done < <(unpinned_references "$file")
+        ;;
+      Dockerfile|*/Dockerfile|*.Dockerfile)
+        command -v crane >/dev/null || { log "crane not installed; not pinning $file"; continue; }
+        while read -r image; do
+          if ! digest=$(crane digest "$image" 2>/dev/null); then
+            log "Could not resolve $image; leaving it unpinned" >&2
+            continue
+          fi
+          sed -i -E "s|^(FROM[[:space:]]+(--platform=[^ ]+[[:space:]]+)?)$image([[:space:]]\|\$)|\1$image@$digest\3|" "$file"
+          log "Pinned $image to $digest in $file"
+        done < <(unpinned_references "$file")
+        ;;
+    esac
+  done
+}
+
+# tool_version prints the first line of a command's version output, or
+# "missing" when it is not installed.
+tool_version() {
+  if command -v "$1" >/dev/null; then
+    "$@" 2>&1 | head -n 1 || true
+  else
+    echo "missing"
+  fi
+}
+
+# write_manifest records what is needed to reproduce the run in manifest.json:
+# the issue input, base commit, tool versions, backend, prompt hash and the
+# CCA_* environment (values of secret-looking variables are redacted).
+write_manifest() {
+  local issue_copy=""
+  if [ -n "$ISSUE_FILE" ]; then
+    issue_copy="issue.${ISSUE_FILE##*.}"
+    cp "$ISSUE_FILE" "$run_dir/$issue_copy"
+  fi
+  local versions
+  versions=$(jq -n \
+    --arg git "$(tool_version git --version)" \
+    --arg gh "$(tool_version gh --version)" \
+    --arg jq "$(tool_version jq --version)" \
+    --arg go "$(tool_version go version)" \
+    --arg node "$(tool_version node --version)" \
+    --arg python "$(tool_version python3 --version)" \
+    --arg claude "$(tool_version claude --version)" \
+    '$ARGS.named')
+  { env | grep '^CCA_' || true; } | sort | jq -R 'capture("^(?<key>[^=]+)=(?<value>.*)$")
+    | if (.key | test("KEY|TOKEN|SECRET|PASSWORD")) then .value = "[redacted]" else . end' |
+    jq -s --arg run_id "$(basename "$run_dir")" --arg issue_url "$ISSUE_URL" --arg issue_file "$issue_copy" \
+      --argjson offline "$OFFLINE" --argjson deterministic "$DETERMINISTIC" --argjson seed "$SEED" --arg base "$(git rev-parse HEAD)" --arg backend "$BACKEND" \
+      --arg model "$(backend_model)" \
+      --arg prompt_sha256 "$prompt_sha256" --argjson tools "$versions" '{
+        run_id: $run_id,
+        issue_url: $issue_url,
+        issue_file: $issue_file,
+        offline: ($offline == 1),
+        deterministic: ($deterministic == 1),
+        seed: $seed,
+        base_commit: $base,
+        backend: $backend,
+        model: $model,
+        prompt_sha256: $prompt_sha256,
+        tools: $tools,
+        env: from_entries
+      }' >"$run_dir/manifest.json"
+}
+
+# run_replay re-runs a recorded run from its manifest with the same issue
+# input, base commit and CCA_* settings, warning about tool version drift.
+run_replay() {
+  local run_id="$1"
+  local manifest
+  manifest="$(git rev-parse --show-toplevel)/.cca/runs/$run_id/manifest.json"
+  if [ ! -f "$manifest" ]; then
+    log "No manifest for run $run_id" >&2
+    exit 1
+  fi
+
+  local tool recorded current
+  while IFS=$'\t' read -r tool recorded; do
+    case "$tool" in
+      go) current=$(tool_version go version) ;;
+      python) current=$(tool_version python3 --version) ;;
+      node) current=$(tool_version node --version) ;;
+      *) current=$(tool_version "$tool" --version) ;;
+    esac
+    [ "$current" = "$recorded" ] || log "$tool version differs: recorded '$recorded', now '$current'" >&2
+  done < <(jq -r '.tools | to_entries[] | [.key, .value] | @tsv' "$manifest")
+
+  local args=() key value
+  while IFS=$'\t' read -r key value; do
+    [ "$value" = "[redacted]" ] || export "$key=$value"
+  done < <(jq -r '.env | to_entries[] | [.key, .value] | @tsv' "$manifest")
+  export CCA_BASE_REF
+  CCA_BASE_REF=$(jq -r '.base_commit' "$manifest")
+  [ "$(jq -r '.offline' "$manifest")" = "false" ] || args+=(--offline)
+  if [ "$(jq -r '.deterministic' "$manifest")" = "true" ]; then
+    args+=(--deterministic)
+    export CCA_SEED
+    CCA_SEED=$(jq -r '.seed' "$manifest")
+  fi
+  if [ -n "$(jq -r '.issue_file' "$manifest")" ]; then
+    args+=(--issue-file "$(dirname "$manifest")/$(jq -r '.issue_file' "$manifest")")
+  else
+    args+=("$(jq -r '.issue_url' "$manifest")")
+  fi
+  log "Replaying run $run_id from $CCA_BASE_REF"
+  exec "$0" "${args[@]}"
+}
+
+# generate_sbom writes an SBOM of the working tree into the run directory with
+# syft and optionally submits it to GitHub's dependency submission API.
+generate_sbom() {
+  if ! command -v syft >/dev/null; then
+    skip "SBOM (syft not installed)"
+    return
+  fi
+  local file="$run_dir/sbom.${SBOM_FORMAT%-json}.json"
+  log "Generating $SBOM_FORMAT SBOM"
+  syft dir:. -q -o "$SBOM_FORMAT=$file"
+  log "Wrote $file"
+
+  if [ "$SBOM_SUBMIT" -eq 1 ] && [ "$OFFLINE" -eq 0 ]; then
+    local snapshot="$run_dir/dependency-snapshot.json"
+    syft dir:. -q -o "github-json=$snapshot"
+    jq --arg id "$(current_run_id)" '.job.id = $id' "$snapshot" >"$snapshot.tmp" && mv "$snapshot.tmp" "$snapshot"
+    gh api "repos/{owner}/{repo}/dependency-graph/snapshots" --input "$snapshot" >/dev/null
+    log "Submitted dependency snapshot to GitHub"
+  fi
+}
+
+# codeowners_file prints the path of the repository's CODEOWNERS file, if any.
+codeowners_file() {
+  local file
+  for file in .github/CODEOWNERS CODEOWNERS docs/CODEOWNERS; do
+    if [ -f "$file" ]; then
+      echo "$file"
+      return
+    fi
+  done
+}
+
+# file_owners prints "<owners>\t<file>" for each file on stdin. Owners come
+# from the last matching CODEOWNERS rule or, for files no rule covers, from
+# the most frequent commit author of the file's directory in the last year.
+file_owners() {
+  local rules file owners
+  rules=$(codeowners_file)
+  while read -r file; do
+    [ -n "$file" ] || continue
+    owners=""
+    if [ -n "$rules" ]; then
+      owners=$(awk -v file="$file" '
+        function glob2re(glob,    re, i, c) {
+          anchored = substr(glob, 1, 1) == "/" || index(substr(glob, 1, length(glob) - 1), "/") > 0
+          sub(/^\//, "", glob)
+          if (substr(glob, length(glob)) == "/") glob = glob "**"
+          re = ""
+          for (i = 1; i <= length(glob); i++) {
+            c = substr(glob, i, 1)
+            if (c == "*" && substr(glob, i + 1, 1) == "*") { re = re ".*"; i++ }
+            else if (c == "*") re = re "[^/]*"
+            else if (c == "?") re = re "[^/]"
+            else if (index(".+()|{}^$[]\\", c)) re = re "\\" c
+            else re = re c
+          }
+          return (anchored ? "^" : "(^|/)") re "(/.*)?$"
+        }
+        /^[[:space:]]*(#|$)/ { next }
+        file ~ glob2re($1) { owners = ""; for (i = 2; i <= NF; i++) owners = owners (i > 2 ? " " : "") $i }
+        END { print owners }
+      ' "$rules")
+    fi
+    if [ -z "$owners" ]; then
+      deepen_until "code owners" history_covers "1 year ago"
+      owners=$(git log --since=1.year --format=%an -- "$(dirname "$file")" 2>/dev/null | sort | uniq -c | sort -rn |
+        awk 'NR == 1 { $1 = ""; print "history:" substr($0, 2) }')
+    fi
+    printf '%s\t%s\n' "${owners:-unowned}" "$file"
+  done
+}
+
+# ownership_groups prints "<owners>\t<files>" for the files changed between
+# $1 and HEAD, one line per set of owners, largest group first.
+ownership_groups() {
+  git diff --name-only "$1...HEAD" | file_owners |
+    awk -F'\t' '{ files[$1] = files[$1] (files[$1] == "" ? "" : " ") $2; count[$1]++ }
+      END { for (o in files) print count[o] "\t" o "\t" files[o] }' |
+    sort -t$'\t' -k1,1rn | cut -f2-
+}
+
+# split_by_owner moves the changes of every ownership group but the largest
+# into a pull request of its own, branched from $1, and reverts them on the
+# current branch. The new pull requests are left in split_prs.
+split_by_owner() {
+  local groups owners files dir part=1 url file
+  groups=$(ownership_groups "$1" | tail -n +2)
+  while IFS=$'\t' read -r owners files; do
+    [ -n "$files" ] || continue
+    dir="$root_dir/.cca/worktrees/$branch-part$part"
+    git worktree add -q -b "$branch-part$part" "$dir" "$1"
+    (
+      cd "$dir"
+      for file in $files; do
+        if git cat-file -e "$branch:$file" 2>/dev/null; then git checkout -q "$branch" -- "$file"; else git rm -q "$file"; fi
+      done
+      cca_commit -q -m "feat: $title ($owners)"
+      push origin "$branch-part$part"
+    )
+    url=$(gh pr create --draft --head "$branch-part$part" --title "$(redact <<<"$(pr_title "$1" "$title ($owners)")")" \
+      --body "$(redact <<<"$(msg pr.split_part "${ISSUE_URL:-$title}" "$branch")$([ "$TRAILERS" -eq 0 ] || printf '\n\n%s' "$(run_metadata)")")")
+    git worktree remove --force "$dir"
+    for file in $files; do
+      if git cat-file -e "$1:$file" 2>/dev/null; then git checkout -q "$1" -- "$file"; else git rm -q "$file"; fi
+    done
+    cca_commit -q -m "chore: move changes owned by $owners to a separate pull request"
+    split_prs+=("- $owners: $url")
+    log "Split changes owned by $owners into $url"
+    part=$((part + 1))
+  done <<<"$groups"
+  set_status split_pr_urls "$(printf '%s\n' ${split_prs[@]+"${split_prs[@]}"} | sed -n 's/^- .*: //p' | paste -sd ' ' -)"
+}
+
+# ownership_section prints a Markdown list of the owners of the change
+# between $1 and HEAD with their files when it spans more than one owner.
+ownership_section() {
+  local groups
+  groups=$(ownership_groups "$1")
+  [ "$(grep -c . <<<"$groups")" -gt 1 ] || return 0
+  awk -F'\t' '{ n = split($2, f, " "); list = ""; for (i = 1; i <= n; i++) list = list (i > 1 ? ", " : "") "`" f[i] "`"; print "- " $1 ": " list }' <<<"$groups"
+}
+
+# uses_lfs succeeds when the repository tracks files with Git LFS and the
+# git-lfs extension is installed.
+uses_lfs() {
+  grep -qs 'filter=lfs' .gitattributes && git lfs version >/dev/null 2>&1
+}
+
+# asset_policy checks the binary files staged for commit against the
+# ASSET_ALLOW globs. Binary files no glob allows fail the run with the list
+# of files and how to allow them. Allowed files of ASSET_LFS_KB or more are
+# tracked with Git LFS when the repository uses it.
+asset_policy() {
+  local file glob allowed size globs blocked=()
+  # read splits the globs without expanding them against the worktree.
+  read -r -a globs <<<"$ASSET_ALLOW"
+  while IFS= read -r file; do
+    allowed=0
+    for glob in ${globs[@]+"${globs[@]}"}; do
+      if [[ "$file" == $glob ]]; then
+        allowed=1
+        break
+      fi
+    done
+    if [ "$allowed" -eq 0 ]; then
+      blocked+=("$file")
+      continue
+    fi
+    size=$(($(wc -c <"$file") / 1024))
+    if [ "$size" -ge "$ASSET_LFS_KB" ] && uses_lfs && [ "$(git check-attr filter -- "$file" | awk '{ print $NF }')" != "lfs" ]; then
+      git lfs track --filename -- "$file" >/dev/null
+      git rm -q --cached -- "$file"
+      git add -- .gitattributes "$file"
+      log "Tracking $file ($size KiB) with Git LFS"
+    fi
+  done < <(git diff --cached --numstat --diff-filter=AM | awk -F'\t' '$1 == "-" { print $3 }')
+  if [ "${#blocked[@]}" -gt 0 ]; then
+    log "The change adds binary files, which are not committed unless CCA_ASSET_ALLOW allows them:" >&2
+    for file in "${blocked[@]}"; do
+      log "  $file" >&2
+    done
+    log "Remove them, add them to .gitignore, or allow them with globs in CCA_ASSET_ALLOW (for example \"docs/images/*.png\")" >&2
+    exit 1
+  fi
+}
+
+# diff_limits prints one line for each pull request size limit the change
+# between $1 and HEAD exceeds: files changed, lines changed and binary files
+# added.
+diff_limits() {
+  local files lines binaries
+  files=$(git diff --name-only "$1" HEAD | grep -c . || true)
+  lines=$(git diff --numstat "$1" HEAD | awk '$1 != "-" { n += $1 + $2 } END { print n + 0 }')
+  binaries=$(git diff --numstat --diff-filter=A "$1" HEAD | awk '$1 == "-"' | grep -c . || true)
+  [ "$files" -le "$MAX_PR_FILES" ] || echo "$files files changed (limit $MAX_PR_FILES)"
+  [ "$lines" -le "$MAX_PR_LINES" ] || echo "$lines lines changed (limit $MAX_PR_LINES)"
+  [ "$binaries" -le "$MAX_PR_BINARIES" ] || echo "$binaries binary files added (limit $MAX_PR_BINARIES)"
+}
+
+# diff_summary prints a Markdown table of the change between $1 and HEAD by
+# top-level directory: files, lines added and removed, and binary files.
+diff_summary() {
+  echo "| Directory | Files | Added | Removed | Binary |"
+  echo "| --- | --- | --- | --- | --- |"
+  git diff --numstat "$1" HEAD | awk -F'\t' '
+    {
+      dir = (split($3, p, "/") > 1 ? p[1] "/" : ".")
+      files[dir]++
+      if ($1 == "-") binary[dir]++; else { added[dir] += $1; removed[dir] += $2 }
+    }
+    END { for (dir in files) printf "| `%s` | %d | %d | %d | %d |\n", dir, files[dir], added[dir], removed[dir], binary[dir] }' | sort
+}
+
+# diff_guard keeps changes too large to review from becoming pull requests.
+# When the change exceeds MAX_PR_FILES, MAX_PR_LINES or MAX_PR_BINARIES, it
+# asks whether to go on with DIFF_GUARD=confirm on a terminal. Otherwise it
+# saves a summary of the change as diff-summary.md, posts it on the issue and
+# stops before anything is pushed.
+diff_guard() {
+  local exceeded summary answer=""
+  exceeded=$(diff_limits "$1")
+  [ -n "$exceeded" ] || return 0
+  log "The change exceeds the pull request size limits:"$'\n'"$exceeded" >&2
+  if [ "$DIFF_GUARD" = "confirm" ] && [ -t 0 ]; then
+    read -r -p "Open the pull request anyway? [y/N] " answer || true
+    [[ "$answer" != [yY]* ]] || return 0
+  fi
+  summary=$(diff_summary "$1")
+  printf '%s\n' "$summary" >"$run_dir/diff-summary.md"
+  if [ -n "$ISSUE_URL" ]; then
+    gh issue comment "$ISSUE_URL" --body "$(redact <<EOF
+$(msg comment.oversized "$branch")
+
+$(sed 's/^/- /' <<<"$exceeded")
+
+$summary
+
+$(run_marker)
+EOF
+)" >/dev/null
+  fi
+  log "Not opening a pull request; the change stays on local branch $branch" >&2
+  exit 1
+}
+
+# findings_tsv prints the findings of the run as "severity\tsource\tlocation\t
+# message" lines, most severe first: the code review checks, the accessibility
+# review and the last self-review iteration.
+findings_tsv() {
+  {
+    [ ! -f "$run_dir/findings.tsv" ] || cat "$run_dir/findings.tsv"
+    [ ! -f "$run_dir/a11y.tsv" ] || awk -F'\t' '{ printf "%s\tWCAG %s\t%s\t%s\n", $1, $2, $3, $4 }' "$run_dir/a11y.tsv"
+    [ ! -f "$run_dir/self-review.jsonl" ] || tail -n 1 "$run_dir/self-review.jsonl" |
+      jq -r '.findings[]? | [.severity, "self-review " + (.id // ""), (.file // "-") + (if (.line // 0) > 0 then ":\(.line)" else "" end), .message] | @tsv'
+  } | awk -F'\t' '
+    BEGIN { n = split("critical high serious major medium moderate minor low info", order, " "); for (i = 1; i <= n; i++) rank[order[i]] = i }
+    NF >= 4 { printf "%d\t%s\n", (($1 in rank) ? rank[$1] : n + 1), $0 }' | sort -t$'\t' -k1,1n -s | cut -f2-
+}
+
+# render_findings writes the findings_tsv lines on stdin as Markdown pages of
+# at most $2 characters to files 1, 2, ... in directory $1. Each severity is a
+# <details> section, open for critical and high, continued on the next page
+# when it does not fit. Every finding starts with an anchor derived from its
+# source, location and message, so links to it survive re-renders.
+render_findings() {
+  awk -F'\t' -v dir="$1" -v max="$2" '
+    function hash(s,  h, i) {
+      h = 5381
+      for (i = 1; i <= length(s); i++) h = (h * 33 + index(chars, substr(s, i, 1))) % 16777216
+      return sprintf("%06x", h)
+    }
+    function heading(s, continued) {
+      return "<details" ((s == "critical" || s == "high") ? " open" : "") "><summary><b>" s "</b> (" count[s] (continued ? ", continued" : "") ")</summary>\n\n"
+    }
+    BEGIN { chars = " !\"#$%&()*+,-./0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_`abcdefghijklmnopqrstuvwxyz{|}~" }
+    NF >= 4 { n++; sev[n] = $1; src[n] = $2; loc[n] = $3; msg[n] = $4; count[$1]++ }
+    END {
+      close_tag = "\n</details>\n\n"
+      p = 1; len = 0; open = 0; cur = ""
+      for (i = 1; i <= n; i++) {
+        line = "- <a id=\"cca-" hash(src[i] loc[i] msg[i]) "\"></a>**" src[i] "** `" loc[i] "`: " msg[i] "\n"
+        fresh = (sev[i] != cur)
+        need = length(line) + length(close_tag) + (fresh ? length(heading(sev[i], 0)) + (open ? length(close_tag) : 0) : 0)
+        if (len > 0 && len + need > max) {
+          if (open) page[p] = page[p] close_tag
+          p++; len = 0; open = 0
+          if (!fresh) { page[p] = heading(sev[i], 1); len = length(page[p]); open = 1 }
+        }
+        if (fresh) {
+          if (open) { page[p] = page[p] close_tag; len += length(close_tag) }
+          h = heading(sev[i], 0); page[p] = page[p] h; len += length(h); open = 1; cur = sev[i]
+        }
+        page[p] = page[p] line; len += length(line)
+      }
+      if (open) page[p] = page[p] close_tag
+      for (i = 1; i <= p; i++) if (n > 0) printf "%s", page[i] > (dir "/" i)
+    }'
+}
+
+# post_findings posts the findings of the run on pull request $1 as one or
+# more comments that fit the GitHub size limit. Comments from an earlier
+# post_findings are found by their page markers and edited in place, and
+# pages no longer needed are deleted, so re-runs do not pile up comments.
+post_findings() {
+  local repo number existing dir pages=0 i id body
+  repo=$(cut -d/ -f4-5 <<<"$1")
+  number="${1##*/}"
+  existing=$(gh api --paginate "repos/$repo/issues/$number/comments" \
+    --jq '.[] | select(.body | test("<!-- cca-findings: page [0-9]+ -->")) | "\(.body | capture("<!-- cca-findings: page (?<n>[0-9]+) -->").n)\t\(.id)"')
+  dir=$(mktemp -d)
+  findings_tsv | redact | render_findings "$dir" "$((COMMENT_MAX_CHARS - 500))"
+  pages=$(find "$dir" -type f | wc -l)
+  if [ "$pages" -eq 0 ] && [ -z "$existing" ]; then
+    rm -rf "$dir"
+    return
+  fi
+  for ((i = 1; i <= (pages > 0 ? pages : 1); i++)); do
+    body="<!-- cca-findings: page $i -->
+### $(msg pr.findings_page "$i" "$((pages > 0 ? pages : 1))")
+
+$(if [ -f "$dir/$i" ]; then cat "$dir/$i"; else msg pr.findings_none; fi)
+
+$(run_marker)"
+    id=$(awk -F'\t' -v page="$i" '$1 == page { print $2; exit }' <<<"$existing")
+    if [ -n "$id" ]; then
+      gh api -X PATCH "repos/$repo/issues/comments/$id" -f body="$body" >/dev/null
+    else
+      gh pr comment "$1" --body "$body" >/dev/null
+    fi
+  done
+  while IFS=$'\t' read -r i id; do
+    [ -n "$id" ] && [ "$i" -gt "$((pages > 0 ? pages : 1))" ] || continue
+    gh api -X DELETE "repos/$repo/issues/comments/$id" >/dev/null
+  done <<<"$existing"
+  rm -rf "$dir"
+  log "Posted $pages pages of findings on $1"
+}
+
+# pr_norms prints, as JSON, the conventions the titles and descriptions of the
+# repository's recently merged pull requests mostly follow: conventional
+# commit prefixes and the scopes they use, a leading emoji, ticket IDs and
+# where they go, lowercase subjects, and the headings most descriptions
+# share. It prints nothing offline, with PR_NORMS=0 or with fewer than five
+# merged pull requests to go by.
+pr_norms() {
+  [ "$OFFLINE" -eq 0 ] && [ "$PR_NORMS" -eq 1 ] || return 0
+  local prs
+  prs=$(gh pr list --state merged --limit 30 --json title,body 2>/dev/null || true)
+  [ "$(jq 'length' <<<"${prs:-[]}")" -ge 5 ] || return 0
+  jq -c '
+    def most: group_by(.) | max_by(length) | .[0];
+    def majority($all): length * 2 > ($all | length);
+    . as $prs
+    | [.[].title] as $titles
+    | [$titles[] | capture("^(?<emoji>\\p{So}\\x{FE0F}?|:[a-z0-9_+-]+:)\\s*") | .emoji] as $emojis
+    | [$titles[] | sub("^(\\p{So}\\x{FE0F}?|:[a-z0-9_+-]+:)\\s*"; "")] as $plain
+    | [$plain[] | sub("^\\[?[A-Z][A-Z0-9]+-[0-9]+\\]?:?\\s+"; "")
+        | capture("^(?<type>[a-z]+)(\\((?<scope>[^)]*)\\))?!?: ")] as $conventional
+    | [$plain[] | capture("(?<pre>^\\[?)(?<key>[A-Z][A-Z0-9]+)-[0-9]+(?<post>\\]?:?\\s+)")
+        // capture("(?<pre>\\s+[\\[(]?)(?<key>[A-Z][A-Z0-9]+)-[0-9]+(?<post>[\\])]?)$")] as $tickets
+    | [$plain[] | sub("^\\[?[A-Z][A-Z0-9]+-[0-9]+\\]?:?\\s+"; "") | sub("^[a-z]+(\\([^)]*\\))?!?: "; "")
+        | select(test("^[A-Za-z]"))] as $subjects
+    | [$prs[] | .body // "" | [scan("(?m)^#{1,3} +[^\\n]*\\S")] | to_entries[] | {heading: .value, pos: .key}] as $headings
+    | ([$prs[] | select((.body // "") != "")] | length) as $bodies
+    | {
+        conventional: ($conventional | majority($titles)),
+        fix_type: ([$conventional[].type | select(test("fix|bug"))] | most // "fix"),
+        scopes: ([$conventional[].scope | select(. != null and . != "")] | unique),
+        scoped: ([$conventional[] | select(.scope != null)] | majority($conventional)),
+        emoji: (if $emojis | majority($titles) then $emojis | most else null end),
+        ticket_key: (if $tickets | majority($titles) then [$tickets[].key] | most else null end),
+        ticket_format: (if $tickets | majority($titles) then [$tickets[] | .pre + "%s" + .post] | most else null end),
+        lowercase: ([$subjects[] | select(test("^[a-z]"))] | majority($subjects)),
+        headings: ($headings | group_by(.heading) | map(select(length * 2 > $bodies and $bodies > 0))
+          | sort_by(map(.pos) | add / length) | map(.[0].heading))
+      }' <<<"$prs"
+}
+
+# pr_scope prints the scope of the repository's conventional titles that
+# names a directory of the change between $1 and HEAD, if any.
+pr_scope() {
+  local dirs
+  dirs=$(git diff --name-only "$1...HEAD" | awk -F/ '{ for (i = 1; i < NF && i <= 2; i++) print $i }' | sort | uniq -c | sort -rn | awk '{ print $2 }')
+  jq -r '.scopes[]?' <<<"$pr_norms" | grep -Fxf <(cat <<<"$dirs") | head -n 1 || true
+}
+
+# pr_title prints the pull request title for the change between $1 and HEAD
+# with subject $2. It follows the norms in pr_norms, in the order emoji,
+# ticket ID, conventional prefix and subject, taking the ticket ID from the
+# issue or the branch name. Without norms it prints "Fix: <subject>".
+pr_title() {
+  if [ -z "$pr_norms" ]; then
+    echo "Fix: $2"
+    return
+  fi
+  jq -r --arg subject "$2" --arg text "$title $body $branch" --arg scope "$(pr_scope "$1")" '
+    . as $n
+    | ($subject | if $n.lowercase then (.[0:1] | ascii_downcase) + .[1:] else (.[0:1] | ascii_upcase) + .[1:] end) as $s
+    | (if $n.ticket_key then [$text | scan("\\b" + $n.ticket_key + "-[0-9]+\\b")] | first else null end) as $ticket
+    | (if $n.conventional then $n.fix_type + (if $n.scoped and $scope != "" then "(" + $scope + ")" else "" end) + ": " else "" end) as $prefix
+    | (if $ticket and ($n.ticket_format | startswith("%s") or startswith("[%s")) then $n.ticket_format | sub("%s"; $ticket) else "" end)
+      + $prefix + $s
+      + (if $ticket and ($n.ticket_format | startswith("%s") or startswith("[%s") | not) then $n.ticket_format | sub("%s"; $ticket) else "" end)
+    | if $n.emoji then $n.emoji + " " + . else . end' <<<"$pr_norms"
+}
+
+# pr_description prints the opening of the pull request description for the
+# change between $1 and HEAD: the reference to the issue or task file, or,
+# when the repository's descriptions share headings, those headings with the
+# reference, the commits of the change and the verification result under the
+# ones they fit. Headings nothing fits are left out.
+pr_description() {
+  local reference heading headings=() kinds=() i
+  if [ -n "$ISSUE_URL" ]; then reference="Resolves: $ISSUE_URL"; else reference="Task: $(basename "$ISSUE_FILE")"; fi
+  [ -z "$pr_norms" ] || mapfile -t headings < <(jq -r '.headings[]' <<<"$pr_norms")
+  for heading in ${headings[@]+"${headings[@]}"}; do
+    case "${heading,,}" in
+      *why*|*motivation*|*context*|*background*|*reason*|*issue*|*related*|*ticket*|*背景*|*目的*|*理由*|*関連*) kinds+=(reference) ;;
+      *summary*|*description*|*what*|*overview*|*change*|*概要*|*変更*|*内容*) kinds+=(summary) ;;
+      *test*|*verif*|*qa*|*how\ to*|*確認*|*テスト*|*検証*) kinds+=(verification) ;;
+      *) kinds+=("") ;;
+    esac
+  done
+  if [[ " ${kinds[*]-} " != *" reference "* ]]; then
+    echo "$reference"
+    [ "${#headings[@]}" -eq 0 ] || echo
+  fi
+  for i in "${!headings[@]}"; do
+    [ -n "${kinds[$i]}" ] || continue
+    printf '%s\n\n' "${headings[$i]}"
+    case "${kinds[$i]}" in
+      reference) echo "$reference" ;;
+      summary) git log --reverse --format='- %s' "$1..HEAD" ;;
+      verification) msg pr.verified; echo ;;
+    esac
+    echo
+  done
+}
+
+# pr_labels prints the labels for the diff between $1 and HEAD: the auto label,
+# a size label, risk/high for risky paths and one area label per top-level dir.
+pr_labels() {
+  local range="$1...HEAD"
+  local lines
+  lines=$(git diff --numstat "$range" | awk '{ n += $1 + $2 } END { print n + 0 }')
+
+  echo "$AUTO_LABEL"
+  local size="XL" name limit
+  for name in XS S M L; do
+    read -r limit
+    if [ "$lines" -lt "$limit" ]; then
+      size="$name"
+      break
+    fi
+  done < <(tr ' ' '\n' <<<"$SIZE_THRESHOLDS")
+  echo "size/$size"
+
+  if git diff --name-only --diff-filter=D "$range" | grep -q . ||
+     git diff --name-only "$range" | grep -Eq "$RISKY_PATHS"; then
+    echo "risk/high"
+  fi
+  git diff --name-only "$range" | awk -F/ 'NF > 1 { print "area/" $1 }' | sort -u
+}
+
+# apply_labels adds labels to a pull request, creating missing ones when
+# CCA_CREATE_LABELS allows it and skipping them otherwise.
+apply_labels() {
+  local url="$1"
+  shift
+  local existing label applied=()
+  existing=$(gh label list --limit 1000 --json name --jq '.[].name')
+  for label in "$@"; do
+    if ! grep -Fxq "$label" <<<"$existing"; then
+      if [ "$CREATE_LABELS" -eq 1 ]; then
+        gh label create "$label" --description "Applied by cca" >/dev/null
+      else
+        log "Label $label does not exist; skipping"
+        continue
+      fi
+    fi
+    gh pr edit "$url" --add-label "$label" >/dev/null
+    applied+=("$label")
+    log "Labeled $label"
+  done
+  set_status pr_labels "${applied[*]}"
+}
+
+# persona_setting prints the value of setting $2 in persona file $1.
+persona_setting() {
+  sed -n -E "s/^[[:space:]]*$2[[:space:]]*=[[:space:]]*\"?([^\"]*)\"?[[:space:]]*$/\1/p" "$1" | tail -n 1
+}
+
+# check_weights exits when a "rule=severity" pair in $2, read from $1, has a
+# severity findings cannot have, which would make findings.json invalid.
+check_weights() {
+  local pairs=() pair
+  read -r -a pairs <<<"$2"
+  for pair in ${pairs[@]+"${pairs[@]}"}; do
+    case "${pair##*=}" in
+      critical|high|serious|major|medium|moderate|minor|low|info|off) ;;
+      *)
+        log "Unknown severity in $pair in $1; use critical, high, serious, major, medium, moderate, minor, low, info or off" >&2
+        exit 1
+        ;;
+    esac
+  done
+}
+
+# select_persona picks the reviewer persona of the run, the one mapped to the
+# first issue label found in PERSONA_LABELS ("label:persona" pairs) or else
+# PERSONA, and loads its role, tone, rule weights and omitted sections from
+# .cca/personas/<name>.conf.
+select_persona() {
+  local pairs=() pair label persona="$PERSONA" file
+  read -r -a pairs <<<"$PERSONA_LABELS"
+  for pair in ${pairs[@]+"${pairs[@]}"}; do
+    label="${pair%:*}"
+    if grep -qxF "$label" <<<"$issue_labels"; then
+      persona="${pair##*:}"
+      break
+    fi
+  done
+  [ -n "$persona" ] || return 0
+  file="$root_dir/.cca/personas/$persona.conf"
+  if [ ! -f "$file" ]; then
+    log "No reviewer persona named $persona (expected $file)" >&2
+    exit 1
+  fi
+  persona_role=$(persona_setting "$file" CCA_PERSONA_ROLE)
+  persona_role="${persona_role:-a strict code reviewer}"
+  persona_tone=$(persona_setting "$file" CCA_PERSONA_TONE)
+  persona_weights=$(persona_setting "$file" CCA_PERSONA_WEIGHTS)
+  check_weights "$file" "$persona_weights"
+  persona_omit=$(persona_setting "$file" CCA_PERSONA_OMIT)
+  log "Reviewer persona: $persona ($persona_role)"
+  set_status persona "$persona"
+}
+
+# persona_weigh applies rule weights to the "severity\trule\tlocation\t..."
+# findings on stdin: first the persona's ("rule=severity" pairs), then those
+# in RULES, where "rule:glob=severity" only applies to findings in files
+# matching the glob and the last matching entry wins. Findings weighted "off"
+# are dropped, as are findings of a rule that RULE_PATHS ("rule=glob" pairs)
+# scopes to other paths.
+persona_weigh() {
+  awk -F'\t' -v OFS='\t' -v weights="$persona_weights" -v rules="$RULES" -v scopes="$RULE_PATHS" '
+    function glob(g) {
+      gsub(/[.+^$(){}|\\]/, "\\\\&", g)
+      gsub(/\*\*/, "\001", g); gsub(/\*/, "[^/]*", g); gsub(/\?/, "[^/]", g); gsub(/\001/, ".*", g)
+      return "^" g "$"
+    }
+    BEGIN {
+      n = split(weights, pairs, " ")
+      for (i = 1; i <= n; i++) { split(pairs[i], kv, "="); weight[kv[1]] = kv[2] }
+      n = split(rules, pairs, " ")
+      for (i = 1; i <= n; i++) {
+        eq = index(pairs[i], "="); key = substr(pairs[i], 1, eq - 1)
+        rules_n++; rule[rules_n] = key; severity[rules_n] = substr(pairs[i], eq + 1); re[rules_n] = ""
+        if ((c = index(key, ":")) > 0) { rule[rules_n] = substr(key, 1, c - 1); re[rules_n] = glob(substr(key, c + 1)) }
+      }
+      n = split(scopes, pairs, " ")
+      for (i = 1; i <= n; i++) {
+        eq = index(pairs[i], "="); key = substr(pairs[i], 1, eq - 1)
+        sep = (key in scope) ? "|" : ""
+        scope[key] = scope[key] sep "(" glob(substr(pairs[i], eq + 1)) ")"
+      }
+    }
+    {
+      path = $3; sub(/:[0-9]+(:[0-9]+)?$/, "", path)
+      if (($2 in scope) && path !~ scope[$2]) next
+      if ($2 in weight) $1 = weight[$2]
+      for (i = 1; i <= rules_n; i++) if (rule[i] == $2 && (re[i] == "" || path ~ re[i])) $1 = severity[i]
+      if ($1 != "off") print
+    }'
+}
+
+# section_omitted succeeds when the persona leaves section $1 out of the pull
+# request description.
+section_omitted() {
+  [[ " $persona_omit " == *" $1 "* ]]
+}
+
+# review_rubric prints the prompt text for the review rubric: the weights of
+# the review sections in REVIEW_RUBRIC ("section=weight" pairs) and the
+# sections in REVIEW_REQUIRED every review must give a verdict on.
+review_rubric() {
+  [ -z "$REVIEW_RUBRIC" ] || echo "Weigh the review sections as follows, higher meaning more important to this team: $(sed 's/=/ /g; s/ \([^ ]*\) */ (weight \1), /g; s/, $//' <<<"$REVIEW_RUBRIC")."
+  [ -z "$REVIEW_REQUIRED" ] || echo "Always cover these sections, giving a one-sentence verdict on each in \"sections\" even when there is nothing to report: $(sed 's/ /, /g' <<<"$REVIEW_REQUIRED")."
+}
+
+# ensemble_review prints the response to review prompt $1. With REVIEW_BACKENDS
+# ("backend[:model]" entries) the prompt goes to each of those backends in
+# parallel and their findings are merged: findings on the same file within
+# three lines of each other (or, without lines, of the same category) are one
+# finding, taken from the reviewer that rated it most severe. Its confidence
+# is 1 minus the product of 1 minus each reviewer's, so agreement raises it,
+# and it is "disputed" when not every reviewer whose review could be read
+# reported it or their severities differ.
+ensemble_review() {
+  local members=() member dir i pids=()
+  if [ -z "$REVIEW_BACKENDS" ]; then
+    claude_chat "$1" "with-p"
+    return
+  fi
+  read -r -a members <<<"$REVIEW_BACKENDS"
+  dir=$(mktemp -d)
+  for i in "${!members[@]}"; do
+    member="${members[$i]}"
+    (
+      BACKEND="${member%%:*}"
+      if [[ "$member" == *:* ]] && [ "$BACKEND" = "ollama" ]; then
+        OLLAMA_MODEL="${member#*:}"
+      elif [[ "$member" == *:* ]]; then
+        MODEL="${member#*:}"
+      fi
+      current_stage="$current_stage-$member"
+      claude_chat "$1" "with-p" >"$dir/$i.json"
+    ) &
+    pids+=($!)
+  done
+  for i in "${!pids[@]}"; do
+    wait "${pids[$i]}" || log "Review by ${members[$i]} failed" >&2
+  done
+  for i in "${!members[@]}"; do
+    jq -c --arg reviewer "${members[$i]}" '{reviewer: $reviewer, findings: [(.findings // [])[] | objects],
+      sections: (if (.sections | type) == "object" then .sections else {} end)}' "$dir/$i.json" 2>/dev/null ||
+      log "Could not parse the review by ${members[$i]}; leaving it out" >&2
+  done | jq -sc '
+    length as $n
+    | def rank: {"critical": 0, "major": 1, "minor": 2}[. // ""] // 3;
+    def near($a; $b): $a.file == $b.file and
+      (if ($a.line // 0) > 0 and ($b.line // 0) > 0 then ($a.line - $b.line | if . < 0 then -. else . end) <= 3
+       else $a.category == $b.category end);
+    ([.[] | .reviewer as $r | .findings[] | . + {reviewer: $r}]
+      | reduce .[] as $f ([];
+          ([to_entries[] | select(near(.value.members[0]; $f) and (any(.value.members[]; .reviewer == $f.reviewer) | not)) | .key] | first) as $g
+          | if $g == null then . + [{members: [$f]}] else .[$g].members += [$f] end)
+      | map(.members as $m
+          | ($m | min_by(.severity | rank)) + {
+              confidence: (1 - ($m | map(1 - ((.confidence // 1) | tonumber? // 1)) | reduce .[] as $x (1; . * $x))),
+              reviewers: ($m | map(.reviewer)),
+              agreement: "\($m | length)/\($n)",
+              disputed: (($m | length) < $n or ($m | map(.severity) | unique | length) > 1)}
+          | del(.reviewer))) as $findings
+    | {findings: $findings, sections: ([.[].sections] | reverse | add // {})}'
+  rm -rf "$dir"
+}
+
+# self_review asks the backend to review the staged change and feeds critical
+# findings back into generation and verification, at most SELF_REVIEW_MAX
+# times. Each finding is scored by its confidence times the weight of its
+# section in REVIEW_RUBRIC, and findings scoring below REVIEW_MIN_SCORE are
+# dropped. Each iteration is recorded in self-review.jsonl and the report; the
+# findings of the last review are left in review_findings.
+self_review() {
+  local iteration=1 prompt_file review weighed critical categories sections missing rubric disputed
+  local tone="${persona_tone:-$REVIEW_TONE}"
+  rubric=$(review_rubric)
+  categories=$(sed -E 's/[:=][^ ]*//g' <<<"$persona_weights $RULES" | tr ' ' '\n' | grep -v '^$' | sort -u | paste -sd, - | sed 's/,/, /g' || true)
+  sections=$(sed -E 's/=[^ ]*//g' <<<"security correctness performance style testing $REVIEW_RUBRIC $REVIEW_REQUIRED" |
+    tr ' ' '\n' | grep -v '^$' | awk '!seen[$0]++' | paste -sd'|' -)
+  while true; do
+    git add -A
+    prompt_file=$(mktemp)
+    cat >"$prompt_file" <<EOF5
+Review this change for the issue "$title" as $persona_role.
+Report bugs, security problems, missing tests and unmet requirements.
+${tone:+$tone
+}${categories:+Where they apply, use these category names: $categories.
+}${rubric:+$rubric
+}Give each finding the review section it belongs to and your confidence in it,
+from 0 (a guess) to 1 (certain).
+${acceptance_criteria:+
+Acceptance criteria:
+$acceptance_criteria
+}
+$(context_diff --cached)
+
+Format as JSON:
+{"findings": [{"severity": "critical|major|minor", "section": "$sections", "confidence": 0.0, "file": "path", "line": 0, "category": "short rule name", "rationale": "why the rule matters", "cwe": "CWE-n or empty", "owasp": "OWASP Top 10 entry or empty", "message": "what is wrong and how to fix it"}], "sections": {"section": "one-sentence verdict"}}
+EOF5
+    log "Self-review iteration $iteration"
+    review=$(ensemble_review "$prompt_file")
+    rm "$prompt_file"
+    if ! weighed=$(jq -r '(.findings // []) | to_entries[] | [.value.severity // "minor", .value.category // "",
+        (.value.file // "-") + (if (.value.line // 0) > 0 then ":\(.value.line)" else "" end), .key]
+        | map(tostring | gsub("[\t\n]"; " ")) | @tsv' <<<"$review" 2>/dev/null); then
+      log "Could not parse self-review response; skipping" >&2
+      review='{"findings": []}'
+    fi
+    review=$(jq -c --arg prefix "R$iteration." --arg weighed "$(persona_weigh <<<"$weighed")" \
+      --arg rubric "$REVIEW_RUBRIC" --arg required "$REVIEW_REQUIRED" --argjson min "$REVIEW_MIN_SCORE" '
+      ($weighed | split("\n") | map(select(. != "") | split("\t") | {(.[3]): .[0]}) | add // {}) as $severity
+      | ($rubric | split(" ") | map(select(contains("=")) | split("=") | {(.[0]): (.[1] | tonumber? // 1)}) | add // {}) as $weight
+      | (if (.sections | type) == "object" then .sections else {} end) as $sections
+      | {findings: [(.findings // []) | to_entries[] | (.key | tostring) as $key | select($severity[$key])
+          | {id: "\($prefix)\(.key + 1)"} + .value | .severity = $severity[$key]
+          | .score = ((((.confidence // 1) | tonumber? // 1) * ($weight[.section // ""] // 1) * 100 | floor) / 100)
+          | select(.score >= $min)] | sort_by(-.score),
+        sections: $sections,
+        missing_sections: [$required | split(" ")[] | . as $s | select($s != "" and ($sections | has($s) | not))]}' <<<"$review")
+    review_findings=$(jq -r '.findings[] | "- **\(.severity)** \(.id) `\(.file // "-")`: \(.message)"
+      + if .disputed then " _(disputed: reported by \(.reviewers | join(", ")), \(.agreement) reviewers)_" else "" end' <<<"$review")
+    critical=$(jq '[.findings[] | select(.severity == "critical")] | length' <<<"$review")
+    jq -c --argjson iteration "$iteration" '{iteration: $iteration} + .' <<<"$review" >>"$run_dir/self-review.jsonl"
+    missing=$(jq -r '.missing_sections | join(", ")' <<<"$review")
+    [ -z "$missing" ] || log "Self-review did not cover the required sections: $missing" >&2
+    disputed=$(jq '[.findings[] | select(.disputed)] | length' <<<"$review")
+    self_review_log+=("iteration $iteration: $(jq '.findings | length' <<<"$review") findings, $critical critical${missing:+, missing $missing}$([ "$disputed" -eq 0 ] || echo ", $disputed disputed")")
+
+    if [ "$critical" -eq 0 ] || [ "$iteration" -ge "$SELF_REVIEW_MAX" ]; then
+      break
+    fi
+
+    prompt_file=$(mktemp)
+    cat >"$prompt_file" <<EOF6
+A review of your implementation found these critical problems:
+
+$(jq -r '.findings[] | select(.severity == "critical") | "- \(.file // "-"): \(.message)"' <<<"$review")
+
+Here are the current code changes:
+$changes_json
+
+Fix the problems and return the corrected implementation.
+
+Format as JSON with the same structure as before:
+{
+  "files": {"path": "content"},
+  "new_files": [],
+  "deleted_files": [],
+  "summary": "..."
+}
+EOF6
+    changes_json=$(claude_chat "$prompt_file" "with-p")
+    rm "$prompt_file"
+    check_changes "$changes_json" || exit 1
+    verify_changes
+    iteration=$((iteration + 1))
+  done
+}
+
+# clarify pauses the run on ambiguous issues. Without pending questions it
+# asks the backend how well the issue specifies the work and, below
+# CLARIFY_THRESHOLD, posts its questions on the issue, saves them under
+# .cca/clarifications/ and exits. With pending questions it exits until the
+# issue author replies, then appends the replies to body and carries on.
+clarify() {
+  local state="$root_dir/.cca/clarifications/$number.json"
+  if [ -f "$state" ]; then
+    local answers
+    answers=$(gh issue view "$ISSUE_URL" --json author,comments | jq -r --arg since "$(jq -r '.asked_at' "$state")" '
+      .author.login as $author
+      | .comments[] | select(.author.login == $author and .createdAt > $since) | .body')
+    if [ -z "$answers" ]; then
+      log "Waiting for the issue author to answer the questions posted on $(jq -r '.asked_at' "$state")"
+      set_status status paused cause "waiting for answers to clarifying questions"
+      exit 0
+    fi
+    body="$body
+
+Clarifications from the issue author:
+Questions:
+$(jq -r '.questions[] | "- " + .' "$state")
+Answers:
+$answers"
+    rm "$state"
+    log "Resuming with the issue author's answers"
+    return
+  fi
+
+  local prompt_file assessment
+  prompt_file=$(mktemp)
+  cat >"$prompt_file" <<EOF8
+Decide whether this GitHub issue describes the required change clearly enough
+to implement it without guessing. Do not write any code.
+
+Issue: $title
+Description: $body
+${acceptance_criteria:+
+Acceptance criteria:
+$acceptance_criteria
+}
+Format as JSON:
+{"confidence": 0.0, "questions": ["questions for the issue author that would remove the ambiguity"]}
+EOF8
+  log "Assessing issue clarity with $BACKEND..."
+  assessment=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  if ! assessment=$(jq -c '{confidence: (.confidence // 1), questions: (.questions // [])}' <<<"$assessment" 2>/dev/null); then
+    log "Could not parse clarity assessment; continuing" >&2
+    return
+  fi
+  log "Issue clarity confidence: $(jq -r '.confidence' <<<"$assessment")"
+  if jq -e --argjson threshold "$CLARIFY_THRESHOLD" '.confidence >= $threshold or (.questions | length) == 0' <<<"$assessment" >/dev/null; then
+    return
+  fi
+
+  gh issue comment "$ISSUE_URL" --body "$(redact <<EOF
+$(msg comment.clarify)
+
+$(jq -r '.questions[] | "- " + .' <<<"$assessment")
+
+$(msg comment.clarify_reply)
+
+$(run_marker)
+EOF
+)" >/dev/null
+  mkdir -p "$(dirname "$state")"
+  jq --arg issue_url "$ISSUE_URL" --arg asked_at "$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+    '{issue_url: $issue_url, asked_at: $asked_at} + .' <<<"$assessment" >"$state"
+  set_status status paused cause "waiting for answers to clarifying questions"
+  log "Posted clarifying questions on $ISSUE_URL; pausing until the issue author replies"
+  exit 0
+}
+
+# decision_guard stops the run on issues dominated by open product or design
+# questions. Without a pending decision it asks the backend whether the issue
+# leaves such a decision open and, at DECISION_THRESHOLD or above, posts the
+# options with their trade-offs on the issue instead of implementing it, saves
+# them under .cca/decisions/ and exits. With a pending decision it exits until
+# someone replies, then appends the replies to body and carries on.
+decision_guard() {
+  local state="$root_dir/.cca/decisions/$number.json"
+  if [ -f "$state" ]; then
+    local replies
+    replies=$(gh issue view "$ISSUE_URL" --json comments | jq -r --arg since "$(jq -r '.asked_at' "$state")" --arg self "$(gh api user -q .login)" '
+      .comments[] | select(.author.login != $self and .createdAt > $since) | "\(.author.login): \(.body)"')
+    if [ -z "$replies" ]; then
+      log "Waiting for a decision on the options posted on $(jq -r '.asked_at' "$state")"
+      set_status status needs-decision cause "waiting for a product or design decision"
+      exit 0
+    fi
+    body="$body
+
+Decision from the maintainers:
+Options:
+$(jq -r '.options[] | "- " + .name + ": " + .description' "$state")
+Replies:
+$replies"
+    rm "$state"
+    log "Resuming with the maintainers' decision"
+    return
+  fi
+
+  local prompt_file assessment
+  prompt_file=$(mktemp)
+  cat >"$prompt_file" <<EOF19
+Decide whether this GitHub issue is dominated by open product or design
+questions (what the behaviour should be, which approach to take, what users
+should see) that the maintainers must answer before any code is written. Bugs
+with a clear expected behaviour and well-specified features are not. Do not
+write any code.
+
+Issue: $title
+Description: $body
+${acceptance_criteria:+
+Acceptance criteria:
+$acceptance_criteria
+}
+If a decision is needed, describe two to four options with their trade-offs.
+
+Format as JSON:
+{"confidence": 0.0, "decisions": ["the open question"], "options": [{"name": "short name", "description": "one sentence", "pros": ["..."], "cons": ["..."]}]}
+where confidence is how sure you are that a human decision is needed.
+EOF19
+  log "Checking whether the issue needs a product or design decision..."
+  assessment=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  if ! assessment=$(jq -c '{confidence: (.confidence // 0), decisions: (.decisions // []), options: (.options // [])}' <<<"$assessment" 2>/dev/null); then
+    log "Could not parse decision assessment; continuing" >&2
+    return
+  fi
+  printf '%s\n' "$assessment" >"$run_dir/decision.json"
+  log "Decision confidence: $(jq -r '.confidence' <<<"$assessment")"
+  if jq -e --argjson threshold "$DECISION_THRESHOLD" '.confidence < $threshold or (.options | length) < 2' <<<"$assessment" >/dev/null; then
+    return
+  fi
+
+  gh issue comment "$ISSUE_URL" --body "$(redact <<EOF
+$(msg comment.decision)
+
+$(jq -r '.decisions[] | "- " + .' <<<"$assessment")
+
+$(jq -r --arg pros "$(msg comment.pros)" --arg cons "$(msg comment.cons)" '.options[] |
+  "### " + .name + "\n\n" + (.description // "") + "\n\n" +
+  "- " + $pros + ": " + ((.pros // []) | join("; ")) + "\n" +
+  "- " + $cons + ": " + ((.cons // []) | join("; ")) + "\n"' <<<"$assessment")
+$(msg comment.decision_reply)
+
+$(run_marker)
+EOF
+)" >/dev/null
+  mkdir -p "$(dirname "$state")"
+  jq --arg issue_url "$ISSUE_URL" --arg asked_at "$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+    '{issue_url: $issue_url, asked_at: $asked_at} + .' <<<"$assessment" >"$state"
+  set_status status needs-decision cause "waiting for a product or design decision"
+  log "Posted design options on $ISSUE_URL; pausing until a maintainer decides"
+  exit 0
+}
+
+# run_resume re-runs every issue paused by clarify or decision_guard, and
+# every generation that was cancelled or interrupted while streaming. Issues
+# that nobody has replied to yet stay paused.
+run_resume() {
+  root_dir=$(git rev-parse --show-toplevel)
+  local state url args
+  for state in "$root_dir"/.cca/clarifications/*.json "$root_dir"/.cca/decisions/*.json \
+    "$root_dir"/.cca/checkpoints/*/checkpoint.json; do
+    [ -f "$state" ] || continue
+    url=$(jq -r '.issue_url // ""' "$state")
+    args=("$url")
+    if [ -z "$url" ]; then
+      url=$(jq -r '.issue_file' "$state")
+      args=(--issue-file "$url")
+      [ "$(jq -r '.offline' "$state")" != "true" ] || args+=(--offline)
+    fi
+    log "Resuming $url"
+    "$0" "${args[@]}" || log "Run for $url failed" >&2
+  done
+}
+
+# run_multi implements issue $1 across the repositories listed in manifest
+# $2, one "owner/repo path [dependency...]" line each with the path of a
+# local clone relative to the manifest. Repositories run in dependency order
+# with the pull requests of their dependencies in the prompt; one whose
+# dependency failed is skipped. Every pull request and the issue then get the
+# merge order, and the outcome is saved in multi.json.
+run_multi() {
+  local issue="$1" manifest="$2" script base repo path deps dep order
+  local -A paths=() needs=() prs=() states=()
+  root_dir=$(git rev-parse --show-toplevel)
+  script=$(realpath "$0")
+  [ -f "$manifest" ] || { log "No such manifest: $manifest" >&2; exit 1; }
+  base=$(cd "$(dirname "$manifest")" && pwd)
+  while read -r repo path deps; do
+    [[ -n "$repo" && "$repo" != \#* ]] || continue
+    [[ "$path" == /* ]] || path="$base/$path"
+    if [ "$(repo_of "$(git -C "$path" remote get-url origin 2>/dev/null)")" != "$repo" ]; then
+      log "$path is not a clone of $repo" >&2
+      exit 1
+    fi
+    paths[$repo]="$path"
+    needs[$repo]="$deps"
+  done <"$manifest"
+  if ! order=$(for repo in "${!paths[@]}"; do
+      echo "$repo $repo"
+      for dep in ${needs[$repo]}; do echo "$dep $repo"; done
+    done | tsort 2>&1); then
+    log "Dependencies in $manifest form a cycle: $(sed -n 's/^tsort: \([^:]*\)$/\1/p' <<<"$order" | paste -sd' ' -)" >&2
+    exit 1
+  fi
+  for repo in $order; do
+    [ -n "${paths[$repo]:-}" ] || { log "$repo is a dependency but not listed in $manifest" >&2; exit 1; }
+  done
+  init_run_dir "multi-${issue##*/}"
+  log "Implementing $issue in $(wc -w <<<"$order") repositories: $(paste -sd' ' - <<<"$order")"
+
+  local note status_file
+  for repo in $order; do
+    states[$repo]="completed"
+    for dep in ${needs[$repo]}; do
+      [ "${states[$dep]}" = "completed" ] || states[$repo]="skipped"
+    done
+    if [ "${states[$repo]}" = "skipped" ]; then
+      log "Skipping $repo: a repository it depends on did not complete" >&2
+      continue
+    fi
+    note="$run_dir/note-${repo//\//-}.md"
+    {
+      echo "This issue is implemented across these repositories, in this order: $(paste -sd' ' - <<<"$order")."
+      echo "You are working in $repo.${needs[$repo]:+ It depends on the changes below, which are already open as pull requests.}"
+      for dep in ${needs[$repo]}; do
+        [ -n "${prs[$dep]:-}" ] || continue
+        echo
+        echo "Pull request in $dep: ${prs[$dep]}"
+        echo '```diff'
+        gh pr diff "${prs[$dep]}" | head -c "$((CONTEXT_MAX_BYTES / 4))"
+        echo '```'
+      done
+      [ -z "${CCA_PROMPT_APPEND:-}" ] || cat "${paths[$repo]}/$CCA_PROMPT_APPEND" 2>/dev/null || cat "$CCA_PROMPT_APPEND" 2>/dev/null || true
+    } >"$note"
+    log "Running CCA in ${paths[$repo]} ($repo)"
+    if ! (cd "${paths[$repo]}" && CCA_PROMPT_APPEND="$note" CCA_READ_ONLY="$READ_ONLY" "$script" "$issue"); then
+      log "Run for $repo failed" >&2
+      states[$repo]="failed"
+      continue
+    fi
+    prs[$repo]=""
+    for status_file in "${paths[$repo]}"/.cca/runs/*/status.json; do
+      [ "$(jq -r '.issue_url // ""' "$status_file" 2>/dev/null)" != "$issue" ] || prs[$repo]=$(jq -r '.pr_url // ""' "$status_file")
+    done
+  done
+
+  local list="" n=0 entry
+  for repo in $order; do
+    n=$((n + 1))
+    case "${states[$repo]}" in
+      completed) entry="${prs[$repo]:-$(msg comment.multi_missing "$repo")}" ;;
+      failed) entry="$repo: $(msg comment.failed)" ;;
+      *) entry="$repo: $(msg comment.skipped)" ;;
+    esac
+    list+="$n. $entry${needs[$repo]:+ ($(msg comment.multi_after "${needs[$repo]// /, }"))}"$'\n'
+  done
+  for repo in $order; do
+    jq -nc --arg repo "$repo" --arg path "${paths[$repo]}" --arg needs "${needs[$repo]}" \
+      --arg state "${states[$repo]}" --arg pr_url "${prs[$repo]:-}" \
+      '{repo: $repo, path: $path, depends_on: ($needs | split(" ") | map(select(. != ""))), state: $state, pr_url: $pr_url}'
+  done | jq -s --arg issue "$issue" '{issue_url: $issue, repositories: .}' >"$run_dir/multi.json"
+  log "Merge order:"$'\n'"$list"
+
+  if [ "$READ_ONLY" -eq 1 ]; then
+    log "Not commenting the merge order (read-only)"
+  else
+    local body
+    body="$(msg comment.multi "$(wc -w <<<"$order")")"$'\n\n'"$list"$'\n'"$(run_marker)"
+    for repo in $order; do
+      [ -z "${prs[$repo]:-}" ] || gh pr comment "${prs[$repo]}" --body "$body" >/dev/null
+    done
+    gh issue comment "$issue" --body "$body" >/dev/null
+  fi
+  jq -e 'all(.repositories[]; .state != "failed")' "$run_dir/multi.json" >/dev/null
+}
+
+# issue_references prints the file paths and identifiers quoted in backticks in
+# the issue body on stdin, one per line.
+issue_references() {
+  grep -o '`[^`[:space:]]\{3,\}`' | tr -d '`' | grep -E '^[A-Za-z_./-][A-Za-z0-9_./:-]*(\(\))?$' | sed 's/()$//; s/:[0-9]*$//' | sort -u || true
+}
+
+# repro_commands prints the shell commands of the issue body on stdin: the
+# lines of sh, bash, shell and console code blocks, without "$ " prompts.
+repro_commands() {
+  awk '
+    /^```/ { if (block) { block = 0 } else if ($0 ~ /^```(sh|bash|shell|console)[[:space:]]*$/) { block = 1 }; next }
+    block && /^\$ / { print substr($0, 3); next }
+    block && !/^#/ && NF { print }
+  '
+}
+
+# run_revalidate checks whether an old issue still applies: it looks up the
+# files and symbols the issue refers to, lists the commits that touched them
+# since it was opened and, with REVALIDATE_RUN=1, runs its reproduction steps
+# on BASE_REF. The backend's verdict is posted as a comment, and obviously
+# fixed issues are closed when REVALIDATE_CLOSE=1.
+run_revalidate() {
+  local url="$1"
+  if [[ "$url" != *github.com* || "$url" != */issues/* ]]; then
+    log "Invalid GitHub issue URL: $url" >&2
+    exit 1
+  fi
+  require_tools
+  root_dir=$(git rev-parse --show-toplevel)
+
+  local issue_json created
+  issue_json=$(gh issue view "$url" --json number,title,body,createdAt,state)
+  number=$(jq -r '.number' <<<"$issue_json")
+  title=$(jq -r '.title' <<<"$issue_json")
+  body=$(jq -r '.body' <<<"$issue_json")
+  created=$(jq -r '.createdAt' <<<"$issue_json")
+  if [ "$(jq -r '.state' <<<"$issue_json")" != "OPEN" ]; then
+    log "Issue #$number is already closed" >&2
+    exit 1
+  fi
+  log "Re-validating #$number: $title (opened $created)"
+  resolve_language
+  init_run_dir "revalidate-$number"
+
+  deepen_until "issue history" history_covers "$created"
+  local ref references="" files=()
+  while read -r ref; do
+    [ -n "$ref" ] || continue
+    if git ls-files --error-unmatch "$ref" >/dev/null 2>&1; then
+      references+="- file \`$ref\` exists"$'\n'
+      files+=("$ref")
+    elif [[ "$ref" == */* || "$ref" == *.* && "$ref" != *[A-Z]* ]]; then
+      references+="- file \`$ref\` no longer exists$(git log --diff-filter=D --format=' (deleted in %h: %s)' -1 -- "$ref")"$'\n'
+    elif [ "$(git grep -wlF "${ref##*.}" | wc -l)" -gt 0 ]; then
+      references+="- symbol \`$ref\` appears in: $(git grep -wlF "${ref##*.}" | head -n 5 | paste -sd' ' -)"$'\n'
+      mapfile -t -O "${#files[@]}" files < <(git grep -wlF "${ref##*.}" | head -n 5)
+    else
+      references+="- symbol \`$ref\` is not found in the code"$'\n'
+    fi
+  done < <(issue_references <<<"$body")
+
+  local history=""
+  if [ "${#files[@]}" -gt 0 ]; then
+    history=$(git log --since="$created" --format='- %h %s' "$BASE_REF" -- "${files[@]}" | head -n 30)
+  fi
+
+  local commands repro=""
+  commands=$(repro_commands <<<"$body")
+  if [ -z "$commands" ]; then
+    repro="No reproduction steps found."
+  elif [ "$REVALIDATE_RUN" -eq 1 ]; then
+    local dir="$root_dir/.cca/worktrees/revalidate-$number" code=0
+    git worktree add --detach "$dir" "$BASE_REF" >/dev/null 2>&1
+    pushd "$dir" >/dev/null
+    detect_toolchains
+    repro=$(limited timeout -k 30s "$VERIFY_TIMEOUT" "${VERIFY_RUNNER[@]}" bash -c "$commands" 2>&1 </dev/null) || code=$?
+    popd >/dev/null
+    git worktree remove --force "$dir"
+    printf '%s\n' "$repro" >"$run_dir/repro.log"
+    repro="Ran the reproduction steps on $BASE_REF (exit code $code):
+$(tail -n 50 <<<"$repro")"
+  else
+    repro="Reproduction steps were not run (CCA_REVALIDATE_RUN=0)."
+    skip "reproduction steps (CCA_REVALIDATE_RUN=0)"
+  fi
+
+  local prompt_file verdict
+  prompt_file=$(mktemp)
+  cat >"$prompt_file" <<EOF14
+Decide whether this GitHub issue, opened on $created, still applies to the
+current code.
+
+Issue: $title
+Description: $body
+
+What the issue refers to, checked against the current code:
+${references:-nothing specific}
+
+Commits touching those files since the issue was opened:
+${history:-none}
+
+$repro
+
+Format as JSON:
+{"status": "applies|fixed|obsolete|unclear", "confidence": 0.0, "summary": "what was found and why"}
+EOF14
+  verdict=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  if ! verdict=$(jq -c '{status: (.status // "unclear"), confidence: (.confidence // 0), summary: (.summary // "")}' <<<"$verdict" 2>/dev/null); then
+    log "Could not parse re-validation verdict" >&2
+    exit 1
+  fi
+  jq . <<<"$verdict" >"$run_dir/revalidate.json"
+
+  local status comment
+  status=$(jq -r '.status' <<<"$verdict")
+  comment="$(msg comment.revalidate "$status" "$(git rev-parse --short "$BASE_REF")")
+
+$(jq -r '.summary' <<<"$verdict")
+${references:+
+$(msg comment.references)
+$references}${history:+
+$(msg comment.history)
+$history}"
+  if [ "$READ_ONLY" -eq 1 ]; then
+    printf '%s\n' "$comment"
+    log "Read-only mode: not commenting on $url"
+    return 0
+  fi
+  gh issue comment "$url" --body "$(fit_body "$(redact <<<"$comment"$'\n\n'"$(run_marker)")" revalidate-comment)" >/dev/null
+  log "Posted re-validation status ($status) on $url"
+  if [ "$status" = "fixed" ] && [ "$REVALIDATE_CLOSE" -eq 1 ] &&
+    jq -e '.confidence >= 0.9' <<<"$verdict" >/dev/null; then
+    gh issue close "$url" --reason completed >/dev/null
+    log "Closed $url as fixed"
+  fi
+}
+
+# make_plan asks the backend for a structured implementation plan, writes it
+# to plan.json and plan.md in the run directory and, with --interactive, lets
+# the user edit plan.json before generation. The plan is left in plan_json.
+make_plan() {
+  local prompt_file plan errors
+  prompt_file=$(mktemp)
+  [ -z "$uncovered_functions" ] || context_replay "$run_dir/coverage-considered.tsv"
+  cat >"$prompt_file" <<EOF7
+Plan the implementation of this GitHub issue. Do not write the code yet.
+
+Issue: $title
+Description: $body
+Repository: $repo
+${acceptance_criteria:+
+Acceptance criteria:
+$acceptance_criteria
+}${error_locations:+
+The error messages quoted in the issue are produced here:
+$error_locations
+}${stack_locations:+
+The stack trace in the issue points at these locations, innermost first:
+$stack_locations
+}${uncovered_functions:+
+These functions in the files likely to change have little or no test
+coverage (path:line function). List tests for the ones the change touches:
+$uncovered_functions
+}
+Format as JSON:
+{
+  "files": [{"path": "path/to/file", "change": "what changes in this file"}],
+  "functions": ["functions or types to add or change"],
+  "tests": ["tests to write"],
+  "migration_steps": ["steps needed to roll the change out, if any"]
+}
+EOF7
+  log "Planning implementation with $BACKEND..."
+  plan=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  plan=$(jq --argjson v "$SCHEMA_VERSION" '{schema_version: $v} + .' <<<"$plan" 2>/dev/null || true)
+  if ! errors=$(validate_json plan <<<"$plan"); then
+    log "Backend did not return a valid plan:"$'\n'"$errors" >&2
+    exit 1
+  fi
+  printf '%s\n' "$plan" >"$run_dir/plan.json"
+
+  if [ "$INTERACTIVE" -eq 1 ] && [ -t 0 ]; then
+    log "Opening plan in ${EDITOR:-vi}; save and exit to continue"
+    "${EDITOR:-vi}" "$run_dir/plan.json"
+    if ! errors=$(validate_json plan <"$run_dir/plan.json"); then
+      log "Edited plan does not match the plan schema:"$'\n'"$errors" >&2
+      exit 1
+    fi
+  fi
+  plan_json=$(jq -c 'del(.schema_version)' "$run_dir/plan.json")
+
+  jq -r '
+    "# Implementation plan\n\n## Files\n" + ([.files[] | "- `\(.path)`: \(.change)"] | join("\n"))
+    + "\n\n## Functions\n" + ([.functions[]? | "- \(.)"] | join("\n"))
+    + "\n\n## Tests\n" + ([.tests[]? | "- \(.)"] | join("\n"))
+    + "\n\n## Migration steps\n" + ([.migration_steps[]? | "- \(.)"] | join("\n"))
+  ' <<<"$plan_json" >"$run_dir/plan.md"
+  log "Wrote plan with $(jq '.files | length' <<<"$plan_json") files to $run_dir/plan.md"
+}
+
+# generate_tests asks the backend for tests only, derived from the acceptance
+# criteria or the issue description, and leaves them in tests_json.
+generate_tests() {
+  local prompt_file
+  prompt_file=$(mktemp)
+  [ -z "$uncovered_functions" ] || context_replay "$run_dir/coverage-considered.tsv"
+  cat >"$prompt_file" <<EOF10
+Write tests for this GitHub issue before it is implemented. Do not implement
+the change itself; the tests must fail until it is.
+
+Issue: $title
+Description: $body
+Repository: $repo
+${acceptance_criteria:+
+Acceptance criteria (write at least one test per criterion):
+$acceptance_criteria
+}${target_paths:+
+The implementation will be limited to these paths:
+$target_paths
+}${uncovered_functions:+
+These functions in the files likely to change have little or no test
+coverage (path:line function). Prefer tests that exercise them:
+$uncovered_functions
+}
+Return only test files with their complete content.
+
+Format as JSON:
+{
+  "files": {"path/to/file_test.go": "complete file content..."},
+  "summary": "Brief description of the tests"
+}
+EOF10
+  log "Generating failing tests with $BACKEND..."
+  tests_json=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  if ! check_changes "$tests_json" || ! jq -e '.files | length > 0' <<<"$tests_json" >/dev/null 2>&1; then
+    log "Backend did not return any tests" >&2
+    exit 1
+  fi
+}
+
+# is_bug_report succeeds when the issue carries one of BUG_LABELS and its
+# description contains reproduction steps.
+is_bug_report() {
+  local label
+  for label in $BUG_LABELS; do
+    if grep -qxF "$label" <<<"$issue_labels"; then
+      grep -qiE 'steps to reproduce|reproduc(e|tion)|^```(sh|bash|shell|console)' <<<"$body"
+      return
+    fi
+  done
+  return 1
+}
+
+# error_fragments prints the literal parts of error messages quoted in the
+# text on stdin: log lines are split at ": " the way wrapped errors are, and
+# quoted values, paths and numbers are cut out since they are usually
+# formatted in at runtime.
+error_fragments() {
+  grep -v '^[[:space:]]*```' | grep -iE '(error|panic|fatal|exception|failed|cannot|unable)' | head -n 50 |
+    sed -E '/`[^`]+`/ { s/^[^`]*`//; s/`[^`]*$//; s/`[^`]*`/\n/g; }' |
+    sed -E 's/^[[:space:]>]*//; s/^[0-9]{4}[-/][0-9]{2}[-/][0-9]{2}[T ][0-9:.,Z+-]+[[:space:]]*//; s/^\[?(ERROR|FATAL|WARN(ING)?|error|fatal|panic)\]?:?[[:space:]]*//' |
+    awk -F': ' '{ for (i = 1; i <= NF; i++) print $i }' |
+    sed -E "s/\"[^\"]*\"|'[^']*'|[^[:space:]]*[/\\][^[:space:]]*|[^[:space:]]*[0-9][^[:space:]]*/\n/g" |
+    sed -E 's/^[[:space:][:punct:]]+|[[:space:][:punct:]]+$//g' |
+    awk 'NF >= 2 && length($0) >= 12' | awk '!seen[$0]++' | head -n 10
+}
+
+# error_sources prints the code that produces the error messages quoted in
+# body, as "<path>:<line>: <code>" under the message fragment that matched.
+error_sources() {
+  local fragment matches
+  while read -r fragment; do
+    matches=$(git grep -nF -e "$fragment" -- ':!*.md' ':!*_test.go' ':!*.test.*' 2>/dev/null | head -n 3 |
+      sed -E 's/^([^:]+:[0-9]+:)[[:space:]]*/\1 /' | cut -c1-200 || true)
+    [ -z "$matches" ] || printf '"%s":\n%s\n' "$fragment" "$(sed 's/^/  /' <<<"$matches")"
+  done < <(error_fragments <<<"$body")
+}
+
+# stack_frames prints "<path>\t<line>\t<function>" for the frames of Go
+# panics, Python tracebacks and JavaScript stack traces in the text on stdin,
+# innermost first.
+stack_frames() {
+  awk '
+    /^[a-zA-Z0-9_.\/*()-]+\(.*\)$/ { fn = $0; sub(/\(.*$/, "", fn); next }
+    /^\t[^ ]+\.go:[0-9]+/ { split($1, a, ":"); print a[1] "\t" a[2] "\t" fn; next }
+    /File "[^"]+", line [0-9]+/ {
+      match($0, /"[^"]+"/); path = substr($0, RSTART + 1, RLENGTH - 2)
+      match($0, /line [0-9]+/); line = substr($0, RSTART + 5, RLENGTH - 5)
+      f = $0; sub(/.*, in /, "", f); if (f == $0) f = ""
+      py[++n] = path "\t" line "\t" f; next
+    }
+    /^[[:space:]]+at / {
+      f = ""; loc = $2
+      if ($3 != "") { f = $2; loc = $3 }
+      gsub(/[()]/, "", loc); sub(/^file:\/\//, "", loc)
+      if (split(loc, a, ":") >= 3) print a[1] "\t" a[2] "\t" f
+    }
+    END { for (i = n; i >= 1; i--) print py[i] }
+  '
+}
+
+# resolve_frame prints the repository path of the stack frame file $1: the
+# longest path suffix that matches a tracked file, or the current name of a
+# file that was renamed since.
+resolve_frame() {
+  local path="${1#./}" suffix match
+  suffix="$path"
+  while :; do
+    match=$(git ls-files | grep -E "(^|/)$(sed 's/[.[\*^$]/\\&/g' <<<"$suffix")$" || true)
+    if [ "$(grep -c . <<<"$match")" -eq 1 ]; then
+      echo "$match"
+      return
+    fi
+    [ "$suffix" != "${suffix#*/}" ] || break
+    suffix="${suffix#*/}"
+  done
+  deepen_until "renamed paths" history_covers "1 year ago"
+  git log --diff-filter=R --name-status --format= "$BASE_REF" 2>/dev/null |
+    awk -F'\t' -v path="$path" 'length($2) <= length(path) && substr(path, length(path) - length($2) + 1) == $2 { print $3; exit }'
+}
+
+# stack_context maps the stack frames in body to files and lines of the
+# current tree and prints each with a short code excerpt, at most 10 frames.
+stack_context() {
+  local path line fn file count=0
+  while IFS=$'\t' read -r path line fn; do
+    file=$(resolve_frame "$path")
+    [ -n "$file" ] && [ -f "$file" ] || continue
+    echo "$file:$line${fn:+ ($fn)}"
+    sed -n "$((line > 3 ? line - 3 : 1)),$((line + 3))p" "$file" | sed 's/^/    /'
+    count=$((count + 1))
+    [ "$count" -lt 10 ] || break
+  done < <(stack_frames <<<"$body" | awk '!seen[$0]++')
+}
+
+# looks_english succeeds when the text on stdin is mostly ASCII and, when it
+# is long enough to tell, uses common English words.
+looks_english() {
+  local text words stopwords non_ascii
+  text=$(cat)
+  non_ascii=$(LC_ALL=C tr -d '\000-\177' <<<"$text" | wc -c)
+  [ $((non_ascii * 10)) -le "${#text}" ] || return 1
+  words=$(wc -w <<<"$text")
+  [ "$words" -ge 20 ] || return 0
+  stopwords=$(tr -cs 'A-Za-z' '\n' <<<"$text" | grep -ciwE 'the|and|to|of|is|in|it|for|when|with|this|that|not|be' || true)
+  [ $((stopwords * 20)) -ge "$words" ]
+}
+
+# normalize_issue translates a non-English issue into English for the prompts
+# with the backend, keeping the original in issue-translation.json and
+# original_title, and records its language in issue_language.
+normalize_issue() {
+  { echo "$title"; echo "$body"; } | looks_english && return 0
+  local prompt_file translation
+  prompt_file=$(mktemp)
+  cat >"$prompt_file" <<EOF16
+Detect the language of this GitHub issue and translate its title and body into
+English. Keep code blocks, identifiers, file paths, URLs, log output and error
+messages exactly as they are.
+
+Title: $title
+Body:
+$body
+
+Format as JSON:
+{"language": "ISO 639-1 code of the original", "title": "English title", "body": "English body"}
+EOF16
+  log "Translating the issue with $BACKEND..."
+  translation=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  if ! jq -e '.language and .title and .body' <<<"$translation" >/dev/null 2>&1; then
+    log "Could not parse the issue translation; using the original" >&2
+    return
+  fi
+  issue_language=$(jq -r '.language' <<<"$translation")
+  [ "$issue_language" != "en" ] || return 0
+  jq --arg title "$title" --arg body "$body" '{language, original: {title: $title, body: $body}, translation: {title, body}}' \
+    <<<"$translation" >"$run_dir/issue-translation.json"
+  original_title="$title"
+  title=$(jq -r '.title' <<<"$translation")
+  body="$(jq -r '.body' <<<"$translation")
+
+(Translated from $issue_language. The original is in issue-translation.json.)"
+  log "Translated the issue from $issue_language"
+}
+
+# generate_repro asks the backend for a test that reproduces the reported bug
+# and leaves it in tests_json, like generate_tests.
+generate_repro() {
+  local prompt_file
+  prompt_file=$(mktemp)
+  [ -z "$related_symbols" ] || context_replay "$run_dir/symbols-considered.tsv"
+  cat >"$prompt_file" <<EOF15
+This GitHub issue reports a bug. Write a test that reproduces the reported
+behavior by following the reproduction steps as closely as possible, and that
+asserts the expected behavior, so it fails until the bug is fixed. Do not fix
+the bug.
+
+Issue: $title
+Description: $body
+Repository: $repo
+${error_locations:+
+The error messages quoted in the issue are produced here:
+$error_locations
+}${stack_locations:+
+The stack trace in the issue points at these locations, innermost first:
+$stack_locations
+}${related_symbols:+
+Existing code that looks related to the issue (path:line, kind, signature):
+$related_symbols
+}
+Put the test next to the existing tests of the affected code. Return only test
+files with their complete content.
+
+Format as JSON:
+{
+  "files": {"path/to/file_test.go": "complete file content..."},
+  "summary": "How the test reproduces the bug"
+}
+EOF15
+  log "Generating a reproduction test with $BACKEND..."
+  tests_json=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  if ! check_changes "$tests_json" || ! jq -e '.files | length > 0' <<<"$tests_json" >/dev/null 2>&1; then
+    log "Backend did not return a reproduction test; continuing without one" >&2
+    tests_json=""
+    return
+  fi
+  repro=1
+}
+
+# commit_failing_tests applies tests_json in the current directory, checks
+# that verification fails with them and commits them on their own with the
+# message $1.
+commit_failing_tests() {
+  local tmp_tests output
+  tmp_tests=$(mktemp)
+  echo "$tests_json" >"$tmp_tests"
+  apply_changes "$tmp_tests"
+  rm "$tmp_tests"
+  format_changes
+
+  detect_toolchains
+  log "Running verification with the new tests only..."
+  if output=$(run_verify full); then
+    log "New tests already pass before the implementation" >&2
+    tdd_log+=("red: new tests passed before implementation (not a failing test)")
+    [ "$repro" -eq 0 ] || repro_result=$(msg pr.repro_passes "$BASE_REF")
+  else
+    redact <<<"$output" >"$run_dir/tdd-red.log"
+    log "New tests fail as expected; see $run_dir/tdd-red.log"
+    tdd_log+=("red: new tests fail before implementation")
+    [ "$repro" -eq 0 ] || repro_result="$(msg pr.repro_fails "$BASE_REF")
+\`\`\`
+$(tail -n 30 <<<"$output" | redact)
+\`\`\`"
+  fi
+  git add -A
+  cca_commit -q -m "$1"
+  log "Committed tests"
+}
+
+# fuzz_candidates prints "<file>\t<function>" for functions in changed Go
+# files whose names suggest parsing or decoding and that take []byte or string.
+fuzz_candidates() {
+  local path
+  while read -r path; do
+    [ -f "$path" ] || continue
+    sed -n -E 's/^func ([A-Za-z0-9_]*([Pp]arse|[Dd]ecode|[Uu]nmarshal|[Rr]ead|[Ll]oad|[Ss]can)[A-Za-z0-9_]*)\([^)]*(\[\]byte|string)[,)].*/\1/p' "$path" |
+      sed "s|^|$path\t|"
+  done < <(git status --porcelain --untracked-files=all | cut -c4- | grep '\.go$' | grep -v '_test\.go$')
+}
+
+# add_fuzz_targets asks the backend for Go native fuzz targets for the parsing
+# functions in the change, seeded from the package's existing tests, and
+# verifies them with the change. With FUZZ_TIME set each target is fuzzed for
+# that long; crashes are recorded in fuzz_findings and their inputs moved to
+# the run directory.
+add_fuzz_targets() {
+  local candidates
+  candidates=$(fuzz_candidates)
+  if [ -z "$candidates" ]; then
+    skip "fuzz targets (no parsing functions changed)"
+    return
+  fi
+
+  local prompt_file fuzz_json file dir test
+  prompt_file=$(mktemp)
+  {
+    echo "Write Go native fuzz targets (func FuzzXxx(f *testing.F)) for these functions,"
+    echo "which parse untrusted input. Add seed inputs with f.Add, taken from the"
+    echo "existing tests where possible. A target must fail only on panics or broken"
+    echo "invariants (for example a decode/encode round trip), not on invalid input."
+    echo
+    cut -f2 <<<"$candidates" | sed 's/^/- /'
+    echo
+    while read -r file; do
+      echo "File: $file"
+      context_file "$file"
+      echo
+      for test in "$(dirname "$file")"/*_test.go; do
+        [ -f "$test" ] || continue
+        echo "Existing test file: $test"
+        context_file "$test"
+        echo
+      done
+    done < <(cut -f1 <<<"$candidates" | sort -u)
+    echo 'Format as JSON: {"files": {"path/to/fuzz_test.go": "complete file content"}}'
+  } >"$prompt_file"
+  log "Generating fuzz targets for $(wc -l <<<"$candidates") functions..."
+  fuzz_json=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  if ! check_changes "$fuzz_json" || ! jq -e '.files | length > 0' <<<"$fuzz_json" >/dev/null 2>&1; then
+    log "Backend did not return fuzz targets; skipping" >&2
+    return
+  fi
+  changes_json=$(jq -c --argjson fuzz "$fuzz_json" '.files += $fuzz.files' <<<"$changes_json")
+  verify_changes
+
+  if [ -z "$FUZZ_TIME" ]; then
+    skip "fuzzing (CCA_FUZZ_TIME not set)"
+    return
+  fi
+  local name corpus before
+  while read -r file; do
+    [ -f "$file" ] || continue
+    dir=$(dirname "$file")
+    for name in $(sed -n 's/^func \(Fuzz[A-Za-z0-9_]*\)(.*/\1/p' "$file"); do
+      corpus="$dir/testdata/fuzz/$name"
+      before=$(ls "$corpus" 2>/dev/null || true)
+      log "Fuzzing $name in $dir for $FUZZ_TIME"
+      if (cd "$dir" && go test -run '^$' -fuzz "^$name\$" -fuzztime "$FUZZ_TIME" . >"$run_dir/fuzz-$name.log" 2>&1); then
+        continue
+      fi
+      fuzz_findings+=("- **critical** \`$file\`: $name found a failing input; see fuzz-$name.log in the run artifacts")
+      mkdir -p "$run_dir/fuzz/$name"
+      comm -13 <(echo "$before") <(ls "$corpus" 2>/dev/null || true) | sed '/^$/d' | while read -r input; do
+        mv "$corpus/$input" "$run_dir/fuzz/$name/"
+      done
+      rmdir -p "$corpus" 2>/dev/null || true
+      log "$name found a failing input" >&2
+    done
+  done < <(jq -r '.files | keys[]' <<<"$fuzz_json")
+}
+
+# http_endpoints prints "<file>:<line>: <registration>" for HTTP route
+# registrations (net/http, gorilla/mux, chi, gin, echo) in changed Go files.
+http_endpoints() {
+  git status --porcelain --untracked-files=all | cut -c4- | grep '\.go$' | grep -v '_test\.go$' |
+    while read -r path; do
+      [ -f "$path" ] || continue
+      grep -nE '\.(HandleFunc|Handle|Get|Post|Put|Patch|Delete|GET|POST|PUT|PATCH|DELETE|Method)\("/' "$path" |
+        sed -E "s|^([0-9]+):[[:space:]]*|$path:\1: |"
+    done
+}
+
+# openapi_spec prints the path of the repository's OpenAPI document, if any.
+openapi_spec() {
+  git ls-files | grep -E '(^|/)(openapi|swagger)\.(ya?ml|json)$' | head -n 1
+}
+
+# add_contract_tests asks the backend for httptest contract tests of the HTTP
+# endpoints registered in the changed files, asserting status codes, content
+# types and response shapes, and for an updated OpenAPI document when the
+# repository has one. The results are verified with the change.
+add_contract_tests() {
+  local endpoints
+  endpoints=$(http_endpoints)
+  if [ -z "$endpoints" ]; then
+    skip "contract tests (no HTTP endpoints changed)"
+    return
+  fi
+
+  local prompt_file contract_json file spec
+  spec=$(openapi_spec)
+  prompt_file=$(mktemp)
+  {
+    echo "Write Go contract tests with net/http/httptest for these HTTP endpoints."
+    echo "For each endpoint, assert the status codes, the Content-Type header and"
+    echo "the shape of the response body (required fields and their JSON types)"
+    echo "for both successful and invalid requests."
+    echo
+    echo "$endpoints"
+    echo
+    while read -r file; do
+      echo "File: $file"
+      context_file "$file"
+      echo
+    done < <(cut -d: -f1 <<<"$endpoints" | sort -u)
+    if [ -n "$spec" ]; then
+      echo "The repository documents its API in $spec. Return it updated so that it"
+      echo "matches these endpoints, and assert the responses against it."
+      echo
+      echo "File: $spec"
+      context_file "$spec"
+      echo
+    fi
+    echo 'Format as JSON: {"files": {"path/to/contract_test.go": "complete file content"}}'
+  } >"$prompt_file"
+  log "Generating contract tests for $(wc -l <<<"$endpoints") endpoints..."
+  contract_json=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  if ! check_changes "$contract_json" || ! jq -e '.files | length > 0' <<<"$contract_json" >/dev/null 2>&1; then
+    log "Backend did not return contract tests; skipping" >&2
+    return
+  fi
+  changes_json=$(jq -c --argjson contract "$contract_json" '.files += $contract.files' <<<"$changes_json")
+  verify_changes
+  if [ -n "$spec" ] && jq -e --arg spec "$spec" '.files | has($spec)' <<<"$contract_json" >/dev/null; then
+    log "Updated OpenAPI document $spec"
+  fi
+}
+
+# trace_criteria asks the backend which tests in the change between $1 and
+# HEAD cover each acceptance criterion, writes traceability.json to the run
+# directory and leaves a markdown matrix in traceability and the criteria
+# without tests in criteria_gaps.
+trace_criteria() {
+  local prompt_file mapping
+  prompt_file=$(mktemp)
+  cat >"$prompt_file" <<EOF9
+Map each acceptance criterion to the test cases in this change that verify it.
+Only list tests that appear in the diff. Leave "tests" empty when no test
+covers a criterion.
+
+Acceptance criteria:
+$acceptance_criteria
+
+$(context_diff "$1...HEAD")
+
+Format as JSON:
+{"criteria": [{"criterion": "text of the criterion", "tests": ["path/to/file: TestName"]}]}
+EOF9
+  log "Tracing acceptance criteria to tests..."
+  mapping=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  if ! mapping=$(jq -c '{criteria: [.criteria[] | {criterion, tests: (.tests // [])}]}' <<<"$mapping" 2>/dev/null); then
+    log "Could not parse acceptance criteria mapping; skipping" >&2
+    return
+  fi
+  jq . <<<"$mapping" >"$run_dir/traceability.json"
+  traceability=$(jq -r '
+    "| Acceptance criterion | Tests |\n| --- | --- |",
+    (.criteria[] | "| \(.criterion | gsub("\\|"; "\\|")) | \(if (.tests | length) == 0 then "**none**" else (.tests | map("`" + . + "`") | join("<br>")) end) |")
+  ' <<<"$mapping")
+  mapfile -t criteria_gaps < <(jq -r '.criteria[] | select((.tests | length) == 0) | .criterion' <<<"$mapping")
+}
+
+report() {
+  log "$(msg report.title)"
+  log "$(msg report.branch "$branch")"
+  log "$(msg report.pr "${pr_url:-$(msg report.none)}")"
+  [ -z "$run_dir" ] || log "$(msg report.artifacts "$run_dir")"
+  [ -z "$baseline_failures" ] || log "$(msg report.baseline "$BASE_REF")"
+  local entry
+  for entry in ${self_review_log[@]+"${self_review_log[@]}"}; do
+    log "$(msg report.self_review "$entry")"
+  done
+  for entry in ${tdd_log[@]+"${tdd_log[@]}"}; do
+    log "$(msg report.tdd "$entry")"
+  done
+  for entry in ${fuzz_findings[@]+"${fuzz_findings[@]}"}; do
+    log "$(msg report.fuzzing "${entry#- }")"
+  done
+  for entry in ${criteria_gaps[@]+"${criteria_gaps[@]}"}; do
+    log "$(msg report.untested "$entry")"
+  done
+  local stage
+  for stage in ${skipped_stages[@]+"${skipped_stages[@]}"}; do
+    log "$(msg report.skipped "$stage")"
+  done
+}
+
+run_issue() {
+  if [ -n "$ISSUE_FILE" ]; then
+    [ -z "$ISSUE_URL" ] || usage
+    if [ ! -f "$ISSUE_FILE" ]; then
+      log "Issue file not found: $ISSUE_FILE" >&2
+      exit 1
+    fi
+  elif [ "$OFFLINE" -eq 1 ]; then
+    log "Offline mode requires --issue-file" >&2
+    exit 1
+  elif [ -z "$ISSUE_URL" ]; then
+    usage
+  elif [[ "$ISSUE_URL" != *github.com* || "$ISSUE_URL" != */issues/* ]]; then
+    log "Invalid GitHub issue URL: $ISSUE_URL" >&2
+    exit 1
+  fi
+
+  require_tools
+  start_budget
+  if [ "$DETERMINISTIC" -eq 1 ] && [ "$BACKEND" != "ollama" ]; then
+    skip "seeded generation ($BACKEND does not support seeds)"
+  fi
+
+  stage "fetch issue"
+  if [ -n "$ISSUE_FILE" ]; then
+    log "Reading issue from $ISSUE_FILE"
+    load_issue_file "$ISSUE_FILE"
+    number="local"
+    repo=$(basename "$(git rev-parse --show-toplevel)")
+    skip "issue fetch (using $ISSUE_FILE)"
+  else
+    log "Starting CCA for issue: $ISSUE_URL"
+    # fetch issue details
+    log "Fetching issue..."
+    issue_json=$(gh issue view "$ISSUE_URL" --json number,title,body,url,labels)
+    number=$(echo "$issue_json" | jq -r '.number')
+    issue_labels=$(echo "$issue_json" | jq -r '.labels[].name')
+    title=$(echo "$issue_json" | jq -r '.title')
+    body=$(echo "$issue_json" | jq -r '.body')
+    repo=$(echo "$ISSUE_URL" | awk -F/ '{print $4"/"$5}')
+    log "Fetched issue #$number: $title"
+  fi
+  resolve_language
+
+  if [ "$DETERMINISTIC" -eq 1 ]; then
+    rand=$(printf '%s' "$SEED-$number-$title" | sha256sum | cut -c1-6)
+  else
+    rand=$(od -An -N3 -tx1 /dev/urandom | tr -d ' \n')
+  fi
+  root_dir=$(git rev-parse --show-toplevel)
+  recover_orphans
+  issue_lock
+  [ -z "$ISSUE_URL" ] || [ "$OFFLINE" -eq 1 ] || duplicate_guard
+  init_run_dir "$number-$rand"
+  start_heartbeat
+  [ -z "$EXPERIMENT_VARIANTS" ] || log "Experiment variants: $EXPERIMENT_VARIANTS"
+  select_persona
+  if [ "$TRANSLATE" -eq 1 ]; then
+    normalize_issue
+  else
+    skip "issue translation"
+  fi
+  run_hook pre-analysis
+
+  if [ "$CLARIFY" -eq 1 ] && [ -n "$ISSUE_URL" ] && [ "$OFFLINE" -eq 0 ] && [ "$READ_ONLY" -eq 0 ]; then
+    stage "clarify"
+    clarify
+  else
+    skip "issue clarification"
+  fi
+  if [ "$DECISION_GUARD" -eq 1 ] && [ -n "$ISSUE_URL" ] && [ "$OFFLINE" -eq 0 ] && [ "$READ_ONLY" -eq 0 ]; then
+    stage "decision guard"
+    decision_guard
+  else
+    skip "decision guard"
+  fi
+  if [ "$PREFLIGHT" -eq 0 ]; then
+    skip "pre-flight checks"
+  elif on_schedule 10 "pre-flight checks"; then
+    stage "pre-flight"
+    preflight
+  fi
+  error_locations=$(error_sources)
+  [ -z "$error_locations" ] || log "Found the source of $(grep -c '^"' <<<"$error_locations") error messages quoted in the issue"
+  stack_locations=$(stack_context)
+  if [ "$FLAG_RISKY" -eq 1 ]; then
+    local framework
+    framework=$(flag_framework)
+    if [ -n "$framework" ]; then
+      flag_guidance="If the change alters behavior existing users rely on, gate it behind a new
+feature flag using $framework (off by default), following how the
+repository already evaluates flags:
+$(flag_examples)"
+    else
+      skip "feature flag gating (no flag framework detected)"
+    fi
+  fi
+  [ -z "$stack_locations" ] || log "Mapped $(grep -c '^[^ ]' <<<"$stack_locations") stack frames from the issue to the code"
+  if [ "$SYMBOL_CONTEXT" -eq 1 ] && on_schedule 15 "symbol search"; then
+    update_index
+    related_symbols=$(search_symbols "$title $body" 20 "$run_dir/symbols-considered.tsv")
+  fi
+  if [ "$COVERAGE_CONTEXT" -eq 0 ]; then
+    skip "coverage context"
+  elif on_schedule 15 "coverage context"; then
+    coverage_context
+  fi
+  if [ "$PLAN" -eq 1 ]; then
+    stage "plan"
+    make_plan
+    [ "$COVERAGE_CONTEXT" -eq 0 ] || ! on_schedule 15 "coverage context for the planned files" || coverage_context
+  fi
+  if [ "$BACKEND" = "claude" ]; then
+    route_model
+  else
+    skip "model routing ($BACKEND uses CCA_OLLAMA_MODEL)"
+  fi
+  if [ "$TDD" -eq 1 ]; then
+    stage "generate tests"
+    generate_tests
+  elif [ "$BUG_REPRO" -eq 1 ] && is_bug_report && on_schedule 20 "reproduction test"; then
+    stage "reproduce"
+    generate_repro
+  fi
+
+  prompt_file=$(mktemp)
+  log "Created prompt file $prompt_file"
+  [ -z "$related_symbols" ] || context_replay "$run_dir/symbols-considered.tsv"
+  [ -z "$uncovered_functions" ] || context_replay "$run_dir/coverage-considered.tsv"
+  local resumed workspace
+  resumed=$(checkpoint_context)
+  workspace=$(workspace_guidance)
+  [ -z "$resumed" ] || log "Resuming from the checkpoint of an interrupted generation"
+  cat >"$prompt_file" <<EOF2
+Implement a solution for this GitHub issue:
+
+Issue: $title
+Description: $body
+Repository: $repo
+${acceptance_criteria:+
+Acceptance criteria:
+$acceptance_criteria
+}${target_paths:+
+Limit changes to these paths:
+$target_paths
+}${workspace:+
+$workspace
+}${plan_json:+
+Follow this implementation plan exactly and only touch the files it lists:
+$plan_json
+}${error_locations:+
+The error messages quoted in the issue are produced here. Start the
+investigation at these locations:
+$error_locations
+}${stack_locations:+
+The stack trace in the issue points at these locations, innermost first. Start
+the investigation there:
+$stack_locations
+}${flag_guidance:+
+$flag_guidance
+}${related_symbols:+
+Existing code that looks related to the issue (path:line, kind, signature):
+$related_symbols
+}${uncovered_functions:+
+These functions in the files likely to change have little or no test
+coverage (path:line function). When the change touches one of them, add tests
+for it as well:
+$uncovered_functions
+}${tests_json:+
+These tests were written first and currently fail. Make them pass without
+changing them:
+$tests_json
+}${resumed:+
+$resumed
+}
+Analyze the issue and provide a complete implementation including:
+1. All necessary code changes
+2. Tests for the implementation
+3. Any documentation updates needed
+
+Return the implementation as file paths and their complete content. For
+small changes to long existing files, you may instead return structured
+edits under "edits". Each edit names the file, an operation (create,
+replace, insert_before, insert_after or delete), an anchor copied exactly
+from the current file that occurs in it only once, and the new content.
+
+Format as JSON:
+{
+  "files": {"path/to/file.ts": "complete file content..."},
+  "edits": [{"file": "path/to/long_file.ts", "operation": "replace", "anchor": "exact existing lines", "content": "new lines"}],
+  "new_files": ["list", "of", "new", "files"],
+  "deleted_files": ["list", "of", "deleted", "files"],
+  "summary": "Brief description of changes made"
+}
+EOF2
+
+  budget_check "generation"
+  stage "generate"
+  log "Generating code changes with $BACKEND..."
+
+  if [ "$TOOLS" -eq 1 ]; then
+    changes_json=$(chat_with_tools "$prompt_file" "with-p")
+  elif [ "$STREAM" -eq 1 ]; then
+    changes_json=$(claude_chat "$prompt_file" "stream")
+  else
+    changes_json=$(claude_chat "$prompt_file" "no-p")
+  fi
+  prompt_sha256=$(sha256sum "$prompt_file" | cut -d' ' -f1)
+  rm "$prompt_file"
+  rm -rf "$(checkpoint_dir)"
+  log "Received code changes from $BACKEND"
+  check_changes "$changes_json" || exit 1
+
+  branch="cca/$(current_run_id)"
+  work_dir="$root_dir/.cca/worktrees/$branch"
+  mkdir -p "$root_dir/.cca/worktrees"
+  git worktree add "$work_dir" -b "$branch" "$BASE_REF"
+  set_status branch "$branch" work_dir "$work_dir"
+  log "Created worktree $work_dir on branch $branch"
+  pushd "$work_dir" >/dev/null
+  log "Switched to worktree $work_dir"
+  init_submodules
+  write_manifest
+  base_commit=$(git rev-parse HEAD)
+
+  if [ "$TDD" -eq 1 ]; then
+    stage "confirm failing tests"
+    commit_failing_tests "test: add failing tests for $title"
+  elif [ "$repro" -eq 1 ]; then
+    stage "confirm reproduction"
+    commit_failing_tests "test: reproduce $title"
+  fi
+  stage "verify"
+  if [ "$SMOKE" -eq 1 ]; then
+    smoke_setup
+  else
+    skip "smoke tests"
+  fi
+  verify_changes
+  if [ -n "$tests_json" ] && [ "$verify_attempts" -gt 0 ]; then
+    tdd_log+=("green: verification passed after $verify_attempts attempts")
+  fi
+  if [ "$SELF_REVIEW" -eq 0 ]; then
+    skip "self-review"
+  elif on_schedule 70 "self-review"; then
+    stage "self-review"
+    self_review
+  fi
+  if [ "$FUZZ" -eq 0 ] || ! has_go; then
+    skip "fuzz targets"
+  elif on_schedule 75 "fuzz targets"; then
+    stage "fuzz targets"
+    add_fuzz_targets
+  fi
+  if [ "$CONTRACT_TESTS" -eq 0 ] || [ ! -f go.mod ]; then
+    skip "contract tests"
+  elif on_schedule 75 "contract tests"; then
+    stage "contract tests"
+    add_contract_tests
+  fi
+  if [ "$PIN" -eq 1 ] && [ "$OFFLINE" -eq 0 ]; then
+    local changed=()
+    mapfile -t changed < <(git status --porcelain | cut -c4-)
+    pin_references ${changed[@]+"${changed[@]}"}
+  else
+    skip "reference pinning"
+  fi
+  write_release_note
+  generate_sbom
+
+  stage "commit"
+  git add .
+  asset_policy
+  log "Committing changes"
+  if [ "$SPLIT_COMMITS" -eq 1 ]; then
+    commit_split
+  else
+    cca_commit -m "Implement: $title"
+  fi
+
+  if [ "$INSTRUMENT" != "suggest" ] && [ "$INSTRUMENT" != "commit" ]; then
+    skip "instrumentation"
+  elif on_schedule 85 "instrumentation"; then
+    stage "instrumentation"
+    instrument "$base_commit"
+  fi
+  if [ "$OBSOLETE_TESTS" = "commit" ] && on_schedule 85 "obsolete test cleanup"; then
+    stage "obsolete test cleanup"
+    clean_obsolete_tests "$base_commit"
+  fi
+  if [ "$CODEGEN" -eq 0 ]; then
+    skip "code generation"
+  elif on_schedule 85 "code generation"; then
+    stage "code generation"
+    regenerate_code "$base_commit"
+  fi
+  run_hook post-generation "$(jq -n --arg files "$(git diff --name-only "$base_commit" HEAD)" \
+    --arg commits "$(git log --reverse --format=%s "$base_commit..HEAD")" --argjson attempts "$verify_attempts" \
+    '{changed_files: ($files | split("\n") | map(select(. != ""))), commits: ($commits | split("\n") | map(select(. != ""))),
+      verify_attempts: $attempts}')"
+
+  stage "analysis"
+  if [ -z "$acceptance_criteria" ]; then
+    skip "acceptance criteria tracing (no criteria)"
+  elif on_schedule 85 "acceptance criteria tracing"; then
+    trace_criteria "$base_commit"
+  fi
+
+  local impact bump
+  impact=$(semver_impact "$base_commit")
+  bump=$(head -n 1 <<<"$impact")
+  local api_breaks
+  api_breaks=$(go_api_breaks "$base_commit")
+  if [ -n "$api_breaks" ]; then
+    bump="major"
+    impact="$bump
+$(tail -n +2 <<<"$impact")
+
+Breaking Go API changes:
+$api_breaks"
+  fi
+  local schema_break_findings
+  schema_break_findings=$(schema_breaks "$base_commit")
+  if [ -n "$schema_break_findings" ]; then
+    bump="major"
+    impact="$bump
+$(tail -n +2 <<<"$impact")
+
+Breaking schema changes:
+$schema_break_findings"
+  fi
+  log "Suggested semver impact: $bump"
+  if [ "$bump" = "major" ] && [ "$FAIL_ON_BREAKING" -eq 1 ]; then
+    gate_decision breaking-changes failed "major"
+    log "Change alters exported APIs and CCA_FAIL_ON_BREAKING is set:" >&2
+    log "$(tail -n +2 <<<"$impact")" >&2
+    exit 1
+  fi
+  gate_decision breaking-changes passed "$bump"
+
+  # dependency_report runs in this shell (not a command substitution) so
+  # that it can record risky_dependencies.
+  local deps_file deps_report name unacknowledged=()
+  risky_dependencies=()
+  deps_file=$(mktemp)
+  dependency_report "$base_commit" > "$deps_file"
+  deps_report=$(cat "$deps_file")
+  rm "$deps_file"
+  for name in ${risky_dependencies[@]+"${risky_dependencies[@]}"}; do
+    if ! grep -Eqw "$name|all" <<<"$ACK_DEPENDENCIES"; then
+      unacknowledged+=("$name")
+    fi
+  done
+  if [ "${#unacknowledged[@]}" -gt 0 ]; then
+    gate_decision dependencies failed "unacknowledged advisories: ${unacknowledged[*]}"
+    log "New dependencies with known advisories need acknowledgment via CCA_ACK_DEPENDENCIES: ${unacknowledged[*]}" >&2
+    exit 1
+  elif [ "${#risky_dependencies[@]}" -gt 0 ]; then
+    gate_decision dependencies acknowledged "advisories acknowledged via CCA_ACK_DEPENDENCIES: ${risky_dependencies[*]}"
+  else
+    gate_decision dependencies passed "no new dependencies with known advisories"
+  fi
+  if [ "$THREAT_MODEL" -eq 0 ]; then
+    skip "threat model"
+    gate_decision threat-model skipped "CCA_THREAT_MODEL=0"
+  else
+    threat_model "$base_commit"
+    for name in $threat_categories; do
+      if ! grep -Eqw "$name|all" <<<"$ACK_THREATS"; then
+        unacknowledged+=("$name")
+      fi
+    done
+    if [ "${#unacknowledged[@]}" -gt 0 ]; then
+      gate_decision threat-model failed "unacknowledged high-risk threats: ${unacknowledged[*]}"
+      log "High-risk threats need acknowledgment via CCA_ACK_THREATS: ${unacknowledged[*]} (see $run_dir/threat-model.json)" >&2
+      exit 1
+    elif [ -n "$threat_categories" ]; then
+      gate_decision threat-model acknowledged "high-risk threats acknowledged via CCA_ACK_THREATS: $threat_categories"
+    else
+      gate_decision threat-model passed "no high-risk threats"
+    fi
+  fi
+
+  local build_findings=""
+  if [ -n "$(build_system)" ]; then
+    skip "build performance analysis ($(build_system) workspace)"
+  elif on_schedule 90 "build performance analysis"; then
+    build_findings=$(go_build_report "$base_commit")
+  fi
+  [ -z "$build_findings" ] || log "Build performance findings:"$'\n'"$build_findings"
+  if [ "$BUNDLE_SIZE" -eq 0 ]; then
+    skip "bundle size analysis"
+  elif on_schedule 90 "bundle size analysis"; then
+    js_bundle_report "$base_commit"
+    if [ -n "$bundle_report" ]; then
+      log "Bundle size changes:"$'\n'"$bundle_report"
+    fi
+    if [ "$bundle_regressions" -gt 0 ] && [ "$FAIL_ON_BUNDLE_GROWTH" -eq 1 ]; then
+      gate_decision bundle-size failed "$bundle_regressions entries grew by more than $BUNDLE_GROWTH_PCT%"
+      log "$bundle_regressions bundle entries grew by more than $BUNDLE_GROWTH_PCT% and CCA_FAIL_ON_BUNDLE_GROWTH is set" >&2
+      exit 1
+    fi
+    gate_decision bundle-size passed "$bundle_regressions entries grew by more than $BUNDLE_GROWTH_PCT%"
+  fi
+  if on_schedule 90 "code review checks"; then
+    code_review "$base_commit"
+  fi
+  if [ "$A11Y" -eq 0 ]; then
+    skip "accessibility review"
+  elif on_schedule 90 "accessibility review"; then
+    a11y_review "$base_commit"
+  fi
+
+  if [ "$OFFLINE" -eq 1 ]; then
+    skip "push (offline)"
+    skip "pull request (offline)"
+  elif [ "$READ_ONLY" -eq 1 ]; then
+    skip "push (read-only)"
+    skip "pull request (read-only)"
+  else
+    stage "pull request"
+    pr_norms=$(pr_norms)
+    if [ -n "$pr_norms" ]; then
+      printf '%s\n' "$pr_norms" >"$run_dir/pr-norms.json"
+      log "Following the title and description conventions of recently merged pull requests"
+    fi
+    if [ "$DIFF_GUARD" != "0" ]; then
+      diff_guard "$base_commit"
+    else
+      skip "pull request size limits"
+    fi
+    local owners=""
+    if [ "$OWNERSHIP" -eq 1 ]; then
+      owners=$(ownership_section "$base_commit")
+      if [ -n "$owners" ] && [ "$OWNERSHIP_SPLIT" -eq 1 ]; then
+        split_by_owner "$base_commit"
+        owners=$(ownership_section "$base_commit")
+      elif [ -n "$owners" ]; then
+        log "The change spans more than one ownership area:"$'\n'"$owners" >&2
+      fi
+    else
+      skip "ownership routing"
+    fi
+    pr_body="$(pr_description "$base_commit")
+
+$(msg pr.semver "$bump")
+$(tail -n +2 <<<"$impact")"
+    if [ -n "$baseline_failures" ] && ! section_omitted baseline; then
+      pr_body="$pr_body
+
+$(msg pr.baseline "$BASE_REF")
+\`\`\`
+$(tail -n 50 <<<"$baseline_failures")
+\`\`\`"
+    fi
+    if [ -n "$repro_result" ] && ! section_omitted reproduction; then
+      pr_body="$pr_body
+
+$(msg pr.reproduction "$(jq -r '.files | keys | map("`" + . + "`") | join(", ")' <<<"$tests_json")")
+$(jq -r '.summary // empty' <<<"$tests_json")
+
+$repro_result"
+    fi
+    if [ -n "$traceability" ] && ! section_omitted criteria; then
+      pr_body="$pr_body
+
+$(msg pr.criteria)
+$traceability"
+    fi
+    if [ "$FINDINGS_COMMENTS" -eq 1 ] && [ -n "$review_findings$code_findings$a11y_findings" ]; then
+      pr_body="$pr_body
+
+$(msg pr.findings_comments)"
+    fi
+    if [ -n "$review_findings" ] && [ "$FINDINGS_COMMENTS" -eq 0 ] && ! section_omitted self-review; then
+      pr_body="$pr_body
+
+$(msg pr.self_review)
+$review_findings"
+    fi
+    if [ "${#fuzz_findings[@]}" -gt 0 ] && ! section_omitted fuzzing; then
+      pr_body="$pr_body
+
+$(msg pr.fuzzing)
+$(printf '%s\n' "${fuzz_findings[@]}")"
+    fi
+    if [ -n "$deps_report" ] && ! section_omitted dependencies; then
+      pr_body="$pr_body
+
+$(msg pr.dependencies)
+$deps_report"
+    fi
+    if [ -n "$threat_summary" ] && ! section_omitted threat-model; then
+      pr_body="$pr_body
+
+$(msg pr.threat_model)
+$threat_summary"
+    fi
+    if [ -n "$build_findings" ] && ! section_omitted build; then
+      pr_body="$pr_body
+
+$(msg pr.build)
+$build_findings"
+    fi
+    if [ -n "$code_findings" ] && [ "$FINDINGS_COMMENTS" -eq 0 ] && ! section_omitted code-review; then
+      pr_body="$pr_body
+
+$(msg pr.code_findings)
+$code_findings"
+    fi
+    if [ -n "$instrumentation_note" ] && ! section_omitted instrumentation; then
+      pr_body="$pr_body
+
+$(msg pr.instrumentation)
+$instrumentation_note"
+    fi
+    if [ -n "$obsolete_note" ] && ! section_omitted obsolete-tests; then
+      pr_body="$pr_body
+
+$(msg pr.obsolete_tests)
+$obsolete_note"
+    fi
+    if [ -n "$codegen_note" ] && ! section_omitted codegen; then
+      pr_body="$pr_body
+
+$(msg pr.codegen)
+$codegen_note"
+    fi
+    if [ -n "$bundle_report" ] && ! section_omitted bundle; then
+      pr_body="$pr_body
+
+$(msg pr.bundle)
+$bundle_report"
+    fi
+    if [ -n "$a11y_findings" ] && [ "$FINDINGS_COMMENTS" -eq 0 ] && ! section_omitted a11y; then
+      pr_body="$pr_body
+
+$(msg pr.a11y)
+$a11y_findings"
+    fi
+    if [ -n "$owners" ] && ! section_omitted owners; then
+      pr_body="$pr_body
+
+$(msg pr.owners)
+$owners"
+    fi
+    if [ "${#split_prs[@]}" -gt 0 ]; then
+      pr_body="$pr_body
+
+$(msg pr.split)
+$(printf '%s\n' "${split_prs[@]}")"
+    fi
+    if [ "$WORKFLOW_DIAGRAM" -eq 1 ] && ! section_omitted pipeline; then
+      pr_body="$pr_body
+
+<details>
+<summary>$(msg pr.pipeline)</summary>
+
+\`\`\`mermaid
+$(workflow_diagram mermaid)
+\`\`\`
+</details>"
+    fi
+    [ "$TRAILERS" -eq 0 ] || pr_body="$pr_body
+
+$(run_metadata)"
+    local pr_title="$title"
+    # Keep the issue's own wording when the repository works in its language.
+    [ -z "$original_title" ] || [ "$issue_language" != "$UI_LANGUAGE" ] || pr_title="$original_title"
+    pr_title=$(pr_title "$base_commit" "$pr_title")
+    run_hook pre-pr "$(jq -n --arg title "$pr_title" --arg body "$pr_body" --arg semver "$bump" \
+      --arg files "$(git diff --name-only "$base_commit" HEAD)" \
+      '{pull_request: {title: $title, body: $body, draft: true}, semver: $semver,
+        changed_files: ($files | split("\n") | map(select(. != "")))}')"
+    log "Pushing branch $branch"
+    push origin "$branch"
+    log "Creating draft pull request"
+    pr_url=$(gh pr create --draft --title "$(redact <<<"$pr_title")" --body "$(fit_body "$(redact <<<"$pr_body")" pr-body)")
+    set_status pr_url "$pr_url" pr_head "$(git rev-parse HEAD)" \
+      pr_lines "$(git diff --numstat "$base_commit" HEAD | awk '{ n += $1 + $2 } END { print n + 0 }')"
+    if [ "$LABELS" -eq 1 ]; then
+      local labels=()
+      mapfile -t labels < <(pr_labels "$base_commit")
+      apply_labels "$pr_url" "${labels[@]}"
+    else
+      skip "labels (CCA_LABELS=0)"
+    fi
+    [ "$FINDINGS_COMMENTS" -eq 0 ] || post_findings "$pr_url"
+  fi
+
+  stage_end ok
+
+  popd >/dev/null
+  log "Cleaning up worktree"
+  git worktree remove "$work_dir"
+
+  report
+}
+
+# run_update re-runs generation on an existing cca pull request, using comments
+# and reviews posted since its last commit as additional instructions.
+run_update() {
+  local pr_url_arg="$1"
+  if [[ "$pr_url_arg" != *github.com* || "$pr_url_arg" != */pull/* ]]; then
+    log "Invalid GitHub pull request URL: $pr_url_arg" >&2
+    exit 1
+  fi
+
+  require_tools
+
+  log "Fetching pull request..."
+  local pr_json
+  pr_json=$(gh pr view "$pr_url_arg" --json number,title,body,headRefName,baseRefName,url,comments,reviews)
+  branch=$(echo "$pr_json" | jq -r '.headRefName')
+  local base pr_body
+  base=$(echo "$pr_json" | jq -r '.baseRefName')
+  pr_body=$(echo "$pr_json" | jq -r '.body')
+  title=$(echo "$pr_json" | jq -r '.title')
+  if [[ "$branch" != cca/* ]]; then
+    log "Pull request branch $branch was not created by cca" >&2
+    exit 1
+  fi
+  log "Fetched pull request #$(echo "$pr_json" | jq -r '.number'): $title"
+
+  ISSUE_URL=$(echo "$pr_body" | sed -n 's/^Resolves: //p' | head -n 1)
+  body=""
+  if [ -n "$ISSUE_URL" ]; then
+    body=$(gh issue view "$ISSUE_URL" --json body --jq '.body')
+  fi
+  resolve_language
+
+  fetch "$branch" "$base"
+  local since feedback mentions scope
+  since=$(TZ=UTC git log -1 --date=iso-strict-local --format=%cd "origin/$branch" | cut -c1-19)
+  feedback=$(echo "$pr_json" | jq -r --arg since "$since" '
+    [(.comments[] | {at: .createdAt, body}), (.reviews[] | {at: .submittedAt, body})]
+    | map(select(.body != "" and .at[0:19] > $since and (.body | contains("<!-- cca-run-id:") | not)))
+    | sort_by(.at)[]
+    | "- " + .body')
+  # Comments addressed to @cca are explicit instructions; when present, the
+  # generation pass is scoped to them instead of the general feedback.
+  mentions=$(pr_mentions "$since" <<<"$pr_json")
+  if [ -n "$mentions" ]; then
+    feedback="$mentions"
+    scope="Make only the changes requested in these instructions; leave unrelated code untouched."
+  else
+    scope="Address the feedback below."
+  fi
+  if [ -z "$feedback" ]; then
+    log "No new comments or reviews since $since; nothing to update"
+    exit 0
+  fi
+
+  root_dir=$(git rev-parse --show-toplevel)
+  init_run_dir "pr-$(echo "$pr_json" | jq -r '.number')"
+  work_dir="$root_dir/.cca/worktrees/$branch"
+  mkdir -p "$root_dir/.cca/worktrees"
+  git worktree add -B "$branch" "$work_dir" "origin/$branch"
+  log "Created worktree $work_dir on branch $branch"
+  pushd "$work_dir" >/dev/null
+  init_submodules
+
+  prompt_file=$(mktemp)
+  cat >"$prompt_file" <<EOF4
+Update the implementation on this pull request. $scope
+
+Pull request: $title
+Original issue description: ${body:-not available}
+
+Current changes against $base:
+$(context_diff "origin/$base...HEAD")
+
+New feedback from comments and reviews:
+$feedback
+
+Return the updated implementation as file paths and their complete content.
+
+Format as JSON:
+{
+  "files": {"path/to/file.ts": "complete file content..."},
+  "new_files": ["list", "of", "new", "files"],
+  "deleted_files": ["list", "of", "deleted", "files"],
+  "summary": "Brief description of changes made"
+}
+EOF4
+
+  log "Generating updated changes with $BACKEND..."
+  changes_json=$(claude_chat "$prompt_file" "no-p")
+  rm "$prompt_file"
+  check_changes "$changes_json" || exit 1
+
+  verify_changes
+
+  local summary
+  summary=$(echo "$changes_json" | jq -r '.summary // "Addressed review feedback"')
+  git add .
+  asset_policy
+  log "Committing changes"
+  cca_commit -m "Address review feedback: $summary"
+  log "Pushing branch $branch"
+  push origin "$branch"
+
+  local entry="- $(date +'%Y-%m-%d'): $summary"
+  if [[ "$pr_body" == *"## Changelog"* ]]; then
+    pr_body="$pr_body"$'\n'"$entry"
+  else
+    pr_body="$pr_body"$'\n\n## Changelog\n'"$entry"
+  fi
+  log "Updating pull request description"
+  gh pr edit "$pr_url_arg" --body "$(fit_body "$(redact <<<"$pr_body")" pr-body)"
+  if [ -n "$mentions" ]; then
+    log "Replying to @cca instructions"
+    gh pr comment "$pr_url_arg" --body "$(redact <<<"$(msg comment.pushed "$(git rev-parse --short HEAD)")
+$mentions
+
+$summary
+
+$(run_marker)")"
+  fi
+  if [ "$FINDINGS_COMMENTS" -eq 1 ]; then
+    code_review "origin/$base"
+    [ "$A11Y" -eq 0 ] || a11y_review "origin/$base"
+    post_findings "$pr_url_arg"
+  fi
+  pr_url="$pr_url_arg"
+
+  popd >/dev/null
+  log "Cleaning up worktree"
+  git worktree remove "$work_dir"
+
+  report
+}
+
+# pr_mentions prints, as "- " lines, the instructions in the comments of the
+# pull request JSON on stdin that mention @cca after $1 (UTC, without zone).
+# Only comments by the logins in CCA_MENTION_AUTHORS or, by default, by the
+# repository's owners, members and collaborators count.
+pr_mentions() {
+  jq -r --arg since "$1" --arg authors "$MENTION_AUTHORS" '
+    ($authors | ascii_downcase | split(" ") | map(select(. != ""))) as $allow
+    | .comments
+    | map(select(.createdAt[0:19] > $since and (.body | test("(^|\\s)@cca\\b"))
+        and (.body | contains("<!-- cca-run-id:") | not)))
+    | map(select(if $allow == [] then .authorAssociation | IN("OWNER", "MEMBER", "COLLABORATOR")
+                 else (.author.login // "" | ascii_downcase) as $l | $allow | index([$l]) end))
+    | sort_by(.createdAt)[]
+    | "- " + (.body | gsub("(^|\\s)@cca\\b\\s*"; " ") | ltrimstr(" "))'
+}
+
+# run_mentions runs update on every open cca pull request with @cca
+# instructions since its last commit, so that a schedule can answer mentions
+# without anything watching the pull requests.
+run_mentions() {
+  require_tools
+  local prs pr url since count=0
+  prs=$(gh pr list --state open --limit 100 --json url,headRefName,comments |
+    jq -c '.[] | select(.headRefName | startswith("cca/"))')
+  while read -r -u 3 pr; do
+    [ -n "$pr" ] || continue
+    url=$(jq -r '.url' <<<"$pr")
+    since=$(gh pr view "$url" --json commits --jq '.commits[-1].committedDate' | cut -c1-19)
+    [ -n "$(pr_mentions "$since" <<<"$pr")" ] || continue
+    count=$((count + 1))
+    log "Answering @cca instructions on $url"
+    "$0" update "$url" </dev/null || log "Update of $url failed" >&2
+  done 3<<<"$prs"
+  [ "$count" -gt 0 ] || log "No open cca pull requests have new @cca instructions"
+}
+
+# run_scaffold creates a new package or service at $2 from the template
+# .cca/templates/$1.md (or .yaml), asking the backend to follow the layout,
+# naming and test style of the closest existing code, and then verifies it.
+run_scaffold() {
+  local template="$1" target="${2%/}"
+  require_tools
+  root_dir=$(git rev-parse --show-toplevel)
+  local manifest
+  manifest=$(ls "$root_dir/.cca/templates/$template".{md,yaml,yml} 2>/dev/null | head -n 1 || true)
+  if [ -z "$manifest" ]; then
+    log "No template $template in .cca/templates/" >&2
+    exit 1
+  fi
+  if [ -e "$target" ]; then
+    log "$target already exists" >&2
+    exit 1
+  fi
+  # Formatting and verification act on every changed file, so start clean.
+  if [ -n "$(git status --porcelain)" ]; then
+    log "Commit or stash local changes before scaffolding" >&2
+    exit 1
+  fi
+  init_run_dir "scaffold-$template"
+
+  # The sibling directory with the most files stands in for the conventions
+  # of the new code.
+  local example
+  example=$(git ls-files "$(dirname "$target")" | awk -F/ -v depth="$(($(tr -cd / <<<"$target/" | wc -c)))" '
+    NF > depth { dir = $1; for (i = 2; i <= depth; i++) dir = dir "/" $i; n[dir]++ }
+    END { for (d in n) print n[d], d }' | sort -rn | head -n 1 | cut -d' ' -f2)
+
+  local prompt_file file
+  prompt_file=$(mktemp)
+  {
+    echo "Create a new component at $target from this template. Follow the directory"
+    echo "layout, naming, error handling, documentation and test style of the"
+    echo "existing code shown below. Create files under $target only."
+    echo
+    echo "Template:"
+    cat "$manifest"
+    echo
+    echo "Repository layout:"
+    git ls-files | awk -F/ 'NF > 1 { print $1 "/" (NF > 2 ? $2 "/" : "") }' | sort -u | head -n 100
+    echo
+    if [ -n "$example" ]; then
+      while read -r file; do
+        echo "Example file: $file"
+        context_file "$file"
+        echo
+      done < <(git ls-files "$example" | head -n 5)
+    fi
+    echo 'Format as JSON: {"files": {"path": "complete file content"}, "summary": "..."}'
+  } >"$prompt_file"
+  log "Generating $template scaffold at $target${example:+ following $example}..."
+  changes_json=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  if ! check_changes "$changes_json" || ! jq -e '.files | length > 0' <<<"$changes_json" >/dev/null 2>&1; then
+    log "Backend did not return any files" >&2
+    exit 1
+  fi
+
+  ALLOWED_PATHS="$target/*"
+  PATH_POLICY=trim
+  if [ -f .cca/verify.sh ]; then
+    verify_changes
+  else
+    local tmp_changes
+    enforce_paths
+    tmp_changes=$(mktemp)
+    echo "$changes_json" >"$tmp_changes"
+    apply_changes "$tmp_changes"
+    rm "$tmp_changes"
+    format_changes
+    skip "verification (no .cca/verify.sh)"
+  fi
+  log "Created $(find "$target" -type f | wc -l) files in $target"
+  report
+}
+
+# file_symbols prints "<path>\t<line>\t<kind>\t<name>\t<signature>\t<doc>"
+# for the functions, types, classes and HTTP routes declared in a file, with
+# the comment line directly above each declaration as its doc.
+file_symbols() {
+  local path="$1"
+  case "$path" in
+    *.go|*.js|*.jsx|*.ts|*.tsx|*.mjs|*.py) ;;
+    *) return 0 ;;
+  esac
+  awk -v path="$path" '
+    function emit(kind, name) {
+      sig = $0; gsub(/\t/, " ", sig); sub(/[[:space:]]*[{:][[:space:]]*$/, "", sig)
+      printf "%s\t%d\t%s\t%s\t%s\t%s\n", path, NR, kind, name, sig, doc
+    }
+    /^[[:space:]]*(\/\/|#)/ { d = $0; sub(/^[[:space:]]*(\/\/|#)[[:space:]]*/, "", d); gsub(/\t/, " ", d); doc = d; next }
+    path ~ /\.go$/ && /^func / {
+      name = $0; sub(/^func (\([^)]*\) )?/, "", name); sub(/[^A-Za-z0-9_].*/, "", name); emit("func", name)
+    }
+    path ~ /\.go$/ && /^type [A-Za-z0-9_]+ / { emit("type", $2) }
+    path ~ /\.(js|jsx|ts|tsx|mjs)$/ && /^(export )?(default )?(async )?function\*? *[A-Za-z0-9_$]+/ {
+      name = $0; sub(/^.*function\*? */, "", name); sub(/[^A-Za-z0-9_$].*/, "", name); emit("function", name)
+    }
+    path ~ /\.(js|jsx|ts|tsx|mjs)$/ && /^(export )?(default )?(abstract )?(class|interface|type) [A-Za-z0-9_$]+/ {
+      name = $0; sub(/^.*(class|interface|type) /, "", name); sub(/[^A-Za-z0-9_$].*/, "", name); emit("type", name)
+    }
+    path ~ /\.py$/ && /^[[:space:]]*(async )?def [A-Za-z0-9_]+/ {
+      name = $0; sub(/^.*def /, "", name); sub(/[^A-Za-z0-9_].*/, "", name); emit("function", name)
+    }
+    path ~ /\.py$/ && /^class [A-Za-z0-9_]+/ {
+      name = $2; sub(/[^A-Za-z0-9_].*/, "", name); emit("type", name)
+    }
+    /\.(HandleFunc|Handle|Get|Post|Put|Patch|Delete|GET|POST|PUT|PATCH|DELETE|get|post|put|patch|delete)\(["\x27]\// {
+      name = $0; sub(/^[^"\x27]*["\x27]/, "", name); sub(/["\x27].*/, "", name); emit("route", name)
+    }
+    { doc = "" }
+  ' "$path" 2>/dev/null || true
+}
+
+# update_index refreshes the symbol index in .cca/index/, re-reading only the
+# files whose content changed since the last update.
+update_index() {
+  local dir="$root_dir/.cca/index" current changed path
+  mkdir -p "$dir"
+  touch "$dir/files.tsv" "$dir/symbols.tsv"
+  current=$(mktemp)
+  changed=$(mktemp)
+  git -C "$root_dir" ls-files -s | awk -F'\t' '{ split($1, f, " "); print $2 "\t" f[2] }' | sort >"$current"
+  comm -3 "$dir/files.tsv" "$current" | sed 's/^\t//' | cut -f1 | sort -u >"$changed"
+  awk -F'\t' 'FILENAME == ARGV[1] { drop[$0] = 1; next } !($1 in drop)' "$changed" "$dir/symbols.tsv" >"$dir/symbols.tsv.tmp"
+  while IFS= read -r path; do
+    [ ! -f "$root_dir/$path" ] || (cd "$root_dir" && file_symbols "$path")
+  done <"$changed" >>"$dir/symbols.tsv.tmp"
+  mv "$dir/symbols.tsv.tmp" "$dir/symbols.tsv"
+  mv "$current" "$dir/files.tsv"
+  log "Symbol index: $(wc -l <"$changed") files updated, $(wc -l <"$dir/symbols.tsv") symbols" >&2
+  rm "$changed"
+}
+
+# search_symbols prints up to $2 indexed symbols matching the words of $1,
+# ranked by how many words appear in their names, then in their docs. With $3
+# set, the symbols and the next ones that missed the cut are written to that
+# file as context records with their scores, for context_replay.
+search_symbols() {
+  local words ranked limit="${2:-20}" score location kind signature rank=0
+  words=$(tr '[:upper:]' '[:lower:]' <<<"$1" | tr -cs 'a-z0-9_' '\n' | awk 'length($0) > 2' | sort -u | paste -sd' ' -)
+  [ -n "$words" ] || return 0
+  ranked=$(awk -F'\t' -v words="$words" '
+    BEGIN { n = split(words, w, " ") }
+    {
+      name = tolower($4); doc = tolower($6); score = 0
+      for (i = 1; i <= n; i++) { if (index(name, w[i])) score += 3; else if (index(doc, w[i]) || index(tolower($1), w[i])) score += 1 }
+      if (score > 0) printf "%d\t%s:%s\t%s\t%s\n", score, $1, $2, $3, $5
+    }' "$root_dir/.cca/index/symbols.tsv" | sort -t$'\t' -k1,1nr -s)
+  [ -n "$ranked" ] || return 0
+  if [ -n "${3:-}" ]; then
+    while IFS=$'\t' read -r score location kind signature; do
+      rank=$((rank + 1))
+      if [ "$rank" -le "$limit" ]; then
+        printf 'symbol %s\t%s\tincluded\tscore %s\n' "$location" "$((${#location} + ${#kind} + ${#signature} + 2))" "$score"
+      else
+        printf 'symbol %s\t0\tpruned\tscore %s, below the top %s\n' "$location" "$score" "$limit"
+      fi
+    done < <(head -n "$((limit + 30))" <<<"$ranked") >"$3"
+  fi
+  head -n "$limit" <<<"$ranked" | cut -f2-
+}
+
+# run_search updates the symbol index and prints the symbols matching a query.
+run_search() {
+  root_dir=$(git rev-parse --show-toplevel)
+  update_index
+  search_symbols "$1" 50
+}
+
+# run_devcontainer_feature writes a dev container feature that installs CCA
+# to .devcontainer/cca/ and, when .devcontainer/devcontainer.json is plain
+# JSON, adds the feature to it. The feature installs the GitHub CLI and, where
+# npm is available, the Claude CLI, links cca onto the PATH and warms its
+# caches after the container is created.
+run_devcontainer_feature() {
+  local dir=".devcontainer/cca" config=".devcontainer/devcontainer.json"
+  cd "$(git rev-parse --show-toplevel)"
+  mkdir -p "$dir"
+  jq -n '{
+    id: "cca",
+    version: "1.0.0",
+    name: "Claude Code Assistant",
+    description: "Installs Claude Code Assistant (CCA), which turns GitHub issues into pull requests",
+    options: {
+      version: {type: "string", default: "main", description: "Branch, tag or commit of CCA to install"},
+      installClaude: {type: "boolean", default: true, description: "Install the Claude CLI with npm when Node.js is available"}
+    },
+    dependsOn: {"ghcr.io/devcontainers/features/github-cli:1": {}},
+    installsAfter: ["ghcr.io/devcontainers/features/node"],
+    postCreateCommand: "cca warm || true"
+  }' >"$dir/devcontainer-feature.json"
+  cat >"$dir/install.sh" <<'EOF24'
+#!/usr/bin/env bash
+# Installs CCA for a dev container; see devcontainer-feature.json for options.
+set -euo pipefail
+VERSION="${VERSION:-main}"
+INSTALLCLAUDE="${INSTALLCLAUDE:-true}"
+
+if command -v apt-get >/dev/null; then
+  apt-get update
+  apt-get install -y --no-install-recommends git jq curl ca-certificates
+  rm -rf /var/lib/apt/lists/*
+elif command -v apk >/dev/null; then
+  apk add --no-cache bash git jq curl ca-certificates
+fi
+
+rm -rf /usr/local/share/cca
+git clone --quiet https://github.com/fumiya-kume/cca.git /usr/local/share/cca
+git -C /usr/local/share/cca checkout --quiet "$VERSION"
+ln -sf /usr/local/share/cca/cca.sh /usr/local/bin/cca
+
+if [ "$INSTALLCLAUDE" = "true" ]; then
+  if command -v npm >/dev/null; then
+    npm install -g @anthropic-ai/claude-code
+  else
+    echo "npm not found; install Node.js before this feature to get the Claude CLI" >&2
+  fi
+fi
+EOF24
+  chmod +x "$dir/install.sh"
+  log "Wrote $dir/devcontainer-feature.json and $dir/install.sh"
+  if [ -f "$config" ] && jq -e . "$config" >/dev/null 2>&1; then
+    jq '.features["./cca"] //= {}' "$config" >"$config.tmp" && mv "$config.tmp" "$config"
+    log "Added the feature to $config"
+  else
+    log "Add \"./cca\": {} to the features of your devcontainer.json to use it"
+  fi
+}
+
+# run_warm pre-builds what a run would otherwise build on its first use, so
+# that it starts without waiting: the symbol index, the nix develop shell, the
+# Go module and build caches (including test binaries) and the JS/TS
+# dependencies. Each step that fails is reported and the rest still run; the
+# command fails at the end.
+run_warm() {
+  root_dir=$(git rev-parse --show-toplevel)
+  cd "$root_dir"
+  local started=$SECONDS step_started module runner failed=0
+  update_index
+  if [ "$OFFLINE" -eq 1 ]; then
+    skip "Go and JS/TS dependencies (offline)"
+  else
+    if [ "$NIX" -eq 1 ] && runner=$(nix_runner 2>/dev/null); then
+      step_started=$SECONDS
+      log "Building the nix develop shell of flake.nix"
+      if mapfile -t runner <<<"$runner" && "${runner[@]}" true; then
+        log "nix develop shell built in $((SECONDS - step_started))s"
+      else
+        log "Could not build the nix develop shell of flake.nix" >&2
+        failed=1
+      fi
+    fi
+    while read -r module; do
+      [ -n "$module" ] || continue
+      step_started=$SECONDS
+      log "Warming Go module $module"
+      if (cd "$module" && go mod download && go build ./... && go test -count=1 -run '^$' ./... >/dev/null); then
+        log "Go module $module warmed in $((SECONDS - step_started))s"
+      else
+        log "Could not warm Go module $module" >&2
+        failed=1
+      fi
+    done < <(go_modules)
+    if [ -f package.json ]; then
+      step_started=$SECONDS
+      log "Installing JS/TS dependencies"
+      if js_install .; then
+        log "JS/TS dependencies installed in $((SECONDS - step_started))s"
+      else
+        log "Could not install the JS/TS dependencies" >&2
+        failed=1
+      fi
+    fi
+  fi
+  if [ "$failed" -eq 1 ]; then
+    log "Warming finished with errors after $((SECONDS - started))s" >&2
+    exit 1
+  fi
+  log "Caches warmed in $((SECONDS - started))s"
+}
+
+# resolve_run_id prints the ID of the local run that $1 refers to: a run ID,
+# a cca/ branch, a commit with a Cca-Run-Id trailer, a pull request or comment
+# URL whose body carries the run marker, or an issue URL (its latest run).
+resolve_run_id() {
+  local ref="$1" runs="$root_dir/.cca/runs" text="" id="" dir
+  if [ -d "$runs/$ref" ]; then
+    echo "$ref"
+    return
+  fi
+  case "$ref" in
+    cca/*) id="${ref#cca/}" ;;
+    https://github.com/*#issuecomment-*)
+      text=$(gh api "repos/$(cut -d/ -f4-5 <<<"$ref")/issues/comments/${ref##*#issuecomment-}" --jq .body)
+      ;;
+    https://github.com/*/pull/*)
+      text=$(gh pr view "$ref" --json body,headRefName --jq '.body + "\n" + .headRefName')
+      ;;
+    https://github.com/*/issues/*)
+      for dir in "$runs"/*/; do
+        [ "$(jq -r '.issue_url // ""' "$dir/status.json" 2>/dev/null)" != "$ref" ] || id=$(basename "$dir")
+      done
+      ;;
+    *)
+      if git rev-parse -q --verify "$ref^{commit}" >/dev/null; then
+        id=$(git log -1 --format='%(trailers:key=Cca-Run-Id,valueonly)' "$ref" | head -n 1)
+      fi
+      ;;
+  esac
+  if [ -n "$text" ]; then
+    id=$(sed -n -E 's/.*<!-- cca-run-id: ([^ ]+) -->.*/\1/p; s/.*<!-- cca-run: .*"run_id":"([^"]+)".*/\1/p; s/^cca\/([^ ]+)$/\1/p' <<<"$text" | head -n 1)
+  fi
+  [ -n "$id" ] && [ -d "$runs/$id" ] || return 1
+  echo "$id"
+}
+
+# run_show prints the report of the local run that $1 refers to (see
+# resolve_run_id): its status, issue, pull request and branch, the time
+# spent in each stage, the findings and the artifacts it left.
+run_show() {
+  root_dir=$(git rev-parse --show-toplevel)
+  local id dir
+  if ! id=$(resolve_run_id "$1"); then
+    log "No local run found for $1" >&2
+    exit 1
+  fi
+  dir="$root_dir/.cca/runs/$id"
+  echo "Run $id"
+  [ ! -f "$dir/status.json" ] || jq -r '
+    "Status: \(.status // "unknown")\(if .cause then " (\(.cause))" else "" end)",
+    (.issue_url // "" | select(. != "") | "Issue: \(.)"),
+    (.pr_url // "" | select(. != "") | "Pull request: \(.)"),
+    (.branch // "" | select(. != "") | "Branch: \(.)"),
+    (.started // "" | select(. != "") | "Started: \(.)"),
+    (.prompt_version // "" | select(. != "") | "Prompt version: \(.)"),
+    ((.variants // []) | select(length > 0) | "Experiment variants: \(join(", "))")' "$dir/status.json"
+  if [ -f "$dir/stages.tsv" ]; then
+    echo
+    echo "Stages:"
+    awk -F'\t' '{ printf "  %-28s %5ds  %s%s\n", $1, $2, $3, ($4 > 0 ? " (" $4 " retries)" : "") }' "$dir/stages.tsv"
+  fi
+  if [ -f "$dir/api-usage.json" ]; then
+    echo
+    echo "GitHub API calls:"
+    jq -r '.categories[] | "  \(.calls)\t\(.kind)\t\(.category)\(if .wait_seconds > 0 then " (\(.wait_seconds)s rate limited)" else "" end)"' \
+      "$dir/api-usage.json" | awk -F'\t' '{ printf "  %5d  %-8s %s\n", $1, $2, $3 }'
+  fi
+  if [ -s "$dir/findings.tsv" ]; then
+    echo
+    echo "Code review findings:"
+    sed 's/^/  /' "$dir/findings.tsv"
+  fi
+  if [ -f "$dir/self-review.jsonl" ]; then
+    echo
+    echo "Self-review findings:"
+    jq -r '.findings[]? | "  \(.id // "-") \(.severity // "") \(.file // ""): \(.message // "")"' "$dir/self-review.jsonl"
+  fi
+  echo
+  echo "Artifacts in $dir:"
+  find "$dir" -maxdepth 1 -type f ! -name heartbeat -printf '  %f (%s bytes)\n' | sort
+  [ ! -d "$dir/transcripts" ] || echo "  transcripts/ ($(find "$dir/transcripts" -name '*.prompt.txt' | wc -l) prompts; see cca debug prompts $id)"
+}
+
+# rollback_step runs a rollback action and adds it to the rollback's
+# actions, or only logs it with --dry-run.
+rollback_step() {
+  local action="$1" result=done
+  shift
+  if [ "$DRY_RUN" -eq 1 ]; then
+    log "Would $action"
+    return 0
+  fi
+  if "$@" >/dev/null; then
+    log "Rollback: $action"
+  else
+    result=failed
+    log "Rollback: could not $action" >&2
+  fi
+  actions+=$(jq -cn --arg action "$action" --arg result "$result" '{action: $action, result: $result}')$'\n'
+}
+
+# revert_pr opens a pull request that reverts merged pull request $1 on its
+# base branch, leaving the base branch itself untouched.
+revert_pr() {
+  local url="$1" pr_json oid base dir revert_branch="cca/revert-$2" args=()
+  pr_json=$(gh pr view "$url" --json title,baseRefName,mergeCommit)
+  oid=$(jq -r '.mergeCommit.oid' <<<"$pr_json")
+  base=$(jq -r '.baseRefName' <<<"$pr_json")
+  fetch "$base"
+  deepen_until "rollback of $url" has_commit "$oid^1"
+  [ "$(git rev-list --parents -n 1 "$oid" | wc -w)" -le 2 ] || args=(-m 1)
+  dir="$root_dir/.cca/worktrees/$revert_branch"
+  git worktree add -q -b "$revert_branch" "$dir" "origin/$base"
+  if ! git -C "$dir" revert --no-edit ${args[@]+"${args[@]}"} "$oid" >/dev/null; then
+    git -C "$dir" revert --abort
+    git worktree remove --force "$dir"
+    git branch -D "$revert_branch" >/dev/null
+    log "Reverting $url conflicts with later changes on $base; revert it by hand" >&2
+    return 1
+  fi
+  (cd "$dir" && push origin "$revert_branch")
+  git worktree remove --force "$dir"
+  gh pr create --draft --base "$base" --head "$revert_branch" \
+    --title "$(redact <<<"Revert \"$(jq -r '.title' <<<"$pr_json")\"")" --body "$(msg pr.revert "$url" "$2")"
+}
+
+# run_rollback undoes what the local run that $1 refers to (see
+# resolve_run_id) did on GitHub: it closes its open pull requests, opens
+# revert pull requests for merged ones, removes the labels it added and the
+# comments it posted, deletes its branches and worktrees, and marks the run
+# rolled back. With --dry-run it only lists the actions.
+run_rollback() {
+  require_commands gh jq
+  root_dir=$(git rev-parse --show-toplevel)
+  local id dir status issue_url branch work_dir url state repo number comment label head actions="" urls=()
+  if ! id=$(resolve_run_id "$1"); then
+    log "No local run found for $1" >&2
+    exit 1
+  fi
+  dir="$root_dir/.cca/runs/$id"
+  status=$(jq -c . "$dir/status.json")
+  if [ "$(jq -r '.status' <<<"$status")" = "rolled_back" ]; then
+    log "Run $id was already rolled back"
+    return 0
+  fi
+  issue_url=$(jq -r '.issue_url // ""' <<<"$status")
+  branch=$(jq -r '.branch // ""' <<<"$status")
+  work_dir=$(jq -r '.work_dir // ""' <<<"$status")
+  mapfile -t urls < <(jq -r '.pr_url // "", (.split_pr_urls // "" | split(" ")[]) | select(. != "")' <<<"$status")
+
+  for url in ${urls[@]+"${urls[@]}"}; do
+    state=$(gh pr view "$url" --json state --jq .state)
+    case "$state" in
+      OPEN) rollback_step "close $url" gh pr close "$url" --comment "$(msg comment.rolled_back "$id")" ;;
+      MERGED) rollback_step "open a pull request that reverts $url" revert_pr "$url" "$id" ;;
+    esac
+  done
+  for label in $(jq -r '.pr_labels // ""' <<<"$status"); do
+    rollback_step "remove label $label from ${urls[0]}" gh pr edit "${urls[0]}" --remove-label "$label"
+  done
+
+  for url in "$issue_url" ${urls[@]+"${urls[@]}"}; do
+    [[ "$url" == https://github.com/* ]] || continue
+    repo=$(cut -d/ -f4-5 <<<"$url")
+    number="${url##*/}"
+    while read -r comment; do
+      [ -z "$comment" ] || rollback_step "delete comment $url#issuecomment-$comment" \
+        gh api -X DELETE "repos/$repo/issues/comments/$comment"
+    done < <(gh api --paginate "repos/$repo/issues/$number/comments" \
+      --jq ".[] | select(.body | contains(\"<!-- cca-run-id: $id -->\")) | .id")
+  done
+
+  if [ -n "$branch" ]; then
+    if [ -n "$work_dir" ] && [ -d "$work_dir" ]; then
+      rollback_step "remove worktree $work_dir" git worktree remove --force "$work_dir"
+    fi
+    while read -r head; do
+      [ -z "$head" ] || rollback_step "delete branch $head on origin" push origin --delete "$head"
+    done < <(git ls-remote --heads origin "$branch" "$branch-part*" | sed 's#.*refs/heads/##')
+    while read -r head; do
+      [ -z "$head" ] || rollback_step "delete local branch $head" git branch -D "$head"
+    done < <(git for-each-ref --format='%(refname:short)' "refs/heads/$branch" "refs/heads/$branch-part*")
+  fi
+
+  [ "$DRY_RUN" -eq 0 ] || return 0
+  jq -s --arg at "$(date -u +%Y-%m-%dT%H:%M:%SZ)" '{rolled_back_at: $at, actions: .}' <<<"$actions" >"$dir/rollback.json"
+  run_dir="$dir" set_status status rolled_back rolled_back_at "$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+  log "Rolled back run $id ($(jq -s 'length' <<<"$actions") actions, $(jq -s 'map(select(.result == "failed")) | length' <<<"$actions") failed; see $dir/rollback.json)"
+  ! jq -se 'any(.result == "failed")' <<<"$actions" >/dev/null
+}
+
+# run_summary prints the figures of the run in directory $1 that report diff
+# compares as one JSON object: status, findings, acceptance criteria coverage,
+# size of the change, stage durations, prompt tokens, cost and CPU time.
+run_summary() {
+  local run_dir="$1" base="" branch="" shortstat="" bytes=0 stages="[]" file
+  [ ! -f "$run_dir/manifest.json" ] || base=$(jq -r '.base_commit // ""' "$run_dir/manifest.json")
+  [ ! -f "$run_dir/status.json" ] || branch=$(jq -r '.branch // ""' "$run_dir/status.json")
+  if [ -n "$base" ] && [ -n "$branch" ] && git rev-parse -q --verify "$branch^{commit}" >/dev/null; then
+    shortstat=$(git diff --shortstat "$base" "$branch")
+  fi
+  [ ! -f "$run_dir/context.jsonl" ] || bytes=$(jq -s 'map(.prompt_bytes) | add // 0' "$run_dir/context.jsonl")
+  [ ! -f "$run_dir/stages.tsv" ] ||
+    stages=$(jq -R 'split("\t") | {name: .[0], seconds: (.[1] | tonumber), result: .[2], retries: (.[3] | tonumber)}' \
+      "$run_dir/stages.tsv" | jq -s .)
+  local args=()
+  for file in status manifest traceability resources plan api-usage; do
+    args+=(--argjson "${file//-/_}" "$(jq -c . "$run_dir/$file.json" 2>/dev/null || echo null)")
+  done
+  jq -n "${args[@]}" --arg id "$(basename "$run_dir")" --arg shortstat "$shortstat" \
+    --argjson tokens "$((bytes / 4))" --arg price "$TOKEN_PRICE" \
+    --argjson findings "$(findings_tsv | jq -R 'split("\t") | {severity: .[0], source: .[1], location: .[2], message: .[3]}' | jq -s .)" \
+    --argjson stages "$stages" '
+    def stat($name): $shortstat | capture("(?<n>[0-9]+) \($name)") .n // "0" | tonumber;
+    {
+      run_id: $id,
+      status: ($status.status // "unknown"),
+      prompt_version: $status.prompt_version,
+      model: $manifest.model,
+      findings: $findings,
+      criteria: (if $traceability then {covered: [$traceability.criteria[] | select(.tests | length > 0)] | length,
+        total: ($traceability.criteria | length)} else null end),
+      change: (if $shortstat == "" then null else {files: stat("files? changed"), insertions: stat("insertions?"),
+        deletions: stat("deletions?")} end),
+      plan_files: (if $plan then $plan.files | length else null end),
+      stages: $stages,
+      duration_seconds: ($stages | map(.seconds) | add // 0),
+      retries: ($stages | map(.retries) | add // 0),
+      prompt_tokens: $tokens,
+      cost: (if $price == "" then null else $tokens * ($price | tonumber) / 1000000 end),
+      cpu_seconds: (if $resources then $resources.cpu_user_seconds + $resources.cpu_system_seconds else null end),
+      fetched_kb: $resources.fetched_kb,
+      api_calls: $api_usage.calls,
+      api_wait_seconds: $api_usage.wait_seconds
+    }'
+}
+
+# run_report_diff compares two local runs (see resolve_run_id): the findings
+# the second run added and resolved, and the change in acceptance criteria
+# coverage, size of the change, duration, cost and CPU time. With
+# DIGEST_FORMAT=json the comparison is printed as JSON.
+run_report_diff() {
+  root_dir=$(git rev-parse --show-toplevel)
+  local ref id summaries=()
+  for ref in "$1" "$2"; do
+    if ! id=$(resolve_run_id "$ref"); then
+      log "No local run found for $ref" >&2
+      exit 1
+    fi
+    summaries+=("$(run_summary "$root_dir/.cca/runs/$id")")
+  done
+  jq -n --argjson a "${summaries[0]}" --argjson b "${summaries[1]}" '
+    def key: [.source, (.location | sub(":[0-9]+$"; "")), .message];
+    def pct: if . == null or .total == 0 then null else 100 * .covered / .total | floor end;
+    def lines: if . == null then null else .insertions + .deletions end;
+    def delta(f): if ($a | f) == null or ($b | f) == null then null else ($b | f) - ($a | f) end;
+    ([$a.findings[] | key]) as $ka | ([$b.findings[] | key]) as $kb |
+    {
+      a: $a.run_id,
+      b: $b.run_id,
+      findings: {
+        added: [$b.findings[] | select(key as $k | $ka | any(. == $k) | not)],
+        resolved: [$a.findings[] | select(key as $k | $kb | any(. == $k) | not)]
+      },
+      deltas: {
+        findings: delta(.findings | length),
+        criteria_coverage_pct: delta(.criteria | pct),
+        files_changed: delta(.change.files),
+        lines_changed: delta(.change | lines),
+        plan_files: delta(.plan_files),
+        duration_seconds: delta(.duration_seconds),
+        retries: delta(.retries),
+        prompt_tokens: delta(.prompt_tokens),
+        cost: delta(.cost),
+        cpu_seconds: delta(.cpu_seconds),
+        fetched_kb: delta(.fetched_kb),
+        api_calls: delta(.api_calls),
+        api_wait_seconds: delta(.api_wait_seconds)
+      },
+      stages: (reduce ($a.stages + $b.stages)[].name as $n ([]; if index([$n]) then . else . + [$n] end) | map(. as $n | {
+        name: .,
+        a: ([$a.stages[] | select(.name == $n) | .seconds] | add),
+        b: ([$b.stages[] | select(.name == $n) | .seconds] | add)
+      })),
+      runs: {a: $a, b: $b}
+    }' | if [ "$DIGEST_FORMAT" = "json" ]; then
+    cat
+  else
+    jq -r '
+      def pct: if . == null or .total == 0 then null else 100 * .covered / .total | floor end;
+      def lines: if . == null then null else .insertions + .deletions end;
+      def show: if . == null then "-" elif type == "number" then (. * 10000 | round / 10000 | tostring) else tostring end;
+      def signed: if . == null then "" elif . > 0 then "+" + show else show end;
+      def row($name; f; d): [$name, (.runs.a | f | show), (.runs.b | f | show), (d | signed)] | @tsv;
+      "Run A: \(.a) (\(.runs.a.status))",
+      "Run B: \(.b) (\(.runs.b.status))",
+      "",
+      (["", "A", "B", "CHANGE"] | @tsv),
+      row("Findings"; .findings | length; .deltas.findings),
+      row("Criteria coverage %"; .criteria | pct; .deltas.criteria_coverage_pct),
+      row("Files changed"; .change.files; .deltas.files_changed),
+      row("Lines changed"; .change | lines; .deltas.lines_changed),
+      row("Planned files"; .plan_files; .deltas.plan_files),
+      row("Duration (s)"; .duration_seconds; .deltas.duration_seconds),
+      row("Stage retries"; .retries; .deltas.retries),
+      row("Prompt tokens"; .prompt_tokens; .deltas.prompt_tokens),
+      row("Cost ($)"; .cost; .deltas.cost),
+      row("CPU (s)"; .cpu_seconds; .deltas.cpu_seconds),
+      row("Fetched (KB)"; .fetched_kb; .deltas.fetched_kb),
+      row("GitHub API calls"; .api_calls; .deltas.api_calls),
+      row("Rate limit waits (s)"; .api_wait_seconds; .deltas.api_wait_seconds),
+      "",
+      "Stage durations (s):",
+      (.stages[] | "  \(.name)\t\(.a | show)\t\(.b | show)\t\(if .a and .b then .b - .a | signed else "" end)"),
+      "",
+      "Findings added in B:",
+      (if .findings.added == [] then "  none" else .findings.added[] | "  \(.severity) \(.source) \(.location): \(.message)" end),
+      "",
+      "Findings resolved in B:",
+      (if .findings.resolved == [] then "  none" else .findings.resolved[] | "  \(.severity) \(.source) \(.location): \(.message)" end)' |
+      awk -F'\t' 'NF == 4 { printf "%-26s  %12s  %12s  %10s\n", $1, $2, $3, $4; next } { print }'
+  fi
+}
+
+# badge_svg prints a flat badge in the style of shields.io with label $1,
+# message $2 and color $3. Text widths are estimated at 7 pixels a character.
+badge_svg() {
+  local label="$1" message="$2" color="$3" lw mw
+  lw=$((${#label} * 7 + 10))
+  mw=$((${#message} * 7 + 10))
+  cat <<EOF14
+<svg xmlns="http://www.w3.org/2000/svg" width="$((lw + mw))" height="20" role="img" aria-label="$label: $message">
+  <title>$label: $message</title>
+  <linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+  <clipPath id="r"><rect width="$((lw + mw))" height="20" rx="3" fill="#fff"/></clipPath>
+  <g clip-path="url(#r)">
+    <rect width="$lw" height="20" fill="#555"/>
+    <rect x="$lw" width="$mw" height="20" fill="$color"/>
+    <rect width="$((lw + mw))" height="20" fill="url(#s)"/>
+  </g>
+  <g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+    <text x="$((lw / 2))" y="14">$label</text>
+    <text x="$((lw + mw / 2))" y="14">$message</text>
+  </g>
+</svg>
+EOF14
+}
+
+# run_badge writes badge.svg and a shields.io endpoint badge.json to
+# BADGE_DIR for the latest finished run: "passing" when it completed without
+# critical, high or serious findings, the number of such findings otherwise
+# or "failing", followed by its acceptance criteria coverage. With
+# BADGE_BRANCH the files are pushed as the only commit on that branch, from
+# where a README can embed them.
+run_badge() {
+  root_dir=$(git rev-parse --show-toplevel)
+  local status_file dir="" status severe message color coverage
+  for status_file in "$root_dir"/.cca/runs/*/status.json; do
+    [ -f "$status_file" ] || continue
+    status=$(jq -r '.status' "$status_file")
+    [[ "$status" != completed && "$status" != failed ]] || dir=$(dirname "$status_file")
+  done
+  if [ -z "$dir" ]; then
+    log "No finished runs in $root_dir/.cca/runs" >&2
+    exit 1
+  fi
+  status=$(jq -r '.status' "$dir/status.json")
+  severe=$(run_dir="$dir" findings_tsv | awk -F'\t' '$1 == "critical" || $1 == "high" || $1 == "serious"' | wc -l)
+  if [ "$status" = "failed" ]; then
+    message="failing"
+    color="#e05d44"
+  elif [ "$severe" -gt 0 ]; then
+    message="$severe finding$([ "$severe" -eq 1 ] || echo s)"
+    color="#fe7d37"
+  else
+    message="passing"
+    color="#4c1"
+  fi
+  if [ -f "$dir/traceability.json" ]; then
+    coverage=$(jq '.criteria | if length == 0 then empty else 100 * ([.[] | select(.tests | length > 0)] | length) / length | floor end' \
+      "$dir/traceability.json")
+    [ -z "$coverage" ] || message+=" | criteria $coverage%"
+  fi
+
+  local out="$BADGE_DIR"
+  [[ "$out" == /* ]] || out="$root_dir/$out"
+  mkdir -p "$out"
+  badge_svg cca "$message" "$color" >"$out/badge.svg"
+  jq -n --arg message "$message" --arg color "${color#\#}" --arg run_id "$(basename "$dir")" \
+    '{schemaVersion: 1, label: "cca", message: $message, color: $color, run_id: $run_id}' >"$out/badge.json"
+  log "Badge for run $(basename "$dir"): $message ($out/badge.svg, $out/badge.json)"
+
+  [ -n "$BADGE_BRANCH" ] || return 0
+  if [ "$READ_ONLY" -eq 1 ]; then
+    log "Not publishing the badge to $BADGE_BRANCH (read-only)"
+    return 0
+  fi
+  local tree parent commit repo
+  tree=$(printf '100644 blob %s\tbadge.json\n100644 blob %s\tbadge.svg\n' \
+    "$(git hash-object -w "$out/badge.json")" "$(git hash-object -w "$out/badge.svg")" | git mktree)
+  parent=$(git ls-remote origin "refs/heads/$BADGE_BRANCH" | cut -f1)
+  if [ -n "$parent" ] && [ "$(git rev-parse "$parent^{tree}" 2>/dev/null)" = "$tree" ]; then
+    log "Badge on $BADGE_BRANCH is up to date"
+  else
+    commit=$(git commit-tree "$tree" -m "Update cca badge for run $(basename "$dir")")
+    push --force origin "$commit:refs/heads/$BADGE_BRANCH"
+    log "Published the badge to $BADGE_BRANCH"
+  fi
+  repo=$(repo_of "$(git remote get-url origin)")
+  echo "![cca](https://raw.githubusercontent.com/$repo/$BADGE_BRANCH/badge.svg)"
+  echo "![cca](https://img.shields.io/endpoint?url=https://raw.githubusercontent.com/$repo/$BADGE_BRANCH/badge.json)"
+}
+
+# run_debug inspects the prompt transcripts of recorded runs: "prompts" lists
+# them, "show" prints one, "diff" compares the prompts of two runs,
+# "reissue" sends an (optionally edited) prompt to the backend again and
+# "context" prints the context report.
+run_debug() {
+  local runs n file
+  runs="$(git rev-parse --show-toplevel)/.cca/runs"
+  [ -n "$OPERAND" ] && [ -d "$runs/$OPERAND/transcripts" ] || { log "No transcripts for run ${OPERAND:-?}" >&2; exit 1; }
+  case "$TARGET" in
+    prompts)
+      for file in "$runs/$OPERAND"/transcripts/*.prompt.txt; do
+        n=$(basename "$file" .prompt.txt)
+        echo "$n prompt $(wc -c <"$file") bytes, response $(wc -c <"${file%.prompt.txt}.response.txt") bytes"
+      done
+      ;;
+    show|reissue)
+      [ -n "$EXTRA" ] || usage
+      file=$(ls "$runs/$OPERAND/transcripts/$(printf '%03d' "$((10#$EXTRA))")"-*.prompt.txt 2>/dev/null | head -n 1 || true)
+      [ -n "$file" ] || { log "No prompt $EXTRA in run $OPERAND" >&2; exit 1; }
+      if [ "$TARGET" = "show" ]; then
+        echo "=== prompt ==="
+        cat "$file"
+        echo "=== response ==="
+        cat "${file%.prompt.txt}.response.txt"
+        return
+      fi
+      local edited
+      edited=$(mktemp)
+      cp "$file" "$edited"
+      if [ -t 0 ]; then
+        "${EDITOR:-vi}" "$edited"
+      fi
+      require_tools
+      log "Sending prompt $EXTRA of $OPERAND to $BACKEND" >&2
+      claude_chat "$edited" "with-p"
+      rm "$edited"
+      ;;
+    diff)
+      [ -n "$EXTRA" ] && [ -d "$runs/$EXTRA/transcripts" ] || usage
+      for file in "$runs/$OPERAND"/transcripts/*.prompt.txt; do
+        n=$(basename "$file" | cut -d- -f1)
+        diff -u --label "$OPERAND/$(basename "$file")" --label "$EXTRA/$n" \
+          "$file" "$(ls "$runs/$EXTRA/transcripts/$n"-*.prompt.txt 2>/dev/null | head -n 1 || echo /dev/null)" || true
+      done
+      ;;
+    context)
+      context_report "$runs/$OPERAND" >&2
+      [ ! -f "$runs/$OPERAND/context-report.md" ] || cat "$runs/$OPERAND/context-report.md"
+      ;;
+    *) usage ;;
+  esac
+}
+
+# run_explain prints a self-review finding with the surrounding code, its
+# rationale and references, followed by a tailored explanation and suggested
+# fix from the backend. The finding is looked up in the given run, or in the
+# most recent run that has it.
+run_explain() {
+  local id="$1" runs dir finding="" file line branch code start
+  runs="$(git rev-parse --show-toplevel)/.cca/runs"
+  for dir in $(ls -dr "$runs"/${OPERAND:-*}/ 2>/dev/null); do
+    [ -f "$dir/self-review.jsonl" ] || continue
+    finding=$(jq -c --arg id "$id" 'select(.findings) | .findings[] | select(.id == $id)' "$dir/self-review.jsonl" | tail -n 1)
+    [ -z "$finding" ] || break
+  done
+  [ -n "$finding" ] || { log "Finding $id not found" >&2; exit 1; }
+  file=$(jq -r '.file // ""' <<<"$finding")
+  line=$(jq -r '.line // 0 | tonumber? // 0' <<<"$finding")
+  branch=$(jq -r '.branch // ""' "$dir/status.json" 2>/dev/null || true)
+
+  echo "$id ($(jq -r '.severity' <<<"$finding")) in $(basename "$dir")"
+  echo "$(jq -r '.category // "uncategorized"' <<<"$finding"): $(jq -r '.message' <<<"$finding")"
+  jq -r '[.cwe, .owasp] | map(select(. != null and . != "")) | if length > 0 then "References: " + join(", ") else empty end' <<<"$finding"
+  jq -r '.rationale // empty | "Rationale: " + .' <<<"$finding"
+
+  code=""
+  if [ -n "$file" ]; then
+    code=$( { [ -n "$branch" ] && git show "$branch:$file" 2>/dev/null; } || cat "$file" 2>/dev/null || true)
+  fi
+  if [ -n "$code" ]; then
+    start=$(( line > 5 ? line - 5 : 1 ))
+    code=$(awk -v start="$start" -v end=$((start + 10)) -v line="$line" -v bold="$( [ -t 1 ] && tput bold 2>/dev/null || true)" \
+      -v reset="$( [ -t 1 ] && tput sgr0 2>/dev/null || true)" \
+      'NR >= start && NR <= end { if (NR == line) printf "%s> %5d  %s%s\n", bold, NR, $0, reset; else printf "  %5d  %s\n", NR, $0 }' <<<"$code")
+    echo
+    echo "$file:"
+    echo "$code"
+  fi
+
+  require_tools
+  local prompt_file
+  prompt_file=$(mktemp)
+  cat >"$prompt_file" <<EOF12
+A code review reported this finding:
+$finding
+${code:+
+The code around it:
+$code
+}
+Explain to the author, as a short lesson, why this is a problem, when it can
+bite in practice and how to recognise it elsewhere. Then show a suggested fix
+as a code snippet. Answer in Markdown.
+EOF12
+  echo
+  claude_chat "$prompt_file" "with-p"
+  rm "$prompt_file"
+}
+
+# resolve_conflicts asks the backend to resolve the conflicted files of an
+# in-progress rebase, refusing when there are none or more than
+# MAX_CONFLICT_FILES are affected.
+resolve_conflicts() {
+  local conflicted=() count prompt_file resolution tmp_resolution
+  mapfile -t conflicted < <(git diff --name-only --diff-filter=U)
+  count=${#conflicted[@]}
+  if [ "$count" -eq 0 ]; then
+    log "The rebase stopped without conflicted files" >&2
+    return 1
+  fi
+  if [ "$count" -gt "$MAX_CONFLICT_FILES" ]; then
+    log "$count conflicted files exceed the limit of $MAX_CONFLICT_FILES" >&2
+    return 1
+  fi
+
+  prompt_file=$(mktemp)
+  {
+    echo "Resolve the git merge conflicts in these files. Keep the intent of both sides."
+    echo "Return every file with its complete resolved content and no conflict markers."
+    echo
+    local path
+    for path in "${conflicted[@]}"; do
+      echo "File: $path"
+      context_file "$path"
+      echo
+    done
+    echo 'Format as JSON: {"files": {"path": "resolved content"}}'
+  } >"$prompt_file"
+  log "Asking $BACKEND to resolve $count conflicted files"
+  resolution=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  check_changes "$resolution" || return 1
+
+  tmp_resolution=$(mktemp)
+  echo "$resolution" > "$tmp_resolution"
+  apply_changes "$tmp_resolution"
+  rm "$tmp_resolution"
+  if grep -l '^<<<<<<< ' -- "${conflicted[@]}" >/dev/null 2>&1; then
+    log "Conflict markers remain after resolution" >&2
+    return 1
+  fi
+  git add -- "${conflicted[@]}"
+}
+
+# rebase_pr rebases one cca pull request onto its base branch, re-runs
+# verification and force-pushes, commenting on the pull request either way.
+# The rebase is aborted after REBASE_ATTEMPTS resolutions, or when it stops
+# without conflicts or twice on the same commit, as when a hook rejects the
+# resolved commit.
+rebase_pr() {
+  local url="$1" head="$2" base="$3"
+  local dir="$root_dir/.cca/worktrees/$head" failure=""
+  local attempts=0 stuck=0 stopped_at
+
+  fetch "$head" "$base"
+  deepen_until "rebasing $head onto $base" has_merge_base "origin/$head" "origin/$base"
+  git worktree add -B "$head" "$dir" "origin/$head"
+  pushd "$dir" >/dev/null
+  init_submodules
+  if ! git rebase "origin/$base" >/dev/null 2>&1; then
+    while [ -d "$(git rev-parse --git-path rebase-merge)" ] || [ -d "$(git rev-parse --git-path rebase-apply)" ]; do
+      attempts=$((attempts + 1))
+      if [ "$attempts" -gt "$REBASE_ATTEMPTS" ] || [ "$stuck" -ge 2 ]; then
+        log "Giving up on the rebase of $head after $((attempts - 1)) resolutions" >&2
+        git rebase --abort
+        failure=$(msg comment.rebase_conflict "$base")
+        break
+      fi
+      if ! resolve_conflicts; then
+        git rebase --abort
+        failure=$(msg comment.rebase_conflict "$base")
+        break
+      fi
+      stopped_at=$(git rev-parse -q --verify REBASE_HEAD || true)
+      if GIT_EDITOR=true git rebase --continue >/dev/null 2>&1; then
+        stuck=0
+      elif [ "$(git rev-parse -q --verify REBASE_HEAD || true)" = "$stopped_at" ]; then
+        stuck=$((stuck + 1))
+      else
+        stuck=0
+      fi
+    done
+  fi
+
+  if [ -z "$failure" ]; then
+    log "Running verification..."
+    local verify_output
+    detect_toolchains
+    if verify_output=$(run_verify full); then
+      push --force-with-lease origin "$head"
+      gh pr comment "$url" --body "$(msg comment.rebased "$base")"$'\n\n'"$(run_marker)"
+      log "Rebased $url"
+    else
+      failure="$(msg comment.rebase_failed "$base")
+\`\`\`
+$(echo "$verify_output" | tail -n 50)
+\`\`\`"
+    fi
+  fi
+  if [ -n "$failure" ]; then
+    gh pr comment "$url" --body "$(redact <<<"$failure"$'\n\n'"$(run_marker)")"
+    log "Could not rebase $url" >&2
+  fi
+
+  popd >/dev/null
+  git worktree remove --force "$dir"
+}
+
+# run_rebase finds open cca pull requests with merge conflicts and rebases them.
+run_rebase() {
+  require_tools
+  root_dir=$(git rev-parse --show-toplevel)
+  mkdir -p "$root_dir/.cca/worktrees"
+  init_run_dir rebase
+
+  local prs
+  if [ -n "$TARGET" ]; then
+    prs=$(gh pr view "$TARGET" --json url,headRefName,baseRefName,mergeable | jq -c '[.]')
   else
-    claude "$prompt"
+    prs=$(gh pr list --state open --limit 100 --json url,headRefName,baseRefName,mergeable)
+  fi
+  prs=$(echo "$prs" | jq -r '.[] | select((.headRefName | startswith("cca/")) and .mergeable == "CONFLICTING")
+    | [.url, .headRefName, .baseRefName] | @tsv')
+  if [ -z "$prs" ]; then
+    log "No conflicting cca pull requests found"
+    return
   fi
+
+  # The list is read on its own descriptor so the backend and verification
+  # commands run for one pull request cannot consume the rest of it.
+  local url head base
+  while IFS=$'\t' read -r -u 3 url head base; do
+    log "Rebasing $url ($head onto $base)"
+    rebase_pr "$url" "$head" "$base"
+  done 3<<<"$prs"
 }
 
-apply_changes() {
-  local file="$1"
-  jq -r '.deleted_files[]?' "$file" | while read -r path; do
-    rm -f "$path"
-    log "Deleted $path"
+# go_module_breaks prints the exported declarations of Go module $1 that exist
+# at version $2 but not at $3, for the module root and the packages the
+# repository imports from it.
+go_module_breaks() {
+  command -v go >/dev/null && [ -f go.mod ] || return 0
+  local old new pkg
+  old=$(go mod download -json "$1@$2" 2>/dev/null | jq -r '.Dir // empty' || true)
+  new=$(go mod download -json "$1@$3" 2>/dev/null | jq -r '.Dir // empty' || true)
+  [ -n "$old" ] && [ -n "$new" ] || return 0
+  while read -r pkg; do
+    [ -d "$old/$pkg" ] || continue
+    comm -23 <(go_api_surface "$old/$pkg") <(go_api_surface "$new/$pkg" 2>/dev/null) |
+      sed "s|^|$1${pkg:+/$pkg}: |"
+  done < <({ echo; git grep -ho "\"$1/[^\"]*\"" -- '*.go' | tr -d '"' | sed "s|^$1/||"; } | sort -u)
+}
+
+# run_triage reviews a dependency update pull request opened by one of
+# TRIAGE_AUTHORS: it lists the version bumps, their use in the code and the Go
+# API they remove, runs verification on the pull request, and asks the backend
+# to rate the risk from this and the changelog in the description. Low-risk
+# updates that pass verification are approved when TRIAGE_APPROVE=1; all
+# others get the analysis as a comment.
+run_triage() {
+  local url="$1"
+  if [[ "$url" != *github.com* || "$url" != */pull/* ]]; then
+    log "Invalid GitHub pull request URL: $url" >&2
+    exit 1
+  fi
+  require_tools
+  root_dir=$(git rev-parse --show-toplevel)
+
+  local pr_json number author base
+  pr_json=$(gh pr view "$url" --json number,title,body,author,baseRefName)
+  number=$(jq -r '.number' <<<"$pr_json")
+  author=$(jq -r '.author.login' <<<"$pr_json")
+  base=$(jq -r '.baseRefName' <<<"$pr_json")
+  title=$(jq -r '.title' <<<"$pr_json")
+  if [[ " $TRIAGE_AUTHORS " != *" $author "* ]]; then
+    log "Pull request #$number was opened by $author, not a dependency bot (CCA_TRIAGE_AUTHORS)" >&2
+    exit 1
+  fi
+  log "Triaging #$number: $title"
+  init_run_dir "triage-$number"
+
+  fetch "$base"
+  fetch "pull/$number/head"
+  local dir="$root_dir/.cca/worktrees/triage-$number"
+  mkdir -p "$root_dir/.cca/worktrees"
+  git worktree add --detach "$dir" FETCH_HEAD >/dev/null 2>&1
+  pushd "$dir" >/dev/null
+  init_submodules
+
+  local bumps="" breaks="" eco name old new uses
+  while read -r eco name old new; do
+    [ -n "$name" ] || continue
+    uses=$(git grep -l -F "$name" -- ':!go.mod' ':!go.sum' ':!package.json' ':!*lock*' | wc -l)
+    bumps+="- $eco \`$name\` $old -> $new (referenced in $uses files)"$'\n'
+    [ "$eco" != "Go" ] || breaks+=$(go_module_breaks "$name" "$old" "$new")
+  done < <(join -j 2 -o 1.1,1.2,1.3,2.3 <(dependencies "origin/$base" | sort -k2,2) <(dependencies HEAD | sort -k2,2) |
+    awk '$3 != $4')
+  [ -z "$breaks" ] || printf '%s\n' "$breaks" >"$run_dir/api-removals.txt"
+
+  local verify_output verified=1
+  log "Running verification..."
+  detect_toolchains
+  if ! verify_output=$(run_verify full); then
+    verified=0
+    printf '%s\n' "$verify_output" >"$run_dir/verify.log"
+  fi
+  popd >/dev/null
+  git worktree remove --force "$dir"
+
+  local prompt_file analysis
+  prompt_file=$(mktemp)
+  cat >"$prompt_file" <<EOF13
+Assess the risk of merging this dependency update.
+
+Pull request: $title
+Description (release notes and changelog):
+$(jq -r '.body' <<<"$pr_json" | head -c "$CONTEXT_MAX_BYTES")
+
+Version changes:
+${bumps:-none detected}
+
+Exported Go API removed or changed by the update:
+$(head -n 100 <<<"${breaks:-none}")
+
+Verification: $([ "$verified" -eq 1 ] && echo passed || echo "failed:
+$(tail -n 50 <<<"$verify_output")")
+
+Rate the risk "low" only when no breaking change affects this repository.
+
+Format as JSON:
+{"risk": "low|medium|high", "summary": "one paragraph", "concerns": ["specific breaking change or follow-up"]}
+EOF13
+  analysis=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  if ! analysis=$(jq -c '{risk: (.risk // "high"), summary: (.summary // ""), concerns: (.concerns // [])}' <<<"$analysis" 2>/dev/null); then
+    log "Could not parse risk assessment; treating as high risk" >&2
+    analysis='{"risk": "high", "summary": "The risk assessment could not be parsed.", "concerns": []}'
+  fi
+  jq --argjson verified "$verified" '. + {verified: ($verified == 1)}' <<<"$analysis" >"$run_dir/triage.json"
+
+  local risk comment
+  risk=$(jq -r '.risk' <<<"$analysis")
+  comment="$(msg comment.triage "$risk" "$([ "$verified" -eq 1 ] && msg comment.passed || msg comment.failed)")
+
+$(jq -r '.summary' <<<"$analysis")
+${bumps:+
+$(msg comment.versions)
+$bumps}$(jq -r --arg heading "$(msg comment.concerns)" 'if (.concerns | length) > 0 then "\n" + $heading + "\n" + (.concerns | map("- " + .) | join("\n")) else empty end' <<<"$analysis")"
+  if [ "$READ_ONLY" -eq 1 ]; then
+    printf '%s\n' "$comment"
+    log "Read-only mode: not commenting on $url"
+  elif [ "$risk" = "low" ] && [ "$verified" -eq 1 ] && [ "$TRIAGE_APPROVE" -eq 1 ]; then
+    gh pr review "$url" --approve --body "$(fit_body "$(redact <<<"$comment"$'\n\n'"$(run_marker)")" triage-review)"
+    log "Approved $url"
+  else
+    gh pr comment "$url" --body "$(fit_body "$(redact <<<"$comment"$'\n\n'"$(run_marker)")" triage-comment)"
+    log "Commented risk analysis on $url"
+  fi
+}
+
+# rank_signals prints one JSON object per open issue in the gh issue list
+# output on stdin, with the signals the ranking is based on: checklist items,
+# open questions, body size, comments, labels and the paths the issue mentions
+# that exist in the checkout ($1 is 1 when the checkout is the ranked repo).
+rank_signals() {
+  local local_checkout="$1" line path located
+  jq -c '.[] | (.body // "") as $body | {
+    number,
+    title,
+    body: $body[:1500],
+    labels: [.labels[].name],
+    comments: (.comments | length),
+    bytes: ($body | length),
+    checklist: ([$body | scan("(?m)^\\s*[-*] \\[[ xX]\\]")] | length),
+    questions: ([$body | scan("\\?(\\s|$)")] | length),
+    paths: ([$body | scan("[A-Za-z0-9_.-]+(?:/[A-Za-z0-9_.-]+)*\\.[A-Za-z0-9]+")] | unique),
+    decision_labels: ([.labels[].name | ascii_downcase | select(test("design|discussion|question|proposal|rfc|needs-decision"))] | length)
+  }' | while IFS= read -r line; do
+    located=0
+    if [ "$local_checkout" -eq 1 ]; then
+      while IFS= read -r path; do
+        [ -z "$path" ] || [ ! -e "$root_dir/$path" ] || located=$((located + 1))
+      done < <(jq -r '.paths[]' <<<"$line")
+    fi
+    jq -c --argjson located "$located" 'del(.paths) + {located_paths: $located}' <<<"$line"
   done
+}
 
-  jq -r '.files | to_entries[] | [.key, (.value|@base64)] | @tsv' "$file" 2>/dev/null | \
-  while IFS=$'\t' read -r path b64; do
-    content=$(echo "$b64" | base64 --decode)
-    mkdir -p "$(dirname "$path")"
-    printf '%s' "$content" > "$path"
-    log "Wrote $path"
+# rank_heuristic prints {"number", "score", "reason"} for a rank_signals line.
+# It is used when the backend's ranking cannot be parsed.
+rank_heuristic() {
+  jq -c '{
+    number,
+    score: ([0, 100, 50 + 10 * ([.checklist, 3] | min) + 10 * ([.located_paths, 2] | min)
+      - 10 * ([.questions, 3] | min) - 30 * ([.decision_labels, 1] | min)
+      - (if .bytes > 4000 then 20 else 0 end) - (if .comments > 10 then 10 else 0 end)] | sort | .[1]),
+    reason: ([
+      (if .checklist > 0 then "\(.checklist) checklist items" else "no checklist" end),
+      (if .located_paths > 0 then "mentions \(.located_paths) existing files" else empty end),
+      (if .questions > 0 then "\(.questions) open questions" else empty end),
+      (if .decision_labels > 0 then "labelled for discussion" else empty end),
+      (if .bytes > 4000 then "long description" else empty end)
+    ] | join(", "))
+  }'
+}
+
+# run_rank scores the open issues of $1 (the current repository when empty)
+# by how likely CCA is to complete them without help and prints them ranked,
+# with the reasons for each score.
+run_rank() {
+  require_commands gh jq
+  local repo="$1" local_checkout=0 current=""
+  root_dir=$(git rev-parse --show-toplevel 2>/dev/null || true)
+  [ -z "$root_dir" ] || current=$(gh repo view --json nameWithOwner -q .nameWithOwner 2>/dev/null || true)
+  [ -n "$repo" ] || repo="$current"
+  if [ -z "$repo" ]; then
+    log "No repository given and the current directory is not a GitHub repository" >&2
+    exit 1
+  fi
+  [ "$repo" != "$current" ] || local_checkout=1
+
+  local signals
+  log "Fetching open issues of $repo" >&2
+  signals=$(gh issue list --repo "$repo" --state open --limit "$RANK_LIMIT" --json number,title,body,labels,comments |
+    rank_signals "$local_checkout")
+  if [ -z "$signals" ]; then
+    log "$repo has no open issues"
+    return
+  fi
+
+  local prompt_file ranking
+  prompt_file=$(mktemp)
+  cat >"$prompt_file" <<EOF18
+Score each of these GitHub issues from 0 to 100 by how likely an autonomous
+coding agent is to resolve it correctly without asking a human.
+
+Score higher when:
+- the requirements are clear and testable (checklists, expected behaviour, reproduction steps)
+- the change is local to a few files (located_paths counts the mentioned files that exist$([ "$local_checkout" -eq 1 ] || echo "; it is 0 because the repository is not checked out"))
+- the change is small
+
+Score lower when the issue leaves design or product decisions open, asks
+questions, or is labelled for discussion.
+
+Issues, one JSON object per line:
+$(head -c "$CONTEXT_MAX_BYTES" <<<"$signals")
+
+Format as a JSON array, one entry per issue:
+[{"number": 1, "score": 0, "reason": "one sentence naming clarity, locality, size and open decisions"}]
+EOF18
+  ranking=$(claude_chat "$prompt_file" "with-p")
+  rm "$prompt_file"
+  if ! ranking=$(jq -c '[.[] | {number: (.number | tonumber), score: (.score | tonumber), reason: (.reason // "")}]' <<<"$ranking" 2>/dev/null); then
+    log "Could not parse the ranking; scoring by heuristics" >&2
+    ranking=$(rank_heuristic <<<"$signals" | jq -sc .)
+  fi
+
+  echo "| Rank | Issue | Score | Title | Reason |"
+  echo "| --- | --- | --- | --- | --- |"
+  jq -rn --argjson ranking "$ranking" --slurpfile issues <(cat <<<"$signals") '
+    ($issues | map({key: (.number | tostring), value: .title}) | from_entries) as $titles
+    | $ranking | sort_by(-.score) | to_entries[]
+    | select($titles[.value.number | tostring])
+    | "| \(.key + 1) | #\(.value.number) | \(.value.score) | \($titles[.value.number | tostring] | gsub("\\|"; "\\|")) | \(.value.reason | gsub("\\|"; "\\|")) |"'
+}
+
+# remove runs a cleanup command, or only prints it with --dry-run.
+remove() {
+  if [ "$DRY_RUN" -eq 1 ]; then
+    log "Would run: $*"
+  else
+    log "Running: $*"
+    "$@"
+  fi
+}
+
+# pr_outcome records in outcome.json of run directory $1 what happened to the
+# run's pull request: its state, and how many changed lines others added on
+# top of the generated change. Merged and closed pull requests are final and
+# not looked up again.
+pr_outcome() {
+  local dir="$1" url repo pr_json state head amended=0
+  url=$(jq -r '.pr_url // ""' "$dir/status.json" 2>/dev/null || true)
+  [ -n "$url" ] || return 0
+  if [ -f "$dir/outcome.json" ] && [ "$(jq -r '.state' "$dir/outcome.json")" != "OPEN" ]; then
+    return
+  fi
+  repo=$(sed -E 's#^https://github.com/([^/]+/[^/]+)/pull/.*#\1#' <<<"$url")
+  pr_json=$(gh pr view "$url" --json state,mergedAt,closedAt,headRefOid,additions,deletions 2>/dev/null) || return 0
+  state=$(jq -r '.state' <<<"$pr_json")
+  head=$(jq -r '.pr_head // ""' "$dir/status.json")
+  if [ -n "$head" ] && [ "$head" != "$(jq -r '.headRefOid' <<<"$pr_json")" ]; then
+    amended=$(gh api "repos/$repo/compare/$head...$(jq -r '.headRefOid' <<<"$pr_json")" \
+      --jq '[.files[]? | .additions + .deletions] | add // 0' 2>/dev/null || echo 0)
+  fi
+  jq -n --argjson pr "$pr_json" --arg repo "$repo" --argjson amended "$amended" \
+    --argjson generated "$(jq '.pr_lines // 0 | tonumber' "$dir/status.json")" \
+    --argjson threshold "$OUTCOME_AMEND_PCT" --arg checked "$(date -u +%Y-%m-%dT%H:%M:%SZ)" '{
+      repo: $repo,
+      state: $pr.state,
+      merged_at: $pr.mergedAt,
+      closed_at: $pr.closedAt,
+      generated_lines: $generated,
+      amended_lines: $amended,
+      heavily_amended: ($generated > 0 and 100 * $amended / $generated >= $threshold),
+      checked_at: $checked
+    }' >"$dir/outcome.json"
+}
+
+# network_setup applies the proxy and TLS settings the same way to gh, git,
+# curl and the AI backend CLIs. Proxy variables are exported in both upper
+# and lower case, since tools disagree on which they read. CA_BUNDLE is added
+# to the system CA certificates in a combined bundle that every client is
+# pointed at, and CLIENT_CERT and CLIENT_KEY are used for mutual TLS by git
+# and curl.
+network_setup() {
+  local var lower bundle system=""
+  for var in HTTPS_PROXY HTTP_PROXY NO_PROXY; do
+    lower="${var,,}"
+    if [ -n "${!var:-}" ] && [ -z "${!lower:-}" ]; then
+      export "$lower=${!var}"
+    elif [ -z "${!var:-}" ] && [ -n "${!lower:-}" ]; then
+      export "$var=${!lower}"
+    fi
   done
+  if [ -n "$CA_BUNDLE" ]; then
+    if [ ! -r "$CA_BUNDLE" ]; then
+      log "CA bundle not found: $CA_BUNDLE" >&2
+      exit 1
+    fi
+    for var in /etc/ssl/certs/ca-certificates.crt /etc/pki/tls/certs/ca-bundle.crt /etc/ssl/cert.pem; do
+      if [ -f "$var" ]; then
+        system="$var"
+        break
+      fi
+    done
+    bundle="${XDG_CACHE_HOME:-$HOME/.cache}/cca/ca-bundle.pem"
+    mkdir -p "$(dirname "$bundle")"
+    { [ -z "$system" ] || cat "$system"; echo; cat "$CA_BUNDLE"; } >"$bundle.$$"
+    mv "$bundle.$$" "$bundle"
+    export SSL_CERT_FILE="$bundle" CURL_CA_BUNDLE="$bundle" GIT_SSL_CAINFO="$bundle" \
+      REQUESTS_CA_BUNDLE="$bundle" AWS_CA_BUNDLE="$bundle" NODE_EXTRA_CA_CERTS="$CA_BUNDLE"
+  fi
+  tls_curl_args=()
+  if [ -n "$CLIENT_CERT" ]; then
+    export GIT_SSL_CERT="$CLIENT_CERT"
+    tls_curl_args+=(--cert "$CLIENT_CERT")
+    if [ -n "$CLIENT_KEY" ]; then
+      export GIT_SSL_KEY="$CLIENT_KEY"
+      tls_curl_args+=(--key "$CLIENT_KEY")
+    fi
+  fi
 }
 
-if [ "$#" -ne 1 ]; then
-  log "Usage: $0 <github-issue-url>" >&2
-  exit 1
-fi
+# doctor_endpoint checks that HTTPS endpoint $2 (named $1) is reachable with
+# the proxy and TLS settings, printing the route, status and certificate
+# issuer, or the error with a hint on what to change. It fails when the
+# endpoint is unreachable.
+doctor_endpoint() {
+  local err code=0 status route issuer hint
+  err=$(mktemp)
+  status=$(curl -sS -v -o /dev/null -w '%{http_code}' --max-time 15 "$2" 2>"$err") || code=$?
+  route="direct"
+  grep -q 'Uses proxy env variable' "$err" && route="via $(redact <<<"${HTTPS_PROXY:-$HTTP_PROXY}" | sed -E 's#//[^@/]*@#//***@#')"
+  issuer=$(sed -n 's/^\*  *issuer: //p' "$err" | head -n 1)
+  if [ "$code" -eq 0 ]; then
+    printf 'ok    %s: HTTP %s, %s%s\n' "$1" "$status" "$route" "${issuer:+, issuer $issuer}"
+    rm -f "$err"
+    return 0
+  fi
+  case "$code" in
+    60) hint="The certificate is not trusted. If a proxy inspects TLS traffic, set CCA_CA_BUNDLE to its CA certificate (PEM)." ;;
+    77) hint="The CA bundle could not be read; check CCA_CA_BUNDLE." ;;
+    58) hint="The client certificate or key could not be used; check CCA_CLIENT_CERT and CCA_CLIENT_KEY." ;;
+    35) hint="The TLS handshake failed. The server or proxy may require a client certificate (CCA_CLIENT_CERT)." ;;
+    5) hint="The proxy host could not be resolved; check HTTPS_PROXY." ;;
+    56) hint="The proxy refused the connection; check HTTPS_PROXY and the proxy credentials." ;;
+    6) hint="The host could not be resolved. If the network requires a proxy, set HTTPS_PROXY." ;;
+    7|28) hint="Could not connect. Check HTTPS_PROXY, and NO_PROXY for hosts that must be reached directly." ;;
+    *) hint="" ;;
+  esac
+  printf 'FAIL  %s: %s (%s)\n' "$1" "$(grep '^curl: ' "$err" | head -n 1 | sed 's/^curl: //')" "$route"
+  [ -z "$hint" ] || printf '      %s\n' "$hint"
+  [ -z "$issuer" ] || printf '      Certificate issuer: %s\n' "$issuer"
+  rm -f "$err"
+  return 1
+}
 
-ISSUE_URL="$1"
-if [[ "$ISSUE_URL" != *github.com* || "$ISSUE_URL" != */issues/* ]]; then
-  log "Invalid GitHub issue URL: $ISSUE_URL" >&2
-  exit 1
-fi
+# doctor_cert prints the subject and expiry of the first certificate in PEM
+# file $2 (named $1), and fails when it cannot be read or has expired.
+doctor_cert() {
+  if [ ! -r "$2" ]; then
+    printf 'FAIL  %s: %s is not readable\n' "$1" "$2"
+    return 1
+  fi
+  if ! command -v openssl >/dev/null; then
+    printf 'ok    %s: %s (%s certificates; install openssl to check expiry)\n' "$1" "$2" "$(grep -c 'BEGIN CERTIFICATE' "$2" || true)"
+    return 0
+  fi
+  local subject end
+  subject=$(openssl x509 -in "$2" -noout -subject 2>/dev/null | sed 's/^subject= *//')
+  end=$(openssl x509 -in "$2" -noout -enddate 2>/dev/null | sed 's/^notAfter=//')
+  if [ -z "$end" ]; then
+    printf 'FAIL  %s: %s does not contain a PEM certificate\n' "$1" "$2"
+    return 1
+  fi
+  if ! openssl x509 -in "$2" -noout -checkend 0 >/dev/null 2>&1; then
+    printf 'FAIL  %s: %s expired on %s\n' "$1" "$subject" "$end"
+    return 1
+  fi
+  printf 'ok    %s: %s, valid until %s\n' "$1" "$subject" "$end"
+}
 
-if ! command -v gh >/dev/null; then
-  log "gh command not found" >&2
-  exit 1
-fi
-if ! command -v jq >/dev/null; then
-  log "jq command not found" >&2
-  exit 1
-fi
-if ! command -v claude >/dev/null; then
-  log "claude command not found" >&2
-  exit 1
-fi
+# run_doctor checks the environment CCA needs: the required tools, the proxy
+# and TLS settings, and that GitHub, the AI backend and OSV can be reached
+# through them. It fails when any check fails.
+run_doctor() {
+  local failed=0 tool version
+  for tool in git gh jq curl $([ "$BACKEND" = "ollama" ] || echo claude); do
+    # type -P looks past the gh and git wrapper functions.
+    if type -P "$tool" >/dev/null; then
+      version=$(tool_version "$tool" --version)
+      printf 'ok    %s: %s\n' "$tool" "$version"
+    else
+      printf 'FAIL  %s: not installed\n' "$tool"
+      failed=1
+    fi
+  done
+  printf '%-6s%s: %s\n' "info" "HTTPS_PROXY" "$(redact <<<"${HTTPS_PROXY:-not set}" | sed -E 's#//[^@/]*@#//***@#')"
+  printf '%-6s%s: %s\n' "info" "NO_PROXY" "${NO_PROXY:-not set}"
+  [ -z "$CA_BUNDLE" ] || doctor_cert "CA bundle" "$CA_BUNDLE" || failed=1
+  if [ -n "$CLIENT_CERT" ]; then
+    doctor_cert "client certificate" "$CLIENT_CERT" || failed=1
+    if [ -n "$CLIENT_KEY" ] && [ ! -r "$CLIENT_KEY" ]; then
+      printf 'FAIL  client key: %s is not readable\n' "$CLIENT_KEY"
+      failed=1
+    fi
+  fi
+  doctor_endpoint "GitHub API" "https://${GH_HOST:-api.github.com}" || failed=1
+  if [ "$BACKEND" = "ollama" ]; then
+    doctor_endpoint "Ollama" "$OLLAMA_HOST/api/tags" || failed=1
+  else
+    doctor_endpoint "Anthropic API" "${ANTHROPIC_BASE_URL:-https://api.anthropic.com}" || failed=1
+  fi
+  doctor_endpoint "OSV" "https://api.osv.dev/v1/query" || failed=1
+  if type -P gh >/dev/null; then
+    if gh auth status >/dev/null 2>&1; then
+      printf 'ok    gh auth: logged in\n'
+    else
+      printf 'FAIL  gh auth: not logged in; run gh auth login or set GH_TOKEN\n'
+      failed=1
+    fi
+  fi
+  return "$failed"
+}
 
-# fetch issue details
-log "Fetching issue..."
-issue_json=$(gh issue view "$ISSUE_URL" --json number,title,body,url)
-number=$(echo "$issue_json" | jq -r '.number')
-title=$(echo "$issue_json" | jq -r '.title')
-body=$(echo "$issue_json" | jq -r '.body')
-repo=$(echo "$ISSUE_URL" | awk -F/ '{print $4"/"$5}')
-log "Fetched issue #$number: $title"
-
-prompt_file=$(mktemp)
-log "Created prompt file $prompt_file"
-cat >"$prompt_file" <<EOF2
-Implement a solution for this GitHub issue:
+# run_evidence_export packages the evidence of the local run that $1 refers to
+# (see resolve_run_id) into .cca/evidence/<run-id>.zip for compliance audits:
+# its SBOM, scan results, gate decisions, the reviews of its pull request, its
+# audit records and its status and manifest. evidence-manifest.json lists the
+# SHA-256 of every file and is signed with EVIDENCE_KEY when that is set.
+run_evidence_export() {
+  root_dir=$(git rev-parse --show-toplevel)
+  local id dir stage bundle file pr_url signer="" audit_file="$AUDIT_LOG"
+  if ! id=$(resolve_run_id "$1"); then
+    log "No local run found for $1" >&2
+    exit 1
+  fi
+  dir="$root_dir/.cca/runs/$id"
+  stage=$(mktemp -d)
+  for file in "$dir"/{status.json,manifest.json,dependency-snapshot.json,findings.tsv,self-review.jsonl,security-scan.jsonl,threat-model.json,obsolete-tests.jsonl,a11y.tsv,traceability.json,verify-output.txt,gates.jsonl,hooks.jsonl,findings.json} "$dir"/sbom.*.json; do
+    [ ! -f "$file" ] || cp "$file" "$stage/"
+  done
+  [[ "$audit_file" == /* ]] || audit_file="$root_dir/$audit_file"
+  if [ -s "$audit_file" ]; then
+    jq -c --arg id "$id" 'select(.run_id == $id)' "$audit_file" >"$stage/audit.jsonl"
+  fi
+  pr_url=$(jq -r '.pr_url // ""' "$dir/status.json" 2>/dev/null || true)
+  if [ -z "$pr_url" ]; then
+    skip "approvals (the run has no pull request)"
+  elif [ "$OFFLINE" -eq 1 ]; then
+    skip "approvals (offline)"
+  else
+    gh pr view "$pr_url" --json url,state,reviewDecision,reviews,mergedAt,mergedBy,mergeCommit >"$stage/approvals.json"
+  fi
+  if [ -n "$EVIDENCE_KEY" ]; then
+    signer="${EVIDENCE_SIGNER:-$(git config user.email || true)}"
+  fi
+  (
+    cd "$stage"
+    find . -type f -printf '%P\n' | sort | while read -r file; do
+      jq -n --arg path "$file" --arg sha256 "$(sha256sum "$file" | cut -d' ' -f1)" --argjson size "$(stat -c %s "$file")" '$ARGS.named'
+    done
+  ) | jq -s --arg run_id "$id" --arg repository "$(git remote get-url origin 2>/dev/null || true)" \
+    --arg created "$(date -u +%Y-%m-%dT%H:%M:%SZ)" --arg signer "$signer" --arg cca_version "$PROMPT_VERSION" \
+    '{run_id: $run_id, repository: $repository, created: $created, cca_version: $cca_version, signer: $signer, files: .}' \
+    >"$stage/evidence-manifest.json"
+  if [ -n "$EVIDENCE_KEY" ]; then
+    ssh-keygen -Y sign -q -n cca-evidence -f "$EVIDENCE_KEY" "$stage/evidence-manifest.json"
+    log "Signed the manifest as $signer"
+  else
+    log "CCA_EVIDENCE_KEY is not set; the bundle is not signed" >&2
+  fi
+  mkdir -p "$root_dir/.cca/evidence"
+  bundle="$root_dir/.cca/evidence/$id.zip"
+  rm -f "$bundle"
+  (cd "$stage" && zip -qrX "$bundle" .)
+  log "Wrote $bundle ($(jq '.files | length' "$stage/evidence-manifest.json") files)"
+  rm -rf "$stage"
+}
 
-Issue: $title
-Description: $body
-Repository: $repo
+# run_evidence_verify checks the evidence bundle $1: every file in its manifest
+# is present with the recorded SHA-256, no file is missing from the manifest,
+# and the manifest's signature is intact. With EVIDENCE_SIGNERS (an SSH
+# allowed signers file) the signer is checked too, and an unsigned bundle
+# fails.
+run_evidence_verify() {
+  local bundle="$1" stage manifest path sha256 signer failed=0
+  if [ ! -f "$bundle" ]; then
+    log "No evidence bundle at $bundle" >&2
+    exit 1
+  fi
+  stage=$(mktemp -d)
+  unzip -q "$bundle" -d "$stage"
+  manifest="$stage/evidence-manifest.json"
+  if ! jq -e '.files | type == "array"' "$manifest" >/dev/null 2>&1; then
+    rm -rf "$stage"
+    log "$bundle has no evidence manifest" >&2
+    exit 1
+  fi
+  while IFS=$'\t' read -r path sha256; do
+    if [[ "$path" == /* || "/$path/" == */../* ]]; then
+      log "Invalid path in the manifest: $path" >&2
+      failed=1
+    elif [ ! -f "$stage/$path" ]; then
+      log "Missing: $path" >&2
+      failed=1
+    elif [ "$(sha256sum <"$stage/$path" | cut -d' ' -f1)" != "$sha256" ]; then
+      log "Modified: $path" >&2
+      failed=1
+    fi
+  done < <(jq -r '.files[] | [.path, .sha256] | @tsv' "$manifest")
+  while read -r path; do
+    log "Not in the manifest: $path" >&2
+    failed=1
+  done < <(cd "$stage" && find . -type f ! -name evidence-manifest.json ! -name evidence-manifest.json.sig -printf '%P\n' |
+    grep -vxFf <(jq -r '.files[].path' "$manifest") || true)
+  signer=$(jq -r '.signer // ""' "$manifest")
+  if [ ! -f "$manifest.sig" ]; then
+    log "The bundle is not signed" >&2
+    [ -z "$EVIDENCE_SIGNERS" ] || failed=1
+  elif [ -n "$EVIDENCE_SIGNERS" ]; then
+    if ssh-keygen -Y verify -f "$EVIDENCE_SIGNERS" -I "$signer" -n cca-evidence -s "$manifest.sig" <"$manifest" >/dev/null 2>&1; then
+      log "Signature by $signer is valid"
+    else
+      log "Signature does not verify for $signer against $EVIDENCE_SIGNERS" >&2
+      failed=1
+    fi
+  elif ssh-keygen -Y check-novalidate -n cca-evidence -s "$manifest.sig" <"$manifest" >/dev/null 2>&1; then
+    log "Signature is intact; set CCA_EVIDENCE_SIGNERS to check that $signer signed it"
+  else
+    log "Signature does not match the manifest" >&2
+    failed=1
+  fi
+  rm -rf "$stage"
+  if [ "$failed" -eq 1 ]; then
+    log "Evidence bundle $bundle failed verification" >&2
+    exit 1
+  fi
+  log "Evidence bundle $bundle is intact ($(unzip -Z1 "$bundle" | grep -c .) files, run $(unzip -p "$bundle" evidence-manifest.json | jq -r .run_id))"
+}
 
-Analyze the issue and provide a complete implementation including:
-1. All necessary code changes
-2. Tests for the implementation
-3. Any documentation updates needed
+# run_audit prints the audit log, optionally only the records whose run ID,
+# action, target or actor contains $1: as a table, or as the raw JSON lines
+# with --format json.
+run_audit() {
+  local file="$AUDIT_LOG"
+  [[ "$file" == /* ]] || file="$(dirname "$(git rev-parse --path-format=absolute --git-common-dir)")/$file"
+  if [ ! -s "$file" ]; then
+    log "No audit records in $file"
+    return 0
+  fi
+  jq -c --arg q "$1" 'select($q == "" or ([.run_id, .action, .target, .actor] | any(contains($q))))' "$file" |
+    if [ "$DIGEST_FORMAT" = "json" ]; then
+      cat
+    else
+      jq -r '[.time, .run_id, .action, .target, (if .exit_code == 0 then "ok" else "exit \(.exit_code)" end), .actor, .credential] | @tsv' |
+        awk -F'\t' 'BEGIN { printf "%-20s  %-28s  %-14s  %-6s  %-40s  %s\n", "TIME", "RUN", "ACTION", "RESULT", "ACTOR", "TARGET" }
+          { printf "%-20s  %-28s  %-14s  %-6s  %-40s  %s\n", $1, $2, $3, $5, $6 " (" $7 ")", $4 }'
+    fi
+}
+
+# monitor_coverage prints the statement coverage of the tests in the current
+# directory as a percentage: the last number CCA_MONITOR_COVERAGE_CMD prints,
+# or the combined coverage of the Go modules. It prints nothing when neither
+# applies.
+monitor_coverage() {
+  if [ -n "$MONITOR_COVERAGE_CMD" ]; then
+    bash -c "$MONITOR_COVERAGE_CMD" 2>/dev/null | grep -Eo '[0-9]+(\.[0-9]+)?' | tail -n 1 || true
+    return
+  fi
+  has_go || return 0
+  local module profiles n=0
+  profiles=$(mktemp -d)
+  while read -r module; do
+    n=$((n + 1))
+    (cd "$module" && go test -coverprofile="$profiles/$n.out" ./... >/dev/null 2>&1) || true
+  done < <(go_modules)
+  cat "$profiles"/*.out 2>/dev/null |
+    awk '$1 != "mode:" && NF == 3 { total += $2; if ($3 > 0) covered += $2 } END { if (total > 0) printf "%.1f\n", 100 * covered / total }'
+  rm -rf "$profiles"
+}
+
+# monitor_advisories prints the advisories affecting the dependencies declared
+# on commit $1 as JSON lines. The severity comes from OSV.dev and is
+# "unknown" offline or when the advisory has none.
+monitor_advisories() {
+  local eco name version id severity
+  while read -r eco name version; do
+    while read -r id; do
+      [ -n "$id" ] || continue
+      severity=""
+      [ "$OFFLINE" -eq 1 ] ||
+        severity=$(curl -sf "https://api.osv.dev/v1/vulns/$id" | jq -r '.database_specific.severity // empty' 2>/dev/null || true)
+      jq -cn --arg id "$id" --arg package "$eco $name" --arg version "$version" --arg severity "${severity:-unknown}" \
+        '{id: $id, package: $package, version: $version, severity: ($severity | ascii_downcase)}'
+    done < <(osv_advisories "$eco" "$name" "$version")
+  done < <(dependencies "$1")
+}
+
+# monitor_notify sends the alerts of monitor snapshot $1 to the Slack
+# incoming webhook in CCA_MONITOR_SLACK_WEBHOOK, as JSON to
+# CCA_MONITOR_WEBHOOK, and with CCA_MONITOR_ISSUE=1 to the open GitHub issue
+# labeled CCA_MONITOR_LABEL, opening one when there is none.
+monitor_notify() {
+  local snapshot="$1" text issue
+  text=$(jq -r '"CCA quality alert for \(.branch) at \(.commit[:7]):", (.alerts[] | "- \(.)")' <<<"$snapshot")
+  if [ -n "$MONITOR_SLACK_WEBHOOK" ]; then
+    curl -fsS -X POST -H 'Content-Type: application/json' -d "$(sed 's/^- /• /' <<<"$text" | jq -Rsc '{text: .}')" \
+      "$MONITOR_SLACK_WEBHOOK" >/dev/null && log "Posted the alerts to Slack" || log "Could not post the alerts to Slack" >&2
+  fi
+  if [ -n "$MONITOR_WEBHOOK" ]; then
+    curl -fsS -X POST -H 'Content-Type: application/json' -d "$snapshot" "$MONITOR_WEBHOOK" >/dev/null &&
+      log "Sent the alerts to CCA_MONITOR_WEBHOOK" || log "Could not send the alerts to CCA_MONITOR_WEBHOOK" >&2
+  fi
+  [ "$MONITOR_ISSUE" -eq 1 ] || return 0
+  if [ "$OFFLINE" -eq 1 ] || [ "$READ_ONLY" -eq 1 ]; then
+    skip "monitor issue (offline or read-only)"
+    return 0
+  fi
+  issue=$(gh issue list --label "$MONITOR_LABEL" --state open --limit 1 --json url --jq '.[0].url // empty' 2>/dev/null || true)
+  if [ -n "$issue" ]; then
+    gh issue comment "$issue" --body "$(redact <<<"$text")" >/dev/null
+    log "Commented on $issue"
+  else
+    gh label create "$MONITOR_LABEL" --description "Quality alerts from cca monitor" --force >/dev/null
+    issue=$(gh issue create --title "CCA quality alert: $(jq -r '.branch' <<<"$snapshot")" --label "$MONITOR_LABEL" \
+      --body "$(redact <<<"$text")")
+    log "Opened $issue"
+  fi
+}
+
+# default_branch prints CCA_MONITOR_BRANCH, or the branch origin's HEAD points
+# at, or the repository's default branch on GitHub, or main.
+default_branch() {
+  local branch="$MONITOR_BRANCH"
+  [ -z "$branch" ] || { echo "$branch"; return; }
+  branch=$(git symbolic-ref --short -q refs/remotes/origin/HEAD | sed 's#^origin/##' || true)
+  [ -n "$branch" ] || [ "$OFFLINE" -eq 1 ] || branch=$(gh repo view --json defaultBranchRef --jq .defaultBranchRef.name 2>/dev/null || true)
+  echo "${branch:-main}"
+}
 
-Return the implementation as file paths and their complete content.
+# run_monitor measures the default branch (CCA_MONITOR_BRANCH, or origin's
+# HEAD): test coverage, advisories affecting its dependencies and the number
+# of TODO, FIXME, HACK and XXX markers. The snapshot is appended to
+# .cca/monitor/history.jsonl and compared with the previous one, and
+# regressions are sent as alerts (see monitor_notify). It is meant to run on
+# a schedule, from cron or a scheduled CI workflow.
+run_monitor() {
+  require_commands git jq
+  root_dir=$(git rev-parse --show-toplevel)
+  local branch history="$root_dir/.cca/monitor/history.jsonl" dir commit coverage advisories debt previous snapshot
+  branch=$(default_branch)
+  [ "$OFFLINE" -eq 1 ] || fetch "$branch" >&2
+  commit=$(git rev-parse "origin/$branch^{commit}")
+  log "Monitoring $branch at ${commit:0:7}" >&2
+
+  dir="$root_dir/.cca/worktrees/cca/monitor"
+  git worktree remove --force "$dir" 2>/dev/null || true
+  git worktree add -q --detach "$dir" "$commit"
+  coverage=$(cd "$dir" && monitor_coverage)
+  git worktree remove --force "$dir"
+  advisories=$(monitor_advisories "$commit" | jq -sc 'unique_by(.id)')
+  debt=$(git grep -I -w -c -E 'TODO|FIXME|HACK|XXX' "$commit" -- . 2>/dev/null | awk -F: '{ n += $NF } END { print n + 0 }')
+
+  previous=$(tail -n 1 "$history" 2>/dev/null || true)
+  snapshot=$(jq -cn --argjson prev "${previous:-null}" --arg branch "$branch" --arg commit "$commit" \
+    --arg coverage "$coverage" --argjson advisories "$advisories" --argjson debt "$debt" \
+    --argjson drop "$MONITOR_COVERAGE_DROP" --arg min "$MONITOR_MIN_COVERAGE" --arg max "$MONITOR_MAX_DEBT" \
+    --arg severities "$MONITOR_SEVERITIES" '
+    ($severities | ascii_downcase | split(" ") | map(select(. != ""))) as $alerting
+    | {at: (now | todate), branch: $branch, commit: $commit,
+       coverage: (if $coverage == "" then null else $coverage | tonumber end),
+       advisories: $advisories, debt_markers: $debt}
+    | .alerts = [
+        (if .coverage != null and $prev.coverage != null and $prev.coverage - .coverage >= $drop then
+          "Coverage dropped from \($prev.coverage)% to \(.coverage)%" else empty end),
+        (if .coverage != null and $min != "" and .coverage < ($min | tonumber) and ($prev.coverage // 100) >= ($min | tonumber) then
+          "Coverage fell below \($min)% to \(.coverage)%" else empty end),
+        ([$prev.advisories[]?.id] as $known | .advisories[]
+          | select(.severity as $s | .id as $id | ($alerting | index($s)) and ($known | index($id) | not))
+          | "New \(.severity) advisory \(.id) in \(.package) \(.version)"),
+        (if $max != "" and .debt_markers > ($max | tonumber) and ($prev.debt_markers // 0) <= ($max | tonumber) then
+          "Debt markers rose above \($max) to \(.debt_markers)" else empty end)
+      ]')
+  mkdir -p "$(dirname "$history")"
+  printf '%s\n' "$snapshot" >>"$history"
+
+  jq -r --argjson prev "${previous:-null}" '
+    "Coverage: \(.coverage // "n/a")\(if .coverage != null then "%" else "" end)\(if $prev.coverage != null then " (previously \($prev.coverage)%)" else "" end)",
+    "Advisories: \(.advisories | length)\(.advisories | map(select(.severity != "unknown")) | group_by(.severity)
+      | map(" \(length) \(.[0].severity)") | if length > 0 then " (" + (join(",") | ltrimstr(" ")) + ")" else "" end)",
+    "Debt markers: \(.debt_markers)\(if $prev.debt_markers != null then " (previously \($prev.debt_markers))" else "" end)",
+    (if (.alerts | length) == 0 then "No regressions" else "Alerts:", (.alerts[] | "- \(.)") end)' <<<"$snapshot"
+  jq -e '.alerts | length > 0' <<<"$snapshot" >/dev/null || return 0
+  monitor_notify "$snapshot" >&2
+}
+
+# advisory_fix prints the lowest version of package $2 in ecosystem $1 above
+# version $3 that fixes advisory $4, from the local OSV bundle or OSV.dev. It
+# prints nothing when no fixed version is known.
+advisory_fix() {
+  local eco="$1" name="$2" version="${3#[~^v]}" id="$4" fixes="" fix
+  if [ -f "$VULNDB_DIR/index.tsv" ]; then
+    fixes=$(awk -F'\t' -v eco="$eco" -v name="$name" -v id="$id" '$1 == eco && $2 == name && $3 == id && $6 == "fixed" { print $5 }' \
+      "$VULNDB_DIR/index.tsv")
+  elif [ "$OFFLINE" -eq 0 ]; then
+    fixes=$(curl -sf "https://api.osv.dev/v1/vulns/$id" | jq -r --arg eco "$eco" --arg name "$name" '
+      .affected[]? | select(.package.ecosystem == $eco and .package.name == $name) | .ranges[]?.events[]?.fixed // empty' 2>/dev/null || true)
+  fi
+  while read -r fix; do
+    [ -n "$fix" ] || continue
+    if ! version_lte "${fix#v}" "$version"; then
+      echo "${fix#v}"
+      return
+    fi
+  done < <(sed 's/^v//' <<<"$fixes" | sort -V)
+}
+
+# security_scan prints the security findings of commit $1, checked out in
+# directory $2, as JSON lines with a group and an ID that stays the same until
+# the finding is fixed: advisories affecting its dependencies (taken from the
+# latest cca monitor snapshot when it is of the same commit) with the version
+# that fixes them, GitHub Actions and Docker base images that are not pinned,
+# and the critical findings of the sql and logging checks.
+security_scan() {
+  local commit="$1" dir="$2" history="$root_dir/.cca/monitor/history.jsonl" advisories line eco name file files=()
+  if [ -f "$history" ] && [ "$(tail -n 1 "$history" | jq -r '.commit')" = "$commit" ]; then
+    log "Using the advisories of the cca monitor snapshot of ${commit:0:7}" >&2
+    advisories=$(tail -n 1 "$history" | jq -c '.advisories[]')
+  else
+    advisories=$(monitor_advisories "$commit")
+  fi
+  while IFS= read -r line; do
+    [ -n "$line" ] || continue
+    read -r eco name <<<"$(jq -r '.package' <<<"$line")"
+    jq -c --arg eco "$eco" --arg name "$name" \
+      --arg fixed "$(advisory_fix "$eco" "$name" "$(jq -r '.version' <<<"$line")" "$(jq -r '.id' <<<"$line")")" '
+      {kind: "dependency", group: "deps-\($eco | ascii_downcase)", id: "\(.id):\($name)", advisory: .id,
+       ecosystem: $eco, package: $name, version, severity, fixed: (if $fixed == "" then null else $fixed end)}' <<<"$line"
+  done <<<"$advisories"
+  while IFS= read -r file; do
+    (cd "$dir" && unpinned_references "$file") | jq -Rc --arg file "$file" \
+      '{kind: "pin", group: "pinning", id: "pin:\($file):\(.)", file: $file, reference: .}'
+  done < <(git -C "$dir" ls-files -- '.github/workflows/*.yml' '.github/workflows/*.yaml' action.yml '*/action.yml' \
+    Dockerfile '*/Dockerfile' '*.Dockerfile')
+  mapfile -t files < <(git -C "$dir" ls-files -- '*.go' ':!*_test.go' ':!vendor/**')
+  [ "${#files[@]}" -gt 0 ] || return 0
+  (cd "$dir" && { sql_review "${files[@]}"; logging_review "${files[@]}"; }) | awk -F'\t' '$1 == "critical"' | sort -u |
+    jq -Rc 'split("\t") | (.[2] | sub(":[0-9]+$"; "")) as $file
+      | {kind: "code", group: "code-\(.[1])", id: "\(.[1]):\($file):\(.[3])", check: .[1], file: $file, location: .[2], message: .[3]}'
+}
+
+# fix_vulns_group opens a pull request on base branch $2 that fixes the
+# findings of group $1, given as JSON lines on stdin: Go or npm dependencies
+# are updated to the highest fixed version their advisories need, references
+# are pinned, and code findings are fixed by the backend. The change is
+# verified with .cca/verify.sh when the repository has one. The pull request
+# links the advisories it addresses and is recorded in
+# .cca/fix-vulns/prs.jsonl for fix_vulns_recheck.
+fix_vulns_group() {
+  local group="$1" base="$2" findings branch dir name fixed title output prompt_file result url files=()
+  findings=$(cat)
+  branch="cca/fix-vulns-$group"
+  if [ -n "$(gh pr list --head "$branch" --state open --json url --jq '.[0].url // empty')" ]; then
+    skip "$group (its pull request is still open)"
+    return 0
+  fi
+  dir="$root_dir/.cca/worktrees/$branch"
+  git worktree remove --force "$dir" 2>/dev/null || true
+  git branch -D "$branch" >/dev/null 2>&1 || true
+  git worktree add -q -b "$branch" "$dir" "origin/$base"
+  pushd "$dir" >/dev/null
+  case "$group" in
+    deps-go)
+      title="fix(deps): update Go dependencies with known vulnerabilities"
+      while IFS=$'\t' read -r name fixed; do
+        go get "$name@v$fixed" >&2 || log "Could not update $name to $fixed" >&2
+      done < <(jq -r '[.package, .fixed] | @tsv' <<<"$findings" | sort -t$'\t' -k1,1 -k2,2V | awk -F'\t' '{ last[$1] = $2 } END { for (n in last) print n "\t" last[n] }')
+      go mod tidy >&2 || true
+      ;;
+    deps-npm)
+      title="fix(deps): update npm dependencies with known vulnerabilities"
+      while IFS=$'\t' read -r name fixed; do
+        npm install --no-audit --no-fund "$name@$fixed" >&2 || log "Could not update $name to $fixed" >&2
+      done < <(jq -r '[.package, .fixed] | @tsv' <<<"$findings" | sort -t$'\t' -k1,1 -k2,2V | awk -F'\t' '{ last[$1] = $2 } END { for (n in last) print n "\t" last[n] }')
+      ;;
+    pinning)
+      title="ci: pin GitHub Actions and base images"
+      mapfile -t files < <(jq -r '.file' <<<"$findings" | sort -u)
+      pin_references "${files[@]}" >&2
+      ;;
+    code-*)
+      title="fix(security): fix critical ${group#code-} findings"
+      prompt_file=$(mktemp)
+      cat >"$prompt_file" <<EOF22
+A security scan reported these critical findings:
+$(jq -r '"- \(.location): \(.message)"' <<<"$findings")
+
+Fix each of them with the smallest change that removes the problem, following
+the repository's existing style. Change nothing else.
+$(for file in $(jq -r '.file' <<<"$findings" | sort -u); do context_file "$file"; done)
 
 Format as JSON:
 {
-  "files": {"path/to/file.ts": "complete file content..."},
-  "new_files": ["list", "of", "new", "files"],
-  "deleted_files": ["list", "of", "deleted", "files"],
-  "summary": "Brief description of changes made"
+  "files": {"path": "complete file content..."},
+  "summary": "one line per finding fixed"
 }
-EOF2
+EOF22
+      log "Fixing ${group#code-} findings with $BACKEND..."
+      result=$(claude_chat "$prompt_file" "with-p")
+      rm "$prompt_file"
+      if check_changes "$result" && jq -e '.files | length > 0' <<<"$result" >/dev/null 2>&1; then
+        printf '%s\n' "$result" >"$run_dir/$group.json"
+        apply_changes "$run_dir/$group.json"
+        format_changes
+      else
+        log "Backend did not return fixes for $group" >&2
+      fi
+      ;;
+  esac
+  if [ -z "$(git status --porcelain)" ]; then
+    popd >/dev/null
+    git worktree remove --force "$dir"
+    git branch -D "$branch" >/dev/null
+    log "Nothing changed for $group" >&2
+    return 1
+  fi
+  if [ -f .cca/verify.sh ] && ! output=$(run_verify full); then
+    printf '%s\n' "$output" | redact >"$run_dir/verify-$group.log"
+    popd >/dev/null
+    git worktree remove --force "$dir"
+    git branch -D "$branch" >/dev/null
+    log "The fix for $group failed verification; see $run_dir/verify-$group.log" >&2
+    return 1
+  fi
+  git add -A
+  cca_commit -q -m "$title"
+  push -q -f origin "$branch"
+  popd >/dev/null
+  git worktree remove --force "$dir"
+  url=$(gh pr create --base "$base" --head "$branch" --title "$title" --body "$(redact <<<"$(msg pr.fix_vulns "$base")
 
-log "Generating code changes with Claude..."
+$(jq -r 'if .kind == "dependency" then "- [\(.advisory)](https://osv.dev/vulnerability/\(.advisory)) (\(.severity)): \(.ecosystem) `\(.package)` \(.version) → \(.fixed)"
+    elif .kind == "pin" then "- `\(.file)`: `\(.reference)`"
+    else "- `\(.location)`: \(.message)" end' <<<"$findings")
 
-changes_json=$(claude_chat "$prompt_file" "no-p")
-rm "$prompt_file"
-log "Received code changes from Claude"
+$(msg pr.fix_vulns_recheck "$base")
 
-rand=$(tr -dc 'a-z0-9' </dev/urandom | head -c 6)
-branch="cca/issue-$number-$rand"
-root_dir=$(git rev-parse --show-toplevel)
-work_dir="$root_dir/.cca/worktrees/$branch"
-mkdir -p "$root_dir/.cca/worktrees"
-git worktree add "$work_dir" -b "$branch"
-log "Created worktree $work_dir on branch $branch"
-pushd "$work_dir" >/dev/null
-log "Switched to worktree $work_dir"
+$(run_marker)")")
+  mkdir -p "$root_dir/.cca/fix-vulns"
+  jq -sc --arg group "$group" --arg pr "$url" --arg branch "$branch" --arg base "$base" --arg at "$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+    '{group: $group, pr: $pr, branch: $branch, base: $base, findings: map(.id), opened_at: $at, status: "open"}' <<<"$findings" \
+    >>"$root_dir/.cca/fix-vulns/prs.jsonl"
+  log "Opened $url for $group ($(grep -c . <<<"$findings") findings)"
+}
 
-max_retries=3
-attempt=1
+# fix_vulns_recheck follows up on the pull requests fix_vulns_group opened.
+# Once one is merged, its base branch is scanned again and the pull request
+# gets a comment saying whether its findings are gone; closed ones are
+# dropped. With --dry-run the records and pull requests are left as they are.
+fix_vulns_recheck() {
+  local file="$root_dir/.cca/fix-vulns/prs.jsonl" record url state base commit dir remaining updated=""
+  local -A scans=()
+  [ -s "$file" ] || return 0
+  while IFS= read -r record; do
+    if [ "$(jq -r '.status' <<<"$record")" = "open" ]; then
+      url=$(jq -r '.pr' <<<"$record")
+      state=$(gh pr view "$url" --json state --jq .state 2>/dev/null || echo UNKNOWN)
+      case "$state" in
+        CLOSED)
+          log "$url was closed without merging"
+          record=$(jq -c '.status = "closed"' <<<"$record")
+          ;;
+        MERGED)
+          base=$(jq -r '.base' <<<"$record")
+          if [ -z "${scans[$base]:-}" ]; then
+            fetch "$base" >&2
+            commit=$(git rev-parse "origin/$base^{commit}")
+            dir="$root_dir/.cca/worktrees/cca/fix-vulns-scan"
+            git worktree remove --force "$dir" 2>/dev/null || true
+            git worktree add -q --detach "$dir" "$commit"
+            scans[$base]=$(mktemp)
+            security_scan "$commit" "$dir" | jq -r '.id' >"${scans[$base]}"
+            git worktree remove --force "$dir"
+          fi
+          remaining=$(jq -r '.findings[]' <<<"$record" | grep -xFf "${scans[$base]}" || true)
+          if [ -z "$remaining" ]; then
+            log "$url: all its findings are gone from $base"
+          else
+            log "$url: $(grep -c . <<<"$remaining") of its findings are still present on $base" >&2
+          fi
+          if [ "$DRY_RUN" -eq 0 ]; then
+            if [ -z "$remaining" ]; then
+              gh pr comment "$url" --body "$(msg comment.fix_vulns_resolved "$base")"$'\n\n'"$(run_marker)" >/dev/null
+            else
+              gh pr comment "$url" --body "$(msg comment.fix_vulns_remaining "$base")"$'\n'"$(sed 's/^/- `/; s/$/`/' <<<"$remaining")"$'\n\n'"$(run_marker)" >/dev/null
+            fi
+          fi
+          record=$(jq -c --arg remaining "$remaining" --arg at "$(date -u +%Y-%m-%dT%H:%M:%SZ)" '
+            .remaining = ($remaining | split("\n") | map(select(. != ""))) | .checked_at = $at
+            | .status = (if (.remaining | length) == 0 then "resolved" else "unresolved" end)' <<<"$record")
+          ;;
+      esac
+    fi
+    updated+="$record"$'\n'
+  done <"$file"
+  rm -f "${scans[@]}"
+  [ "$DRY_RUN" -eq 1 ] || printf '%s' "$updated" >"$file"
+}
 
-while true; do
-  log "Verification attempt $attempt"
-  tmp_changes=$(mktemp)
-  echo "$changes_json" > "$tmp_changes"
+# run_fix_vulns scans the default branch (see security_scan) and opens one
+# pull request per group of fixable findings (see fix_vulns_group): the Go
+# and npm dependencies with a fixed version, the unpinned references, and the
+# critical findings of each code check. Advisories without a fixed version are
+# only listed. The merged pull requests of earlier runs are rechecked first
+# (see fix_vulns_recheck), and with "recheck" that is all it does. Once pull
+# requests are waiting, a recheck task is added to .cca/schedule at
+# CCA_FIX_VULNS_RESCAN unless one is there. With --dry-run it only lists the
+# groups.
+run_fix_vulns() {
+  require_commands git jq gh
+  root_dir=$(git rev-parse --show-toplevel)
+  init_run_dir "fix-vulns-$(date -u +%Y%m%d%H%M%S)"
+  fix_vulns_recheck
+  [ "$1" != "recheck" ] || return 0
+  local branch commit dir findings group failed=0 schedule="$root_dir/.cca/schedule"
+  branch=$(default_branch)
+  fetch "$branch" >&2
+  commit=$(git rev-parse "origin/$branch^{commit}")
+  log "Scanning $branch at ${commit:0:7}"
+  dir="$root_dir/.cca/worktrees/cca/fix-vulns-scan"
+  git worktree remove --force "$dir" 2>/dev/null || true
+  git worktree add -q --detach "$dir" "$commit"
+  findings=$(security_scan "$commit" "$dir")
+  git worktree remove --force "$dir"
+  printf '%s\n' "$findings" | grep -v '^$' >"$run_dir/security-scan.jsonl" || true
+  jq -r 'select(.kind == "dependency" and .fixed == null) | "No fixed version of \(.ecosystem) \(.package) \(.version) for \(.advisory) yet"' \
+    "$run_dir/security-scan.jsonl" | while read -r line; do log "$line"; done
+  findings=$(jq -c 'select(.kind != "dependency" or .fixed != null)' "$run_dir/security-scan.jsonl")
+  if [ -z "$findings" ]; then
+    log "No fixable security findings on $branch"
+    return 0
+  fi
+  for group in $(jq -r '.group' <<<"$findings" | sort -u); do
+    if [ "$DRY_RUN" -eq 1 ]; then
+      log "Would open a pull request for $group:"
+      jq -r --arg group "$group" 'select(.group == $group) | "  \(.id)\(if .fixed then " (fixed in \(.fixed))" else "" end)"' <<<"$findings"
+      continue
+    fi
+    jq -c --arg group "$group" 'select(.group == $group)' <<<"$findings" | fix_vulns_group "$group" "$branch" || failed=1
+  done
+  if [ "$DRY_RUN" -eq 0 ] && [ -n "$FIX_VULNS_RESCAN" ] && grep -q '"status":"open"' "$root_dir/.cca/fix-vulns/prs.jsonl" 2>/dev/null &&
+    ! grep -qE '^[^#]*fix-vulns recheck' "$schedule" 2>/dev/null; then
+    mkdir -p "$(dirname "$schedule")"
+    printf '%s fix-vulns recheck\n' "$FIX_VULNS_RESCAN" >>"$schedule"
+    log "Added a recheck of the fix-vulns pull requests to .cca/schedule ($FIX_VULNS_RESCAN)"
+  fi
+  return "$failed"
+}
 
-  apply_changes "$tmp_changes"
-  rm "$tmp_changes"
+# cron_field succeeds when value $1 matches cron field $2, whose values range
+# from $3 to $4: *, a number, a range, a step (*/n, a-b/n or a/n) or a
+# comma-separated list of those.
+cron_field() {
+  local value="$1" parts part lo hi step
+  IFS=, read -ra parts <<<"$2"
+  for part in "${parts[@]}"; do
+    step=1
+    if [[ "$part" == */* ]]; then
+      step="${part#*/}"
+      part="${part%/*}"
+    fi
+    case "$part" in
+      \*) lo="$3" hi="$4" ;;
+      *-*) lo="${part%-*}" hi="${part#*-}" ;;
+      *) lo="$part" hi="$part"; [ "$step" -eq 1 ] || hi="$4" ;;
+    esac
+    ((10#$value >= 10#$lo && 10#$value <= 10#$hi && (10#$value - 10#$lo) % 10#$step == 0)) && return 0
+  done
+  return 1
+}
 
-  log "Running verification..."
-  verify_output=$(bash .cca/verify.sh 2>&1)
-  verify_code=$?
+# cron_valid succeeds when $1 is a five-field cron expression or one of
+# @hourly, @daily, @midnight, @weekly, @monthly, @yearly and @annually.
+cron_valid() {
+  local field='(\*|[0-9]+(-[0-9]+)?)(/[1-9][0-9]*)?' fields
+  case "$1" in
+    @hourly|@daily|@midnight|@weekly|@monthly|@yearly|@annually) return 0 ;;
+  esac
+  read -ra fields <<<"$1"
+  [ "${#fields[@]}" -eq 5 ] && [[ "$1" =~ ^($field(,$field)*[[:space:]]+){4}$field(,$field)*$ ]]
+}
 
-  if [ $verify_code -eq 0 ]; then
-    log "Verification passed"
-    break
+# cron_matches succeeds when cron expression $1 matches the minute whose
+# "minute hour day-of-month month day-of-week" fields are $2. As in cron, a
+# restricted day of month and day of week match when either does, and both
+# 0 and 7 mean Sunday.
+cron_matches() {
+  local expr="$1" m h d mo w minute hour dom month dow day
+  case "$expr" in
+    @hourly) expr="0 * * * *" ;;
+    @daily|@midnight) expr="0 0 * * *" ;;
+    @weekly) expr="0 0 * * 0" ;;
+    @monthly) expr="0 0 1 * *" ;;
+    @yearly|@annually) expr="0 0 1 1 *" ;;
+  esac
+  read -r m h d mo w <<<"$expr"
+  read -r minute hour dom month dow <<<"$2"
+  cron_field "$minute" "$m" 0 59 && cron_field "$hour" "$h" 0 23 && cron_field "$month" "$mo" 1 12 || return 1
+  day=1
+  cron_field "$dow" "$w" 0 7 || { [ "$dow" -eq 0 ] && cron_field 7 "$w" 0 7; } || day=0
+  if [ "$d" != "*" ] && [ "$w" != "*" ]; then
+    cron_field "$dom" "$d" 1 31 || [ "$day" -eq 1 ]
+  else
+    cron_field "$dom" "$d" 1 31 && [ "$day" -eq 1 ]
   fi
+}
 
-  if [ $attempt -ge $max_retries ]; then
-    log "Verification failed after $max_retries attempts" >&2
-    log "$verify_output" >&2
-    exit 1
+# schedule_tasks prints the tasks in .cca/schedule as "<id>\t<expression>\t
+# <command>", skipping comments and lines with an invalid expression. The ID
+# is derived from the line, so a task keeps its history until it is edited.
+schedule_tasks() {
+  local line expr command a b c d e rest
+  [ -f "$root_dir/.cca/schedule" ] || return 0
+  while IFS= read -r line || [ -n "$line" ]; do
+    line="${line%%#*}"
+    read -r a b c d e rest <<<"$line"
+    [ -n "$a" ] || continue
+    if [[ "$a" == @* ]]; then
+      expr="$a"
+      command=$(sed -E 's/^[[:space:]]*[^[:space:]]+[[:space:]]*//' <<<"$line")
+    else
+      expr="$a $b $c $d $e"
+      command="$rest"
+    fi
+    if ! cron_valid "$expr" || [ -z "$command" ]; then
+      log "Ignoring invalid line in .cca/schedule: $line" >&2
+      continue
+    fi
+    command=$(sed 's/[[:space:]]*$//' <<<"$command")
+    printf '%s\t%s\t%s\n' "$(printf '%s %s' "$expr" "$command" | sha256sum | cut -c1-12)" "$expr" "$command"
+  done <"$root_dir/.cca/schedule"
+}
+
+# run_scheduled_task runs the cca subcommand of a scheduled task unless the
+# previous run of the task is still going, logging its output under
+# .cca/scheduler/logs/ and recording the run in .cca/scheduler/history.jsonl.
+run_scheduled_task() {
+  local id="$1" expr="$2" command="$3" dir="$root_dir/.cca/scheduler" lock args=() started logfile code=0
+  lock="$dir/locks/$id"
+  if ! take_lock "$lock" "$BASHPID"; then
+    log "Skipping '$command': its previous run (pid ${lock_holder:-unknown}) is still running"
+    jq -cn --arg id "$id" --arg command "$command" --arg at "$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+      '{id: $id, command: $command, started: $at, result: "skipped", reason: "previous run still running"}' >>"$dir/history.jsonl"
+    return 0
   fi
+  [ -z "$lock_holder" ] || log "Taking over the lock of '$command' from a run that stopped (pid $lock_holder)"
+  read -ra args <<<"$command"
+  started=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+  logfile="$dir/logs/$id-$(date -u +%Y%m%dT%H%M%SZ).log"
+  log "Running '$command' ($expr)"
+  (cd "$root_dir" && CCA_READ_ONLY="$READ_ONLY" "$(realpath "$0")" "${args[@]}") >"$logfile" 2>&1 || code=$?
+  rm -rf "$lock"
+  jq -cn --arg id "$id" --arg expr "$expr" --arg command "$command" --arg started "$started" \
+    --arg finished "$(date -u +%Y-%m-%dT%H:%M:%SZ)" --argjson code "$code" --arg log "$logfile" \
+    '{id: $id, schedule: $expr, command: $command, started: $started, finished: $finished,
+      result: (if $code == 0 then "ok" else "failed" end), exit_code: $code, log: $log}' >>"$dir/history.jsonl"
+  log "'$command' $([ "$code" -eq 0 ] && echo "finished" || echo "failed with exit code $code"); see $logfile"
+  return "$code"
+}
 
-  log "Verification failed: $verify_output"
+# run_schedule runs the tasks in .cca/schedule that are due: those whose cron
+# expression matches a minute since the previous check, going back at most a
+# day, so runs every minute from cron and less regular ones from CI both work.
+# Due tasks run in parallel; with --dry-run they are only listed. With
+# "list", prints each task with its last run from the history.
+run_schedule() {
+  root_dir=$(git rev-parse --show-toplevel)
+  local dir="$root_dir/.cca/scheduler" tasks now last t id expr command state minutes=() due=() pids=() pid failed=0
+  tasks=$(schedule_tasks)
+  if [ -z "$tasks" ]; then
+    log "No tasks in $root_dir/.cca/schedule"
+    return 0
+  fi
+  mkdir -p "$dir/locks" "$dir/logs"
+  if [ "$1" = "list" ]; then
+    while IFS=$'\t' read -r id expr command; do
+      if [ -d "$dir/locks/$id" ]; then
+        state="running"
+      else
+        state=$(jq -rs --arg id "$id" 'map(select(.id == $id)) | last // empty
+          | "last \(.result) at \(.started)\(if (.exit_code // 0) != 0 then " (exit code \(.exit_code))" else "" end)"' \
+          "$dir/history.jsonl" 2>/dev/null || true)
+      fi
+      printf '%-20s %-40s %s\n' "$expr" "$command" "${state:-never run}"
+    done <<<"$tasks"
+    return 0
+  fi
 
-  fix_prompt_file=$(mktemp)
-  cat >"$fix_prompt_file" <<EOF3
-The verification script failed with these errors:
+  now=$(($(date +%s) / 60 * 60))
+  last=$(cat "$dir/last-check" 2>/dev/null || echo $((now - 60)))
+  [ "$last" -ge $((now - 86400)) ] || last=$((now - 86400))
+  for ((t = last + 60; t <= now; t += 60)); do
+    minutes+=("$(date -d "@$t" '+%-M %-H %-d %-m %w')")
+  done
+  while IFS=$'\t' read -r id expr command; do
+    for ((t = 0; t < ${#minutes[@]}; t++)); do
+      if cron_matches "$expr" "${minutes[$t]}"; then
+        due+=("$id"$'\t'"$expr"$'\t'"$command")
+        break
+      fi
+    done
+  done <<<"$tasks"
+  if [ "${#due[@]}" -eq 0 ]; then
+    log "No tasks due"
+    [ "$DRY_RUN" -eq 1 ] || echo "$now" >"$dir/last-check"
+    return 0
+  fi
+  if [ "$DRY_RUN" -eq 1 ]; then
+    printf '%s\n' "${due[@]}" | cut -f2- | while IFS=$'\t' read -r expr command; do log "Would run '$command' ($expr)"; done
+    return 0
+  fi
+  echo "$now" >"$dir/last-check"
+  for t in "${due[@]}"; do
+    IFS=$'\t' read -r id expr command <<<"$t"
+    run_scheduled_task "$id" "$expr" "$command" &
+    pids+=("$!")
+  done
+  for pid in "${pids[@]}"; do
+    wait "$pid" || failed=$((failed + 1))
+  done
+  [ "$failed" -eq 0 ] || { log "$failed scheduled tasks failed" >&2; return 1; }
+}
 
-$verify_output
+# run_outcomes updates the outcome of every run that opened a pull request
+# and prints the acceptance rate of the finished ones per repository, prompt
+# version, finding category and experiment variant.
+run_outcomes() {
+  require_commands gh jq
+  root_dir=$(git rev-parse --show-toplevel)
+  local dir rules records=""
+  for dir in "$root_dir"/.cca/runs/*/; do
+    [ -f "$dir/status.json" ] || continue
+    pr_outcome "$dir"
+    [ -f "$dir/outcome.json" ] || continue
+    rules=$({
+      [ ! -f "$dir/findings.tsv" ] || cut -f2 "$dir/findings.tsv"
+      [ ! -f "$dir/self-review.jsonl" ] || jq -r '.findings[]? | .category // empty' "$dir/self-review.jsonl"
+    } | grep -v '^$' | sort -u | jq -Rsc 'split("\n") | map(select(. != ""))')
+    records+=$(jq -c --argjson rules "$rules" --slurpfile status "$dir/status.json" \
+      '. + {prompt_version: ($status[0].prompt_version // "unknown"), variants: ($status[0].variants // []), rules: $rules}' "$dir/outcome.json")$'\n'
+  done
+  if [ -z "$records" ]; then
+    log "No pull requests opened by CCA runs yet"
+    return
+  fi
+  jq -rs '
+    def rate(n; d): if d == 0 then "n/a" else "\(100 * n / d | floor)%" end;
+    def table(title; key):
+      "### Acceptance by \(title)\n\n| \(title[:1] | ascii_upcase)\(title[1:]) | Pull requests | Open | Merged | Closed | Acceptance | Heavily amended |\n| --- | --- | --- | --- | --- | --- | --- |",
+      (group_by(key)[] | (map(select(.state == "MERGED")) | length) as $merged | (map(select(.state == "CLOSED")) | length) as $closed
+        | "| \(.[0] | key) | \(length) | \(map(select(.state == "OPEN")) | length) | \($merged) | \($closed) | \(rate($merged; $merged + $closed)) | \(rate(map(select(.state == "MERGED" and .heavily_amended)) | length; $merged)) |"),
+      "";
+    table("repository"; .repo),
+    table("prompt version"; .prompt_version),
+    ([.[] | .rule = (.rules[]?)] | if length > 0 then table("finding category"; .rule) else empty end),
+    ([.[] | .variant = (.variants[]?)] | if length > 0 then table("experiment variant"; .variant) else empty end)
+  ' <<<"$records"
+}
 
-Here are the current code changes:
-$changes_json
+# digest_period prints one line of tab-separated totals for the runs whose
+# directory names sort between $1 and $2: runs, pull requests, merged pull
+# requests, covered and total acceptance criteria, and prompt bytes sent.
+digest_period() {
+  local dir name runs=0 prs=0 merged=0 covered=0 criteria=0 bytes=0 url
+  for dir in "$root_dir"/.cca/runs/*/; do
+    name=$(basename "$dir")
+    [[ "$name" > "$1" && "$name" < "$2" ]] || continue
+    runs=$((runs + 1))
+    url=$(jq -r '.pr_url // ""' "$dir/status.json" 2>/dev/null || true)
+    if [ -n "$url" ]; then
+      prs=$((prs + 1))
+      if [ "$OFFLINE" -eq 0 ] && [ "$(gh pr view "$url" --json state --jq .state 2>/dev/null || true)" = "MERGED" ]; then
+        merged=$((merged + 1))
+      fi
+    fi
+    if [ -f "$dir/traceability.json" ]; then
+      covered=$((covered + $(jq '[.criteria[] | select(.tests | length > 0)] | length' "$dir/traceability.json")))
+      criteria=$((criteria + $(jq '.criteria | length' "$dir/traceability.json")))
+    fi
+    if [ -f "$dir/context.jsonl" ]; then
+      bytes=$((bytes + $(jq -s 'map(.prompt_bytes) | add // 0' "$dir/context.jsonl")))
+    fi
+  done
+  printf '%s\t%s\t%s\t%s\t%s\t%s\n' "$runs" "$prs" "$merged" "$covered" "$criteria" "$bytes"
+}
 
-Please fix the code to resolve these verification errors. Return the corrected implementation.
+# run_digest summarizes the runs of the last $1 (for example 7d, 2w or 12h):
+# pull requests created and merged, the most common self-review finding
+# categories, acceptance criteria coverage against the period before, and the
+# estimated backend usage. The digest is printed as Markdown or, with
+# DIGEST_FORMAT=slack, posted to DIGEST_WEBHOOK as a Slack message.
+run_digest() {
+  local amount="${1%[hdw]}" unit="${1: -1}" seconds now since previous
+  [[ "$amount" =~ ^[0-9]+$ ]] || { log "Invalid period: $1" >&2; exit 1; }
+  case "$unit" in
+    h) seconds=$((amount * 3600)) ;;
+    d) seconds=$((amount * 86400)) ;;
+    w) seconds=$((amount * 604800)) ;;
+    *) log "Invalid period: $1" >&2; exit 1 ;;
+  esac
+  now=$(date +%s)
+  since=$(date -d "@$((now - seconds))" +%Y%m%d-%H%M%S)
+  previous=$(date -d "@$((now - 2 * seconds))" +%Y%m%d-%H%M%S)
+  root_dir=$(git rev-parse --show-toplevel)
 
-Format as JSON with the same structure as before:
-{
-  "files": {"path": "content"},
-  "new_files": [],
-  "deleted_files": [],
-  "summary": "..."
+  local runs prs merged covered criteria bytes prev_covered prev_criteria
+  IFS=$'\t' read -r runs prs merged covered criteria bytes < <(digest_period "$since" "99999999")
+  IFS=$'\t' read -r _ _ _ prev_covered prev_criteria _ < <(digest_period "$previous" "$since")
+
+  local categories="" dir
+  for dir in "$root_dir"/.cca/runs/*/; do
+    [[ "$(basename "$dir")" > "$since" ]] && [ -f "$dir/self-review.jsonl" ] || continue
+    categories+=$(jq -r '.findings[]? | .category // "uncategorized"' "$dir/self-review.jsonl")$'\n'
+  done
+  categories=$(grep -v '^$' <<<"$categories" | sort | uniq -c | sort -rn | head -n 5 |
+    awk '{ count = $1; $1 = ""; printf "- %s (%d)\n", substr($0, 2), count }' || true)
+
+  local coverage="n/a" prev_coverage="n/a" cost=""
+  [ "$criteria" -eq 0 ] || coverage="$((100 * covered / criteria))%"
+  [ "$prev_criteria" -eq 0 ] || prev_coverage="$((100 * prev_covered / prev_criteria))%"
+  if [ -n "$TOKEN_PRICE" ]; then
+    cost=$(awk -v tokens="$((bytes / 4))" -v price="$TOKEN_PRICE" 'BEGIN { printf ", about $%.2f", tokens * price / 1000000 }')
+  fi
+
+  local digest
+  digest="## CCA digest: last $1
+
+- Runs: $runs
+- Pull requests created: $prs
+- Merged: $merged$( [ "$prs" -eq 0 ] || echo " ($((100 * merged / prs))%)")
+- Acceptance criteria coverage: $coverage (previous $1: $prev_coverage)
+- Backend usage: ~$((bytes / 4)) prompt tokens$cost
+
+### Top finding categories
+
+${categories:-None}"
+
+  if [ "$DIGEST_FORMAT" = "slack" ]; then
+    local payload
+    payload=$(sed -e 's/^## \(.*\)/*\1*/' -e 's/^### \(.*\)/*\1*/' -e 's/^- /• /' <<<"$digest" | jq -Rsc '{text: .}')
+    if [ -n "$DIGEST_WEBHOOK" ]; then
+      curl -fsS -X POST -H 'Content-Type: application/json' -d "$payload" "$DIGEST_WEBHOOK" >/dev/null
+      log "Posted digest to Slack"
+    else
+      echo "$payload"
+    fi
+  else
+    echo "$digest"
+  fi
 }
-EOF3
-  changes_json=$(claude_chat "$fix_prompt_file" "with-p")
-  rm "$fix_prompt_file"
-  attempt=$((attempt + 1))
-  log "Retrying verification..."
+
+# run_gc removes cca worktrees and run artifacts older than the retention
+# period and the local and remote branches of cca pull requests that were
+# merged or closed.
+run_gc() {
+  require_commands gh
+  root_dir=$(git rev-parse --show-toplevel)
+  local cutoff path
+  cutoff=$(date -d "-$RETENTION_DAYS days" +%s)
+
+  log "Looking for runs that stopped sending heartbeats"
+  recover_orphans
+
+  log "Looking for worktrees older than $RETENTION_DAYS days"
+  while read -r path; do
+    if [ "$(stat -c %Y "$path")" -lt "$cutoff" ]; then
+      remove git worktree remove --force "$path"
+    fi
+  done < <(git worktree list --porcelain | sed -n 's/^worktree //p' | grep -F "$root_dir/.cca/worktrees/" || true)
+  remove git worktree prune
+
+  log "Looking for run artifacts older than $RETENTION_DAYS days"
+  if [ -d "$root_dir/.cca/runs" ]; then
+    while read -r path; do
+      remove rm -rf "$path"
+    done < <(find "$root_dir/.cca/runs" -mindepth 1 -maxdepth 1 -type d -mtime "+$RETENTION_DAYS")
+  fi
+
+  log "Looking for branches of merged or closed pull requests"
+  local head
+  while read -r head; do
+    if git show-ref --verify --quiet "refs/heads/$head"; then
+      remove git branch -D "$head"
+    fi
+    if [ "$READ_ONLY" -eq 0 ] && git ls-remote --exit-code --heads origin "$head" >/dev/null 2>&1; then
+      remove push origin --delete "$head"
+    fi
+  done < <(gh pr list --state all --limit 500 --json headRefName,state \
+    --jq '.[] | select((.headRefName | startswith("cca/")) and .state != "OPEN") | .headRefName' | sort -u)
+}
+
+# config_set assigns CCA_* settings from a KEY=value config stream, leaving
+# variables that are already set untouched so earlier sources take precedence.
+config_set() {
+  local key value
+  while IFS='=' read -r key value; do
+    key=$(echo "$key" | tr -d '[:space:]')
+    [[ "$key" =~ ^CCA_[A-Z0-9_]+$ ]] || continue
+    [ -z "${!key+set}" ] || continue
+    value="${value#"${value%%[![:space:]]*}"}"
+    value="${value%\"}"
+    value="${value#\"}"
+    export "$key=$value"
+  done < <(grep -Ev '^[[:space:]]*(#|$)')
+}
+
+# shared_config prints the config referenced by CCA_EXTENDS
+# (github.com/<owner>/<repo>[/<path>][@<ref>], path defaulting to .cca/config),
+# caching it for CCA_CONFIG_CACHE_HOURS and using the cache when offline.
+shared_config() {
+  local spec="${CCA_EXTENDS#github.com/}" ref="" owner repo path
+  if [[ "$spec" == *@* ]]; then
+    ref="${spec##*@}"
+    spec="${spec%@*}"
+  fi
+  owner=$(cut -d/ -f1 <<<"$spec")
+  repo=$(cut -d/ -f2 <<<"$spec")
+  path=$(cut -d/ -f3- <<<"$spec")
+  path="${path:-.cca/config}"
+
+  local cache="${XDG_CACHE_HOME:-$HOME/.cache}/cca/config/$owner/$repo/${ref:-default}/$path"
+  local max_age=$((${CCA_CONFIG_CACHE_HOURS:-24} * 60))
+  if [ ! -f "$cache" ] || { [ "$OFFLINE" -eq 0 ] && [ -n "$(find "$cache" -mmin "+$max_age")" ]; }; then
+    if [ "$OFFLINE" -eq 1 ]; then
+      log "Shared config $CCA_EXTENDS is not cached and cannot be fetched offline" >&2
+      return
+    fi
+    mkdir -p "$(dirname "$cache")"
+    if gh api "repos/$owner/$repo/contents/$path${ref:+?ref=$ref}" -H "Accept: application/vnd.github.raw" >"$cache.tmp"; then
+      mv "$cache.tmp" "$cache"
+      log "Fetched shared config $CCA_EXTENDS" >&2
+    else
+      rm -f "$cache.tmp"
+      log "Could not fetch shared config $CCA_EXTENDS; using cached copy if any" >&2
+    fi
+  fi
+  [ ! -f "$cache" ] || cat "$cache"
+}
+
+# choose_variants applies the settings of the variant each experiment under
+# .cca/experiments/ assigns to this run and records "<experiment>/<variant>"
+# in EXPERIMENT_VARIANTS. A variant is a <variant>.conf file of CCA_* settings
+# whose CCA_VARIANT_PCT line gives the percentage of runs it receives. Runs
+# are bucketed by a hash of the experiment and the issue, so re-running an
+# issue keeps its variant; runs no variant claims are tagged "control".
+choose_variants() {
+  local dir file name bucket pct total chosen
+  for dir in "$1"/.cca/experiments/*/; do
+    [ -d "$dir" ] || continue
+    name=$(basename "$dir")
+    bucket=$((16#$(printf '%s' "$name-${ISSUE_URL:-$ISSUE_FILE}" | sha256sum | cut -c1-6) % 100))
+    total=0
+    chosen="control"
+    for file in "$dir"*.conf; do
+      [ -f "$file" ] || continue
+      pct=$(sed -n 's/^[[:space:]]*CCA_VARIANT_PCT[[:space:]]*=[[:space:]]*\([0-9]*\).*/\1/p' "$file" | head -n 1)
+      total=$((total + ${pct:-0}))
+      if [ "$bucket" -lt "$total" ]; then
+        config_set < <(grep -v '^[[:space:]]*CCA_VARIANT_PCT' "$file")
+        chosen=$(basename "$file" .conf)
+        break
+      fi
+    done
+    EXPERIMENT_VARIANTS+="$name/$chosen "
+  done
+}
+
+# repo_of prints owner/repo for a GitHub issue, pull request or remote URL.
+repo_of() {
+  sed -E 's#^(https?://|ssh://)?(git@)?github\.com[:/]##; s#\.git$##' <<<"$1" | cut -d/ -f1,2
+}
+
+# policy_patterns prints the repository patterns of kind $1 (allow or deny),
+# one per line: those in CCA_REPO_ALLOW or CCA_REPO_DENY and the "allow" and
+# "deny" lines of the user's policy file.
+policy_patterns() {
+  local patterns=()
+  if [ "$1" = "allow" ]; then
+    read -r -a patterns <<<"$REPO_ALLOW"
+  else
+    read -r -a patterns <<<"$REPO_DENY"
+  fi
+  [ "${#patterns[@]}" -eq 0 ] || printf '%s\n' "${patterns[@]}"
+  [ ! -f "$REPO_POLICY_FILE" ] || awk -v kind="$1" '$1 == kind && NF >= 2 { print $2 }' "$REPO_POLICY_FILE"
+}
+
+# repo_policy checks owner/repo $1 against the repository policy. A denied
+# repository stops the run. When there is an allowlist, a repository that is
+# not on it needs confirmation in a terminal with REPO_UNLISTED=confirm and
+# is denied otherwise.
+repo_policy() {
+  local repo="${1,,}" pattern answer=""
+  local allow=() deny=()
+  mapfile -t allow < <(policy_patterns allow)
+  mapfile -t deny < <(policy_patterns deny)
+  for pattern in ${deny[@]+"${deny[@]}"}; do
+    if [[ "$repo" == ${pattern,,} ]]; then
+      log "Repository $1 is denied by the repository policy ($pattern)" >&2
+      exit 1
+    fi
+  done
+  [ "${#allow[@]}" -gt 0 ] || return 0
+  for pattern in "${allow[@]}"; do
+    [[ "$repo" != ${pattern,,} ]] || return 0
+  done
+  log "Repository $1 is not on the repository allowlist" >&2
+  if [ "$REPO_UNLISTED" = "confirm" ] && [ -t 0 ]; then
+    read -r -p "Operate on $1 anyway? [y/N] " answer || true
+    [[ "$answer" != [yY]* ]] || return 0
+  fi
+  exit 1
+}
+
+# enforce_repo_policy applies repo_policy to the repositories a command acts
+# on: those of the issue, pull request or repository given, and the origin of
+# the checkout, where branches are pushed.
+enforce_repo_policy() {
+  case "$COMMAND" in
+    run|update|rebase|triage|revalidate|rank|badge|monitor|fix-vulns) ;;
+    *) return 0 ;;
+  esac
+  [ -n "$(policy_patterns allow)$(policy_patterns deny)" ] || return 0
+  local ref origin repo repos=()
+  for ref in "$ISSUE_URL" "$TARGET" "$RANK_REPO"; do
+    if [[ "$ref" == *github.com/* ]]; then
+      repos+=("$(repo_of "$ref")")
+    elif [ "$ref" = "$RANK_REPO" ] && [ -n "$ref" ]; then
+      repos+=("$ref")
+    fi
+  done
+  origin=$(git remote get-url origin 2>/dev/null || true)
+  if [ "$OFFLINE" -eq 0 ] && [[ "$origin" == *github.com* ]]; then
+    repos+=("$(repo_of "$origin")")
+  fi
+  while read -r repo; do
+    [ -z "$repo" ] || repo_policy "$repo"
+  done < <(printf '%s\n' ${repos[@]+"${repos[@]}"} | sort -u)
+}
+
+# load_config applies settings from the environment, then the experiment
+# variants of the run, then .cca/config in the repository, then the shared
+# config it extends.
+load_config() {
+  local root file
+  root=$(git rev-parse --show-toplevel 2>/dev/null) || return 0
+  [ "$COMMAND" != "run" ] || choose_variants "$root"
+  file="$root/.cca/config"
+  [ ! -f "$file" ] || config_set <"$file"
+  [ -z "${CCA_EXTENDS:-}" ] || config_set < <(shared_config)
+}
+
+COMMAND="run"
+EXPERIMENT_VARIANTS=""
+case "${1:-}" in
+  gc|update|rebase|resume|replay|vulndb|cassette|scaffold|index|search|debug|explain|digest|triage|revalidate|rank|outcomes|show|report|badge|multi|rollback|monitor|fix-vulns|schedule|audit|evidence|warm|devcontainer|schema|doctor)
+    COMMAND="$1"
+    shift
+    ;;
+esac
+
+OFFLINE=0
+# READ_ONLY comes from the command line or the environment only, so that a
+# repository's configuration cannot turn it off.
+READ_ONLY="${CCA_READ_ONLY:-0}"
+DETERMINISTIC=""
+PLAN=""
+INTERACTIVE=0
+TDD=""
+BEST_EFFORT=""
+TIME_BUDGET=""
+ISSUE_FILE=""
+ISSUE_URL=""
+# TARGET is the positional argument of a subcommand: a pull request URL or
+# run ID.
+TARGET=""
+# OPERAND and EXTRA are the second and third positional arguments of the
+# cassette, scaffold, debug, explain, report, evidence and multi subcommands.
+OPERAND=""
+EXTRA=""
+DRY_RUN=0
+RETENTION_DAYS=""
+DIGEST_SINCE=""
+DIGEST_FORMAT=""
+RANK_REPO=""
+while [ "$#" -gt 0 ]; do
+  case "$1" in
+    --offline) OFFLINE=1 ;;
+    --read-only) READ_ONLY=1 ;;
+    --deterministic) DETERMINISTIC=1 ;;
+    --plan) PLAN=1 ;;
+    --interactive) INTERACTIVE=1 ;;
+    --tdd) TDD=1 ;;
+    --best-effort) BEST_EFFORT=1 ;;
+    --time-budget)
+      [ "$#" -ge 2 ] || usage
+      TIME_BUDGET="$2"
+      shift
+      ;;
+    --issue-file)
+      [ "$#" -ge 2 ] || usage
+      ISSUE_FILE="$2"
+      shift
+      ;;
+    --dry-run) DRY_RUN=1 ;;
+    --retention-days)
+      [ "$#" -ge 2 ] || usage
+      RETENTION_DAYS="$2"
+      shift
+      ;;
+    --since)
+      [ "$#" -ge 2 ] || usage
+      DIGEST_SINCE="$2"
+      shift
+      ;;
+    --format)
+      [ "$#" -ge 2 ] || usage
+      DIGEST_FORMAT="$2"
+      shift
+      ;;
+    --repo)
+      [ "$#" -ge 2 ] || usage
+      RANK_REPO="$2"
+      shift
+      ;;
+    -*) usage ;;
+    *)
+      if [ "$COMMAND" != "run" ]; then
+        if [ -z "$TARGET" ]; then
+          TARGET="$1"
+        elif [[ "$COMMAND" == cassette || "$COMMAND" == scaffold || "$COMMAND" == debug || "$COMMAND" == explain ||
+                "$COMMAND" == report || "$COMMAND" == evidence || "$COMMAND" == multi || "$COMMAND" == schema ]] && [ -z "$OPERAND" ]; then
+          OPERAND="$1"
+        elif [[ "$COMMAND" == debug || "$COMMAND" == report ]] && [ -z "$EXTRA" ]; then
+          EXTRA="$1"
+        else
+          usage
+        fi
+      else
+        [ -z "$ISSUE_URL" ] || usage
+        ISSUE_URL="$1"
+      fi
+      ;;
+  esac
+  shift
 done
 
+# The repository policy comes only from the environment and the user's policy
+# file, never from the configuration of the repository it restricts.
+REPO_ALLOW="${CCA_REPO_ALLOW:-}"
+REPO_DENY="${CCA_REPO_DENY:-}"
+REPO_UNLISTED="${CCA_REPO_UNLISTED:-confirm}"
+REPO_POLICY_FILE="${CCA_REPO_POLICY_FILE:-${XDG_CONFIG_HOME:-$HOME/.config}/cca/policy}"
+load_config
 
-git add .
-log "Committing changes"
-git commit -m "Implement: $title"
-log "Pushing branch $branch"
-git push origin "$branch"
-log "Creating draft pull request"
-pr_url=$(gh pr create --draft --title "Fix: $title" --body "Resolves: $ISSUE_URL")
+CONTEXT_EXCLUDE="${CCA_CONTEXT_EXCLUDE:-.env .env.* *.pem *.key id_rsa*}"
+CONTEXT_MAX_BYTES="${CCA_CONTEXT_MAX_BYTES:-100000}"
+STRIP_COMMENTS="${CCA_STRIP_COMMENTS:-0}"
+CONTEXT_PENDING=$(mktemp)
+CASSETTE_STATE=$(mktemp -d)
+REDACT_PATTERNS="${CCA_REDACT_PATTERNS:-}"
+REDACT_VARS="${CCA_REDACT_VARS:-}"
+REDACT_VALUES=()
+VERIFY_ENV_FILE=""
+VERIFY_ENV_EXEC=""
+CASSETTE="${CCA_CASSETTE:-}"
+CASSETTE_MODE="${CCA_CASSETTE_MODE:-replay}"
+GH_RETRIES="${CCA_GH_RETRIES:-3}"
+CHAOS="${CCA_CHAOS:-0}"
+CHAOS_FAULTS="${CCA_CHAOS_FAULTS:-api ratelimit slow push}"
+CHAOS_DELAY="${CCA_CHAOS_DELAY:-30}"
+DETERMINISTIC="${DETERMINISTIC:-${CCA_DETERMINISTIC:-0}}"
+SEED="${CCA_SEED:-0}"
+PLAN="${PLAN:-${CCA_PLAN:-0}}"
+TDD="${TDD:-${CCA_TDD:-0}}"
+BUG_REPRO="${CCA_BUG_REPRO:-1}"
+BUG_LABELS="${CCA_BUG_LABELS:-bug}"
+RETENTION_DAYS="${RETENTION_DAYS:-${CCA_RETENTION_DAYS:-14}}"
+DIGEST_SINCE="${DIGEST_SINCE:-${CCA_DIGEST_SINCE:-7d}}"
+DIGEST_FORMAT="${DIGEST_FORMAT:-${CCA_DIGEST_FORMAT:-markdown}}"
+DIGEST_WEBHOOK="${CCA_DIGEST_WEBHOOK:-}"
+MONITOR_BRANCH="${CCA_MONITOR_BRANCH:-}"
+MONITOR_COVERAGE_CMD="${CCA_MONITOR_COVERAGE_CMD:-}"
+MONITOR_COVERAGE_DROP="${CCA_MONITOR_COVERAGE_DROP:-1}"
+MONITOR_MIN_COVERAGE="${CCA_MONITOR_MIN_COVERAGE:-}"
+MONITOR_MAX_DEBT="${CCA_MONITOR_MAX_DEBT:-}"
+MONITOR_SEVERITIES="${CCA_MONITOR_SEVERITIES:-critical}"
+MONITOR_SLACK_WEBHOOK="${CCA_MONITOR_SLACK_WEBHOOK:-}"
+MONITOR_WEBHOOK="${CCA_MONITOR_WEBHOOK:-}"
+MONITOR_ISSUE="${CCA_MONITOR_ISSUE:-0}"
+MONITOR_LABEL="${CCA_MONITOR_LABEL:-cca:monitor}"
+FIX_VULNS_RESCAN="${CCA_FIX_VULNS_RESCAN-0 */6 * * *}"
+TOKEN_PRICE="${CCA_TOKEN_PRICE:-}"
+TRIAGE_AUTHORS="${CCA_TRIAGE_AUTHORS:-app/dependabot app/renovate dependabot[bot] renovate[bot]}"
+TRIAGE_APPROVE="${CCA_TRIAGE_APPROVE:-0}"
+REVALIDATE_RUN="${CCA_REVALIDATE_RUN:-0}"
+REVALIDATE_CLOSE="${CCA_REVALIDATE_CLOSE:-0}"
+LANGUAGE_SETTING="${CCA_LANGUAGE:-auto}"
+TRANSLATE="${CCA_TRANSLATE:-1}"
+GO_CHECKS="${CCA_GO_CHECKS-sql concurrency context logging errors}"
+LOGGER="${CCA_LOGGER:-}"
+FLAG_REVIEW="${CCA_FLAG_REVIEW:-1}"
+TEST_REVIEW="${CCA_TEST_REVIEW:-1}"
+TEST_MAX_MOCKS="${CCA_TEST_MAX_MOCKS:-5}"
+PERSONA="${CCA_PERSONA:-}"
+PERSONA_LABELS="${CCA_PERSONA_LABELS:-}"
+FLAG_STALE_DAYS="${CCA_FLAG_STALE_DAYS:-90}"
+FLAG_RISKY="${CCA_FLAG_RISKY:-0}"
+INSTRUMENT="${CCA_INSTRUMENT:-suggest}"
+OBSOLETE_TESTS="${CCA_OBSOLETE_TESTS:-report}"
+CODEGEN="${CCA_CODEGEN:-1}"
+CODEGEN_CMD="${CCA_CODEGEN_CMD:-}"
+API_DRIFT="${CCA_API_DRIFT:-1}"
+OWNERSHIP="${CCA_OWNERSHIP:-1}"
+OWNERSHIP_SPLIT="${CCA_OWNERSHIP_SPLIT:-0}"
+RACE="${CCA_RACE:-1}"
+A11Y="${CCA_A11Y:-1}"
+A11Y_SERVE="${CCA_A11Y_SERVE:-}"
+A11Y_URLS="${CCA_A11Y_URLS:-}"
+UI_LANGUAGE="en"
+[ "$LANGUAGE_SETTING" = "auto" ] || resolve_language
+PREFLIGHT="${CCA_PREFLIGHT:-1}"
+BEST_EFFORT="${BEST_EFFORT:-${CCA_BEST_EFFORT:-0}}"
+TIME_BUDGET="${TIME_BUDGET:-${CCA_TIME_BUDGET:-}}"
+CLARIFY="${CCA_CLARIFY:-1}"
+CLARIFY_THRESHOLD="${CCA_CLARIFY_THRESHOLD:-0.6}"
+DECISION_GUARD="${CCA_DECISION_GUARD:-1}"
+DECISION_THRESHOLD="${CCA_DECISION_THRESHOLD:-0.7}"
+if [ "$OFFLINE" -eq 1 ]; then
+  BACKEND="${CCA_BACKEND:-ollama}"
+else
+  BACKEND="${CCA_BACKEND:-claude}"
+fi
+OLLAMA_HOST="${OLLAMA_HOST:-http://localhost:11434}"
+OLLAMA_MODEL="${CCA_OLLAMA_MODEL:-llama3}"
+MODEL="${CCA_MODEL:-}"
+MODEL_ROUTING="${CCA_MODEL_ROUTING:-1}"
+MODEL_SMALL="${CCA_MODEL_SMALL:-haiku}"
+MODEL_MEDIUM="${CCA_MODEL_MEDIUM:-sonnet}"
+MODEL_LARGE="${CCA_MODEL_LARGE:-opus}"
+MODEL_ROUTING_FILES="${CCA_MODEL_ROUTING_FILES:-2 8}"
+MODEL_SMALL_WORDS="${CCA_MODEL_SMALL_WORDS:-150}"
+MODEL_RISK_LABELS="${CCA_MODEL_RISK_LABELS:-security breaking-change}"
+MAX_CONFLICT_FILES="${CCA_MAX_CONFLICT_FILES:-5}"
+REBASE_ATTEMPTS="${CCA_REBASE_ATTEMPTS:-10}"
+LABELS="${CCA_LABELS:-1}"
+PR_NORMS="${CCA_PR_NORMS:-1}"
+AUTO_LABEL="${CCA_AUTO_LABEL:-cca:auto}"
+SIZE_THRESHOLDS="${CCA_SIZE_THRESHOLDS:-10 30 100 500}"
+RISKY_PATHS="${CCA_RISKY_PATHS:-^\.github/|(^|/)(go\.mod|go\.sum|package\.json|package-lock\.json|Dockerfile)$}"
+CREATE_LABELS="${CCA_CREATE_LABELS:-1}"
+RELEASE_NOTE_TYPE="${CCA_RELEASE_NOTE_TYPE:-feature}"
+RELEASE_NOTE_BUMP="${CCA_RELEASE_NOTE_BUMP:-patch}"
+FAIL_ON_BREAKING="${CCA_FAIL_ON_BREAKING:-0}"
+VULNDB_DIR="${CCA_VULNDB_DIR:-${XDG_CACHE_HOME:-$HOME/.cache}/cca/vulndb}"
+VULNDB_ECOSYSTEMS="${CCA_VULNDB_ECOSYSTEMS:-Go npm}"
+VULNDB_MAX_AGE_DAYS="${CCA_VULNDB_MAX_AGE_DAYS:-7}"
+ACK_DEPENDENCIES="${CCA_ACK_DEPENDENCIES:-}"
+THREAT_MODEL="${CCA_THREAT_MODEL:-1}"
+ACK_THREATS="${CCA_ACK_THREATS:-}"
+TIDY="${CCA_TIDY:-1}"
+SPLIT_COMMITS="${CCA_SPLIT_COMMITS:-1}"
+MINIMIZE_DIFF="${CCA_MINIMIZE_DIFF:-1}"
+LICENSE_HEADERS="${CCA_LICENSE_HEADERS:-1}"
+LICENSE_HEADER="${CCA_LICENSE_HEADER:-.cca/license-header.txt}"
+LICENSE_OWNER="${CCA_LICENSE_OWNER:-}"
+PATCH_RETRIES="${CCA_PATCH_RETRIES:-2}"
+ALLOWED_PATHS="${CCA_ALLOWED_PATHS:-}"
+PATH_POLICY="${CCA_PATH_POLICY:-trim}"
+SELF_REVIEW="${CCA_SELF_REVIEW:-1}"
+SELF_REVIEW_MAX="${CCA_SELF_REVIEW_MAX:-2}"
+REVIEW_RUBRIC="${CCA_REVIEW_RUBRIC:-}"
+REVIEW_REQUIRED="${CCA_REVIEW_REQUIRED:-}"
+REVIEW_TONE="${CCA_REVIEW_TONE:-}"
+REVIEW_MIN_SCORE="${CCA_REVIEW_MIN_SCORE:-0}"
+REVIEW_BACKENDS="${CCA_REVIEW_BACKENDS:-}"
+TEST_SELECTION="${CCA_TEST_SELECTION:-1}"
+VERIFY_WORKERS="${CCA_VERIFY_WORKERS:-1}"
+VERIFY_TIMEOUT="${CCA_VERIFY_TIMEOUT:-30m}"
+TOOLCHAINS="${CCA_TOOLCHAINS:-1}"
+DEVCONTAINER="${CCA_DEVCONTAINER:-1}"
+NIX="${CCA_NIX:-1}"
+SERVICES="${CCA_SERVICES:-1}"
+SERVICES_FILE="${CCA_SERVICES_FILE:-}"
+SERVICES_TIMEOUT="${CCA_SERVICES_TIMEOUT:-120}"
+VERIFY_RUNNER=(env)
+BASE_REF="${CCA_BASE_REF:-HEAD}"
+PIN="${CCA_PIN:-1}"
+FUZZ="${CCA_FUZZ:-1}"
+FUZZ_TIME="${CCA_FUZZ_TIME:-}"
+CONTRACT_TESTS="${CCA_CONTRACT_TESTS:-1}"
+SMOKE="${CCA_SMOKE:-1}"
+SMOKE_UPDATE="${CCA_SMOKE_UPDATE:-0}"
+WORKFLOW_DIAGRAM="${CCA_WORKFLOW_DIAGRAM:-1}"
+HEARTBEAT_INTERVAL="${CCA_HEARTBEAT_INTERVAL:-30}"
+HEARTBEAT_TIMEOUT="${CCA_HEARTBEAT_TIMEOUT:-10}"
+MAX_MEMORY_MB="${CCA_MAX_MEMORY_MB:-}"
+MAX_DISK_MB="${CCA_MAX_DISK_MB:-}"
+MAX_PROCS="${CCA_MAX_PROCS:-}"
+SYMBOL_CONTEXT="${CCA_SYMBOL_CONTEXT:-1}"
+COVERAGE_CONTEXT="${CCA_COVERAGE_CONTEXT:-1}"
+COVERAGE_FILE="${CCA_COVERAGE_FILE:-}"
+TOOLS="${CCA_TOOLS:-0}"
+STREAM="${CCA_STREAM:-0}"
+ON_DUPLICATE="${CCA_ON_DUPLICATE:-abort}"
+AUDIT="${CCA_AUDIT:-1}"
+AUDIT_LOG="${CCA_AUDIT_LOG:-.cca/audit.jsonl}"
+AUDIT_WEBHOOK="${CCA_AUDIT_WEBHOOK:-}"
+EVIDENCE_KEY="${CCA_EVIDENCE_KEY:-}"
+EVIDENCE_SIGNER="${CCA_EVIDENCE_SIGNER:-}"
+EVIDENCE_SIGNERS="${CCA_EVIDENCE_SIGNERS:-}"
+CA_BUNDLE="${CCA_CA_BUNDLE:-}"
+CLIENT_CERT="${CCA_CLIENT_CERT:-}"
+CLIENT_KEY="${CCA_CLIENT_KEY:-}"
+FETCH_DEPTH="${CCA_FETCH_DEPTH:-1}"
+BADGE_DIR="${CCA_BADGE_DIR:-.cca/badge}"
+BADGE_BRANCH="${CCA_BADGE_BRANCH:-}"
+DEEPEN_STEP="${CCA_DEEPEN_STEP:-50}"
+DEEPEN_MAX="${CCA_DEEPEN_MAX:-4}"
+TOOLS_ALLOWED="${CCA_TOOLS_ALLOWED:-read_file search_code find_symbols git_blame}"
+TOOL_MAX_ROUNDS="${CCA_TOOL_MAX_ROUNDS:-5}"
+SBOM_FORMAT="${CCA_SBOM_FORMAT:-cyclonedx-json}"
+SBOM_SUBMIT="${CCA_SBOM_SUBMIT:-0}"
+BINARY_GROWTH_PCT="${CCA_BINARY_GROWTH_PCT:-10}"
+BUNDLE_SIZE="${CCA_BUNDLE_SIZE:-1}"
+BUNDLE_GROWTH_PCT="${CCA_BUNDLE_GROWTH_PCT:-10}"
+FAIL_ON_BUNDLE_GROWTH="${CCA_FAIL_ON_BUNDLE_GROWTH:-0}"
+BUILD_TIME_GROWTH_PCT="${CCA_BUILD_TIME_GROWTH_PCT:-25}"
+RANK_LIMIT="${CCA_RANK_LIMIT:-50}"
+DIFF_GUARD="${CCA_DIFF_GUARD:-refuse}"
+MAX_PR_FILES="${CCA_MAX_PR_FILES:-50}"
+MAX_PR_LINES="${CCA_MAX_PR_LINES:-2000}"
+MAX_PR_BINARIES="${CCA_MAX_PR_BINARIES:-10}"
+ASSET_ALLOW="${CCA_ASSET_ALLOW:-}"
+ASSET_LFS_KB="${CCA_ASSET_LFS_KB:-1024}"
+TRAILERS="${CCA_TRAILERS:-1}"
+HOOK_TIMEOUT="${CCA_HOOK_TIMEOUT:-300}"
+CO_AUTHOR="${CCA_CO_AUTHOR:-}"
+COMMENT_MAX_CHARS="${CCA_COMMENT_MAX_CHARS:-65000}"
+FINDINGS_COMMENTS="${CCA_FINDINGS_COMMENTS:-1}"
+RULES="${CCA_RULES:-}"
+RULE_PATHS="${CCA_RULE_PATHS:-}"
+MENTION_AUTHORS="${CCA_MENTION_AUTHORS:-}"
+REPORT_UPLOAD="${CCA_REPORT_UPLOAD:-auto}"
+OUTCOME_AMEND_PCT="${CCA_OUTCOME_AMEND_PCT:-30}"
+# PROMPT_VERSION tags runs so outcomes can be compared across prompt changes;
+# by default it changes whenever this script does.
+PROMPT_VERSION="${CCA_PROMPT_VERSION:-$(sha256sum "${BASH_SOURCE[0]}" | cut -c1-12)}"
+PROMPT_APPEND="${CCA_PROMPT_APPEND:-}"
+if [ -n "$PROMPT_APPEND" ] && [[ "$PROMPT_APPEND" != /* ]]; then
+  PROMPT_APPEND="$(git rev-parse --show-toplevel)/$PROMPT_APPEND"
+fi
+skipped_stages=()
+self_review_log=()
+review_findings=""
+traceability=""
+criteria_gaps=()
+fuzz_findings=()
+stage_records=()
+current_stage=""
+stage_start=0
+heartbeat_pid=""
+disk_peak_kb=0
+systemd_scope=""
+fetch_records=""
+history_deepened=0
+api_records=""
+rate_limit_read=0
+rate_limit_before=""
+rejected_changes=""
+stage_retries=0
+baseline_failures=""
+plan_json=""
+tests_json=""
+repro=0
+repro_result=""
+issue_labels=""
+persona_role="a strict code reviewer"
+persona_tone=""
+persona_weights=""
+persona_omit=""
+stack_locations=""
+issue_language=""
+original_title=""
+a11y_findings=""
+bundle_report=""
+code_findings=""
+flag_guidance=""
+instrumentation_note=""
+threat_summary=""
+threat_categories=""
+obsolete_note=""
+codegen_note=""
+pr_norms=""
+split_prs=()
+bundle_regressions=0
+error_locations=""
+related_symbols=""
+uncovered_functions=""
+tdd_log=()
+verify_attempts=0
+base_commit=""
+acceptance_criteria=""
+target_paths=""
+branch=""
+pr_url=""
+run_dir=""
+prompt_sha256=""
+work_dir=""
+issue_lock_dir=""
+lock_holder=""
+budget_seconds=0
+budget_started=0
+tls_curl_args=()
+network_setup
+load_secrets || exit 1
+load_verify_env || exit 1
+trap on_exit EXIT
+enforce_repo_policy
+check_weights CCA_RULES "$RULES"
 
-popd >/dev/null
-log "Cleaning up worktree"
-git worktree remove "$work_dir"
-log "Pull request created: $pr_url"
+case "$COMMAND" in
+  run) run_issue ;;
+  update)
+    if [ "$OFFLINE" -eq 1 ] || [ -n "$ISSUE_FILE" ]; then
+      usage
+    fi
+    [ "$READ_ONLY" -eq 0 ] || { log "update pushes to the pull request and is not available in read-only mode" >&2; exit 1; }
+    if [ -n "$TARGET" ]; then
+      run_update "$TARGET"
+    else
+      run_mentions
+    fi
+    ;;
+  rebase)
+    if [ "$OFFLINE" -eq 1 ] || [ -n "$ISSUE_FILE" ]; then
+      usage
+    fi
+    [ "$READ_ONLY" -eq 0 ] || { log "rebase force-pushes pull request branches and is not available in read-only mode" >&2; exit 1; }
+    run_rebase
+    ;;
+  gc)
+    if [ "$OFFLINE" -eq 1 ] || [ -n "$ISSUE_FILE" ] || [ -n "$TARGET" ]; then
+      usage
+    fi
+    run_gc
+    ;;
+  resume)
+    if [ "$OFFLINE" -eq 1 ] || [ -n "$ISSUE_FILE" ] || [ -n "$TARGET" ]; then
+      usage
+    fi
+    run_resume
+    ;;
+  replay)
+    if [ -z "$TARGET" ] || [ "$OFFLINE" -eq 1 ] || [ -n "$ISSUE_FILE" ]; then
+      usage
+    fi
+    run_replay "$TARGET"
+    ;;
+  vulndb)
+    [ "$TARGET" = "sync" ] || usage
+    run_vulndb_sync
+    ;;
+  cassette) run_cassette ;;
+  scaffold)
+    if [ -z "$OPERAND" ] || [ -n "$ISSUE_FILE" ]; then
+      usage
+    fi
+    run_scaffold "$TARGET" "$OPERAND"
+    ;;
+  index)
+    [ -z "$TARGET" ] || usage
+    root_dir=$(git rev-parse --show-toplevel)
+    update_index
+    ;;
+  warm)
+    [ -z "$TARGET" ] || usage
+    run_warm
+    ;;
+  devcontainer)
+    [ "$TARGET" = "feature" ] || usage
+    run_devcontainer_feature
+    ;;
+  search)
+    [ -n "$TARGET" ] || usage
+    run_search "$TARGET"
+    ;;
+  debug) run_debug ;;
+  triage)
+    [ -n "$TARGET" ] && [ "$OFFLINE" -eq 0 ] || usage
+    run_triage "$TARGET"
+    ;;
+  revalidate)
+    [ -n "$TARGET" ] && [ "$OFFLINE" -eq 0 ] || usage
+    run_revalidate "$TARGET"
+    ;;
+  multi)
+    [ -n "$TARGET" ] && [ -n "$OPERAND" ] && [ "$OFFLINE" -eq 0 ] || usage
+    run_multi "$TARGET" "$OPERAND"
+    ;;
+  show)
+    [ -n "$TARGET" ] || usage
+    run_show "$TARGET"
+    ;;
+  report)
+    [ "$TARGET" = "diff" ] && [ -n "$OPERAND" ] && [ -n "$EXTRA" ] || usage
+    run_report_diff "$OPERAND" "$EXTRA"
+    ;;
+  badge)
+    [ -z "$TARGET" ] || usage
+    run_badge
+    ;;
+  monitor)
+    [ -z "$TARGET" ] || usage
+    run_monitor
+    ;;
+  fix-vulns)
+    [ -z "$TARGET" ] || [ "$TARGET" = "recheck" ] || usage
+    [ "$OFFLINE" -eq 0 ] || usage
+    [ "$READ_ONLY" -eq 0 ] || [ "$DRY_RUN" -eq 1 ] || { log "fix-vulns opens pull requests and is not available in read-only mode" >&2; exit 1; }
+    run_fix_vulns "$TARGET"
+    ;;
+  schedule)
+    [ -z "$TARGET" ] || [ "$TARGET" = "list" ] || usage
+    run_schedule "$TARGET"
+    ;;
+  rollback)
+    [ -n "$TARGET" ] && [ "$OFFLINE" -eq 0 ] || usage
+    [ "$READ_ONLY" -eq 0 ] || [ "$DRY_RUN" -eq 1 ] || { log "rollback changes GitHub and is not available in read-only mode" >&2; exit 1; }
+    run_rollback "$TARGET"
+    ;;
+  outcomes)
+    [ -z "$TARGET" ] && [ "$OFFLINE" -eq 0 ] || usage
+    run_outcomes
+    ;;
+  rank)
+    [ -z "$TARGET" ] && [ "$OFFLINE" -eq 0 ] || usage
+    run_rank "$RANK_REPO"
+    ;;
+  audit) run_audit "$TARGET" ;;
+  evidence)
+    [ -n "$OPERAND" ] || usage
+    case "$TARGET" in
+      export) run_evidence_export "$OPERAND" ;;
+      verify) run_evidence_verify "$OPERAND" ;;
+      *) usage ;;
+    esac
+    ;;
+  schema) run_schema "$TARGET" "$OPERAND" ;;
+  doctor)
+    [ -z "$TARGET" ] || usage
+    run_doctor
+    ;;
+  digest)
+    [ -z "$TARGET" ] || usage
+    run_digest "$DIGEST_SINCE"
+    ;;
+  explain)
+    [ -n "$TARGET" ] || usage
+    run_explain "$TARGET"
+    ;;
+esac
@@ -0,0 +1,37 @@
+#!/usr/bin/env bash
+# Checks that findings.json accepts every severity the code review checks
+# emit, and the ones findings are ranked by, and rejects others.
+# Run it from anywhere: tests/schema_test.sh
+set -euo pipefail
+
+cca="$(cd "$(dirname "${BASH_SOURCE[0]}")/.." && pwd)/cca.sh"
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+# findings_json writes a findings.json with one finding per severity given.
+findings_json() {
+  printf '%s\n' "$@" | jq -Rn '{schema_version: 1,
+    findings: [inputs | {severity: ., category: "test", location: "a.go:1", message: "m"}]}'
+}
+
+emitted=$({
+  grep -oE 'report\("[a-z]+"' "$cca" | sed -E 's/report\("([a-z]+)"/\1/'
+  grep -oE "(printf [\"']|/)[a-z]+\\\\t[a-z0-9 ]+\\\\t" "$cca" | sed -E "s/^(printf [\"']|\/)//; s/\\\\t.*//"
+} | sort -u)
+[ -n "$emitted" ] || { echo "FAIL: found no severities in $cca"; exit 1; }
+
+# shellcheck disable=SC2086
+findings_json $emitted critical high serious major medium moderate minor low info >"$tmp/findings.json"
+if ! "$cca" schema findings "$tmp/findings.json" >/dev/null 2>&1; then
+  echo "FAIL: findings.json rejects a severity the checks emit ($(echo $emitted)):"
+  "$cca" schema findings "$tmp/findings.json" || true
+  exit 1
+fi
+
+findings_json urgent >"$tmp/findings.json"
+if "$cca" schema findings "$tmp/findings.json" >/dev/null 2>&1; then
+  echo "FAIL: findings.json accepts the unknown severity urgent"
+  exit 1
+fi
+
+echo "ok"